@@ -8,6 +8,7 @@ import (
 
 	"go.sia.tech/core/types"
 	"go.sia.tech/renterd/hostdb"
+	"go.sia.tech/renterd/object"
 )
 
 const (
@@ -38,9 +39,10 @@ type (
 
 	// AutopilotConfig contains all autopilot configuration.
 	AutopilotConfig struct {
-		Contracts ContractsConfig `json:"contracts"`
-		Hosts     HostsConfig     `json:"hosts"`
-		Wallet    WalletConfig    `json:"wallet"`
+		Contracts  ContractsConfig  `json:"contracts"`
+		Hosts      HostsConfig      `json:"hosts"`
+		Migrations MigrationsConfig `json:"migrations"`
+		Wallet     WalletConfig     `json:"wallet"`
 	}
 
 	// ContractsConfig contains all contract settings used in the autopilot.
@@ -62,12 +64,27 @@ type (
 		ScoreOverrides    map[types.PublicKey]float64 `json:"scoreOverrides"`
 	}
 
+	// MigrationsConfig contains all migration settings used in the autopilot.
+	// MaxSlabsPerMinute limits the rate at which slabs are handed to the
+	// workers for migration, 0 disables the limit.
+	MigrationsConfig struct {
+		MaxSlabsPerMinute uint64 `json:"maxSlabsPerMinute"`
+	}
+
 	// WalletConfig contains all wallet settings used in the autopilot.
 	WalletConfig struct {
 		DefragThreshold uint64 `json:"defragThreshold"`
 	}
 )
 
+// Alert severities, ordered from least to most severe.
+const (
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityError    = "error"
+	AlertSeverityCritical = "critical"
+)
+
 type (
 	// An Action is an autopilot operation.
 	Action struct {
@@ -76,6 +93,17 @@ type (
 		Action    interface{ isAction() }
 	}
 
+	// An Alert is raised by the autopilot when something requires the
+	// attention of the operator. It's dismissed when the underlying issue is
+	// resolved, the timestamp is the time the alert was first raised.
+	Alert struct {
+		ID        types.Hash256          `json:"id"`
+		Severity  string                 `json:"severity"`
+		Message   string                 `json:"message"`
+		Data      map[string]interface{} `json:"data,omitempty"`
+		Timestamp time.Time              `json:"timestamp"`
+	}
+
 	// AutopilotTriggerRequest is the request object used by the /debug/trigger
 	// endpoint
 	AutopilotTriggerRequest struct {
@@ -89,15 +117,90 @@ type (
 	}
 
 	// AutopilotStatusResponse is the response type for the /autopilot/status
-	// endpoint.
+	// endpoint. The MigratingLast fields describe the last migration pass that
+	// finished, the error is set if the pass was aborted.
 	AutopilotStatusResponse struct {
-		Configured         bool          `json:"configured"`
-		Migrating          bool          `json:"migrating"`
-		MigratingLastStart ParamTime     `json:"migratingLastStart"`
-		Scanning           bool          `json:"scanning"`
-		ScanningLastStart  ParamTime     `json:"scanningLastStart"`
-		Synced             bool          `json:"synced"`
-		UptimeMS           ParamDuration `json:"uptimeMS"`
+		Configured              bool          `json:"configured"`
+		Migrating               bool          `json:"migrating"`
+		MigratingLastStart      ParamTime     `json:"migratingLastStart"`
+		MigratingLastFinish     ParamTime     `json:"migratingLastFinish"`
+		MigratingLastDurationMS ParamDuration `json:"migratingLastDurationMS"`
+		MigratingLastError      string        `json:"migratingLastError,omitempty"`
+		MigratingLastProcessed  uint64        `json:"migratingLastProcessed"`
+		MigrationsPaused        bool          `json:"migrationsPaused"`
+		Scanning                bool          `json:"scanning"`
+		ScanningLastStart       ParamTime     `json:"scanningLastStart"`
+		Synced                  bool          `json:"synced"`
+		UptimeMS                ParamDuration `json:"uptimeMS"`
+	}
+
+	// MigrationStatusResponse is the response type for the /migrations/status
+	// endpoint. The counts cover the current migration pass or, if no
+	// migrations are running, the last one. The rate is the number of slabs
+	// processed per second over the most recent migrations, the ETA is the
+	// estimated time until the slabs that were queued so far are processed.
+	// Slabs that failed to migrate too often aren't retried anymore, they are
+	// listed in FailedSlabs. MaxSlabsPerMinute is the configured rate limit, 0
+	// if migrations aren't limited. DryRun contains the result of the last dry
+	// run, if any.
+	MigrationStatusResponse struct {
+		Migrating bool      `json:"migrating"`
+		Paused    bool      `json:"paused"`
+		PassStart ParamTime `json:"passStart"`
+
+		Queued    uint64 `json:"queued"`
+		Completed uint64 `json:"completed"`
+		Failed    uint64 `json:"failed"`
+		Skipped   uint64 `json:"skipped"`
+		Bytes     uint64 `json:"bytes"`
+
+		Rate              float64       `json:"rate"`
+		ETAMS             ParamDuration `json:"etaMS"`
+		MaxSlabsPerMinute uint64        `json:"maxSlabsPerMinute"`
+
+		BackingOff  int                    `json:"backingOff"`
+		FailedSlabs []SlabMigrationFailure `json:"failedSlabs"`
+
+		DryRun *MigrationDryRun `json:"dryRun,omitempty"`
+	}
+
+	// MigrationDryRunResponse is the response type for the /migrations/dryrun
+	// endpoint, indicating whether a dry run was started.
+	MigrationDryRunResponse struct {
+		Started bool `json:"started"`
+	}
+
+	// MigrationDryRun is the result of a dry run of the migrations, it
+	// estimates the work a migration pass would do without migrating any
+	// slabs. Shards are re-uploaded to hosts in the contract set that don't
+	// store a shard of the slab already, Hosts is the number of hosts that
+	// would receive shards. Slabs for which the contract set doesn't contain
+	// enough hosts are counted in InsufficientHosts, slabs with fewer than
+	// MinShards good shards can't be migrated and are counted in
+	// Unrecoverable. The cost is estimated using the hosts' cached price
+	// tables and covers downloading MinShards shards and uploading the new
+	// ones. Finished is zero while the dry run is in progress.
+	MigrationDryRun struct {
+		Started  ParamTime `json:"started"`
+		Finished ParamTime `json:"finished"`
+		Error    string    `json:"error,omitempty"`
+
+		Slabs             uint64         `json:"slabs"`
+		Skipped           uint64         `json:"skipped"`
+		Shards            uint64         `json:"shards"`
+		Hosts             uint64         `json:"hosts"`
+		InsufficientHosts uint64         `json:"insufficientHosts"`
+		Unrecoverable     uint64         `json:"unrecoverable"`
+		Bytes             uint64         `json:"bytes"`
+		Cost              types.Currency `json:"cost"`
+	}
+
+	// SlabMigrationFailure describes a slab that repeatedly failed to migrate.
+	SlabMigrationFailure struct {
+		Key         object.EncryptionKey `json:"key"`
+		Attempts    int                  `json:"attempts"`
+		LastAttempt time.Time            `json:"lastAttempt"`
+		LastError   string               `json:"lastError"`
 	}
 
 	// HostHandlerResponse is the response type for the /host/:hostkey endpoint.
@@ -18,9 +18,17 @@ const (
 	HostFilterModeAllowed = "allowed"
 	HostFilterModeBlocked = "blocked"
 
-	ContractArchivalReasonHostPruned = "hostpruned"
-	ContractArchivalReasonRemoved    = "removed"
-	ContractArchivalReasonRenewed    = "renewed"
+	ContractArchivalReasonHostBlocked = "hostblocked"
+	ContractArchivalReasonHostPruned  = "hostpruned"
+	ContractArchivalReasonRemoved     = "removed"
+	ContractArchivalReasonRenewed     = "renewed"
+
+	ContractSetChangeReasonAdded      = "added"
+	ContractSetChangeReasonArchived   = "archived"
+	ContractSetChangeReasonRemoved    = "removed"
+	ContractSetChangeReasonRenewed    = "renewed"
+	ContractSetChangeReasonSetRemoved = "setremoved"
+	ContractSetChangeReasonUpdated    = "updated"
 
 	UsabilityFilterModeAll      = "all"
 	UsabilityFilterModeUsable   = "usable"
@@ -57,6 +65,45 @@ var (
 // ArchiveContractsRequest is the request type for the /contracts/archive endpoint.
 type ArchiveContractsRequest = map[types.FileContractID]string
 
+// ContractsRemoveRequest is the request type for the /contracts/remove
+// endpoint.
+type ContractsRemoveRequest struct {
+	IDs    []types.FileContractID `json:"ids"`
+	Reason string                 `json:"reason"`
+}
+
+// ContractsRemoveResponse is the response type for the /contracts/remove
+// endpoint, it contains the contracts that were removed and the ids that
+// didn't belong to an active contract.
+type ContractsRemoveResponse struct {
+	Removed []types.FileContractID `json:"removed"`
+	Unknown []types.FileContractID `json:"unknown"`
+}
+
+// HostContractsArchiveRequest is the request type for the
+// /host/:hostkey/contracts/archive endpoint.
+type HostContractsArchiveRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ArchivedContractsPruneRequest is the request type for the
+// /contracts/archived/prune endpoint.
+type ArchivedContractsPruneRequest struct {
+	MinStartHeight uint64 `json:"minStartHeight"`
+	PreserveChains bool   `json:"preserveChains"`
+}
+
+// ArchivedContractsPruneResponse is the response type for the
+// /contracts/archived/prune endpoint.
+type ArchivedContractsPruneResponse struct {
+	Pruned int64 `json:"pruned"`
+}
+
+// SectorsPruneResponse is the response type for the /sectors/prune endpoint.
+type SectorsPruneResponse struct {
+	Pruned int64 `json:"pruned"`
+}
+
 // AccountHandlerPOST is the request type for the /account/:id endpoint.
 type AccountHandlerPOST struct {
 	HostKey types.PublicKey `json:"hostKey"`
@@ -76,24 +123,28 @@ type ConsensusNetwork struct {
 
 // ContractsIDAddRequest is the request type for the /contract/:id endpoint.
 type ContractsIDAddRequest struct {
-	Contract    rhpv2.ContractRevision `json:"contract"`
-	StartHeight uint64                 `json:"startHeight"`
-	TotalCost   types.Currency         `json:"totalCost"`
+	Contract         rhpv2.ContractRevision `json:"contract"`
+	HostAddress      string                 `json:"hostAddress"`
+	SettingsSnapshot *HostSettingsSnapshot  `json:"settingsSnapshot,omitempty"`
+	StartHeight      uint64                 `json:"startHeight"`
+	TotalCost        types.Currency         `json:"totalCost"`
 }
 
 // ContractsIDRenewedRequest is the request type for the /contract/:id/renewed
 // endpoint.
 type ContractsIDRenewedRequest struct {
-	Contract    rhpv2.ContractRevision `json:"contract"`
-	RenewedFrom types.FileContractID   `json:"renewedFrom"`
-	StartHeight uint64                 `json:"startHeight"`
-	TotalCost   types.Currency         `json:"totalCost"`
+	Contract         rhpv2.ContractRevision `json:"contract"`
+	RenewedFrom      types.FileContractID   `json:"renewedFrom"`
+	SettingsSnapshot *HostSettingsSnapshot  `json:"settingsSnapshot,omitempty"`
+	StartHeight      uint64                 `json:"startHeight"`
+	TotalCost        types.Currency         `json:"totalCost"`
 }
 
 // ContractAcquireRequest is the request type for the /contract/acquire
 // endpoint.
 type ContractAcquireRequest struct {
 	Duration ParamDuration `json:"duration"`
+	Holder   string        `json:"holder,omitempty"`
 	Priority int           `json:"priority"`
 }
 
@@ -108,12 +159,74 @@ type ContractReleaseRequest struct {
 	LockID uint64 `json:"lockID"`
 }
 
+// ContractRevisionUpdateRequest is the request type for the
+// /contract/:id/revision endpoint.
+type ContractRevisionUpdateRequest struct {
+	RevisionNumber uint64 `json:"revisionNumber"`
+	Size           uint64 `json:"size"`
+}
+
 // ContractAcquireResponse is the response type for the /contract/:id/acquire
 // endpoint.
 type ContractAcquireResponse struct {
 	LockID uint64 `json:"lockID"`
 }
 
+// ContractsAcquireRequest is the request type for the /contracts/acquire
+// endpoint.
+type ContractsAcquireRequest struct {
+	ContractIDs []types.FileContractID `json:"contractIDs"`
+	Duration    ParamDuration          `json:"duration"`
+	Holder      string                 `json:"holder,omitempty"`
+}
+
+// ContractsAcquireResponse is the response type for the /contracts/acquire
+// endpoint, the lock ids are in the order of the requested contracts.
+type ContractsAcquireResponse struct {
+	LockIDs []uint64 `json:"lockIDs"`
+}
+
+// ContractsReleaseRequest is the request type for the /contracts/release
+// endpoint.
+type ContractsReleaseRequest struct {
+	ContractIDs []types.FileContractID `json:"contractIDs"`
+	LockIDs     []uint64               `json:"lockIDs"`
+}
+
+// ContractLock describes a contract lock that is currently held, holder is the
+// description passed by the caller that acquired it and waiting is the number
+// of callers waiting to acquire it.
+type ContractLock struct {
+	ID          types.FileContractID `json:"id"`
+	Holder      string               `json:"holder,omitempty"`
+	LockedUntil time.Time            `json:"lockedUntil"`
+	Waiting     int                  `json:"waiting"`
+}
+
+// SpendingHistoryPruneRequest is the request type for the
+// /contracts/spending/prune endpoint.
+type SpendingHistoryPruneRequest struct {
+	Before time.Time `json:"before"`
+}
+
+// SpendingHistoryPruneResponse is the response type for the
+// /contracts/spending/prune endpoint.
+type SpendingHistoryPruneResponse struct {
+	Pruned int64 `json:"pruned"`
+}
+
+// ContractSetChangesPruneRequest is the request type for the
+// /contracts/sets/changes/prune endpoint.
+type ContractSetChangesPruneRequest struct {
+	Before time.Time `json:"before"`
+}
+
+// ContractSetChangesPruneResponse is the response type for the
+// /contracts/sets/changes/prune endpoint.
+type ContractSetChangesPruneResponse struct {
+	Pruned int64 `json:"pruned"`
+}
+
 // HostsRemoveRequest is the request type for the /hosts/remove endpoint.
 type HostsRemoveRequest struct {
 	MaxDowntimeHours      ParamDurationHour `json:"maxDowntimeHours"`
@@ -238,6 +351,7 @@ type AddObjectRequest struct {
 type MigrationSlabsRequest struct {
 	ContractSet  string  `json:"contractSet"`
 	HealthCutoff float64 `json:"healthCutoff"`
+	Offset       int     `json:"offset"`
 	Limit        int     `json:"limit"`
 }
 
@@ -1,10 +1,66 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	rhpv2 "go.sia.tech/core/rhp/v2"
 	"go.sia.tech/core/types"
 )
 
+const (
+	ContractSortStartHeight = "startHeight"
+	ContractSortTotalCost   = "totalCost"
+	ContractSortHostKey     = "hostKey"
+)
+
+const (
+	// HostIPSourceHost indicates the host IP of a contract is the host's most
+	// recently announced net address.
+	HostIPSourceHost = "host"
+
+	// HostIPSourceContract indicates the host's address is unknown and the
+	// host IP of a contract is the net address the host had when the contract
+	// was formed or last renewed.
+	HostIPSourceContract = "contract"
+)
+
+// ContractsExportVersion is the version of the format contracts are exported
+// in, it's bumped whenever the format changes in an incompatible way.
+const ContractsExportVersion = 1
+
+// ContractSetAll is the name of the virtual contract set that contains all
+// active contracts, it's reserved and can't be used as the name of a contract
+// set.
+const ContractSetAll = "all"
+
+var (
+	// ErrInvalidContractSortKey is returned when contracts are requested to be
+	// sorted by an unknown key.
+	ErrInvalidContractSortKey = errors.New("invalid contract sort key")
+
+	// ErrReservedSetName is returned when trying to create, update or remove
+	// a contract set using a reserved name.
+	ErrReservedSetName = errors.New("contract set name is reserved")
+
+	// ErrContractsNotFound is returned when some of the contracts a contract
+	// set is updated with can't be found.
+	ErrContractsNotFound = errors.New("couldn't find contracts")
+
+	// ErrBudgetExceeded is returned when recorded spending pushes the spending
+	// of a contract past its budget.
+	ErrBudgetExceeded = errors.New("contract spending exceeds budget")
+
+	// ErrCurrencyOverflow is returned when a currency value that is about to
+	// be written to the database doesn't fit into 128 bits.
+	ErrCurrencyOverflow = errors.New("currency value overflows 128 bits")
+
+	// ErrContractLocked is returned when a batch of contracts can't be
+	// acquired because one of them is locked already.
+	ErrContractLocked = errors.New("contract is locked")
+)
+
 type (
 	// A Contract wraps the contract metadata with the latest contract revision.
 	Contract struct {
@@ -14,10 +70,13 @@ type (
 
 	// ContractMetadata contains all metadata for a contract.
 	ContractMetadata struct {
-		ID         types.FileContractID `json:"id"`
-		HostIP     string               `json:"hostIP"`
-		HostKey    types.PublicKey      `json:"hostKey"`
-		SiamuxAddr string               `json:"siamuxAddr"`
+		ID           types.FileContractID `json:"id"`
+		CreatedAt    time.Time            `json:"createdAt"`
+		HostAddress  string               `json:"hostAddress,omitempty"` // address the contract was formed with, kept across renewals
+		HostIP       string               `json:"hostIP"`
+		HostIPSource string               `json:"hostIPSource,omitempty"`
+		HostKey      types.PublicKey      `json:"hostKey"`
+		SiamuxAddr   string               `json:"siamuxAddr"`
 
 		ProofHeight    uint64 `json:"proofHeight"`
 		RevisionHeight uint64 `json:"revisionHeight"`
@@ -29,7 +88,246 @@ type (
 
 		RenewedFrom types.FileContractID `json:"renewedFrom"`
 		Spending    ContractSpending     `json:"spending"`
+		Budget      ContractSpending     `json:"budget"`
 		TotalCost   types.Currency       `json:"totalCost"`
+
+		UploadedBytes   uint64 `json:"uploadedBytes"`
+		DownloadedBytes uint64 `json:"downloadedBytes"`
+
+		SettingsSnapshot *HostSettingsSnapshot `json:"settingsSnapshot,omitempty"`
+	}
+
+	// HostSettingsSnapshot is a snapshot of the host's settings and prices at
+	// the time a contract was formed or renewed. The data is opaque to the
+	// bus, only the prices are interpreted.
+	HostSettingsSnapshot struct {
+		ContractPrice types.Currency `json:"contractPrice"`
+		StoragePrice  types.Currency `json:"storagePrice"`
+		Data          []byte         `json:"data"`
+	}
+
+	// ContractsPageFilter contains the filters for fetching a page of
+	// contracts. An empty set matches all contracts, zero times mean there's
+	// no bound on the creation time and a Limit of -1 means there's no limit
+	// on the number of contracts returned. Contracts created in
+	// [CreatedFrom, CreatedTo) are returned.
+	ContractsPageFilter struct {
+		Set         string
+		SortBy      string
+		CreatedFrom time.Time
+		CreatedTo   time.Time
+
+		Offset int
+		Limit  int
+	}
+
+	// ContractsPageResponse is the response type for the /contracts/page
+	// endpoint, it contains a page of contracts and the total number of
+	// contracts matching the filter.
+	ContractsPageResponse struct {
+		Contracts []ContractMetadata `json:"contracts"`
+		Total     int64              `json:"total"`
+	}
+
+	// ContractSet contains the name of a contract set and the number of
+	// contracts in it. Virtual sets are not stored but derived from all
+	// active contracts.
+	ContractSet struct {
+		Name      string `json:"name"`
+		Contracts int64  `json:"contracts"`
+		Virtual   bool   `json:"virtual,omitempty"`
+	}
+
+	// ContractDescendant is the response type for the /contract/:id/descendant
+	// endpoint. It contains either the active contract a contract was
+	// eventually renewed into or, if the renewals end before an active
+	// contract is reached, the last archived contract and DeadEnd is set.
+	// Renewals is the number of renewals that were followed.
+	ContractDescendant struct {
+		Contract *ContractMetadata `json:"contract,omitempty"`
+		Archived *ArchivedContract `json:"archived,omitempty"`
+		DeadEnd  bool              `json:"deadEnd"`
+		Renewals int               `json:"renewals"`
+	}
+
+	// ContractSize contains the number of sectors stored in a contract and
+	// the amount of data they make up.
+	ContractSize struct {
+		ID      types.FileContractID `json:"id"`
+		Sectors uint64               `json:"sectors"`
+		Size    uint64               `json:"size"`
+	}
+
+	// ContractToRenew is a contract whose proof window starts within the
+	// renewal horizon, PastWindowStart is set if the window started already.
+	ContractToRenew struct {
+		ContractMetadata
+		PastWindowStart bool `json:"pastWindowStart"`
+	}
+
+	// ContractPrunableData contains the number of sectors stored in a
+	// contract that are no longer referenced by any slab and the amount of
+	// data that could be reclaimed by pruning them.
+	ContractPrunableData struct {
+		ID       types.FileContractID `json:"id"`
+		Sectors  uint64               `json:"sectors"`
+		Prunable uint64               `json:"prunable"`
+		Size     uint64               `json:"size"`
+	}
+
+	// ContractsExport is a self-contained export of the active contracts that
+	// can be imported to recover the contracts after losing the database.
+	ContractsExport struct {
+		Version    int                `json:"version"`
+		ExportedAt time.Time          `json:"exportedAt"`
+		Contracts  []ExportedContract `json:"contracts"`
+	}
+
+	// ExportedContract contains everything that's needed to recreate a
+	// contract, the host is recreated from its key and address if it's
+	// unknown when importing the contract.
+	ExportedContract struct {
+		ID          types.FileContractID `json:"id"`
+		CreatedAt   time.Time            `json:"createdAt"`
+		HostAddress string               `json:"hostAddress,omitempty"` // address the contract was formed with, kept across renewals
+		HostIP      string               `json:"hostIP"`
+		HostKey     types.PublicKey      `json:"hostKey"`
+
+		ProofHeight    uint64 `json:"proofHeight"`
+		RevisionHeight uint64 `json:"revisionHeight"`
+		RevisionNumber uint64 `json:"revisionNumber"`
+		Size           uint64 `json:"size"`
+		StartHeight    uint64 `json:"startHeight"`
+		WindowStart    uint64 `json:"windowStart"`
+		WindowEnd      uint64 `json:"windowEnd"`
+
+		RenewedFrom types.FileContractID `json:"renewedFrom"`
+		Spending    ContractSpending     `json:"spending"`
+		Budget      ContractSpending     `json:"budget"`
+		TotalCost   types.Currency       `json:"totalCost"`
+
+		UploadedBytes   uint64 `json:"uploadedBytes"`
+		DownloadedBytes uint64 `json:"downloadedBytes"`
+
+		SettingsSnapshot *HostSettingsSnapshot `json:"settingsSnapshot,omitempty"`
+	}
+
+	// ContractsImportResponse is the response type for the /contracts/import
+	// endpoint, contracts that existed already are skipped.
+	ContractsImportResponse struct {
+		Imported []types.FileContractID `json:"imported"`
+		Skipped  []types.FileContractID `json:"skipped"`
+	}
+
+	// RenewalChainEntry is a contract in a renewal chain, it's either an
+	// active or an archived contract.
+	RenewalChainEntry struct {
+		ID          types.FileContractID `json:"id"`
+		HostKey     types.PublicKey      `json:"hostKey"`
+		RenewedFrom types.FileContractID `json:"renewedFrom"`
+		RenewedTo   types.FileContractID `json:"renewedTo"`
+
+		Archived bool   `json:"archived"`
+		Reason   string `json:"reason,omitempty"`
+
+		RevisionNumber uint64 `json:"revisionNumber"`
+		Size           uint64 `json:"size"`
+		StartHeight    uint64 `json:"startHeight"`
+		WindowStart    uint64 `json:"windowStart"`
+		WindowEnd      uint64 `json:"windowEnd"`
+	}
+
+	// RenewalChainResponse is the response type for the /contract/:id/chain
+	// endpoint. If the chain is truncated, a contract in the chain refers to a
+	// contract that couldn't be found.
+	RenewalChainResponse struct {
+		Contracts []RenewalChainEntry `json:"contracts"`
+		Truncated bool                `json:"truncated"`
+	}
+
+	// ArchivedContractsFilter contains the filters for fetching archived
+	// contracts. Empty fields are ignored, a MaxStartHeight of 0 means there's
+	// no upper bound on the start height and a Limit of -1 means there's no
+	// limit on the number of contracts returned. If set, only contracts
+	// archived in [ArchivedFrom, ArchivedTo) are returned.
+	ArchivedContractsFilter struct {
+		HostKey        types.PublicKey
+		Reason         string
+		MinStartHeight uint64
+		MaxStartHeight uint64
+		ArchivedFrom   time.Time
+		ArchivedTo     time.Time
+
+		Offset int
+		Limit  int
+	}
+
+	// ContractSetChange describes a change in the contracts of a contract
+	// set, size is the number of contracts in the set after the change.
+	ContractSetChange struct {
+		Name    string                 `json:"name"`
+		Added   []types.FileContractID `json:"added"`
+		Removed []types.FileContractID `json:"removed"`
+		Size    int                    `json:"size"`
+	}
+
+	// ContractSetMembershipChange records a contract entering or leaving a
+	// contract set.
+	ContractSetMembershipChange struct {
+		Set        string               `json:"set"`
+		ContractID types.FileContractID `json:"contractID"`
+		Added      bool                 `json:"added"`
+		Reason     string               `json:"reason"`
+		Timestamp  time.Time            `json:"timestamp"`
+	}
+
+	// ContractSetChangesFilter contains the filters for fetching contract set
+	// membership changes. Empty fields are ignored, only changes in
+	// [From, To) are returned and a Limit of -1 means there's no limit on the
+	// number of changes returned.
+	ContractSetChangesFilter struct {
+		Set        string
+		ContractID types.FileContractID
+		From       time.Time
+		To         time.Time
+
+		Offset int
+		Limit  int
+	}
+
+	// ContractSetUpdateResponse is the response type for the PUT
+	// /contracts/set/:set endpoint, it contains the contracts that were added
+	// to and removed from the set and, if missing contracts were allowed, the
+	// contracts that couldn't be found.
+	ContractSetUpdateResponse struct {
+		Added   []types.FileContractID `json:"added"`
+		Removed []types.FileContractID `json:"removed"`
+		Missing []types.FileContractID `json:"missing,omitempty"`
+	}
+
+	// ContractSpendingRecordResponse is the response type for the POST
+	// /contracts/spending endpoint, it contains the contracts whose spending
+	// was pushed past their budget.
+	ContractSpendingRecordResponse struct {
+		BudgetExceeded []types.FileContractID `json:"budgetExceeded,omitempty"`
+	}
+
+	// BudgetExceededError is returned when recorded spending pushed the
+	// spending of contracts past their budget, it lists those contracts.
+	BudgetExceededError struct {
+		Contracts []types.FileContractID
+	}
+
+	// ContractLockedError is returned when a batch of contracts can't be
+	// acquired, it identifies the contract that was locked already.
+	ContractLockedError struct {
+		ID types.FileContractID
+	}
+
+	// MissingContractsError is returned when a contract set is updated with
+	// contracts that don't exist, it lists the contracts that are missing.
+	MissingContractsError struct {
+		Missing []types.FileContractID
 	}
 
 	// ContractSpending contains all spending details for a contract.
@@ -39,11 +337,54 @@ type (
 		FundAccount types.Currency `json:"fundAccount"`
 	}
 
+	// ContractSpendingPeriod contains the spending in the period starting at
+	// Start.
+	ContractSpendingPeriod struct {
+		ContractSpending
+		Start time.Time `json:"start"`
+	}
+
+	// RenewalChainSpending contains the spending and total cost of a contract
+	// and all of the contracts it was renewed from.
+	RenewalChainSpending struct {
+		ID               types.FileContractID `json:"id"`
+		Contracts        int                  `json:"contracts"`
+		FirstStartHeight uint64               `json:"firstStartHeight"`
+		TotalCost        types.Currency       `json:"totalCost"`
+		Spending         ContractSpending     `json:"spending"`
+	}
+
+	// ContractSpendingRecord records the spending of a contract and the
+	// amount of data transferred with it. If the revision number is zero the
+	// contract's revision is left untouched.
 	ContractSpendingRecord struct {
 		ContractSpending
 		ContractID     types.FileContractID `json:"contractID"`
 		RevisionNumber uint64               `json:"revisionNumber"`
 		Size           uint64               `json:"size"`
+
+		UploadedBytes   uint64 `json:"uploadedBytes"`
+		DownloadedBytes uint64 `json:"downloadedBytes"`
+	}
+
+	// ContractsSummary is the response type for the /contracts/summary
+	// endpoint, it summarizes the active contracts and counts the archived
+	// ones. The height range spans from the lowest start height to the
+	// highest window end of all active contracts.
+	ContractsSummary struct {
+		Active   int64         `json:"active"`
+		Archived int64         `json:"archived"`
+		Locked   int           `json:"locked"`
+		Sets     []ContractSet `json:"sets"`
+
+		TotalCost types.Currency   `json:"totalCost"`
+		Spending  ContractSpending `json:"spending"`
+
+		UploadedBytes   uint64 `json:"uploadedBytes"`
+		DownloadedBytes uint64 `json:"downloadedBytes"`
+
+		MinStartHeight uint64 `json:"minStartHeight"`
+		MaxWindowEnd   uint64 `json:"maxWindowEnd"`
 	}
 
 	// An ArchivedContract contains all information about a contract with a host
@@ -52,8 +393,19 @@ type (
 		ID        types.FileContractID `json:"id"`
 		HostKey   types.PublicKey      `json:"hostKey"`
 		RenewedTo types.FileContractID `json:"renewedTo"`
+		Reason    string               `json:"reason"`
+		HostIP    string               `json:"hostIP,omitempty"`
+		TotalCost types.Currency       `json:"totalCost"`
 		Spending  ContractSpending     `json:"spending"`
 
+		UploadedBytes   uint64 `json:"uploadedBytes"`
+		DownloadedBytes uint64 `json:"downloadedBytes"`
+
+		CreatedAt  time.Time `json:"createdAt"`
+		ArchivedAt time.Time `json:"archivedAt"`
+
+		SettingsSnapshot *HostSettingsSnapshot `json:"settingsSnapshot,omitempty"`
+
 		ProofHeight    uint64 `json:"proofHeight"`
 		RevisionHeight uint64 `json:"revisionHeight"`
 		RevisionNumber uint64 `json:"revisionNumber"`
@@ -64,6 +416,30 @@ type (
 	}
 )
 
+// Error implements the error interface.
+func (e *ContractLockedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrContractLocked, e.ID)
+}
+
+// Unwrap returns ErrContractLocked.
+func (e *ContractLockedError) Unwrap() error { return ErrContractLocked }
+
+// Error implements the error interface.
+func (e *MissingContractsError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrContractsNotFound, e.Missing)
+}
+
+// Unwrap returns ErrContractsNotFound.
+func (e *MissingContractsError) Unwrap() error { return ErrContractsNotFound }
+
+// Error implements the error interface.
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrBudgetExceeded, e.Contracts)
+}
+
+// Unwrap returns ErrBudgetExceeded.
+func (e *BudgetExceededError) Unwrap() error { return ErrBudgetExceeded }
+
 // Add returns the sum of the current and given contract spending.
 func (x ContractSpending) Add(y ContractSpending) (z ContractSpending) {
 	z.Uploads = x.Uploads.Add(y.Uploads)
@@ -143,6 +143,7 @@ type DownloadStatsResponse struct {
 	AvgOverdrivePct      float64           `json:"avgOverdrivePct"`
 	HealthyDownloaders   uint64            `json:"healthyDownloaders"`
 	NumDownloaders       uint64            `json:"numDownloaders"`
+	NumHedgedLaunches    uint64            `json:"numHedgedLaunches"`
 	DownloadersStats     []DownloaderStats `json:"downloadersStats"`
 }
 
@@ -150,6 +151,79 @@ type DownloaderStats struct {
 	AvgSectorDownloadSpeedMBPS float64         `json:"avgSectorDownloadSpeedMBPS"`
 	HostKey                    types.PublicKey `json:"hostKey"`
 	NumDownloads               uint64          `json:"numDownloads"`
+	NumFundRetries             uint64          `json:"numFundRetries"`
+}
+
+// CachedPriceTable contains the key fields of a price table in the worker's
+// price table cache.
+type CachedPriceTable struct {
+	HostKey  types.PublicKey  `json:"hostKey"`
+	UID      rhpv3.SettingsID `json:"uid"`
+	Expiry   time.Time        `json:"expiry"`
+	Updating bool             `json:"updating"`
+
+	UpdatePriceTableCost  types.Currency `json:"updatePriceTableCost"`
+	InitBaseCost          types.Currency `json:"initBaseCost"`
+	ReadBaseCost          types.Currency `json:"readBaseCost"`
+	WriteBaseCost         types.Currency `json:"writeBaseCost"`
+	DownloadBandwidthCost types.Currency `json:"downloadBandwidthCost"`
+	UploadBandwidthCost   types.Currency `json:"uploadBandwidthCost"`
+}
+
+// PriceTableUpdateRequest is the request type for the /pricetables/update
+// endpoint. If a contract is given it's used to pay for the price table if
+// paying by account fails.
+type PriceTableUpdateRequest struct {
+	HostKey    types.PublicKey      `json:"hostKey"`
+	ContractID types.FileContractID `json:"contractID,omitempty"`
+}
+
+// HostPrices contains the key prices of a host's cached price table, prices
+// are expressed per byte where applicable.
+type HostPrices struct {
+	HostKey types.PublicKey `json:"hostKey"`
+	Expiry  time.Time       `json:"expiry"`
+	Valid   bool            `json:"valid"`
+
+	DownloadPerByte      types.Currency `json:"downloadPerByte"`
+	UploadPerByte        types.Currency `json:"uploadPerByte"`
+	BaseRPCCost          types.Currency `json:"baseRPCCost"`
+	UpdatePriceTableCost types.Currency `json:"updatePriceTableCost"`
+}
+
+// PriceTablesStatsResponse is the response type for the /stats/pricetables
+// endpoint.
+type PriceTablesStatsResponse struct {
+	Cache          PriceTableCacheStats `json:"cache"`
+	NumPriceTables uint64               `json:"numPriceTables"`
+	NumEvictions   uint64               `json:"numEvictions"`
+	NumExpired     uint64               `json:"numExpired"`
+	NumUpdates     uint64               `json:"numUpdates"`
+	NumFailures    uint64               `json:"numFailures"`
+	HostsStats     []PriceTableStats    `json:"hostsStats"`
+}
+
+// PriceTableCacheStats contains the outcomes of price table lookups and
+// updates since the worker started.
+type PriceTableCacheStats struct {
+	NumValidHits      uint64 `json:"numValidHits"`
+	NumStaleHits      uint64 `json:"numStaleHits"`
+	NumMisses         uint64 `json:"numMisses"`
+	NumUpdates        uint64 `json:"numUpdates"`
+	NumDeduplicated   uint64 `json:"numDeduplicated"`
+	NumUpdateFailures uint64 `json:"numUpdateFailures"`
+}
+
+type PriceTableStats struct {
+	HostKey             types.PublicKey `json:"hostKey"`
+	NumUpdates          uint64          `json:"numUpdates"`
+	NumFailures         uint64          `json:"numFailures"`
+	NumExpired          uint64          `json:"numExpired"`
+	ConsecutiveFailures uint64          `json:"consecutiveFailures"`
+	BackoffUntil        time.Time       `json:"backoffUntil"`
+	LastError           string          `json:"lastError,omitempty"`
+	AvgUpdateLatencyMS  float64         `json:"avgUpdateLatencyMS"`
+	P90UpdateLatencyMS  float64         `json:"p90UpdateLatencyMS"`
 }
 
 // UploadStatsResponse is the response type for the /stats/uploads endpoint.
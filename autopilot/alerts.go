@@ -0,0 +1,66 @@
+package autopilot
+
+import (
+	"sort"
+	"sync"
+
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+	"go.uber.org/zap"
+)
+
+// alerts keeps track of the active alerts raised by the autopilot.
+type alerts struct {
+	logger *zap.SugaredLogger
+
+	mu     sync.Mutex
+	alerts map[types.Hash256]api.Alert
+}
+
+func newAlerts(logger *zap.SugaredLogger) *alerts {
+	return &alerts{
+		logger: logger.Named("alerts"),
+		alerts: make(map[types.Hash256]api.Alert),
+	}
+}
+
+// Active returns the active alerts, sorted by the time they were raised.
+func (a *alerts) Active() []api.Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	active := make([]api.Alert, 0, len(a.alerts))
+	for _, alert := range a.alerts {
+		active = append(active, alert)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].Timestamp.Equal(active[j].Timestamp) {
+			return active[i].Timestamp.Before(active[j].Timestamp)
+		}
+		return active[i].ID.String() < active[j].ID.String()
+	})
+	return active
+}
+
+// Dismiss removes the alerts with the given ids, unknown ids are ignored.
+func (a *alerts) Dismiss(ids ...types.Hash256) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, id := range ids {
+		delete(a.alerts, id)
+	}
+}
+
+// Register raises an alert, alerts with the same id replace each other but
+// keep the time the alert was first raised. Newly raised alerts are logged.
+func (a *alerts) Register(alert api.Alert) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if existing, exists := a.alerts[alert.ID]; exists {
+		alert.Timestamp = existing.Timestamp
+	} else if alert.Severity == api.AlertSeverityCritical || alert.Severity == api.AlertSeverityError {
+		a.logger.Errorw(alert.Message, "id", alert.ID, "severity", alert.Severity, "data", alert.Data)
+	} else {
+		a.logger.Warnw(alert.Message, "id", alert.ID, "severity", alert.Severity, "data", alert.Data)
+	}
+	a.alerts[alert.ID] = alert
+}
@@ -51,13 +51,13 @@ type Bus interface {
 
 	// contracts
 	Contracts(ctx context.Context) (contracts []api.ContractMetadata, err error)
-	AddContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64) (api.ContractMetadata, error)
-	AddRenewedContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID) (api.ContractMetadata, error)
+	AddContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, hostAddress string, snapshot *api.HostSettingsSnapshot) (api.ContractMetadata, error)
+	AddRenewedContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID, snapshot *api.HostSettingsSnapshot) (api.ContractMetadata, error)
 	AncestorContracts(ctx context.Context, id types.FileContractID, minStartHeight uint64) ([]api.ArchivedContract, error)
 	ArchiveContracts(ctx context.Context, toArchive map[types.FileContractID]string) error
 	ContractSetContracts(ctx context.Context, set string) ([]api.ContractMetadata, error)
 	FileContractTax(ctx context.Context, payout types.Currency) (types.Currency, error)
-	SetContractSet(ctx context.Context, set string, contracts []types.FileContractID) error
+	SetContractSet(ctx context.Context, set string, contracts []types.FileContractID, allowMissing bool) (added, removed, missing []types.FileContractID, err error)
 
 	// txpool
 	RecommendedFee(ctx context.Context) (types.Currency, error)
@@ -68,7 +68,7 @@ type Bus interface {
 
 	// objects
 	Slab(ctx context.Context, key object.EncryptionKey) (object.Slab, error)
-	SlabsForMigration(ctx context.Context, healthCutoff float64, set string, limit int) ([]api.UnhealthySlab, error)
+	SlabsForMigration(ctx context.Context, healthCutoff float64, set string, offset, limit int) ([]api.UnhealthySlab, error)
 
 	// settings
 	UpdateSetting(ctx context.Context, key string, value interface{}) error
@@ -101,10 +101,11 @@ type Autopilot struct {
 	synced     bool
 	state      state
 
-	a *accounts
-	c *contractor
-	m *migrator
-	s *scanner
+	a      *accounts
+	c      *contractor
+	m      *migrator
+	s      *scanner
+	alerts *alerts
 
 	tickerDuration time.Duration
 	wg             sync.WaitGroup
@@ -162,12 +163,17 @@ func (wp *workerPool) withWorkers(workerFunc func([]Worker)) {
 // Handler returns an HTTP handler that serves the autopilot api.
 func (ap *Autopilot) Handler() http.Handler {
 	return jape.Mux(tracing.TracedRoutes("autopilot", map[string]jape.Handler{
-		"GET    /config":        ap.configHandlerGET,
-		"PUT    /config":        ap.configHandlerPUT,
-		"POST   /debug/trigger": ap.triggerHandlerPOST,
-		"POST   /hosts":         ap.hostsHandlerPOST,
-		"GET    /host/:hostKey": ap.hostHandlerGET,
-		"GET    /status":        ap.statusHandlerGET,
+		"GET    /alerts":            ap.alertsHandlerGET,
+		"GET    /config":            ap.configHandlerGET,
+		"PUT    /config":            ap.configHandlerPUT,
+		"POST   /debug/trigger":     ap.triggerHandlerPOST,
+		"POST   /hosts":             ap.hostsHandlerPOST,
+		"GET    /host/:hostKey":     ap.hostHandlerGET,
+		"POST   /migrations/dryrun": ap.migrationsDryRunHandlerPOST,
+		"POST   /migrations/pause":  ap.migrationsPauseHandlerPOST,
+		"POST   /migrations/resume": ap.migrationsResumeHandlerPOST,
+		"GET    /migrations/status": ap.migrationStatusHandlerGET,
+		"GET    /status":            ap.statusHandlerGET,
 	}))
 }
 
@@ -525,7 +531,7 @@ func (ap *Autopilot) triggerHandlerPOST(jc jape.Context) {
 }
 
 // New initializes an Autopilot.
-func New(id string, bus Bus, workers []Worker, logger *zap.Logger, heartbeat time.Duration, scannerScanInterval time.Duration, scannerBatchSize, scannerMinRecentFailures, scannerNumThreads uint64, migrationHealthCutoff float64, accountsRefillInterval time.Duration, revisionSubmissionBuffer uint64) (*Autopilot, error) {
+func New(id string, bus Bus, workers []Worker, logger *zap.Logger, heartbeat time.Duration, scannerScanInterval time.Duration, scannerBatchSize, scannerMinRecentFailures, scannerNumThreads uint64, migrationHealthCutoff, migrationCriticalHealthCutoff float64, migratorBatchSize uint64, accountsRefillInterval time.Duration, revisionSubmissionBuffer uint64) (*Autopilot, error) {
 	ap := &Autopilot{
 		id:      id,
 		bus:     bus,
@@ -534,6 +540,8 @@ func New(id string, bus Bus, workers []Worker, logger *zap.Logger, heartbeat tim
 
 		tickerDuration: heartbeat,
 	}
+	ap.alerts = newAlerts(ap.logger)
+
 	scanner, err := newScanner(
 		ap,
 		scannerBatchSize,
@@ -547,9 +555,14 @@ func New(id string, bus Bus, workers []Worker, logger *zap.Logger, heartbeat tim
 		return nil, err
 	}
 
+	migrator, err := newMigrator(ap, migrationHealthCutoff, migrationCriticalHealthCutoff, migratorBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
 	ap.s = scanner
 	ap.c = newContractor(ap, revisionSubmissionBuffer)
-	ap.m = newMigrator(ap, migrationHealthCutoff)
+	ap.m = migrator
 	ap.a = newAccounts(ap, ap.bus, ap.bus, ap.workers, ap.logger, accountsRefillInterval)
 
 	return ap, nil
@@ -569,19 +582,50 @@ func (ap *Autopilot) hostHandlerGET(jc jape.Context) {
 }
 
 func (ap *Autopilot) statusHandlerGET(jc jape.Context) {
-	migrating, mLastStart := ap.m.Status()
+	ms := ap.m.Status()
+	var mLastErr string
+	if ms.lastErr != nil {
+		mLastErr = ms.lastErr.Error()
+	}
 	scanning, sLastStart := ap.s.Status()
 	jc.Encode(api.AutopilotStatusResponse{
-		Configured:         ap.isConfigured(),
-		Migrating:          migrating,
-		MigratingLastStart: api.ParamTime(mLastStart),
-		Scanning:           scanning,
-		ScanningLastStart:  api.ParamTime(sLastStart),
-		Synced:             ap.isSynced(),
-		UptimeMS:           api.ParamDuration(ap.Uptime()),
+		Configured:              ap.isConfigured(),
+		Migrating:               ms.migrating,
+		MigratingLastStart:      api.ParamTime(ms.lastStart),
+		MigratingLastFinish:     api.ParamTime(ms.lastFinish),
+		MigratingLastDurationMS: api.ParamDuration(ms.lastDuration),
+		MigratingLastError:      mLastErr,
+		MigratingLastProcessed:  ms.lastProcessed,
+		MigrationsPaused:        ms.paused,
+		Scanning:                scanning,
+		ScanningLastStart:       api.ParamTime(sLastStart),
+		Synced:                  ap.isSynced(),
+		UptimeMS:                api.ParamDuration(ap.Uptime()),
 	})
 }
 
+func (ap *Autopilot) alertsHandlerGET(jc jape.Context) {
+	jc.Encode(ap.alerts.Active())
+}
+
+func (ap *Autopilot) migrationsDryRunHandlerPOST(jc jape.Context) {
+	jc.Encode(api.MigrationDryRunResponse{
+		Started: ap.m.TryDryRun(),
+	})
+}
+
+func (ap *Autopilot) migrationsPauseHandlerPOST(jc jape.Context) {
+	ap.m.Pause()
+}
+
+func (ap *Autopilot) migrationsResumeHandlerPOST(jc jape.Context) {
+	ap.m.Resume()
+}
+
+func (ap *Autopilot) migrationStatusHandlerGET(jc jape.Context) {
+	jc.Encode(ap.m.MigrationStatus())
+}
+
 func (ap *Autopilot) hostsHandlerPOST(jc jape.Context) {
 	var req api.SearchHostsRequest
 	if jc.Decode(&req) != nil {
@@ -49,6 +49,38 @@ func (c *Client) HostInfos(ctx context.Context, filterMode, usabilityMode string
 	return
 }
 
+// Alerts returns the active alerts.
+func (c *Client) Alerts() (alerts []api.Alert, err error) {
+	err = c.c.GET("/alerts", &alerts)
+	return
+}
+
+// PauseMigrations pauses the migrations, migrations that are in progress are
+// finished but no new ones are started.
+func (c *Client) PauseMigrations() error {
+	return c.c.POST("/migrations/pause", nil, nil)
+}
+
+// ResumeMigrations resumes the migrations after they were paused.
+func (c *Client) ResumeMigrations() error {
+	return c.c.POST("/migrations/resume", nil, nil)
+}
+
+// MigrationDryRun starts a dry run of the migrations, its result is reported
+// by MigrationStatus. It returns false if a dry run is already in progress.
+func (c *Client) MigrationDryRun() (_ bool, err error) {
+	var resp api.MigrationDryRunResponse
+	err = c.c.POST("/migrations/dryrun", nil, &resp)
+	return resp.Started, err
+}
+
+// MigrationStatus returns the progress of the current or, if no migrations
+// are running, the last migration pass.
+func (c *Client) MigrationStatus() (resp api.MigrationStatusResponse, err error) {
+	err = c.c.GET("/migrations/status", &resp)
+	return
+}
+
 func (c *Client) Status() (resp api.AutopilotStatusResponse, err error) {
 	err = c.c.GET("/status", &resp)
 	return
@@ -2,6 +2,7 @@ package autopilot
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -336,10 +337,13 @@ func (c *contractor) performContractMaintenance(ctx context.Context, w Worker) (
 	if c.ap.isStopped() {
 		return false, errors.New("autopilot stopped before maintenance could be completed")
 	}
-	err = c.ap.bus.SetContractSet(ctx, state.cfg.Contracts.Set, updatedSet)
+	added, removed, missing, err := c.ap.bus.SetContractSet(ctx, state.cfg.Contracts.Set, updatedSet, true)
 	if err != nil {
 		return false, err
+	} else if len(missing) > 0 {
+		c.logger.Warnf("%d contracts couldn't be added to contract set '%s' because they no longer exist: %v", len(missing), state.cfg.Contracts.Set, missing)
 	}
+	c.logger.Debugf("contract set '%s' updated, %d contracts added, %d contracts removed", state.cfg.Contracts.Set, len(added), len(removed))
 
 	// return whether the maintenance changed the contract set
 	return c.computeContractSetChanged(currentSet, updatedSet, formed, refreshed, renewed, toStopUsing, contractData), nil
@@ -1139,7 +1143,7 @@ func (c *contractor) renewContract(ctx context.Context, w Worker, ci contractInf
 	*budget = budget.Sub(renterFunds)
 
 	// persist the contract
-	renewedContract, err := c.ap.bus.AddRenewedContract(ctx, newRevision, renterFunds, cs.BlockHeight, fcid)
+	renewedContract, err := c.ap.bus.AddRenewedContract(ctx, newRevision, renterFunds, cs.BlockHeight, fcid, settingsSnapshot(settings))
 	if err != nil {
 		c.logger.Errorw(fmt.Sprintf("renewal failed to persist, err: %v", err), "hk", hk, "fcid", fcid)
 		return api.ContractMetadata{}, false, err
@@ -1221,7 +1225,7 @@ func (c *contractor) refreshContract(ctx context.Context, w Worker, ci contractI
 	*budget = budget.Sub(renterFunds)
 
 	// persist the contract
-	refreshedContract, err := c.ap.bus.AddRenewedContract(ctx, newRevision, renterFunds, state.cs.BlockHeight, contract.ID)
+	refreshedContract, err := c.ap.bus.AddRenewedContract(ctx, newRevision, renterFunds, state.cs.BlockHeight, contract.ID, settingsSnapshot(settings))
 	if err != nil {
 		c.logger.Errorw(fmt.Sprintf("refresh failed, err: %v", err), "hk", hk, "fcid", fcid)
 		return api.ContractMetadata{}, false, err
@@ -1287,7 +1291,7 @@ func (c *contractor) formContract(ctx context.Context, w Worker, host hostdb.Hos
 	*budget = budget.Sub(renterFunds)
 
 	// persist contract in store
-	formedContract, err := c.ap.bus.AddContract(ctx, contract, renterFunds, state.cs.BlockHeight)
+	formedContract, err := c.ap.bus.AddContract(ctx, contract, renterFunds, state.cs.BlockHeight, host.NetAddress, settingsSnapshot(scan.Settings))
 	if err != nil {
 		c.logger.Errorw(fmt.Sprintf("contract formation failed, err: %v", err), "hk", hk)
 		return api.ContractMetadata{}, true, err
@@ -1359,6 +1363,20 @@ func endHeight(cfg api.AutopilotConfig, currentPeriod uint64) uint64 {
 	return currentPeriod + cfg.Contracts.Period + cfg.Contracts.RenewWindow
 }
 
+// settingsSnapshot returns a snapshot of the given host settings to store
+// alongside the contract that was formed or renewed with them.
+func settingsSnapshot(settings rhpv2.HostSettings) *api.HostSettingsSnapshot {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil
+	}
+	return &api.HostSettingsSnapshot{
+		ContractPrice: settings.ContractPrice,
+		StoragePrice:  settings.StoragePrice,
+		Data:          data,
+	}
+}
+
 // renterFundsToExpectedStorage returns how much storage a renter is expected to
 // be able to afford given the provided 'renterFunds'.
 func renterFundsToExpectedStorage(renterFunds types.Currency, duration uint64, host rhpv2.HostSettings) uint64 {
@@ -2,39 +2,256 @@ package autopilot
 
 import (
 	"context"
-	"math"
+	"errors"
+	"fmt"
 	"sort"
 	"sync"
 	"time"
 
+	rhpv2 "go.sia.tech/core/rhp/v2"
+	"go.sia.tech/core/types"
 	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/hostdb"
 	"go.sia.tech/renterd/object"
 	"go.sia.tech/renterd/tracing"
 	"go.uber.org/zap"
 )
 
 const (
-	migratorBatchSize = math.MaxInt // TODO: change once we have a fix for the infinite loop
+	// migratorRateWindow is the number of recent migrations the migration
+	// rate is computed over.
+	migratorRateWindow = 100
+
+	// migratorBackoffMin and migratorBackoffMax bound the time a slab that
+	// failed to migrate is skipped for, the backoff doubles with every
+	// consecutive failure.
+	migratorBackoffMin = 30 * time.Minute
+	migratorBackoffMax = 24 * time.Hour
+
+	// migratorMaxAttempts is the number of consecutive failures after which a
+	// slab isn't retried anymore.
+	migratorMaxAttempts = 10
+
+	// migratorMaxQueueTime is the time after which a slab in the normal tier
+	// of the migration queue is dispatched before the critical ones, it
+	// bounds the time the normal tier can be starved for.
+	migratorMaxQueueTime = 30 * time.Minute
 )
 
 type migrator struct {
-	ap                        *Autopilot
+	ap *Autopilot
+	// TODO: use the actual bus interface when it has consolidated a bit, we
+	// currently use an inline interface to avoid having to update the
+	// migrator tests with every interface change
+	bus interface {
+		ContractSetContracts(ctx context.Context, set string) ([]api.ContractMetadata, error)
+		Host(ctx context.Context, hostKey types.PublicKey) (hostdb.HostInfo, error)
+		Slab(ctx context.Context, key object.EncryptionKey) (object.Slab, error)
+		SlabsForMigration(ctx context.Context, healthCutoff float64, set string, offset, limit int) ([]api.UnhealthySlab, error)
+	}
 	logger                    *zap.SugaredLogger
 	healthCutoff              float64
+	criticalCutoff            float64
+	batchSize                 int
 	signalMaintenanceFinished chan struct{}
 
-	mu                 sync.Mutex
-	migrating          bool
-	migratingLastStart time.Time
+	// now returns the current time, it's used to schedule retries and to
+	// pace migrations, after is used to wait for the rate limit
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	mu                     sync.Mutex
+	migrating              bool
+	migratingLastStart     time.Time
+	migratingLastFinish    time.Time
+	migratingLastDuration  time.Duration
+	migratingLastErr       error
+	migratingLastProcessed uint64
+	paused                 bool
+	pauseChanged           chan struct{} // closed when paused or resumed
+	stats                  migrationStats
+	failures               map[object.EncryptionKey]*slabFailure
+	critical               map[object.EncryptionKey]struct{}
+	dryRun                 *api.MigrationDryRun
+}
+
+// migratorStatus describes the state of the migrator and the outcome of the
+// last migration pass. The error is set if the last pass was aborted,
+// processed is the number of slabs that were migrated or failed to migrate.
+type migratorStatus struct {
+	migrating bool
+	paused    bool
+	lastStart time.Time
+
+	lastFinish    time.Time
+	lastDuration  time.Duration
+	lastErr       error
+	lastProcessed uint64
+}
+
+// errMigrationsInterrupted is returned by performMigrations if the autopilot
+// was stopped before all slabs were migrated.
+var errMigrationsInterrupted = errors.New("migrations interrupted")
+
+// slabFailure keeps track of the consecutive failures to migrate a slab. A slab
+// isn't retried before nextAttempt and never again once it failed
+// migratorMaxAttempts times.
+type slabFailure struct {
+	attempts    int
+	lastAttempt time.Time
+	lastErr     string
+	nextAttempt time.Time
+}
+
+// migrationStats tracks the progress of a migration pass.
+type migrationStats struct {
+	queued    uint64
+	completed uint64
+	failed    uint64
+	skipped   uint64
+	bytes     uint64
+
+	// recent contains the times the most recent migrations finished at
+	recent []time.Time
 }
 
-func newMigrator(ap *Autopilot, healthCutoff float64) *migrator {
+func newMigrator(ap *Autopilot, healthCutoff, criticalCutoff float64, batchSize uint64) (*migrator, error) {
+	if batchSize == 0 {
+		return nil, errors.New("migrator batch size has to be greater than zero")
+	}
 	return &migrator{
 		ap:                        ap,
+		bus:                       ap.bus,
 		logger:                    ap.logger.Named("migrator"),
 		healthCutoff:              healthCutoff,
+		criticalCutoff:            criticalCutoff,
+		batchSize:                 int(batchSize),
 		signalMaintenanceFinished: make(chan struct{}, 1),
+		pauseChanged:              make(chan struct{}),
+		now:                       time.Now,
+		after:                     time.After,
+		failures:                  make(map[object.EncryptionKey]*slabFailure),
+		critical:                  make(map[object.EncryptionKey]struct{}),
+	}, nil
+}
+
+// migrationQueue holds the slabs that are waiting to be migrated. It consists
+// of a critical tier, for slabs with a health below the critical cutoff, and a
+// normal tier. Critical slabs are dispatched first unless the oldest slab in
+// the normal tier was queued more than maxQueueTime ago.
+type migrationQueue struct {
+	criticalCutoff float64
+	maxQueueTime   time.Duration
+
+	critical []queuedSlab
+	normal   []queuedSlab
+	queued   map[object.EncryptionKey]struct{}
+}
+
+type queuedSlab struct {
+	api.UnhealthySlab
+	queuedAt time.Time
+}
+
+func newMigrationQueue(criticalCutoff float64, maxQueueTime time.Duration) *migrationQueue {
+	return &migrationQueue{
+		criticalCutoff: criticalCutoff,
+		maxQueueTime:   maxQueueTime,
+		queued:         make(map[object.EncryptionKey]struct{}),
+	}
+}
+
+// push adds the slabs to the tier matching their health. Slabs that are queued
+// already are moved to the tier matching their updated health.
+func (q *migrationQueue) push(slabs []api.UnhealthySlab, now time.Time) {
+	for _, slab := range slabs {
+		if _, exists := q.queued[slab.Key]; exists {
+			q.critical = removeQueuedSlab(q.critical, slab.Key)
+			q.normal = removeQueuedSlab(q.normal, slab.Key)
+		}
+		q.queued[slab.Key] = struct{}{}
+		if slab.Health < q.criticalCutoff {
+			q.critical = append(q.critical, queuedSlab{slab, now})
+		} else {
+			q.normal = append(q.normal, queuedSlab{slab, now})
+		}
+	}
+}
+
+// len returns the number of queued slabs.
+func (q *migrationQueue) len() int {
+	return len(q.critical) + len(q.normal)
+}
+
+// next returns the slab that should be dispatched next and whether it's in the
+// critical tier, the slab is only removed from the queue when pop is called.
+func (q *migrationQueue) next(now time.Time) (api.UnhealthySlab, bool) {
+	if len(q.normal) > 0 && (len(q.critical) == 0 || now.Sub(q.normal[0].queuedAt) >= q.maxQueueTime) {
+		return q.normal[0].UnhealthySlab, false
+	}
+	return q.critical[0].UnhealthySlab, true
+}
+
+// pop removes the first slab of the given tier.
+func (q *migrationQueue) pop(critical bool) {
+	if critical {
+		delete(q.queued, q.critical[0].Key)
+		q.critical = q.critical[1:]
+	} else {
+		delete(q.queued, q.normal[0].Key)
+		q.normal = q.normal[1:]
+	}
+}
+
+func removeQueuedSlab(slabs []queuedSlab, key object.EncryptionKey) []queuedSlab {
+	for i, slab := range slabs {
+		if slab.Key == key {
+			return append(slabs[:i], slabs[i+1:]...)
+		}
+	}
+	return slabs
+}
+
+// migrationLimiter paces the migrations to respect the configured rate limit.
+type migrationLimiter struct {
+	last time.Time
+}
+
+// delay returns the time to wait before the next slab can be migrated without
+// exceeding the given rate, a rate of 0 disables the limit.
+func (l *migrationLimiter) delay(now time.Time, slabsPerMinute uint64) time.Duration {
+	if slabsPerMinute == 0 || l.last.IsZero() {
+		return 0
+	}
+	next := l.last.Add(time.Minute / time.Duration(slabsPerMinute))
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// record records that a slab was handed out for migration.
+func (l *migrationLimiter) record(now time.Time) {
+	l.last = now
+}
+
+// criticalSlabAlertID returns the id of the alert that's raised when the health
+// of the slab with the given key falls below the critical cutoff.
+func criticalSlabAlertID(key object.EncryptionKey) types.Hash256 {
+	return types.HashBytes([]byte("criticalslab" + key.String()))
+}
+
+// migrationBackoff returns the time a slab is skipped for after it failed to
+// migrate the given number of consecutive times.
+func migrationBackoff(attempts int) time.Duration {
+	backoff := migratorBackoffMin
+	for i := 1; i < attempts && backoff < migratorBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > migratorBackoffMax {
+		backoff = migratorBackoffMax
 	}
+	return backoff
 }
 
 func (m *migrator) SignalMaintenanceFinished() {
@@ -44,20 +261,229 @@ func (m *migrator) SignalMaintenanceFinished() {
 	}
 }
 
-func (m *migrator) Status() (bool, time.Time) {
+func (m *migrator) Status() migratorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return migratorStatus{
+		migrating: m.migrating,
+		paused:    m.paused,
+		lastStart: m.migratingLastStart,
+
+		lastFinish:    m.migratingLastFinish,
+		lastDuration:  m.migratingLastDuration,
+		lastErr:       m.migratingLastErr,
+		lastProcessed: m.migratingLastProcessed,
+	}
+}
+
+// Pause pauses the migrations, no new migrations are started until Resume is
+// called. Migrations that are in progress are finished.
+func (m *migrator) Pause() {
+	m.setPaused(true)
+}
+
+// Resume resumes the migrations after they were paused.
+func (m *migrator) Resume() {
+	m.setPaused(false)
+}
+
+func (m *migrator) setPaused(paused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused == paused {
+		return
+	}
+	m.paused = paused
+	close(m.pauseChanged)
+	m.pauseChanged = make(chan struct{})
+}
+
+// pauseState returns whether the migrations are paused and a channel that's
+// closed when they are paused or resumed.
+func (m *migrator) pauseState() (bool, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused, m.pauseChanged
+}
+
+// MigrationStatus returns the progress of the current or last migration pass.
+func (m *migrator) MigrationStatus() api.MigrationStatusResponse {
+	limit := m.ap.State().cfg.Migrations.MaxSlabsPerMinute
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// compute the rate over the most recent migrations, if there weren't
+	// enough migrations yet the rate is computed since the start of the pass
+	now := m.now()
+	var rate float64
+	if n := len(m.stats.recent); n > 0 {
+		since := m.migratingLastStart
+		if n == migratorRateWindow {
+			since = m.stats.recent[0]
+		}
+		if elapsed := now.Sub(since).Seconds(); elapsed > 0 {
+			rate = float64(n) / elapsed
+		}
+	}
+
+	// estimate the time until the queued slabs are processed
+	var eta time.Duration
+	if remaining := m.stats.queued - m.stats.completed - m.stats.failed; remaining > 0 && rate > 0 {
+		eta = time.Duration(float64(remaining) / rate * float64(time.Second))
+	}
+
+	// collect the slabs that aren't retried anymore
+	var backingOff int
+	failed := make([]api.SlabMigrationFailure, 0)
+	for key, f := range m.failures {
+		if f.attempts < migratorMaxAttempts {
+			backingOff++
+			continue
+		}
+		failed = append(failed, api.SlabMigrationFailure{
+			Key:         key,
+			Attempts:    f.attempts,
+			LastAttempt: f.lastAttempt,
+			LastError:   f.lastErr,
+		})
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].LastAttempt.Before(failed[j].LastAttempt)
+	})
+
+	var dryRun *api.MigrationDryRun
+	if m.dryRun != nil {
+		dr := *m.dryRun
+		dryRun = &dr
+	}
+
+	return api.MigrationStatusResponse{
+		Migrating: m.migrating,
+		Paused:    m.paused,
+		PassStart: api.ParamTime(m.migratingLastStart),
+
+		Queued:    m.stats.queued,
+		Completed: m.stats.completed,
+		Failed:    m.stats.failed,
+		Skipped:   m.stats.skipped,
+		Bytes:     m.stats.bytes,
+
+		Rate:              rate,
+		ETAMS:             api.ParamDuration(eta),
+		MaxSlabsPerMinute: limit,
+
+		BackingOff:  backingOff,
+		FailedSlabs: failed,
+
+		DryRun: dryRun,
+	}
+}
+
+// canMigrate returns whether a slab is eligible for migration, slabs that
+// failed to migrate recently or too often are not.
+func (m *migrator) canMigrate(key object.EncryptionKey) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, exists := m.failures[key]
+	if !exists {
+		return true
+	}
+	return f.attempts < migratorMaxAttempts && !m.now().Before(f.nextAttempt)
+}
+
+// recordQueued updates the number of slabs that were queued and skipped in
+// the current pass.
+func (m *migrator) recordQueued(queued, skipped int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.queued += uint64(queued)
+	m.stats.skipped += uint64(skipped)
+}
+
+// recordMigration records the outcome of migrating a slab in the current pass,
+// bytes is the amount of data stored in the slab. Failures are tracked per slab
+// to schedule the next attempt, a successful migration clears them.
+func (m *migrator) recordMigration(key object.EncryptionKey, bytes uint64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.stats.failed++
+
+		f, exists := m.failures[key]
+		if !exists {
+			f = &slabFailure{}
+			m.failures[key] = f
+		}
+		f.attempts++
+		f.lastAttempt = m.now()
+		f.lastErr = err.Error()
+		f.nextAttempt = f.lastAttempt.Add(migrationBackoff(f.attempts))
+	} else {
+		m.stats.completed++
+		m.stats.bytes += bytes
+		delete(m.failures, key)
+		m.clearCriticalSlabLocked(key)
+	}
+	m.stats.recent = append(m.stats.recent, m.now())
+	if len(m.stats.recent) > migratorRateWindow {
+		m.stats.recent = m.stats.recent[1:]
+	}
+}
+
+// updateCriticalSlab raises an alert if the slab's health is below the critical
+// cutoff and clears it once the slab recovered. It returns whether the slab is
+// critical.
+func (m *migrator) updateCriticalSlab(slab api.UnhealthySlab) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.migrating, m.migratingLastStart
+	if slab.Health >= m.criticalCutoff {
+		m.clearCriticalSlabLocked(slab.Key)
+		return false
+	}
+	m.critical[slab.Key] = struct{}{}
+	m.ap.alerts.Register(api.Alert{
+		ID:       criticalSlabAlertID(slab.Key),
+		Severity: api.AlertSeverityCritical,
+		Message:  "slab health is below the critical health cutoff",
+		Data: map[string]interface{}{
+			"slabKey": slab.Key.String(),
+			"health":  slab.Health,
+		},
+		Timestamp: m.now(),
+	})
+	return true
+}
+
+// clearCriticalSlabLocked dismisses the alert for a slab that was critical.
+func (m *migrator) clearCriticalSlabLocked(key object.EncryptionKey) {
+	if _, exists := m.critical[key]; exists {
+		delete(m.critical, key)
+		m.ap.alerts.Dismiss(criticalSlabAlertID(key))
+	}
+}
+
+// clearCriticalSlabs dismisses the alerts for all slabs that were critical
+// except for the given ones.
+func (m *migrator) clearCriticalSlabs(except map[object.EncryptionKey]struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.critical {
+		if _, exists := except[key]; !exists {
+			m.clearCriticalSlabLocked(key)
+		}
+	}
 }
 
 func (m *migrator) tryPerformMigrations(ctx context.Context, wp *workerPool) {
 	m.mu.Lock()
-	if m.migrating || m.ap.isStopped() {
+	if m.migrating || m.paused || m.ap.isStopped() {
 		m.mu.Unlock()
 		return
 	}
 	m.migrating = true
-	m.migratingLastStart = time.Now()
+	m.migratingLastStart = m.now()
+	m.stats = migrationStats{}
 	m.mu.Unlock()
 
 	set := m.ap.State().cfg.Contracts.Set
@@ -65,16 +491,25 @@ func (m *migrator) tryPerformMigrations(ctx context.Context, wp *workerPool) {
 	m.ap.wg.Add(1)
 	go func() {
 		defer m.ap.wg.Done()
-		m.performMigrations(wp, set)
+		err := m.performMigrations(wp, set)
+		if err != nil {
+			m.logger.Error(err)
+		}
+
 		m.mu.Lock()
 		m.migrating = false
+		m.migratingLastFinish = m.now()
+		m.migratingLastDuration = m.migratingLastFinish.Sub(m.migratingLastStart)
+		m.migratingLastErr = err
+		m.migratingLastProcessed = m.stats.completed + m.stats.failed
 		m.mu.Unlock()
 	}()
 }
 
-func (m *migrator) performMigrations(p *workerPool, set string) {
+// performMigrations migrates the slabs in the given contract set, it returns an
+// error if the pass was aborted before all slabs were processed.
+func (m *migrator) performMigrations(p *workerPool, set string) error {
 	m.logger.Info("performing migrations")
-	b := m.ap.bus
 	ctx, span := tracing.Tracer.Start(context.Background(), "migrator.performMigrations")
 	defer span.End()
 
@@ -83,6 +518,7 @@ func (m *migrator) performMigrations(p *workerPool, set string) {
 		api.UnhealthySlab
 		slabIdx   int
 		batchSize int
+		done      func()
 	}
 	jobs := make(chan job)
 	var wg sync.WaitGroup
@@ -105,88 +541,326 @@ func (m *migrator) performMigrations(p *workerPool, set string) {
 				}
 
 				for j := range jobs {
-					slab, err := b.Slab(ctx, j.Key)
-					if err != nil {
-						m.logger.Errorf("%v: failed to fetch slab for migration %d/%d, health: %v, err: %v", id, j.slabIdx+1, j.batchSize, j.Health, err)
-						continue
-					}
-					err = w.MigrateSlab(ctx, slab)
-					if err != nil {
-						m.logger.Errorf("%v: failed to migrate slab %d/%d, health: %v, err: %v", id, j.slabIdx+1, j.batchSize, j.Health, err)
-						continue
-					}
-					m.logger.Debugf("%v: successfully migrated slab '%v' (health: %v) %d/%d", id, j.Key, j.Health, j.slabIdx+1, j.batchSize)
+					func() {
+						defer j.done()
+						slab, err := m.bus.Slab(ctx, j.Key)
+						if err != nil {
+							m.recordMigration(j.Key, 0, err)
+							m.logger.Errorf("%v: failed to fetch slab for migration %d/%d, health: %v, err: %v", id, j.slabIdx+1, j.batchSize, j.Health, err)
+							return
+						}
+						err = w.MigrateSlab(ctx, slab)
+						m.recordMigration(j.Key, uint64(slab.Length()), err)
+						if err != nil {
+							m.logger.Errorf("%v: failed to migrate slab %d/%d, health: %v, err: %v", id, j.slabIdx+1, j.batchSize, j.Health, err)
+							return
+						}
+						m.logger.Debugf("%v: successfully migrated slab '%v' (health: %v) %d/%d", id, j.Key, j.Health, j.slabIdx+1, j.batchSize)
+					}()
 				}
 			}(w)
 		}
 	})
-	var toMigrate []api.UnhealthySlab
 
-	// ignore a potential signal before the first iteration of the 'OUTER' loop
+	// dispatch the queued slabs, critical ones first, until the queue is
+	// empty or the slabs are updated, in which case the remaining slabs stay
+	// queued and newly found critical slabs are dispatched before them
+	var limiter migrationLimiter
+	var dispatched int
+	queue := newMigrationQueue(m.criticalCutoff, migratorMaxQueueTime)
+	dispatchQueued := func(interrupt <-chan struct{}) bool {
+		var batchWG sync.WaitGroup
+		defer batchWG.Wait()
+		for queue.len() > 0 {
+			// don't dispatch jobs while the migrations are paused
+			paused, pauseChanged := m.pauseState()
+			dispatch := jobs
+			if paused {
+				dispatch = nil
+			}
+
+			// respect the rate limit, the limit is fetched before every job
+			// so config updates apply immediately
+			if !paused {
+				limit := m.ap.State().cfg.Migrations.MaxSlabsPerMinute
+				if wait := limiter.delay(m.now(), limit); wait > 0 {
+					select {
+					case <-m.ap.stopChan:
+						return false
+					case <-pauseChanged:
+					case <-m.after(wait):
+					}
+					continue
+				}
+			}
+
+			slab, critical := queue.next(m.now())
+			batchWG.Add(1)
+			select {
+			case <-m.ap.stopChan:
+				batchWG.Done()
+				return false
+			case <-interrupt:
+				// signal migrateSlabs to update the slabs
+				batchWG.Done()
+				m.SignalMaintenanceFinished()
+				return true
+			case <-pauseChanged:
+				batchWG.Done()
+			case dispatch <- job{slab, dispatched, dispatched + queue.len(), batchWG.Done}:
+				limiter.record(m.now())
+				queue.pop(critical)
+				dispatched++
+			}
+		}
+		return true
+	}
+
+	// migrate the slabs batch by batch, waiting for a batch to be done before
+	// fetching the next one
+	err := m.migrateSlabs(ctx, set, func(batch []api.UnhealthySlab) bool {
+		queue.push(batch, m.now())
+		return dispatchQueued(m.signalMaintenanceFinished)
+	})
+	if err != nil {
+		return err
+	}
+
+	// slabs that were queued before the last update might still be waiting
+	if !dispatchQueued(nil) || m.ap.isStopped() {
+		return errMigrationsInterrupted
+	}
+	return nil
+}
+
+// migrateSlabs fetches the slabs that need to be migrated in batches and passes
+// them to 'migrate', which returns false if the migrations should be stopped.
+// Slabs that were already passed to 'migrate' are skipped in the following
+// batches unless their health changed, this ensures slabs that can't be
+// migrated don't keep coming back and starve the others. Slabs that failed to
+// migrate in previous passes are skipped until their backoff expired. Alerts are
+// raised for slabs whose health is below the critical cutoff.
+func (m *migrator) migrateSlabs(ctx context.Context, set string, migrate func([]api.UnhealthySlab) bool) error {
+	// ignore a potential signal before the first batch
 	select {
 	case <-m.signalMaintenanceFinished:
 	default:
 	}
 
-OUTER:
+	attempted := make(map[object.EncryptionKey]float64)
+	critical := make(map[object.EncryptionKey]struct{})
+	var offset int
 	for {
+		// start over if the contract set might have changed, slabs that were
+		// attempted already are only retried if their health changed
+		select {
+		case <-m.ap.stopChan:
+			return nil
+		case <-m.signalMaintenanceFinished:
+			m.logger.Info("migrations interrupted - updating slabs for migration")
+			offset = 0
+		default:
+		}
+
 		// fetch slabs for migration
-		toMigrateNew, err := b.SlabsForMigration(ctx, m.healthCutoff, set, migratorBatchSize)
+		batch, err := m.bus.SlabsForMigration(ctx, m.healthCutoff, set, offset, m.batchSize)
 		if err != nil {
-			m.logger.Errorf("failed to fetch slabs for migration, err: %v", err)
-			return
-		}
-		m.logger.Debugf("%d potential slabs fetched for migration", len(toMigrateNew))
-
-		// merge toMigrateNew with toMigrate
-		// NOTE: when merging, we remove all slabs from toMigrate that don't
-		// require migration anymore. However, slabs that have been in toMigrate
-		// before will be repaired before any new slabs. This is to prevent
-		// starvation.
-		migrateNewMap := make(map[object.EncryptionKey]*api.UnhealthySlab)
-		for i, slab := range toMigrateNew {
-			migrateNewMap[slab.Key] = &toMigrateNew[i]
-		}
-		removed := 0
-		for i := 0; i < len(toMigrate)-removed; {
-			slab := toMigrate[i]
-			if _, exists := migrateNewMap[slab.Key]; exists {
-				delete(migrateNewMap, slab.Key) // delete from map to leave only new slabs
-				i++
+			return fmt.Errorf("failed to fetch slabs for migration: %w", err)
+		}
+		m.logger.Debugf("%d potential slabs fetched for migration", len(batch))
+
+		// return if there are no slabs to migrate, slabs that were critical
+		// but weren't fetched in this pass recovered
+		if len(batch) == 0 {
+			m.clearCriticalSlabs(critical)
+			return nil
+		}
+
+		// raise alerts for slabs that are critical
+		for _, slab := range batch {
+			if m.updateCriticalSlab(slab) {
+				critical[slab.Key] = struct{}{}
 			} else {
-				toMigrate[i] = toMigrate[len(toMigrate)-1-removed]
-				removed++
+				delete(critical, slab.Key)
 			}
 		}
-		toMigrate = toMigrate[:len(toMigrate)-removed]
-		for _, slab := range migrateNewMap {
-			toMigrate = append(toMigrate, *slab)
+
+		// skip the slabs that were attempted already or are backing off, they
+		// remain unhealthy so the next batch starts after them
+		var toMigrate []api.UnhealthySlab
+		for _, slab := range batch {
+			if health, exists := attempted[slab.Key]; exists && health == slab.Health {
+				offset++
+				continue
+			} else if !m.canMigrate(slab.Key) {
+				offset++
+				continue
+			}
+			attempted[slab.Key] = slab.Health
+			toMigrate = append(toMigrate, slab)
 		}
+		m.recordQueued(len(toMigrate), len(batch)-len(toMigrate))
+		m.logger.Debugf("%d slabs to migrate", len(toMigrate))
 
-		// sort the newsly added slabs by health
-		newSlabs := toMigrate[len(toMigrate)-len(migrateNewMap):]
-		sort.Slice(newSlabs, func(i, j int) bool {
-			return newSlabs[i].Health < newSlabs[j].Health
-		})
-		migrateNewMap = nil // free map
+		if len(toMigrate) > 0 && !migrate(toMigrate) {
+			return nil
+		}
+	}
+}
 
-		// log the updated list of slabs to migrate
-		m.logger.Debugf("%d slabs to migrate", len(toMigrate))
+// TryDryRun starts a dry run of the migrations unless one is in progress
+// already. It returns whether a dry run was started.
+func (m *migrator) TryDryRun() bool {
+	m.mu.Lock()
+	if (m.dryRun != nil && time.Time(m.dryRun.Finished).IsZero()) || m.ap.isStopped() {
+		m.mu.Unlock()
+		return false
+	}
+	m.dryRun = &api.MigrationDryRun{Started: api.ParamTime(m.now())}
+	m.mu.Unlock()
 
-		// return if there are no slabs to migrate
-		if len(toMigrate) == 0 {
-			return
+	state := m.ap.State()
+
+	m.ap.wg.Add(1)
+	go func() {
+		defer m.ap.wg.Done()
+		res, err := m.performDryRun(state.cfg)
+		if err != nil {
+			m.logger.Errorf("migration dry run failed: %v", err)
+			res.Error = err.Error()
 		}
 
-		for i, slab := range toMigrate {
-			select {
-			case <-m.ap.stopChan:
-				return
-			case <-m.signalMaintenanceFinished:
-				m.logger.Info("migrations interrupted - updating slabs for migration")
-				continue OUTER
-			case jobs <- job{slab, i, len(toMigrate)}:
+		m.mu.Lock()
+		res.Started = m.dryRun.Started
+		res.Finished = api.ParamTime(m.now())
+		m.dryRun = &res
+		m.mu.Unlock()
+	}()
+	return true
+}
+
+// performDryRun estimates the work a migration pass would do. It fetches the
+// slabs for migration the same way a migration pass does but instead of
+// migrating them it computes the shards that would have to be re-uploaded and
+// the hosts they would be uploaded to. The migration state, e.g. the stats and
+// the failures, isn't updated.
+func (m *migrator) performDryRun(cfg api.AutopilotConfig) (res api.MigrationDryRun, err error) {
+	ctx, span := tracing.Tracer.Start(context.Background(), "migrator.performDryRun")
+	defer span.End()
+
+	// fetch the hosts in the contract set, shards are uploaded to them
+	contracts, err := m.bus.ContractSetContracts(ctx, cfg.Contracts.Set)
+	if err != nil {
+		return res, fmt.Errorf("failed to fetch contract set contracts: %w", err)
+	}
+	var setHosts []types.PublicKey
+	inSet := make(map[types.PublicKey]struct{})
+	for _, c := range contracts {
+		if _, exists := inSet[c.HostKey]; !exists {
+			inSet[c.HostKey] = struct{}{}
+			setHosts = append(setHosts, c.HostKey)
+		}
+	}
+
+	// fetch the hosts lazily, their price tables are used to estimate the cost
+	hosts := make(map[types.PublicKey]hostdb.Host)
+	host := func(hk types.PublicKey) (hostdb.Host, error) {
+		if h, exists := hosts[hk]; exists {
+			return h, nil
+		}
+		hi, err := m.bus.Host(ctx, hk)
+		if err != nil {
+			return hostdb.Host{}, fmt.Errorf("failed to fetch host %v: %w", hk, err)
+		}
+		hosts[hk] = hi.Host
+		return hi.Host, nil
+	}
+
+	// keep track of the number of shards uploaded to every host, new shards are
+	// uploaded to the hosts that received the fewest shards so far
+	uploads := make(map[types.PublicKey]int)
+
+	for offset := 0; ; {
+		select {
+		case <-m.ap.stopChan:
+			return res, errors.New("autopilot was stopped")
+		default:
+		}
+
+		batch, err := m.bus.SlabsForMigration(ctx, m.healthCutoff, cfg.Contracts.Set, offset, m.batchSize)
+		if err != nil {
+			return res, fmt.Errorf("failed to fetch slabs for migration: %w", err)
+		} else if len(batch) == 0 {
+			break
+		}
+		offset += len(batch)
+
+		for _, us := range batch {
+			if !m.canMigrate(us.Key) {
+				res.Skipped++
+				continue
+			}
+			slab, err := m.bus.Slab(ctx, us.Key)
+			if err != nil {
+				return res, fmt.Errorf("failed to fetch slab %v: %w", us.Key, err)
+			}
+			res.Slabs++
+
+			// shards on hosts outside the contract set and shards on the
+			// same host as another shard are re-uploaded
+			var good []types.PublicKey
+			used := make(map[types.PublicKey]struct{})
+			for _, shard := range slab.Shards {
+				if _, exists := used[shard.Host]; exists {
+					continue
+				} else if _, exists := inSet[shard.Host]; !exists {
+					continue
+				}
+				used[shard.Host] = struct{}{}
+				good = append(good, shard.Host)
 			}
+			if len(good) < int(slab.MinShards) {
+				res.Unrecoverable++
+				continue
+			}
+
+			// downloading the slab requires MinShards shards
+			for _, hk := range good[:slab.MinShards] {
+				h, err := host(hk)
+				if err != nil {
+					return res, err
+				}
+				res.Cost = res.Cost.Add(downloadCostForScore(cfg, h, rhpv2.SectorSize))
+			}
+
+			// pick the hosts the missing shards are uploaded to
+			var candidates []types.PublicKey
+			for _, hk := range setHosts {
+				if _, exists := used[hk]; !exists {
+					candidates = append(candidates, hk)
+				}
+			}
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return uploads[candidates[i]] < uploads[candidates[j]]
+			})
+			missing := len(slab.Shards) - len(good)
+			if len(candidates) < missing {
+				res.InsufficientHosts++
+				missing = len(candidates)
+			}
+			for _, hk := range candidates[:missing] {
+				h, err := host(hk)
+				if err != nil {
+					return res, err
+				}
+				res.Cost = res.Cost.Add(uploadCostForScore(cfg, h, rhpv2.SectorSize))
+				uploads[hk]++
+			}
+			res.Shards += uint64(missing)
 		}
 	}
+
+	res.Hosts = uint64(len(uploads))
+	res.Bytes = res.Shards * rhpv2.SectorSize
+	return res, nil
 }
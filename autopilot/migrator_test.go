@@ -0,0 +1,939 @@
+package autopilot
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	rhpv2 "go.sia.tech/core/rhp/v2"
+	rhpv3 "go.sia.tech/core/rhp/v3"
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/hostdb"
+	"go.sia.tech/renterd/object"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type mockMigratorBus struct {
+	mu    sync.Mutex
+	slabs []api.UnhealthySlab
+	err   error
+
+	// shards, contracts and hosts are only used by the dry run tests
+	shards    map[object.EncryptionKey][]object.Sector
+	contracts []api.ContractMetadata
+	hosts     map[types.PublicKey]hostdb.Host
+}
+
+func (b *mockMigratorBus) ContractSetContracts(ctx context.Context, set string) ([]api.ContractMetadata, error) {
+	return b.contracts, nil
+}
+
+func (b *mockMigratorBus) Host(ctx context.Context, hostKey types.PublicKey) (hostdb.HostInfo, error) {
+	h, exists := b.hosts[hostKey]
+	if !exists {
+		return hostdb.HostInfo{}, errors.New("host not found")
+	}
+	return hostdb.HostInfo{Host: h}, nil
+}
+
+func (b *mockMigratorBus) Slab(ctx context.Context, key object.EncryptionKey) (object.Slab, error) {
+	if shards, exists := b.shards[key]; exists {
+		return object.Slab{Key: key, MinShards: 1, Shards: shards}, nil
+	}
+	return object.Slab{Key: key, MinShards: 1, Shards: make([]object.Sector, 2)}, nil
+}
+
+func (b *mockMigratorBus) SlabsForMigration(ctx context.Context, healthCutoff float64, set string, offset, limit int) ([]api.UnhealthySlab, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	sort.SliceStable(b.slabs, func(i, j int) bool {
+		return b.slabs[i].Health < b.slabs[j].Health
+	})
+	if offset > len(b.slabs) {
+		return nil, nil
+	}
+	end := offset + limit
+	if end > len(b.slabs) {
+		end = len(b.slabs)
+	}
+	return append([]api.UnhealthySlab{}, b.slabs[offset:end]...), nil
+}
+
+func (b *mockMigratorBus) remove(key object.EncryptionKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, slab := range b.slabs {
+		if slab.Key == key {
+			b.slabs = append(b.slabs[:i], b.slabs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *mockMigratorBus) setHealth(key object.EncryptionKey, health float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, slab := range b.slabs {
+		if slab.Key == key {
+			b.slabs[i].Health = health
+			return
+		}
+	}
+}
+
+// mockMigratorWorker migrates slabs by removing them from the bus unless they
+// are broken, every migration blocks until it's unblocked.
+type mockMigratorWorker struct {
+	Worker // only ID and MigrateSlab are implemented
+
+	bus     *mockMigratorBus
+	broken  map[object.EncryptionKey]struct{}
+	unblock chan struct{}
+
+	mu    sync.Mutex
+	calls int
+	order []object.EncryptionKey
+}
+
+func (w *mockMigratorWorker) ID(ctx context.Context) (string, error) {
+	return "worker", nil
+}
+
+func (w *mockMigratorWorker) MigrateSlab(ctx context.Context, s object.Slab) error {
+	w.mu.Lock()
+	w.calls++
+	w.order = append(w.order, s.Key)
+	w.mu.Unlock()
+
+	<-w.unblock
+	if _, ok := w.broken[s.Key]; ok {
+		return errors.New("broken slab")
+	}
+	w.bus.remove(s.Key)
+	return nil
+}
+
+// mockClock is a fake clock that only moves forward when it's advanced, timers
+// fire once the clock is advanced past their deadline.
+type mockClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []mockTimer
+}
+
+type mockTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Unix(0, 0)}
+}
+
+func (c *mockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *mockClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, mockTimer{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *mockClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if c.now.Before(t.deadline) {
+			timers = append(timers, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+func (c *mockClock) numTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func newTestMigrator(b *mockMigratorBus, batchSize int) *migrator {
+	logger := zap.New(zapcore.NewNopCore()).Sugar()
+	return &migrator{
+		ap:                        &Autopilot{stopChan: make(chan struct{}), alerts: newAlerts(logger)},
+		bus:                       b,
+		logger:                    logger,
+		healthCutoff:              0.75,
+		criticalCutoff:            0.25,
+		batchSize:                 batchSize,
+		signalMaintenanceFinished: make(chan struct{}, 1),
+		pauseChanged:              make(chan struct{}),
+		now:                       time.Now,
+		after:                     time.After,
+		failures:                  make(map[object.EncryptionKey]*slabFailure),
+		critical:                  make(map[object.EncryptionKey]struct{}),
+	}
+}
+
+// TestMigratorBatches asserts slabs that can't be migrated don't starve the
+// other slabs when fetching them in small batches.
+func TestMigratorBatches(t *testing.T) {
+	// prepare 10 slabs that can't be migrated, they are the least healthy
+	// ones so they are fetched first, and 20 slabs that can be migrated
+	b := &mockMigratorBus{}
+	broken := make(map[object.EncryptionKey]struct{})
+	for i := 0; i < 30; i++ {
+		slab := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5}
+		if i < 10 {
+			slab.Health = 0.1
+			broken[slab.Key] = struct{}{}
+		}
+		b.slabs = append(b.slabs, slab)
+	}
+
+	// the first broken slab is repaired partially the first time it's migrated
+	partial := b.slabs[0].Key
+
+	m := newTestMigrator(b, 5)
+
+	// migrate the slabs, the broken ones stay unhealthy
+	attempts := make(map[object.EncryptionKey]int)
+	done := make(chan error)
+	go func() {
+		done <- m.migrateSlabs(context.Background(), "autopilot", func(batch []api.UnhealthySlab) bool {
+			if len(batch) > m.batchSize {
+				t.Errorf("batch too large, %v > %v", len(batch), m.batchSize)
+			}
+			for _, slab := range batch {
+				attempts[slab.Key]++
+				if slab.Key == partial && attempts[slab.Key] == 1 {
+					b.setHealth(slab.Key, 0.2)
+				} else if _, ok := broken[slab.Key]; !ok {
+					b.remove(slab.Key)
+				}
+			}
+			return true
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("migrations didn't finish")
+	}
+
+	// assert every slab was attempted once, except for the partially repaired
+	// one which is retried since its health changed
+	if len(attempts) != 30 {
+		t.Fatalf("unexpected number of slabs attempted, %v != 30", len(attempts))
+	}
+	for key, n := range attempts {
+		if key == partial && n != 2 {
+			t.Fatalf("partially repaired slab should've been attempted twice, got %v", n)
+		} else if key != partial && n != 1 {
+			t.Fatalf("slab should've been attempted once, got %v", n)
+		}
+	}
+
+	// assert only the broken slabs remain
+	if len(b.slabs) != len(broken) {
+		t.Fatalf("unexpected number of slabs left, %v != %v", len(b.slabs), len(broken))
+	}
+	for _, slab := range b.slabs {
+		if _, ok := broken[slab.Key]; !ok {
+			t.Fatal("slab should've been migrated", slab.Key)
+		}
+	}
+}
+
+// TestMigrationStatus asserts the migration status reflects the progress of a
+// migration pass while it's running.
+func TestMigrationStatus(t *testing.T) {
+	// prepare 2 slabs that can't be migrated and 4 slabs that can
+	b := &mockMigratorBus{}
+	broken := make(map[object.EncryptionKey]struct{})
+	for i := 0; i < 6; i++ {
+		slab := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5}
+		if i < 2 {
+			slab.Health = 0.1
+			broken[slab.Key] = struct{}{}
+		}
+		b.slabs = append(b.slabs, slab)
+	}
+	w := &mockMigratorWorker{bus: b, broken: broken, unblock: make(chan struct{})}
+
+	// serve the autopilot api
+	m := newTestMigrator(b, 3)
+	m.ap.m = m
+	srv := httptest.NewServer(m.ap.Handler())
+	defer srv.Close()
+	c := NewClient(srv.URL, "")
+
+	// start migrating
+	m.tryPerformMigrations(context.Background(), newWorkerPool([]Worker{w}))
+	status := func() api.MigrationStatusResponse {
+		t.Helper()
+		status, err := c.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	waitFor := func(fn func(api.MigrationStatusResponse) bool) api.MigrationStatusResponse {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			if s := status(); fn(s) {
+				return s
+			}
+		}
+		t.Fatal("timed out waiting for status", status())
+		return api.MigrationStatusResponse{}
+	}
+
+	// unblock the first two migrations, the broken slabs come first
+	w.unblock <- struct{}{}
+	w.unblock <- struct{}{}
+	s := waitFor(func(s api.MigrationStatusResponse) bool { return s.Failed == 2 })
+	if !s.Migrating {
+		t.Fatal("expected migrations to be running")
+	} else if s.Queued != 3 || s.Completed != 0 || s.Skipped != 0 || s.Bytes != 0 {
+		t.Fatalf("unexpected status %+v", s)
+	} else if s.Rate <= 0 {
+		t.Fatalf("expected rate to be set %+v", s)
+	}
+
+	// unblock the remaining migrations
+	close(w.unblock)
+	s = waitFor(func(s api.MigrationStatusResponse) bool { return !s.Migrating })
+	if s.Queued != 6 || s.Completed != 4 || s.Failed != 2 || s.Skipped != 2 {
+		t.Fatalf("unexpected status %+v", s)
+	} else if s.Bytes != 4*rhpv2.SectorSize {
+		t.Fatalf("unexpected bytes %v", s.Bytes)
+	} else if s.ETAMS != 0 {
+		t.Fatalf("unexpected eta %v", s.ETAMS)
+	} else if s.BackingOff != 2 || len(s.FailedSlabs) != 0 {
+		t.Fatalf("unexpected failures %+v", s)
+	}
+	m.ap.wg.Wait()
+}
+
+// TestMigratorBackoff asserts slabs that failed to migrate are retried with an
+// exponential backoff and are given up on after too many failures.
+func TestMigratorBackoff(t *testing.T) {
+	// assert the backoff doubles and is capped
+	if migrationBackoff(1) != migratorBackoffMin {
+		t.Fatal("unexpected backoff", migrationBackoff(1))
+	} else if migrationBackoff(2) != 2*migratorBackoffMin {
+		t.Fatal("unexpected backoff", migrationBackoff(2))
+	} else if migrationBackoff(3) != 4*migratorBackoffMin {
+		t.Fatal("unexpected backoff", migrationBackoff(3))
+	} else if migrationBackoff(100) != migratorBackoffMax {
+		t.Fatal("unexpected backoff", migrationBackoff(100))
+	}
+
+	// prepare a slab that can't be migrated and one that fails once
+	broken, flaky := object.GenerateEncryptionKey(), object.GenerateEncryptionKey()
+	b := &mockMigratorBus{slabs: []api.UnhealthySlab{
+		{Key: broken, Health: 0.1},
+		{Key: flaky, Health: 0.2},
+	}}
+
+	// use a fake clock
+	m := newTestMigrator(b, 5)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	// pass performs a migration pass and returns the migrated slabs
+	attempts := make(map[object.EncryptionKey]int)
+	pass := func() (migrated []object.EncryptionKey) {
+		t.Helper()
+		if err := m.migrateSlabs(context.Background(), "autopilot", func(batch []api.UnhealthySlab) bool {
+			for _, slab := range batch {
+				migrated = append(migrated, slab.Key)
+				attempts[slab.Key]++
+				if slab.Key == broken || attempts[slab.Key] == 1 {
+					m.recordMigration(slab.Key, 0, errors.New("failed"))
+				} else {
+					m.recordMigration(slab.Key, 1, nil)
+					b.remove(slab.Key)
+				}
+			}
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// both slabs fail in the first pass
+	if migrated := pass(); len(migrated) != 2 {
+		t.Fatal("unexpected migrations", migrated)
+	}
+
+	// they are skipped until the backoff expires
+	if migrated := pass(); len(migrated) != 0 {
+		t.Fatal("unexpected migrations", migrated)
+	}
+	now = now.Add(migratorBackoffMin - time.Second)
+	if migrated := pass(); len(migrated) != 0 {
+		t.Fatal("unexpected migrations", migrated)
+	}
+
+	// once it expired they are retried, the flaky slab succeeds
+	now = now.Add(time.Second)
+	if migrated := pass(); len(migrated) != 2 {
+		t.Fatal("unexpected migrations", migrated)
+	} else if s := m.MigrationStatus(); s.BackingOff != 1 || len(s.FailedSlabs) != 0 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+
+	// the broken slab's backoff doubled
+	now = now.Add(migratorBackoffMin)
+	if migrated := pass(); len(migrated) != 0 {
+		t.Fatal("unexpected migrations", migrated)
+	}
+	now = now.Add(migratorBackoffMin)
+	if migrated := pass(); len(migrated) != 1 || migrated[0] != broken {
+		t.Fatal("unexpected migrations", migrated)
+	}
+
+	// keep failing until the slab is given up on
+	for attempts[broken] < migratorMaxAttempts {
+		now = now.Add(migratorBackoffMax)
+		if migrated := pass(); len(migrated) != 1 {
+			t.Fatal("unexpected migrations", migrated)
+		}
+	}
+	s := m.MigrationStatus()
+	if s.BackingOff != 0 || len(s.FailedSlabs) != 1 {
+		t.Fatalf("unexpected status %+v", s)
+	} else if f := s.FailedSlabs[0]; f.Key != broken || f.Attempts != migratorMaxAttempts || f.LastError != "failed" || !f.LastAttempt.Equal(now) {
+		t.Fatalf("unexpected failure %+v", f)
+	}
+
+	// it's never retried again
+	now = now.Add(100 * migratorBackoffMax)
+	if migrated := pass(); len(migrated) != 0 {
+		t.Fatal("unexpected migrations", migrated)
+	}
+}
+
+// TestMigrationStatusRate asserts the migration rate and ETA are computed using
+// the migrator's clock.
+func TestMigrationStatusRate(t *testing.T) {
+	m := newTestMigrator(&mockMigratorBus{}, 5)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	// start a pass and migrate half of the queued slabs, one every second
+	m.mu.Lock()
+	m.migratingLastStart = now
+	m.stats.queued = 20
+	m.mu.Unlock()
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		m.recordMigration(object.GenerateEncryptionKey(), 1, nil)
+	}
+
+	s := m.MigrationStatus()
+	if s.Rate != 1 {
+		t.Fatal("unexpected rate", s.Rate)
+	} else if eta := time.Duration(s.ETAMS); eta != 10*time.Second {
+		t.Fatal("unexpected eta", eta)
+	}
+}
+
+// TestMigratorCriticalSlabAlerts asserts alerts are raised for slabs whose
+// health is below the critical cutoff and cleared when they are migrated or
+// recover.
+func TestMigratorCriticalSlabAlerts(t *testing.T) {
+	// prepare two critical slabs, one of them can't be migrated, and one slab
+	// that's unhealthy but not critical
+	broken, critical, unhealthy := object.GenerateEncryptionKey(), object.GenerateEncryptionKey(), object.GenerateEncryptionKey()
+	b := &mockMigratorBus{slabs: []api.UnhealthySlab{
+		{Key: broken, Health: -0.5},
+		{Key: critical, Health: -0.2},
+		{Key: unhealthy, Health: 0.3},
+	}}
+	m := newTestMigrator(b, 5)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	// serve the autopilot api
+	m.ap.m = m
+	srv := httptest.NewServer(m.ap.Handler())
+	defer srv.Close()
+	c := NewClient(srv.URL, "")
+
+	pass := func() {
+		t.Helper()
+		if err := m.migrateSlabs(context.Background(), "autopilot", func(batch []api.UnhealthySlab) bool {
+			for _, slab := range batch {
+				if slab.Key == broken {
+					m.recordMigration(slab.Key, 0, errors.New("failed"))
+				} else {
+					m.recordMigration(slab.Key, 1, nil)
+					b.remove(slab.Key)
+				}
+			}
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertAlerts := func(keys ...object.EncryptionKey) {
+		t.Helper()
+		alerts, err := c.Alerts()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(alerts) != len(keys) {
+			t.Fatalf("unexpected number of alerts, %v != %v", len(alerts), len(keys))
+		}
+		for i, key := range keys {
+			if alerts[i].ID != criticalSlabAlertID(key) || alerts[i].Severity != api.AlertSeverityCritical {
+				t.Fatalf("unexpected alert %+v", alerts[i])
+			} else if alerts[i].Data["slabKey"] != key.String() {
+				t.Fatalf("unexpected alert data %+v", alerts[i].Data)
+			}
+		}
+	}
+
+	// after the first pass only the slab that couldn't be migrated is critical
+	pass()
+	assertAlerts(broken)
+
+	// the alert is cleared once the slab recovers, even though it's skipped
+	// since it's backing off
+	b.setHealth(broken, 0.3)
+	pass()
+	assertAlerts()
+
+	// it's raised again if the slab becomes critical again
+	b.setHealth(broken, -0.5)
+	pass()
+	assertAlerts(broken)
+
+	// it's cleared if the slab doesn't need to be migrated anymore
+	b.remove(broken)
+	pass()
+	assertAlerts()
+}
+
+// TestMigratorPause asserts no new migrations are started while the
+// migrations are paused.
+func TestMigratorPause(t *testing.T) {
+	b := &mockMigratorBus{}
+	for i := 0; i < 4; i++ {
+		b.slabs = append(b.slabs, api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5})
+	}
+	w := &mockMigratorWorker{bus: b, unblock: make(chan struct{})}
+	m := newTestMigrator(b, 4)
+	wp := newWorkerPool([]Worker{w})
+
+	calls := func() int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.calls
+	}
+	waitFor := func(fn func() bool) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			if fn() {
+				return
+			}
+		}
+		t.Fatal("timed out")
+	}
+
+	// start migrating and wait for the first migration to start
+	m.tryPerformMigrations(context.Background(), wp)
+	waitFor(func() bool { return calls() == 1 })
+
+	// pause the migrations and finish the one that's in progress
+	m.Pause()
+	time.Sleep(100 * time.Millisecond)
+	w.unblock <- struct{}{}
+
+	// no new migrations should be started
+	time.Sleep(100 * time.Millisecond)
+	if n := calls(); n != 1 {
+		t.Fatalf("unexpected number of migrations, %v != 1", n)
+	} else if s := m.Status(); !s.migrating || !s.paused {
+		t.Fatal("unexpected status", s.migrating, s.paused)
+	}
+
+	// resume the migrations and wait for the pass to finish
+	m.Resume()
+	close(w.unblock)
+	waitFor(func() bool {
+		return !m.Status().migrating
+	})
+	if n := calls(); n != 4 {
+		t.Fatalf("unexpected number of migrations, %v != 4", n)
+	} else if len(b.slabs) != 0 {
+		t.Fatal("expected all slabs to be migrated", len(b.slabs))
+	}
+
+	// pausing between passes prevents a new pass from starting
+	b.mu.Lock()
+	b.slabs = append(b.slabs, api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5})
+	b.mu.Unlock()
+	m.Pause()
+	m.tryPerformMigrations(context.Background(), wp)
+	if m.Status().migrating {
+		t.Fatal("migrations shouldn't have started")
+	}
+	m.Resume()
+	m.tryPerformMigrations(context.Background(), wp)
+	waitFor(func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.slabs) == 0
+	})
+	m.ap.wg.Wait()
+}
+
+// TestMigratorRateLimit asserts the migrations are paced according to the
+// configured rate limit and that updates to the limit apply immediately.
+func TestMigratorRateLimit(t *testing.T) {
+	b := &mockMigratorBus{}
+	for i := 0; i < 4; i++ {
+		b.slabs = append(b.slabs, api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5})
+	}
+	w := &mockMigratorWorker{bus: b, unblock: make(chan struct{})}
+	close(w.unblock)
+
+	clock := newMockClock()
+	m := newTestMigrator(b, 4)
+	m.now = clock.Now
+	m.after = clock.After
+
+	setLimit := func(limit uint64) {
+		m.ap.mu.Lock()
+		m.ap.state.cfg.Migrations.MaxSlabsPerMinute = limit
+		m.ap.mu.Unlock()
+	}
+	setLimit(1)
+
+	calls := func() int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.calls
+	}
+	waitFor := func(fn func() bool) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			if fn() {
+				return
+			}
+		}
+		t.Fatal("timed out")
+	}
+
+	// the first slab is migrated right away, the second one has to wait
+	m.tryPerformMigrations(context.Background(), newWorkerPool([]Worker{w}))
+	waitFor(func() bool { return calls() == 1 && clock.numTimers() == 1 })
+	if limit := m.MigrationStatus().MaxSlabsPerMinute; limit != 1 {
+		t.Fatal("unexpected limit", limit)
+	}
+
+	// half a minute later the limit still applies
+	clock.Advance(30 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if n := calls(); n != 1 {
+		t.Fatalf("unexpected number of migrations, %v != 1", n)
+	}
+
+	// after a minute the next slab is migrated
+	clock.Advance(30 * time.Second)
+	waitFor(func() bool { return calls() == 2 && clock.numTimers() == 1 })
+
+	// disabling the limit migrates the remaining slabs without waiting
+	setLimit(0)
+	clock.Advance(time.Minute)
+	waitFor(func() bool {
+		return !m.Status().migrating
+	})
+	if n := calls(); n != 4 {
+		t.Fatalf("unexpected number of migrations, %v != 4", n)
+	} else if n := clock.numTimers(); n != 0 {
+		t.Fatalf("unexpected number of timers, %v != 0", n)
+	}
+	m.ap.wg.Wait()
+}
+
+// TestMigrationQueue asserts critical slabs are dispatched first and that
+// slabs in the normal tier aren't starved.
+func TestMigrationQueue(t *testing.T) {
+	now := time.Now()
+	q := newMigrationQueue(0.25, time.Minute)
+
+	// queue two normal slabs and one critical slab
+	n1 := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5}
+	n2 := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5}
+	c1 := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.1}
+	q.push([]api.UnhealthySlab{n1, n2}, now)
+	q.push([]api.UnhealthySlab{c1}, now.Add(30*time.Second))
+
+	// the critical slab goes first
+	if slab, critical := q.next(now.Add(30 * time.Second)); !critical || slab.Key != c1.Key {
+		t.Fatal("expected critical slab", slab.Key, critical)
+	}
+
+	// once the normal slabs waited for too long they go first
+	if slab, critical := q.next(now.Add(time.Minute)); critical || slab.Key != n1.Key {
+		t.Fatal("expected normal slab", slab.Key, critical)
+	}
+	q.pop(false)
+	if q.len() != 2 {
+		t.Fatal("unexpected queue length", q.len())
+	}
+
+	// a queued slab whose health dropped moves to the critical tier
+	n2.Health = 0
+	q.push([]api.UnhealthySlab{n2}, now.Add(time.Minute))
+	if q.len() != 2 {
+		t.Fatal("unexpected queue length", q.len())
+	}
+	for _, key := range []object.EncryptionKey{c1.Key, n2.Key} {
+		if slab, critical := q.next(now.Add(time.Minute)); !critical || slab.Key != key {
+			t.Fatal("unexpected slab", slab.Key, critical)
+		}
+		q.pop(true)
+	}
+	if q.len() != 0 {
+		t.Fatal("unexpected queue length", q.len())
+	}
+}
+
+// TestMigratorCriticalFirst asserts critical slabs that are found while slabs
+// are being migrated are dispatched before the slabs that were queued earlier.
+func TestMigratorCriticalFirst(t *testing.T) {
+	b := &mockMigratorBus{}
+	var normal []object.EncryptionKey
+	for i := 0; i < 5; i++ {
+		slab := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5}
+		normal = append(normal, slab.Key)
+		b.slabs = append(b.slabs, slab)
+	}
+	w := &mockMigratorWorker{bus: b, unblock: make(chan struct{})}
+	m := newTestMigrator(b, 10)
+
+	waitFor := func(fn func() bool) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			if fn() {
+				return
+			}
+		}
+		t.Fatal("timed out")
+	}
+
+	// start migrating and wait for the first slab to be picked up
+	m.tryPerformMigrations(context.Background(), newWorkerPool([]Worker{w}))
+	waitFor(func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.calls == 1
+	})
+
+	// two slabs become critical while the others are queued
+	var critical []object.EncryptionKey
+	b.mu.Lock()
+	for i := 0; i < 2; i++ {
+		slab := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.1}
+		critical = append(critical, slab.Key)
+		b.slabs = append(b.slabs, slab)
+	}
+	b.mu.Unlock()
+	m.SignalMaintenanceFinished()
+
+	// finish the migrations
+	close(w.unblock)
+	waitFor(func() bool {
+		return !m.Status().migrating
+	})
+	m.ap.wg.Wait()
+
+	// assert the critical slabs were migrated right after the slab that was
+	// being migrated when they were found
+	expected := append([]object.EncryptionKey{normal[0]}, critical...)
+	expected = append(expected, normal[1:]...)
+	if len(w.order) != len(expected) {
+		t.Fatalf("unexpected number of migrations, %v != %v", len(w.order), len(expected))
+	}
+	for i := range expected {
+		if w.order[i] != expected[i] {
+			t.Fatalf("unexpected slab at index %v", i)
+		}
+	}
+}
+
+// TestMigratorDryRun asserts a dry run estimates the work of a migration pass
+// without migrating any slabs.
+func TestMigratorDryRun(t *testing.T) {
+	// prepare 6 hosts, the first 4 are in the contract set
+	b := &mockMigratorBus{
+		shards: make(map[object.EncryptionKey][]object.Sector),
+		hosts:  make(map[types.PublicKey]hostdb.Host),
+	}
+	var hks []types.PublicKey
+	for i := 0; i < 6; i++ {
+		hk := types.PublicKey{byte(i + 1)}
+		hks = append(hks, hk)
+		b.hosts[hk] = hostdb.Host{
+			PublicKey: hk,
+			PriceTable: hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{
+				DownloadBandwidthCost: types.NewCurrency64(1),
+				UploadBandwidthCost:   types.NewCurrency64(2),
+			}},
+		}
+		if i < 4 {
+			b.contracts = append(b.contracts, api.ContractMetadata{ID: types.FileContractID{byte(i + 1)}, HostKey: hk})
+		}
+	}
+
+	// add a slab with one good shard, a slab with a good shard and two
+	// shards on the same bad host and a slab without good shards
+	addSlab := func(hosts ...types.PublicKey) {
+		key := object.GenerateEncryptionKey()
+		var shards []object.Sector
+		for _, hk := range hosts {
+			shards = append(shards, object.Sector{Host: hk})
+		}
+		b.shards[key] = shards
+		b.slabs = append(b.slabs, api.UnhealthySlab{Key: key, Health: 0.5})
+	}
+	addSlab(hks[0], hks[4], hks[5])
+	addSlab(hks[1], hks[5], hks[5])
+	addSlab(hks[4], hks[5])
+
+	m := newTestMigrator(b, 2)
+	m.ap.state.cfg.Contracts.Period = 144
+	now := time.Now().Add(-time.Hour)
+	m.now = func() time.Time { return now }
+	w := &mockMigratorWorker{bus: b, unblock: make(chan struct{})}
+	m.ap.workers = newWorkerPool([]Worker{w})
+
+	// perform a dry run
+	if !m.TryDryRun() {
+		t.Fatal("dry run wasn't started")
+	}
+	m.ap.wg.Wait()
+
+	// assert nothing was migrated
+	if w.calls != 0 {
+		t.Fatalf("unexpected number of migrations, %v != 0", w.calls)
+	} else if len(b.slabs) != 3 {
+		t.Fatalf("unexpected number of slabs, %v != 3", len(b.slabs))
+	}
+	status := m.MigrationStatus()
+	if status.Migrating || status.Queued != 0 {
+		t.Fatal("dry run shouldn't affect the migration status", status.Migrating, status.Queued)
+	}
+
+	// assert the estimate, the first two slabs both need 2 new shards which
+	// are spread over all 4 hosts in the set, the last slab can't be migrated
+	dr := status.DryRun
+	if dr == nil {
+		t.Fatal("expected dry run result")
+	} else if dr.Error != "" {
+		t.Fatal(dr.Error)
+	} else if !time.Time(dr.Started).Equal(now) || !time.Time(dr.Finished).Equal(now) {
+		t.Fatal("dry run should use the migrator's clock", dr.Started, dr.Finished)
+	} else if dr.Slabs != 3 || dr.Skipped != 0 || dr.Unrecoverable != 1 || dr.InsufficientHosts != 0 {
+		t.Fatalf("unexpected slabs %+v", dr)
+	} else if dr.Shards != 4 || dr.Hosts != 4 || dr.Bytes != 4*rhpv2.SectorSize {
+		t.Fatalf("unexpected shards %+v", dr)
+	}
+
+	cfg := m.ap.state.cfg
+	h := b.hosts[hks[0]]
+	expected := downloadCostForScore(cfg, h, rhpv2.SectorSize).Mul64(2).
+		Add(uploadCostForScore(cfg, h, rhpv2.SectorSize).Mul64(4))
+	if !dr.Cost.Equals(expected) {
+		t.Fatalf("unexpected cost, %v != %v", dr.Cost, expected)
+	} else if dr.Cost.IsZero() {
+		t.Fatal("expected non-zero cost")
+	}
+}
+
+// TestMigratorLastPass asserts the outcome of the last migration pass is
+// reported by the migrator's status, both when the pass finished and when it
+// was aborted.
+func TestMigratorLastPass(t *testing.T) {
+	b := &mockMigratorBus{}
+	broken := make(map[object.EncryptionKey]struct{})
+	for i := 0; i < 3; i++ {
+		slab := api.UnhealthySlab{Key: object.GenerateEncryptionKey(), Health: 0.5}
+		if i == 0 {
+			broken[slab.Key] = struct{}{}
+		}
+		b.slabs = append(b.slabs, slab)
+	}
+	w := &mockMigratorWorker{bus: b, broken: broken, unblock: make(chan struct{})}
+	close(w.unblock)
+	m := newTestMigrator(b, 10)
+
+	// assert nothing is reported before the first pass
+	if s := m.Status(); !s.lastFinish.IsZero() || s.lastErr != nil || s.lastProcessed != 0 {
+		t.Fatal("unexpected status", s)
+	}
+
+	// perform a pass that finishes
+	m.tryPerformMigrations(context.Background(), newWorkerPool([]Worker{w}))
+	m.ap.wg.Wait()
+
+	s := m.Status()
+	if s.migrating {
+		t.Fatal("pass should be finished")
+	} else if s.lastErr != nil {
+		t.Fatal("unexpected error", s.lastErr)
+	} else if s.lastProcessed != 3 {
+		t.Fatalf("unexpected number of processed slabs, %v != 3", s.lastProcessed)
+	} else if s.lastFinish.Before(s.lastStart) {
+		t.Fatal("pass finished before it started")
+	} else if s.lastDuration != s.lastFinish.Sub(s.lastStart) {
+		t.Fatal("unexpected duration", s.lastDuration)
+	}
+	lastFinish := s.lastFinish
+
+	// perform a pass that's aborted because the slabs can't be fetched
+	b.mu.Lock()
+	b.err = errors.New("bus unavailable")
+	b.mu.Unlock()
+	m.tryPerformMigrations(context.Background(), newWorkerPool([]Worker{w}))
+	m.ap.wg.Wait()
+
+	s = m.Status()
+	if !errors.Is(s.lastErr, b.err) {
+		t.Fatal("expected error", s.lastErr)
+	} else if s.lastProcessed != 0 {
+		t.Fatalf("unexpected number of processed slabs, %v != 0", s.lastProcessed)
+	} else if s.lastFinish.Before(lastFinish) {
+		t.Fatal("finish time wasn't updated")
+	}
+}
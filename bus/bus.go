@@ -78,19 +78,49 @@ type (
 
 	// A MetadataStore stores information about contracts and objects.
 	MetadataStore interface {
-		AddContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64) (api.ContractMetadata, error)
-		AddRenewedContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID) (api.ContractMetadata, error)
+		AddContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, hostAddress string, snapshot *api.HostSettingsSnapshot) (api.ContractMetadata, error)
+		AddRenewedContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID, snapshot *api.HostSettingsSnapshot) (api.ContractMetadata, error)
 		AncestorContracts(ctx context.Context, fcid types.FileContractID, minStartHeight uint64) ([]api.ArchivedContract, error)
+		RenewalChainSpending(ctx context.Context, fcid types.FileContractID) (api.RenewalChainSpending, error)
 		ArchiveContract(ctx context.Context, id types.FileContractID, reason string) error
 		ArchiveContracts(ctx context.Context, toArchive map[types.FileContractID]string) error
 		ArchiveAllContracts(ctx context.Context, reason string) error
+		ArchiveContractsForHost(ctx context.Context, hk types.PublicKey, reason string) ([]types.FileContractID, error)
+		ArchivedContract(ctx context.Context, id types.FileContractID) (api.ArchivedContract, error)
+		ArchivedContracts(ctx context.Context, filter api.ArchivedContractsFilter) ([]api.ArchivedContract, error)
+		ContractRenewedFrom(ctx context.Context, id types.FileContractID) (api.RenewalChainEntry, error)
+		Descendant(ctx context.Context, id types.FileContractID) (api.ContractDescendant, error)
+		RenewalChain(ctx context.Context, id types.FileContractID) ([]api.RenewalChainEntry, bool, error)
+		PruneArchivedContracts(ctx context.Context, minStartHeight uint64, preserveChains bool) (int64, error)
 		Contract(ctx context.Context, id types.FileContractID) (api.ContractMetadata, error)
 		Contracts(ctx context.Context) ([]api.ContractMetadata, error)
 		ContractSetContracts(ctx context.Context, set string) ([]api.ContractMetadata, error)
-		ContractSets(ctx context.Context) ([]string, error)
+		ContractSize(ctx context.Context, id types.FileContractID) (api.ContractSize, error)
+		ContractRoots(ctx context.Context, id types.FileContractID, offset, limit int) ([]types.Hash256, error)
+		ContractSizes(ctx context.Context) ([]api.ContractSize, error)
+		ContractPrunableData(ctx context.Context, id types.FileContractID) (api.ContractPrunableData, error)
+		ContractsPrunableData(ctx context.Context) ([]api.ContractPrunableData, error)
+		ContractSets(ctx context.Context) ([]api.ContractSet, error)
+		ContractsSummary(ctx context.Context) (api.ContractsSummary, error)
+		ContractsExpiringBefore(ctx context.Context, height uint64) ([]api.ContractMetadata, error)
+		ContractsToRenew(ctx context.Context, set string, currentHeight, horizon uint64, offset, limit int) ([]api.ContractToRenew, error)
+		ContractsForHost(ctx context.Context, hk types.PublicKey, set string) ([]api.ContractMetadata, error)
+		ContractsPage(ctx context.Context, filter api.ContractsPageFilter) ([]api.ContractMetadata, int64, error)
+		ExportContracts(ctx context.Context) (api.ContractsExport, error)
+		ImportContracts(ctx context.Context, export api.ContractsExport) (api.ContractsImportResponse, error)
 		RecordContractSpending(ctx context.Context, records []api.ContractSpendingRecord) error
+		RemoveContracts(ctx context.Context, ids []types.FileContractID, reason string) (removed, unknown []types.FileContractID, err error)
+		UpdateContractBudget(ctx context.Context, id types.FileContractID, budget api.ContractSpending) error
+		ContractSpendingHistory(ctx context.Context, fcid types.FileContractID, from, to time.Time) ([]api.ContractSpendingPeriod, error)
+		SpendingHistory(ctx context.Context, from, to time.Time) ([]api.ContractSpendingPeriod, error)
+		PruneSpendingHistory(ctx context.Context, before time.Time) (int64, error)
+		AddContractsToSet(ctx context.Context, set string, contracts []types.FileContractID) error
+		ContractSetChanges(ctx context.Context, filter api.ContractSetChangesFilter) ([]api.ContractSetMembershipChange, error)
+		PruneContractSetChanges(ctx context.Context, before time.Time) (int64, error)
 		RemoveContractSet(ctx context.Context, name string) error
-		SetContractSet(ctx context.Context, set string, contracts []types.FileContractID) error
+		RemoveContractsFromSet(ctx context.Context, set string, contracts []types.FileContractID) error
+		SetContractSet(ctx context.Context, set string, contracts []types.FileContractID, allowMissing bool) (added, removed, missing []types.FileContractID, err error)
+		UpdateContractRevision(ctx context.Context, fcid types.FileContractID, revisionNumber, size uint64) error
 
 		Object(ctx context.Context, path string) (object.Object, error)
 		ObjectEntries(ctx context.Context, path, prefix string, offset, limit int) ([]api.ObjectMetadata, error)
@@ -101,8 +131,10 @@ type (
 
 		ObjectsStats(ctx context.Context) (api.ObjectsStats, error)
 
+		PruneDanglingSectors(ctx context.Context) (int64, error)
+
 		Slab(ctx context.Context, key object.EncryptionKey) (object.Slab, error)
-		UnhealthySlabs(ctx context.Context, healthCutoff float64, set string, limit int) ([]api.UnhealthySlab, error)
+		UnhealthySlabs(ctx context.Context, healthCutoff float64, set string, offset, limit int) ([]api.UnhealthySlab, error)
 		UpdateSlab(ctx context.Context, s object.Slab, contractSet string, usedContracts map[types.PublicKey]types.FileContractID) error
 	}
 
@@ -496,6 +528,18 @@ func (b *bus) hostsPubkeyHandlerGET(jc jape.Context) {
 	}
 }
 
+func (b *bus) hostsPubkeyContractsArchiveHandlerPOST(jc jape.Context) {
+	var hostKey types.PublicKey
+	var req api.HostContractsArchiveRequest
+	if jc.DecodeParam("hostkey", &hostKey) != nil || jc.Decode(&req) != nil {
+		return
+	}
+	archived, err := b.ms.ArchiveContractsForHost(jc.Request.Context(), hostKey, req.Reason)
+	if jc.Check("couldn't archive host contracts", err) == nil {
+		jc.Encode(archived)
+	}
+}
+
 func (b *bus) hostsPubkeyHandlerPOST(jc jape.Context) {
 	var interactions []hostdb.Interaction
 	if jc.Decode(&interactions) != nil {
@@ -506,13 +550,61 @@ func (b *bus) hostsPubkeyHandlerPOST(jc jape.Context) {
 	}
 }
 
+func (b *bus) contractsSpendingHandlerGET(jc jape.Context) {
+	from, to := time.Time{}, time.Now()
+	if jc.DecodeForm("from", (*api.ParamTime)(&from)) != nil || jc.DecodeForm("to", (*api.ParamTime)(&to)) != nil {
+		return
+	}
+	history, err := b.ms.SpendingHistory(jc.Request.Context(), from, to)
+	if jc.Check("couldn't load spending history", err) == nil {
+		jc.Encode(history)
+	}
+}
+
+func (b *bus) contractsSpendingPruneHandlerPOST(jc jape.Context) {
+	var req api.SpendingHistoryPruneRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	pruned, err := b.ms.PruneSpendingHistory(jc.Request.Context(), req.Before)
+	if jc.Check("couldn't prune spending history", err) == nil {
+		jc.Encode(api.SpendingHistoryPruneResponse{Pruned: pruned})
+	}
+}
+
+func (b *bus) contractIDSpendingHandlerGET(jc jape.Context) {
+	var id types.FileContractID
+	from, to := time.Time{}, time.Now()
+	if jc.DecodeParam("id", &id) != nil || jc.DecodeForm("from", (*api.ParamTime)(&from)) != nil || jc.DecodeForm("to", (*api.ParamTime)(&to)) != nil {
+		return
+	}
+	history, err := b.ms.ContractSpendingHistory(jc.Request.Context(), id, from, to)
+	if jc.Check("couldn't load spending history", err) == nil {
+		jc.Encode(history)
+	}
+}
+
+func (b *bus) contractIDSpendingChainHandlerGET(jc jape.Context) {
+	var id types.FileContractID
+	if jc.DecodeParam("id", &id) != nil {
+		return
+	}
+	spending, err := b.ms.RenewalChainSpending(jc.Request.Context(), id)
+	if jc.Check("couldn't load renewal chain spending", err) == nil {
+		jc.Encode(spending)
+	}
+}
+
 func (b *bus) contractsSpendingHandlerPOST(jc jape.Context) {
 	var records []api.ContractSpendingRecord
 	if jc.Decode(&records) != nil {
 		return
 	}
-	if jc.Check("failed to record spending metrics for contract", b.ms.RecordContractSpending(jc.Request.Context(), records)) != nil {
-		return
+	var bee *api.BudgetExceededError
+	if err := b.ms.RecordContractSpending(jc.Request.Context(), records); errors.As(err, &bee) {
+		jc.Encode(api.ContractSpendingRecordResponse{BudgetExceeded: bee.Contracts})
+	} else if jc.Check("failed to record spending metrics for contract", err) == nil {
+		jc.Encode(api.ContractSpendingRecordResponse{})
 	}
 }
 
@@ -557,12 +649,55 @@ func (b *bus) hostsBlocklistHandlerPUT(jc jape.Context) {
 }
 
 func (b *bus) contractsHandlerGET(jc jape.Context) {
-	cs, err := b.ms.Contracts(jc.Request.Context())
-	if jc.Check("couldn't load contracts", err) == nil {
+	var hostKey types.PublicKey
+	var set string
+	if jc.DecodeForm("hostKey", &hostKey) != nil || jc.DecodeForm("set", &set) != nil {
+		return
+	}
+
+	var cs []api.ContractMetadata
+	var err error
+	if hostKey != (types.PublicKey{}) {
+		cs, err = b.ms.ContractsForHost(jc.Request.Context(), hostKey, set)
+	} else if set != "" {
+		cs, err = b.ms.ContractSetContracts(jc.Request.Context(), set)
+	} else {
+		cs, err = b.ms.Contracts(jc.Request.Context())
+	}
+	if errors.Is(err, api.ErrContractSetNotFound) {
+		jc.Error(err, http.StatusNotFound)
+		return
+	} else if jc.Check("couldn't load contracts", err) == nil {
 		jc.Encode(cs)
 	}
 }
 
+func (b *bus) contractsPageHandlerGET(jc jape.Context) {
+	filter := api.ContractsPageFilter{Limit: -1}
+	if jc.DecodeForm("offset", &filter.Offset) != nil ||
+		jc.DecodeForm("limit", &filter.Limit) != nil ||
+		jc.DecodeForm("set", &filter.Set) != nil ||
+		jc.DecodeForm("sortBy", &filter.SortBy) != nil ||
+		jc.DecodeForm("createdFrom", (*api.ParamTime)(&filter.CreatedFrom)) != nil ||
+		jc.DecodeForm("createdTo", (*api.ParamTime)(&filter.CreatedTo)) != nil {
+		return
+	}
+	cs, total, err := b.ms.ContractsPage(jc.Request.Context(), filter)
+	if errors.Is(err, api.ErrInvalidContractSortKey) {
+		jc.Error(err, http.StatusBadRequest)
+		return
+	} else if errors.Is(err, api.ErrContractSetNotFound) {
+		jc.Error(err, http.StatusNotFound)
+		return
+	} else if jc.Check("couldn't load contracts", err) != nil {
+		return
+	}
+	jc.Encode(api.ContractsPageResponse{
+		Contracts: cs,
+		Total:     total,
+	})
+}
+
 func (b *bus) contractsArchiveHandlerPOST(jc jape.Context) {
 	var toArchive api.ArchiveContractsRequest
 	if jc.Decode(&toArchive) != nil {
@@ -572,9 +707,127 @@ func (b *bus) contractsArchiveHandlerPOST(jc jape.Context) {
 	jc.Check("failed to archive contracts", b.ms.ArchiveContracts(jc.Request.Context(), toArchive))
 }
 
+func (b *bus) contractsRemoveHandlerPOST(jc jape.Context) {
+	var req api.ContractsRemoveRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	removed, unknown, err := b.ms.RemoveContracts(jc.Request.Context(), req.IDs, req.Reason)
+	if jc.Check("failed to remove contracts", err) == nil {
+		jc.Encode(api.ContractsRemoveResponse{
+			Removed: removed,
+			Unknown: unknown,
+		})
+	}
+}
+
+func (b *bus) contractsArchivedHandlerGET(jc jape.Context) {
+	filter := api.ArchivedContractsFilter{Limit: -1}
+	if jc.DecodeForm("hostKey", &filter.HostKey) != nil ||
+		jc.DecodeForm("reason", &filter.Reason) != nil ||
+		jc.DecodeForm("minStartHeight", &filter.MinStartHeight) != nil ||
+		jc.DecodeForm("maxStartHeight", &filter.MaxStartHeight) != nil ||
+		jc.DecodeForm("archivedFrom", (*api.ParamTime)(&filter.ArchivedFrom)) != nil ||
+		jc.DecodeForm("archivedTo", (*api.ParamTime)(&filter.ArchivedTo)) != nil ||
+		jc.DecodeForm("offset", &filter.Offset) != nil ||
+		jc.DecodeForm("limit", &filter.Limit) != nil {
+		return
+	}
+	contracts, err := b.ms.ArchivedContracts(jc.Request.Context(), filter)
+	if jc.Check("couldn't load archived contracts", err) == nil {
+		jc.Encode(contracts)
+	}
+}
+
+func (b *bus) contractsArchivedPruneHandlerPOST(jc jape.Context) {
+	var req api.ArchivedContractsPruneRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	pruned, err := b.ms.PruneArchivedContracts(jc.Request.Context(), req.MinStartHeight, req.PreserveChains)
+	if jc.Check("couldn't prune archived contracts", err) == nil {
+		jc.Encode(api.ArchivedContractsPruneResponse{Pruned: pruned})
+	}
+}
+
+func (b *bus) contractsExpiringHandlerGET(jc jape.Context) {
+	var before uint64
+	if jc.DecodeForm("before", &before) != nil {
+		return
+	}
+	contracts, err := b.ms.ContractsExpiringBefore(jc.Request.Context(), before)
+	if jc.Check("couldn't load expiring contracts", err) == nil {
+		jc.Encode(contracts)
+	}
+}
+
+func (b *bus) contractsRenewHandlerGET(jc jape.Context) {
+	var set string
+	var height, horizon uint64
+	offset, limit := 0, -1
+	if jc.DecodeForm("set", &set) != nil || jc.DecodeForm("height", &height) != nil || jc.DecodeForm("horizon", &horizon) != nil || jc.DecodeForm("offset", &offset) != nil || jc.DecodeForm("limit", &limit) != nil {
+		return
+	}
+	contracts, err := b.ms.ContractsToRenew(jc.Request.Context(), set, height, horizon, offset, limit)
+	if errors.Is(err, api.ErrContractSetNotFound) {
+		jc.Error(err, http.StatusNotFound)
+		return
+	} else if jc.Check("couldn't load contracts to renew", err) == nil {
+		jc.Encode(contracts)
+	}
+}
+
+func (b *bus) contractsSizesHandlerGET(jc jape.Context) {
+	sizes, err := b.ms.ContractSizes(jc.Request.Context())
+	if jc.Check("couldn't load contract sizes", err) == nil {
+		jc.Encode(sizes)
+	}
+}
+
+func (b *bus) contractsPrunableHandlerGET(jc jape.Context) {
+	data, err := b.ms.ContractsPrunableData(jc.Request.Context())
+	if jc.Check("couldn't load prunable data", err) == nil {
+		jc.Encode(data)
+	}
+}
+
+func (b *bus) contractsExportHandlerGET(jc jape.Context) {
+	export, err := b.ms.ExportContracts(jc.Request.Context())
+	if jc.Check("couldn't export contracts", err) == nil {
+		jc.Encode(export)
+	}
+}
+
+func (b *bus) contractsImportHandlerPOST(jc jape.Context) {
+	var export api.ContractsExport
+	if jc.Decode(&export) != nil {
+		return
+	}
+	resp, err := b.ms.ImportContracts(jc.Request.Context(), export)
+	if jc.Check("couldn't import contracts", err) == nil {
+		jc.Encode(resp)
+	}
+}
+
+func (b *bus) contractsLockedHandlerGET(jc jape.Context) {
+	jc.Encode(b.contractLocks.Locked())
+}
+
+func (b *bus) contractsSummaryHandlerGET(jc jape.Context) {
+	summary, err := b.ms.ContractsSummary(jc.Request.Context())
+	if jc.Check("couldn't fetch contracts summary", err) != nil {
+		return
+	}
+	summary.Locked = len(b.contractLocks.Locked())
+	jc.Encode(summary)
+}
+
 func (b *bus) contractsSetHandlerGET(jc jape.Context) {
 	cs, err := b.ms.ContractSetContracts(jc.Request.Context(), jc.PathParam("set"))
-	if jc.Check("couldn't load contracts", err) == nil {
+	if errors.Is(err, api.ErrContractSetNotFound) {
+		jc.Error(err, http.StatusNotFound)
+		return
+	} else if jc.Check("couldn't load contracts", err) == nil {
 		jc.Encode(cs)
 	}
 }
@@ -586,17 +839,82 @@ func (b *bus) contractsSetsHandlerGET(jc jape.Context) {
 	}
 }
 
+func (b *bus) contractsSetsChangesHandlerGET(jc jape.Context) {
+	filter := api.ContractSetChangesFilter{Limit: -1}
+	if jc.DecodeForm("set", &filter.Set) != nil ||
+		jc.DecodeForm("contractID", &filter.ContractID) != nil ||
+		jc.DecodeForm("from", (*api.ParamTime)(&filter.From)) != nil ||
+		jc.DecodeForm("to", (*api.ParamTime)(&filter.To)) != nil ||
+		jc.DecodeForm("offset", &filter.Offset) != nil ||
+		jc.DecodeForm("limit", &filter.Limit) != nil {
+		return
+	}
+	changes, err := b.ms.ContractSetChanges(jc.Request.Context(), filter)
+	if jc.Check("couldn't load contract set changes", err) == nil {
+		jc.Encode(changes)
+	}
+}
+
+func (b *bus) contractsSetsChangesPruneHandlerPOST(jc jape.Context) {
+	var req api.ContractSetChangesPruneRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	pruned, err := b.ms.PruneContractSetChanges(jc.Request.Context(), req.Before)
+	if jc.Check("couldn't prune contract set changes", err) == nil {
+		jc.Encode(api.ContractSetChangesPruneResponse{Pruned: pruned})
+	}
+}
+
 func (b *bus) contractsSetHandlerPUT(jc jape.Context) {
+	var contractIds []types.FileContractID
+	var allowMissing bool
+	if set := jc.PathParam("set"); set == "" {
+		jc.Error(errors.New("param 'set' can not be empty"), http.StatusBadRequest)
+	} else if set == api.ContractSetAll {
+		jc.Error(fmt.Errorf("%w '%s'", api.ErrReservedSetName, set), http.StatusBadRequest)
+	} else if jc.DecodeForm("allowMissing", &allowMissing) != nil {
+		return
+	} else if jc.Decode(&contractIds) == nil {
+		added, removed, missing, err := b.ms.SetContractSet(jc.Request.Context(), set, contractIds, allowMissing)
+		if errors.Is(err, api.ErrContractsNotFound) {
+			jc.Error(err, http.StatusNotFound)
+		} else if jc.Check("could not add contracts to set", err) == nil {
+			jc.Encode(api.ContractSetUpdateResponse{
+				Added:   added,
+				Removed: removed,
+				Missing: missing,
+			})
+		}
+	}
+}
+
+func (b *bus) contractsSetAddHandlerPOST(jc jape.Context) {
+	var contractIds []types.FileContractID
+	if set := jc.PathParam("set"); set == "" {
+		jc.Error(errors.New("param 'set' can not be empty"), http.StatusBadRequest)
+	} else if set == api.ContractSetAll {
+		jc.Error(fmt.Errorf("%w '%s'", api.ErrReservedSetName, set), http.StatusBadRequest)
+	} else if jc.Decode(&contractIds) == nil {
+		jc.Check("could not add contracts to set", b.ms.AddContractsToSet(jc.Request.Context(), set, contractIds))
+	}
+}
+
+func (b *bus) contractsSetRemoveHandlerPOST(jc jape.Context) {
 	var contractIds []types.FileContractID
 	if set := jc.PathParam("set"); set == "" {
 		jc.Error(errors.New("param 'set' can not be empty"), http.StatusBadRequest)
 	} else if jc.Decode(&contractIds) == nil {
-		jc.Check("could not add contracts to set", b.ms.SetContractSet(jc.Request.Context(), set, contractIds))
+		jc.Check("could not remove contracts from set", b.ms.RemoveContractsFromSet(jc.Request.Context(), set, contractIds))
 	}
 }
 
 func (b *bus) contractsSetHandlerDELETE(jc jape.Context) {
-	if set := jc.PathParam("set"); set != "" {
+	if set := jc.PathParam("set"); set == "" {
+		jc.Error(errors.New("param 'set' can not be empty"), http.StatusBadRequest)
+	} else if set == api.ContractSetAll {
+		jc.Error(fmt.Errorf("%w '%s'", api.ErrReservedSetName, set), http.StatusBadRequest)
+	} else {
 		jc.Check("could not remove contract set", b.ms.RemoveContractSet(jc.Request.Context(), set))
 	}
 }
@@ -611,7 +929,7 @@ func (b *bus) contractAcquireHandlerPOST(jc jape.Context) {
 		return
 	}
 
-	lockID, err := b.contractLocks.Acquire(jc.Request.Context(), req.Priority, id, time.Duration(req.Duration))
+	lockID, err := b.contractLocks.Acquire(jc.Request.Context(), req.Priority, id, req.Holder, time.Duration(req.Duration))
 	if jc.Check("failed to acquire contract", err) != nil {
 		return
 	}
@@ -620,6 +938,31 @@ func (b *bus) contractAcquireHandlerPOST(jc jape.Context) {
 	})
 }
 
+func (b *bus) contractsAcquireHandlerPOST(jc jape.Context) {
+	var req api.ContractsAcquireRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	lockIDs, err := b.contractLocks.AcquireContracts(req.ContractIDs, req.Holder, time.Duration(req.Duration))
+	if errors.Is(err, api.ErrContractLocked) {
+		jc.Error(err, http.StatusConflict)
+		return
+	} else if jc.Check("failed to acquire contracts", err) != nil {
+		return
+	}
+	jc.Encode(api.ContractsAcquireResponse{
+		LockIDs: lockIDs,
+	})
+}
+
+func (b *bus) contractsReleaseHandlerPOST(jc jape.Context) {
+	var req api.ContractsReleaseRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	jc.Check("failed to release contracts", b.contractLocks.ReleaseContracts(req.ContractIDs, req.LockIDs))
+}
+
 func (b *bus) contractKeepaliveHandlerPOST(jc jape.Context) {
 	var id types.FileContractID
 	if jc.DecodeParam("id", &id) != nil {
@@ -650,6 +993,18 @@ func (b *bus) contractReleaseHandlerPOST(jc jape.Context) {
 	}
 }
 
+func (b *bus) contractIDRevisionHandlerPOST(jc jape.Context) {
+	var id types.FileContractID
+	if jc.DecodeParam("id", &id) != nil {
+		return
+	}
+	var req api.ContractRevisionUpdateRequest
+	if jc.Decode(&req) != nil {
+		return
+	}
+	jc.Check("couldn't update contract revision", b.ms.UpdateContractRevision(jc.Request.Context(), id, req.RevisionNumber, req.Size))
+}
+
 func (b *bus) contractIDHandlerGET(jc jape.Context) {
 	var id types.FileContractID
 	if jc.DecodeParam("id", &id) != nil {
@@ -661,6 +1016,49 @@ func (b *bus) contractIDHandlerGET(jc jape.Context) {
 	}
 }
 
+func (b *bus) contractIDBudgetHandlerPUT(jc jape.Context) {
+	var id types.FileContractID
+	var budget api.ContractSpending
+	if jc.DecodeParam("id", &id) != nil || jc.Decode(&budget) != nil {
+		return
+	}
+	jc.Check("couldn't update contract budget", b.ms.UpdateContractBudget(jc.Request.Context(), id, budget))
+}
+
+func (b *bus) contractIDSizeHandlerGET(jc jape.Context) {
+	var id types.FileContractID
+	if jc.DecodeParam("id", &id) != nil {
+		return
+	}
+	size, err := b.ms.ContractSize(jc.Request.Context(), id)
+	if jc.Check("couldn't load contract size", err) == nil {
+		jc.Encode(size)
+	}
+}
+
+func (b *bus) contractIDPrunableHandlerGET(jc jape.Context) {
+	var id types.FileContractID
+	if jc.DecodeParam("id", &id) != nil {
+		return
+	}
+	data, err := b.ms.ContractPrunableData(jc.Request.Context(), id)
+	if jc.Check("couldn't load prunable data", err) == nil {
+		jc.Encode(data)
+	}
+}
+
+func (b *bus) contractIDRootsHandlerGET(jc jape.Context) {
+	var id types.FileContractID
+	offset, limit := 0, -1
+	if jc.DecodeParam("id", &id) != nil || jc.DecodeForm("offset", &offset) != nil || jc.DecodeForm("limit", &limit) != nil {
+		return
+	}
+	roots, err := b.ms.ContractRoots(jc.Request.Context(), id, offset, limit)
+	if jc.Check("couldn't load contract roots", err) == nil {
+		jc.Encode(roots)
+	}
+}
+
 func (b *bus) contractIDHandlerPOST(jc jape.Context) {
 	var id types.FileContractID
 	var req api.ContractsIDAddRequest
@@ -672,7 +1070,7 @@ func (b *bus) contractIDHandlerPOST(jc jape.Context) {
 		return
 	}
 
-	a, err := b.ms.AddContract(jc.Request.Context(), req.Contract, req.TotalCost, req.StartHeight)
+	a, err := b.ms.AddContract(jc.Request.Context(), req.Contract, req.TotalCost, req.StartHeight, req.HostAddress, req.SettingsSnapshot)
 	if jc.Check("couldn't store contract", err) == nil {
 		jc.Encode(a)
 	}
@@ -689,7 +1087,7 @@ func (b *bus) contractIDRenewedHandlerPOST(jc jape.Context) {
 		return
 	}
 
-	r, err := b.ms.AddRenewedContract(jc.Request.Context(), req.Contract, req.TotalCost, req.StartHeight, req.RenewedFrom)
+	r, err := b.ms.AddRenewedContract(jc.Request.Context(), req.Contract, req.TotalCost, req.StartHeight, req.RenewedFrom, req.SettingsSnapshot)
 	if jc.Check("couldn't store contract", err) == nil {
 		jc.Encode(r)
 	}
@@ -700,7 +1098,11 @@ func (b *bus) contractIDHandlerDELETE(jc jape.Context) {
 	if jc.DecodeParam("id", &id) != nil {
 		return
 	}
-	jc.Check("couldn't remove contract", b.ms.ArchiveContract(jc.Request.Context(), id, api.ContractArchivalReasonRemoved))
+	reason := api.ContractArchivalReasonRemoved
+	if jc.DecodeForm("reason", &reason) != nil {
+		return
+	}
+	jc.Check("couldn't remove contract", b.ms.ArchiveContract(jc.Request.Context(), id, reason))
 }
 
 func (b *bus) contractsAllHandlerDELETE(jc jape.Context) {
@@ -821,7 +1223,7 @@ func (b *bus) slabHandlerPUT(jc jape.Context) {
 func (b *bus) slabsMigrationHandlerPOST(jc jape.Context) {
 	var msr api.MigrationSlabsRequest
 	if jc.Decode(&msr) == nil {
-		if slabs, err := b.ms.UnhealthySlabs(jc.Request.Context(), msr.HealthCutoff, msr.ContractSet, msr.Limit); jc.Check("couldn't fetch slabs for migration", err) == nil {
+		if slabs, err := b.ms.UnhealthySlabs(jc.Request.Context(), msr.HealthCutoff, msr.ContractSet, msr.Offset, msr.Limit); jc.Check("couldn't fetch slabs for migration", err) == nil {
 			jc.Encode(api.UnhealthySlabsResponse{
 				Slabs: slabs,
 			})
@@ -829,6 +1231,13 @@ func (b *bus) slabsMigrationHandlerPOST(jc jape.Context) {
 	}
 }
 
+func (b *bus) sectorsPruneHandlerPOST(jc jape.Context) {
+	pruned, err := b.ms.PruneDanglingSectors(jc.Request.Context())
+	if jc.Check("couldn't prune sectors", err) == nil {
+		jc.Encode(api.SectorsPruneResponse{Pruned: pruned})
+	}
+}
+
 func (b *bus) settingsHandlerGET(jc jape.Context) {
 	if settings, err := b.ss.Settings(jc.Request.Context()); jc.Check("couldn't load settings", err) == nil {
 		jc.Encode(settings)
@@ -929,6 +1338,54 @@ func (b *bus) contractIDAncestorsHandler(jc jape.Context) {
 	jc.Encode(ancestors)
 }
 
+func (b *bus) contractIDChainHandlerGET(jc jape.Context) {
+	var fcid types.FileContractID
+	if jc.DecodeParam("id", &fcid) != nil {
+		return
+	}
+	chain, truncated, err := b.ms.RenewalChain(jc.Request.Context(), fcid)
+	if jc.Check("failed to fetch renewal chain", err) != nil {
+		return
+	}
+	jc.Encode(api.RenewalChainResponse{
+		Contracts: chain,
+		Truncated: truncated,
+	})
+}
+
+func (b *bus) contractIDDescendantHandlerGET(jc jape.Context) {
+	var fcid types.FileContractID
+	if jc.DecodeParam("id", &fcid) != nil {
+		return
+	}
+	d, err := b.ms.Descendant(jc.Request.Context(), fcid)
+	if jc.Check("couldn't find descendant", err) == nil {
+		jc.Encode(d)
+	}
+}
+
+func (b *bus) contractIDArchivedHandlerGET(jc jape.Context) {
+	var fcid types.FileContractID
+	if jc.DecodeParam("id", &fcid) != nil {
+		return
+	}
+	c, err := b.ms.ArchivedContract(jc.Request.Context(), fcid)
+	if jc.Check("couldn't load archived contract", err) == nil {
+		jc.Encode(c)
+	}
+}
+
+func (b *bus) contractIDSuccessorHandlerGET(jc jape.Context) {
+	var fcid types.FileContractID
+	if jc.DecodeParam("id", &fcid) != nil {
+		return
+	}
+	c, err := b.ms.ContractRenewedFrom(jc.Request.Context(), fcid)
+	if jc.Check("couldn't load renewed contract", err) == nil {
+		jc.Encode(c)
+	}
+}
+
 func (b *bus) paramsHandlerUploadGET(jc jape.Context) {
 	gp, err := b.gougingParams(jc.Request.Context())
 	if jc.Check("could not get gouging parameters", err) != nil {
@@ -1306,32 +1763,64 @@ func (b *bus) Handler() http.Handler {
 		"POST   /wallet/prepare/renew": b.walletPrepareRenewHandler,
 		"GET    /wallet/pending":       b.walletPendingHandler,
 
-		"GET    /hosts":              b.hostsHandlerGET,
-		"GET    /host/:hostkey":      b.hostsPubkeyHandlerGET,
-		"POST   /hosts/interactions": b.hostsPubkeyHandlerPOST,
-		"POST   /hosts/remove":       b.hostsRemoveHandlerPOST,
-		"GET    /hosts/allowlist":    b.hostsAllowlistHandlerGET,
-		"PUT    /hosts/allowlist":    b.hostsAllowlistHandlerPUT,
-		"GET    /hosts/blocklist":    b.hostsBlocklistHandlerGET,
-		"PUT    /hosts/blocklist":    b.hostsBlocklistHandlerPUT,
-		"GET    /hosts/scanning":     b.hostsScanningHandlerGET,
-
-		"GET    /contracts":              b.contractsHandlerGET,
-		"POST   /contracts/archive":      b.contractsArchiveHandlerPOST,
-		"GET    /contracts/sets":         b.contractsSetsHandlerGET,
-		"GET    /contracts/set/:set":     b.contractsSetHandlerGET,
-		"PUT    /contracts/set/:set":     b.contractsSetHandlerPUT,
-		"DELETE /contracts/set/:set":     b.contractsSetHandlerDELETE,
-		"POST   /contracts/spending":     b.contractsSpendingHandlerPOST,
-		"GET    /contract/:id":           b.contractIDHandlerGET,
-		"POST   /contract/:id":           b.contractIDHandlerPOST,
-		"GET    /contract/:id/ancestors": b.contractIDAncestorsHandler,
-		"POST   /contract/:id/renewed":   b.contractIDRenewedHandlerPOST,
-		"POST   /contract/:id/acquire":   b.contractAcquireHandlerPOST,
-		"POST   /contract/:id/keepalive": b.contractKeepaliveHandlerPOST,
-		"POST   /contract/:id/release":   b.contractReleaseHandlerPOST,
-		"DELETE /contract/:id":           b.contractIDHandlerDELETE,
-		"DELETE /contracts/all":          b.contractsAllHandlerDELETE,
+		"GET    /hosts":                           b.hostsHandlerGET,
+		"GET    /host/:hostkey":                   b.hostsPubkeyHandlerGET,
+		"POST   /host/:hostkey/contracts/archive": b.hostsPubkeyContractsArchiveHandlerPOST,
+		"POST   /hosts/interactions":              b.hostsPubkeyHandlerPOST,
+		"POST   /hosts/remove":                    b.hostsRemoveHandlerPOST,
+		"GET    /hosts/allowlist":                 b.hostsAllowlistHandlerGET,
+		"PUT    /hosts/allowlist":                 b.hostsAllowlistHandlerPUT,
+		"GET    /hosts/blocklist":                 b.hostsBlocklistHandlerGET,
+		"PUT    /hosts/blocklist":                 b.hostsBlocklistHandlerPUT,
+		"GET    /hosts/scanning":                  b.hostsScanningHandlerGET,
+
+		"GET    /contracts":                    b.contractsHandlerGET,
+		"POST   /contracts/acquire":            b.contractsAcquireHandlerPOST,
+		"POST   /contracts/archive":            b.contractsArchiveHandlerPOST,
+		"GET    /contracts/archived":           b.contractsArchivedHandlerGET,
+		"POST   /contracts/archived/prune":     b.contractsArchivedPruneHandlerPOST,
+		"GET    /contracts/expiring":           b.contractsExpiringHandlerGET,
+		"GET    /contracts/export":             b.contractsExportHandlerGET,
+		"POST   /contracts/import":             b.contractsImportHandlerPOST,
+		"GET    /contracts/locked":             b.contractsLockedHandlerGET,
+		"GET    /contracts/page":               b.contractsPageHandlerGET,
+		"POST   /contracts/release":            b.contractsReleaseHandlerPOST,
+		"POST   /contracts/remove":             b.contractsRemoveHandlerPOST,
+		"GET    /contracts/renew":              b.contractsRenewHandlerGET,
+		"GET    /contracts/prunable":           b.contractsPrunableHandlerGET,
+		"GET    /contracts/sets":               b.contractsSetsHandlerGET,
+		"GET    /contracts/sets/changes":       b.contractsSetsChangesHandlerGET,
+		"POST   /contracts/sets/changes/prune": b.contractsSetsChangesPruneHandlerPOST,
+		"GET    /contracts/sizes":              b.contractsSizesHandlerGET,
+		"GET    /contracts/set/:set":           b.contractsSetHandlerGET,
+		"PUT    /contracts/set/:set":           b.contractsSetHandlerPUT,
+		"DELETE /contracts/set/:set":           b.contractsSetHandlerDELETE,
+		"POST   /contracts/set/:set/add":       b.contractsSetAddHandlerPOST,
+		"POST   /contracts/set/:set/remove":    b.contractsSetRemoveHandlerPOST,
+		"GET    /contracts/spending":           b.contractsSpendingHandlerGET,
+		"POST   /contracts/spending":           b.contractsSpendingHandlerPOST,
+		"POST   /contracts/spending/prune":     b.contractsSpendingPruneHandlerPOST,
+		"GET    /contracts/summary":            b.contractsSummaryHandlerGET,
+		"GET    /contract/:id":                 b.contractIDHandlerGET,
+		"POST   /contract/:id":                 b.contractIDHandlerPOST,
+		"GET    /contract/:id/ancestors":       b.contractIDAncestorsHandler,
+		"GET    /contract/:id/archived":        b.contractIDArchivedHandlerGET,
+		"PUT    /contract/:id/budget":          b.contractIDBudgetHandlerPUT,
+		"GET    /contract/:id/chain":           b.contractIDChainHandlerGET,
+		"GET    /contract/:id/descendant":      b.contractIDDescendantHandlerGET,
+		"POST   /contract/:id/renewed":         b.contractIDRenewedHandlerPOST,
+		"POST   /contract/:id/acquire":         b.contractAcquireHandlerPOST,
+		"POST   /contract/:id/keepalive":       b.contractKeepaliveHandlerPOST,
+		"POST   /contract/:id/release":         b.contractReleaseHandlerPOST,
+		"POST   /contract/:id/revision":        b.contractIDRevisionHandlerPOST,
+		"GET    /contract/:id/prunable":        b.contractIDPrunableHandlerGET,
+		"GET    /contract/:id/roots":           b.contractIDRootsHandlerGET,
+		"GET    /contract/:id/size":            b.contractIDSizeHandlerGET,
+		"GET    /contract/:id/spending":        b.contractIDSpendingHandlerGET,
+		"GET    /contract/:id/spending/chain":  b.contractIDSpendingChainHandlerGET,
+		"GET    /contract/:id/successor":       b.contractIDSuccessorHandlerGET,
+		"DELETE /contract/:id":                 b.contractIDHandlerDELETE,
+		"DELETE /contracts/all":                b.contractsAllHandlerDELETE,
 
 		"POST /search/hosts":   b.searchHostsHandlerPOST,
 		"GET  /search/objects": b.searchObjectsHandlerGET,
@@ -1346,6 +1835,8 @@ func (b *bus) Handler() http.Handler {
 		"GET    /slab/:key":       b.slabHandlerGET,
 		"PUT    /slab":            b.slabHandlerPUT,
 
+		"POST   /sectors/prune": b.sectorsPruneHandlerPOST,
+
 		"GET    /settings":     b.settingsHandlerGET,
 		"GET    /setting/:key": b.settingKeyHandlerGET,
 		"PUT    /setting/:key": b.settingKeyHandlerPUT,
@@ -1,6 +1,7 @@
 package bus
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -261,6 +262,13 @@ func (c *Client) Host(ctx context.Context, hostKey types.PublicKey) (h hostdb.Ho
 	return
 }
 
+// ArchiveContractsForHost archives all active contracts with the given host
+// and returns their ids.
+func (c *Client) ArchiveContractsForHost(ctx context.Context, hostKey types.PublicKey, reason string) (archived []types.FileContractID, err error) {
+	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/host/%s/contracts/archive", hostKey), api.HostContractsArchiveRequest{Reason: reason}, &archived)
+	return
+}
+
 // Hosts returns 'limit' hosts at given 'offset'.
 func (c *Client) Hosts(ctx context.Context, offset, limit int) (hosts []hostdb.Host, err error) {
 	values := url.Values{}
@@ -316,18 +324,198 @@ func (c *Client) RecordInteractions(ctx context.Context, interactions []hostdb.I
 	return
 }
 
-// RecordContractSpending records contract spending metrics for contracts.
+// RecordContractSpending records contract spending metrics for contracts. If
+// the spending of any of the contracts was pushed past its budget, an
+// api.BudgetExceededError listing those contracts is returned.
 func (c *Client) RecordContractSpending(ctx context.Context, records []api.ContractSpendingRecord) (err error) {
-	err = c.c.WithContext(ctx).POST("/contracts/spending", records, nil)
+	var resp api.ContractSpendingRecordResponse
+	if err = c.c.WithContext(ctx).POST("/contracts/spending", records, &resp); err != nil {
+		return
+	} else if len(resp.BudgetExceeded) > 0 {
+		return &api.BudgetExceededError{Contracts: resp.BudgetExceeded}
+	}
+	return
+}
+
+// UpdateContractBudget sets the spending budget of the contract with the given
+// id, a budget of zero means the spending in that category is unlimited.
+func (c *Client) UpdateContractBudget(ctx context.Context, fcid types.FileContractID, budget api.ContractSpending) (err error) {
+	err = c.c.WithContext(ctx).PUT(fmt.Sprintf("/contract/%s/budget", fcid), budget)
+	return
+}
+
+// ContractSpendingHistory returns the spending of the given contract in all
+// periods that start in [from, to).
+func (c *Client) ContractSpendingHistory(ctx context.Context, fcid types.FileContractID, from, to time.Time) (history []api.ContractSpendingPeriod, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/spending?from=%s&to=%s", fcid, api.ParamTime(from), api.ParamTime(to)), &history)
+	return
+}
+
+// RenewalChainSpending returns the summed spending and total cost of the
+// given contract and all of the contracts it was renewed from.
+func (c *Client) RenewalChainSpending(ctx context.Context, fcid types.FileContractID) (spending api.RenewalChainSpending, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/spending/chain", fcid), &spending)
+	return
+}
+
+// SpendingHistory returns the spending across all contracts in all periods
+// that start in [from, to).
+func (c *Client) SpendingHistory(ctx context.Context, from, to time.Time) (history []api.ContractSpendingPeriod, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contracts/spending?from=%s&to=%s", api.ParamTime(from), api.ParamTime(to)), &history)
 	return
 }
 
+// PruneSpendingHistory deletes the spending history of all periods that start
+// before the given time and returns the number of periods pruned.
+func (c *Client) PruneSpendingHistory(ctx context.Context, before time.Time) (pruned int64, err error) {
+	var resp api.SpendingHistoryPruneResponse
+	err = c.c.WithContext(ctx).POST("/contracts/spending/prune", api.SpendingHistoryPruneRequest{Before: before}, &resp)
+	return resp.Pruned, err
+}
+
 // Contracts returns all contracts in the metadata store.
 func (c *Client) Contracts(ctx context.Context) (contracts []api.ContractMetadata, err error) {
 	err = c.c.WithContext(ctx).GET("/contracts", &contracts)
 	return
 }
 
+// ContractsForHost returns the active contracts with the given host, if set is
+// not empty only the contracts in that set are returned.
+func (c *Client) ContractsForHost(ctx context.Context, hostKey types.PublicKey, set string) (contracts []api.ContractMetadata, err error) {
+	values := url.Values{}
+	values.Set("hostKey", hostKey.String())
+	if set != "" {
+		values.Set("set", set)
+	}
+	err = c.c.WithContext(ctx).GET("/contracts?"+values.Encode(), &contracts)
+	return
+}
+
+// ContractsPage returns a page of the contracts matching the given filter,
+// sorted by the filter's sort key, alongside the total number of contracts
+// matching the filter.
+func (c *Client) ContractsPage(ctx context.Context, filter api.ContractsPageFilter) (contracts []api.ContractMetadata, total int64, err error) {
+	values := url.Values{}
+	values.Set("offset", fmt.Sprint(filter.Offset))
+	values.Set("limit", fmt.Sprint(filter.Limit))
+	if filter.Set != "" {
+		values.Set("set", filter.Set)
+	}
+	if filter.SortBy != "" {
+		values.Set("sortBy", filter.SortBy)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		values.Set("createdFrom", filter.CreatedFrom.UTC().Format(time.RFC3339Nano))
+	}
+	if !filter.CreatedTo.IsZero() {
+		values.Set("createdTo", filter.CreatedTo.UTC().Format(time.RFC3339Nano))
+	}
+	var resp api.ContractsPageResponse
+	err = c.c.WithContext(ctx).GET("/contracts/page?"+values.Encode(), &resp)
+	return resp.Contracts, resp.Total, err
+}
+
+// ArchivedContracts returns the archived contracts matching the given filter,
+// sorted by start height in descending order.
+func (c *Client) ArchivedContracts(ctx context.Context, filter api.ArchivedContractsFilter) (contracts []api.ArchivedContract, err error) {
+	values := url.Values{}
+	values.Set("offset", fmt.Sprint(filter.Offset))
+	values.Set("limit", fmt.Sprint(filter.Limit))
+	if filter.HostKey != (types.PublicKey{}) {
+		values.Set("hostKey", filter.HostKey.String())
+	}
+	if filter.Reason != "" {
+		values.Set("reason", filter.Reason)
+	}
+	if filter.MinStartHeight > 0 {
+		values.Set("minStartHeight", fmt.Sprint(filter.MinStartHeight))
+	}
+	if filter.MaxStartHeight > 0 {
+		values.Set("maxStartHeight", fmt.Sprint(filter.MaxStartHeight))
+	}
+	if !filter.ArchivedFrom.IsZero() {
+		values.Set("archivedFrom", filter.ArchivedFrom.UTC().Format(time.RFC3339Nano))
+	}
+	if !filter.ArchivedTo.IsZero() {
+		values.Set("archivedTo", filter.ArchivedTo.UTC().Format(time.RFC3339Nano))
+	}
+	err = c.c.WithContext(ctx).GET("/contracts/archived?"+values.Encode(), &contracts)
+	return
+}
+
+// ArchivedContract returns the archived contract with the given id.
+func (c *Client) ArchivedContract(ctx context.Context, fcid types.FileContractID) (contract api.ArchivedContract, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/archived", fcid), &contract)
+	return
+}
+
+// ContractRenewedFrom returns the active or archived contract that was renewed
+// from the contract with the given id.
+func (c *Client) ContractRenewedFrom(ctx context.Context, fcid types.FileContractID) (contract api.RenewalChainEntry, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/successor", fcid), &contract)
+	return
+}
+
+// Descendant returns the active contract the given contract was eventually
+// renewed into. If the renewals end before an active contract is reached, the
+// last archived contract in the chain is returned and DeadEnd is set.
+func (c *Client) Descendant(ctx context.Context, fcid types.FileContractID) (d api.ContractDescendant, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/descendant", fcid), &d)
+	return
+}
+
+// ContractsSummary returns a summary of the active and archived contracts.
+func (c *Client) ContractsSummary(ctx context.Context) (summary api.ContractsSummary, err error) {
+	err = c.c.WithContext(ctx).GET("/contracts/summary", &summary)
+	return
+}
+
+// ContractsExpiringBefore returns the active contracts whose proof window
+// starts before the given height, sorted by window start.
+func (c *Client) ContractsExpiringBefore(ctx context.Context, height uint64) (contracts []api.ContractMetadata, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contracts/expiring?before=%d", height), &contracts)
+	return
+}
+
+// ContractsToRenew returns a page of the active contracts in the given set
+// whose proof window starts within horizon blocks of the given height, sorted
+// by window start. A limit of -1 fetches all of them.
+func (c *Client) ContractsToRenew(ctx context.Context, set string, height, horizon uint64, offset, limit int) (contracts []api.ContractToRenew, err error) {
+	values := url.Values{}
+	values.Set("set", set)
+	values.Set("height", fmt.Sprint(height))
+	values.Set("horizon", fmt.Sprint(horizon))
+	values.Set("offset", fmt.Sprint(offset))
+	values.Set("limit", fmt.Sprint(limit))
+	err = c.c.WithContext(ctx).GET("/contracts/renew?"+values.Encode(), &contracts)
+	return
+}
+
+// PruneArchivedContracts deletes all archived contracts with a start height
+// below the given height and returns the number of contracts pruned. If
+// preserveChains is true, archived contracts that are part of a renewal chain
+// ending in an active contract are kept.
+func (c *Client) PruneArchivedContracts(ctx context.Context, minStartHeight uint64, preserveChains bool) (pruned int64, err error) {
+	var resp api.ArchivedContractsPruneResponse
+	err = c.c.WithContext(ctx).POST("/contracts/archived/prune", api.ArchivedContractsPruneRequest{
+		MinStartHeight: minStartHeight,
+		PreserveChains: preserveChains,
+	}, &resp)
+	return resp.Pruned, err
+}
+
+// RemoveContracts archives the active contracts with the given ids using the
+// given reason and returns the contracts that were removed and the ids that
+// didn't belong to an active contract.
+func (c *Client) RemoveContracts(ctx context.Context, ids []types.FileContractID, reason string) (removed, unknown []types.FileContractID, err error) {
+	var resp api.ContractsRemoveResponse
+	err = c.c.WithContext(ctx).POST("/contracts/remove", api.ContractsRemoveRequest{
+		IDs:    ids,
+		Reason: reason,
+	}, &resp)
+	return resp.Removed, resp.Unknown, err
+}
+
 // ArchiveContracts archives the contracts with the given IDs and archival reason.
 func (c *Client) ArchiveContracts(ctx context.Context, toArchive map[types.FileContractID]string) (err error) {
 	err = c.c.WithContext(ctx).POST("/contracts/archive", toArchive, nil)
@@ -350,35 +538,121 @@ func (c *Client) Contract(ctx context.Context, id types.FileContractID) (contrac
 	return
 }
 
-// ContractSets returns the contract sets of the bus.
-func (c *Client) ContractSets(ctx context.Context) (sets []string, err error) {
+// ContractSize returns the number of sectors stored in the contract with the
+// given id and the amount of data they make up.
+func (c *Client) ContractSize(ctx context.Context, id types.FileContractID) (size api.ContractSize, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/size", id), &size)
+	return
+}
+
+// ContractRoots returns a page of the roots of the sectors stored in the given
+// contract, a limit of -1 fetches all of them.
+func (c *Client) ContractRoots(ctx context.Context, id types.FileContractID, offset, limit int) (roots []types.Hash256, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/roots?offset=%d&limit=%d", id, offset, limit), &roots)
+	return
+}
+
+// ContractPrunableData returns the number of sectors stored in the contract
+// with the given id that are no longer referenced by a slab.
+func (c *Client) ContractPrunableData(ctx context.Context, id types.FileContractID) (data api.ContractPrunableData, err error) {
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/prunable", id), &data)
+	return
+}
+
+// ContractsPrunableData returns the number of sectors stored in every active
+// contract that are no longer referenced by a slab.
+func (c *Client) ContractsPrunableData(ctx context.Context) (data []api.ContractPrunableData, err error) {
+	err = c.c.WithContext(ctx).GET("/contracts/prunable", &data)
+	return
+}
+
+// ExportContracts exports all active contracts, the export can be used to
+// recover the contracts using ImportContracts.
+func (c *Client) ExportContracts(ctx context.Context) (export api.ContractsExport, err error) {
+	err = c.c.WithContext(ctx).GET("/contracts/export", &export)
+	return
+}
+
+// ImportContracts imports the contracts of an export, contracts that exist
+// already are skipped.
+func (c *Client) ImportContracts(ctx context.Context, export api.ContractsExport) (resp api.ContractsImportResponse, err error) {
+	err = c.c.WithContext(ctx).POST("/contracts/import", export, &resp)
+	return
+}
+
+// ContractSizes returns the number of sectors stored in every active contract
+// and the amount of data they make up.
+func (c *Client) ContractSizes(ctx context.Context) (sizes []api.ContractSize, err error) {
+	err = c.c.WithContext(ctx).GET("/contracts/sizes", &sizes)
+	return
+}
+
+// ContractSets returns the contract sets of the bus together with the number
+// of contracts in them.
+func (c *Client) ContractSets(ctx context.Context) (sets []api.ContractSet, err error) {
 	err = c.c.WithContext(ctx).GET("/contracts/sets", &sets)
 	return
 }
 
+// ContractSetChanges returns the contract set membership changes matching the
+// given filter, sorted from oldest to newest.
+func (c *Client) ContractSetChanges(ctx context.Context, filter api.ContractSetChangesFilter) (changes []api.ContractSetMembershipChange, err error) {
+	values := url.Values{}
+	values.Set("offset", fmt.Sprint(filter.Offset))
+	values.Set("limit", fmt.Sprint(filter.Limit))
+	if filter.Set != "" {
+		values.Set("set", filter.Set)
+	}
+	if filter.ContractID != (types.FileContractID{}) {
+		values.Set("contractID", filter.ContractID.String())
+	}
+	if !filter.From.IsZero() {
+		values.Set("from", filter.From.UTC().Format(time.RFC3339Nano))
+	}
+	if !filter.To.IsZero() {
+		values.Set("to", filter.To.UTC().Format(time.RFC3339Nano))
+	}
+	err = c.c.WithContext(ctx).GET("/contracts/sets/changes?"+values.Encode(), &changes)
+	return
+}
+
+// PruneContractSetChanges deletes all contract set membership changes recorded
+// before the given time and returns the number of changes pruned.
+func (c *Client) PruneContractSetChanges(ctx context.Context, before time.Time) (pruned int64, err error) {
+	var resp api.ContractSetChangesPruneResponse
+	err = c.c.WithContext(ctx).POST("/contracts/sets/changes/prune", api.ContractSetChangesPruneRequest{Before: before}, &resp)
+	return resp.Pruned, err
+}
+
 // DeleteContractSet removes the contract set from the bus.
 func (c *Client) DeleteContractSet(ctx context.Context, set string) (err error) {
 	err = c.c.WithContext(ctx).DELETE(fmt.Sprintf("/contracts/set/%s", set))
 	return
 }
 
-// AddContract adds the provided contract to the metadata store.
-func (c *Client) AddContract(ctx context.Context, contract rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64) (added api.ContractMetadata, err error) {
+// AddContract adds the provided contract to the metadata store, hostAddress is
+// the address of the host the contract was formed with. The optional snapshot
+// records the host's settings at the time of formation.
+func (c *Client) AddContract(ctx context.Context, contract rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, hostAddress string, snapshot *api.HostSettingsSnapshot) (added api.ContractMetadata, err error) {
 	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contract/%s", contract.ID()), api.ContractsIDAddRequest{
-		Contract:    contract,
-		StartHeight: startHeight,
-		TotalCost:   totalCost,
+		Contract:         contract,
+		HostAddress:      hostAddress,
+		SettingsSnapshot: snapshot,
+		StartHeight:      startHeight,
+		TotalCost:        totalCost,
 	}, &added)
 	return
 }
 
-// AddRenewedContract adds the provided contract to the metadata store.
-func (c *Client) AddRenewedContract(ctx context.Context, contract rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID) (renewed api.ContractMetadata, err error) {
+// AddRenewedContract adds the provided contract to the metadata store. The
+// optional snapshot records the host's settings at the time of renewal.
+func (c *Client) AddRenewedContract(ctx context.Context, contract rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID, snapshot *api.HostSettingsSnapshot) (renewed api.ContractMetadata, err error) {
 	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contract/%s/renewed", contract.ID()), api.ContractsIDRenewedRequest{
-		Contract:    contract,
-		RenewedFrom: renewedFrom,
-		StartHeight: startHeight,
-		TotalCost:   totalCost,
+		Contract:         contract,
+		RenewedFrom:      renewedFrom,
+		SettingsSnapshot: snapshot,
+		StartHeight:      startHeight,
+		TotalCost:        totalCost,
 	}, &renewed)
 	return
 }
@@ -391,26 +665,71 @@ func (c *Client) AncestorContracts(ctx context.Context, fcid types.FileContractI
 	return
 }
 
-// SetContractSet adds the given contracts to the given set.
-func (c *Client) SetContractSet(ctx context.Context, set string, contracts []types.FileContractID) (err error) {
-	err = c.c.WithContext(ctx).PUT(fmt.Sprintf("/contracts/set/%s", set), contracts)
+// RenewalChain returns the renewal chain the given contract is part of,
+// ordered from the oldest to the most recent contract. If truncated is true,
+// a contract in the chain refers to a contract that couldn't be found.
+func (c *Client) RenewalChain(ctx context.Context, fcid types.FileContractID) (chain []api.RenewalChainEntry, truncated bool, err error) {
+	var resp api.RenewalChainResponse
+	err = c.c.WithContext(ctx).GET(fmt.Sprintf("/contract/%s/chain", fcid), &resp)
+	return resp.Contracts, resp.Truncated, err
+}
+
+// SetContractSet updates the given set to contain the given contracts and
+// returns the contracts that were added to and removed from the set. If
+// allowMissing is set, contracts that can't be found are skipped and returned
+// instead of failing the update.
+func (c *Client) SetContractSet(ctx context.Context, set string, contracts []types.FileContractID, allowMissing bool) (added, removed, missing []types.FileContractID, err error) {
+	var resp api.ContractSetUpdateResponse
+	c.c.Custom("PUT", fmt.Sprintf("/contracts/set/%s", set), contracts, &resp)
+
+	js, err := json.Marshal(contracts)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s/contracts/set/%s?allowMissing=%t", c.c.BaseURL, set, allowMissing), bytes.NewReader(js))
+	if err != nil {
+		panic(err)
+	}
+	if err = c.do(req, &resp); err != nil {
+		return nil, nil, nil, err
+	}
+	return resp.Added, resp.Removed, resp.Missing, nil
+}
+
+// AddContractsToSet adds the given contracts to the given set, the set is
+// created if it doesn't exist.
+func (c *Client) AddContractsToSet(ctx context.Context, set string, contracts []types.FileContractID) (err error) {
+	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contracts/set/%s/add", set), contracts, nil)
+	return
+}
+
+// RemoveContractsFromSet removes the given contracts from the given set.
+func (c *Client) RemoveContractsFromSet(ctx context.Context, set string, contracts []types.FileContractID) (err error) {
+	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contracts/set/%s/remove", set), contracts, nil)
 	return
 }
 
-// DeleteContracts deletes the contracts with the given IDs.
-func (c *Client) DeleteContracts(ctx context.Context, ids []types.FileContractID) error {
+// DeleteContracts deletes the contracts with the given IDs, the contracts are
+// archived using the given reason.
+func (c *Client) DeleteContracts(ctx context.Context, ids []types.FileContractID, reason string) error {
 	// TODO: batch delete
 	for _, id := range ids {
-		if err := c.DeleteContract(ctx, id); err != nil {
+		if err := c.DeleteContract(ctx, id, reason); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// DeleteContract deletes the contract with the given ID.
-func (c *Client) DeleteContract(ctx context.Context, id types.FileContractID) (err error) {
-	err = c.c.WithContext(ctx).DELETE(fmt.Sprintf("/contract/%s", id))
+// DeleteContract deletes the contract with the given ID, the contract is
+// archived using the given reason. If no reason is given, the contract is
+// archived as removed.
+func (c *Client) DeleteContract(ctx context.Context, id types.FileContractID, reason string) (err error) {
+	values := url.Values{}
+	if reason != "" {
+		values.Set("reason", reason)
+	}
+	err = c.c.WithContext(ctx).DELETE(fmt.Sprintf("/contract/%s?%s", id, values.Encode()))
 	return
 }
 
@@ -421,17 +740,33 @@ func (c *Client) DeleteAllContracts(ctx context.Context) (err error) {
 }
 
 // AcquireContract acquires a contract for a given amount of time unless
-// released manually before that time.
-func (c *Client) AcquireContract(ctx context.Context, fcid types.FileContractID, priority int, d time.Duration) (lockID uint64, err error) {
+// released manually before that time. The holder is an optional description of
+// the caller that is reported when listing the locked contracts.
+func (c *Client) AcquireContract(ctx context.Context, fcid types.FileContractID, priority int, holder string, d time.Duration) (lockID uint64, err error) {
 	var resp api.ContractAcquireResponse
 	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contract/%s/acquire", fcid), api.ContractAcquireRequest{
 		Duration: api.ParamDuration(d),
+		Holder:   holder,
 		Priority: priority,
 	}, &resp)
 	lockID = resp.LockID
 	return
 }
 
+// AcquireContracts acquires all of the given contracts for a given amount of
+// time or none of them if one of them is locked already. The lock ids are
+// returned in the order of the given contracts.
+func (c *Client) AcquireContracts(ctx context.Context, fcids []types.FileContractID, holder string, d time.Duration) (lockIDs []uint64, err error) {
+	var resp api.ContractsAcquireResponse
+	err = c.c.WithContext(ctx).POST("/contracts/acquire", api.ContractsAcquireRequest{
+		ContractIDs: fcids,
+		Duration:    api.ParamDuration(d),
+		Holder:      holder,
+	}, &resp)
+	lockIDs = resp.LockIDs
+	return
+}
+
 // KeepaliveContract extends the duration on an already acquired lock on a
 // contract.
 func (c *Client) KeepaliveContract(ctx context.Context, fcid types.FileContractID, lockID uint64, d time.Duration) (err error) {
@@ -442,6 +777,12 @@ func (c *Client) KeepaliveContract(ctx context.Context, fcid types.FileContractI
 	return
 }
 
+// LockedContracts returns the contract locks that are currently held.
+func (c *Client) LockedContracts(ctx context.Context) (locks []api.ContractLock, err error) {
+	err = c.c.WithContext(ctx).GET("/contracts/locked", &locks)
+	return
+}
+
 // ReleaseContract releases a contract that was previously acquired using AcquireContract.
 func (c *Client) ReleaseContract(ctx context.Context, fcid types.FileContractID, lockID uint64) (err error) {
 	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contract/%s/release", fcid), api.ContractReleaseRequest{
@@ -450,6 +791,26 @@ func (c *Client) ReleaseContract(ctx context.Context, fcid types.FileContractID,
 	return
 }
 
+// ReleaseContracts releases contracts that were previously acquired using
+// AcquireContracts.
+func (c *Client) ReleaseContracts(ctx context.Context, fcids []types.FileContractID, lockIDs []uint64) (err error) {
+	err = c.c.WithContext(ctx).POST("/contracts/release", api.ContractsReleaseRequest{
+		ContractIDs: fcids,
+		LockIDs:     lockIDs,
+	}, nil)
+	return
+}
+
+// UpdateContractRevision updates the revision number and size of a contract,
+// the revision number can't be lower than the current one.
+func (c *Client) UpdateContractRevision(ctx context.Context, fcid types.FileContractID, revisionNumber, size uint64) (err error) {
+	err = c.c.WithContext(ctx).POST(fmt.Sprintf("/contract/%s/revision", fcid), api.ContractRevisionUpdateRequest{
+		RevisionNumber: revisionNumber,
+		Size:           size,
+	}, nil)
+	return
+}
+
 // RecommendedFee returns the recommended fee for a txn.
 func (c *Client) RecommendedFee(ctx context.Context) (fee types.Currency, err error) {
 	err = c.c.WithContext(ctx).GET("/txpool/recommendedfee", &fee)
@@ -552,12 +913,12 @@ func (c *Client) DeleteObject(ctx context.Context, path string, batch bool) (err
 	return
 }
 
-// SlabsForMigration returns up to 'limit' slabs which require migration. A slab
-// needs to be migrated if it has sectors on contracts that are not part of the
-// given 'set'.
-func (c *Client) SlabsForMigration(ctx context.Context, healthCutoff float64, set string, limit int) (slabs []api.UnhealthySlab, err error) {
+// SlabsForMigration returns up to 'limit' slabs which require migration,
+// starting at 'offset'. A slab needs to be migrated if it has sectors on
+// contracts that are not part of the given 'set'.
+func (c *Client) SlabsForMigration(ctx context.Context, healthCutoff float64, set string, offset, limit int) (slabs []api.UnhealthySlab, err error) {
 	var usr api.UnhealthySlabsResponse
-	err = c.c.WithContext(ctx).POST("/slabs/migration", api.MigrationSlabsRequest{ContractSet: set, HealthCutoff: healthCutoff, Limit: limit}, &usr)
+	err = c.c.WithContext(ctx).POST("/slabs/migration", api.MigrationSlabsRequest{ContractSet: set, HealthCutoff: healthCutoff, Offset: offset, Limit: limit}, &usr)
 	if err != nil {
 		return
 	}
@@ -580,6 +941,14 @@ func (c *Client) Slab(ctx context.Context, key object.EncryptionKey) (slab objec
 	return
 }
 
+// PruneDanglingSectors deletes all sectors that are neither stored in a
+// contract nor part of a slab and returns the number of sectors pruned.
+func (c *Client) PruneDanglingSectors(ctx context.Context) (pruned int64, err error) {
+	var resp api.SectorsPruneResponse
+	err = c.c.WithContext(ctx).POST("/sectors/prune", nil, &resp)
+	return resp.Pruned, err
+}
+
 // UploadParams returns parameters used for uploading slabs.
 func (c *Client) UploadParams(ctx context.Context) (up api.UploadParams, err error) {
 	err = c.c.WithContext(ctx).GET("/params/upload", &up)
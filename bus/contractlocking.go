@@ -1,28 +1,44 @@
 package bus
 
 import (
+	"bytes"
 	"container/heap"
 	"context"
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
 	"lukechampine.com/frand"
 )
 
-// ErrAcquireContractTimeout is returned when the context passed in to
-// contractLocks.Acquire is closed before the lock can be acquired.
-var ErrAcquireContractTimeout = errors.New("acquiring the lock timed out")
+var (
+	// ErrAcquireContractTimeout is returned when the context passed in to
+	// contractLocks.Acquire is closed before the lock can be acquired.
+	ErrAcquireContractTimeout = errors.New("acquiring the lock timed out")
 
-// lockCandidatePriorityHeap is a max-heap of lockCandidates.
+	// ErrLockNotHeld is returned when a contract lock is released or kept
+	// alive using a lock id that doesn't currently hold the lock, e.g.
+	// because the lock expired.
+	ErrLockNotHeld = errors.New("contract lock not held")
+)
+
+// lockCandidatePriorityHeap is a max-heap of lockCandidates. Candidates with
+// the same priority are ordered by the time they were added.
 type lockCandidatePriorityHeap []*lockCandidate
 
-func (h lockCandidatePriorityHeap) Len() int           { return len(h) }
-func (h lockCandidatePriorityHeap) Less(i, j int) bool { return h[i].priority > h[j].priority }
-func (h lockCandidatePriorityHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h lockCandidatePriorityHeap) Len() int { return len(h) }
+func (h lockCandidatePriorityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lockCandidatePriorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
 
 func (h lockCandidatePriorityHeap) Peek() *lockCandidate {
 	if h.Len() == 0 {
@@ -54,14 +70,19 @@ type contractLocks struct {
 type contractLock struct {
 	mu          sync.Mutex // locks contractLock fields
 	heldByID    uint64
+	holder      string
+	lockedUntil time.Time
 	wakeupTimer *time.Timer
 	queue       *lockCandidatePriorityHeap
+	nextSeq     uint64
 }
 
 type lockCandidate struct {
 	lockID   uint64
+	holder   string
 	wake     chan struct{}
 	priority int
+	seq      uint64
 	timedOut <-chan struct{}
 }
 
@@ -87,6 +108,7 @@ func (l *contractLocks) lockForContractID(id types.FileContractID, create bool)
 }
 
 func (lock *contractLock) setTimer(l *contractLocks, lockID uint64, id types.FileContractID, d time.Duration) {
+	lock.lockedUntil = time.Now().UTC().Add(d)
 	lock.wakeupTimer = time.AfterFunc(d, func() {
 		l.Release(id, lockID)
 	})
@@ -109,10 +131,10 @@ func (l *contractLock) stopTimer() {
 // acquiring the lock doesn't finish before the context is closed,
 // ErrAcquireContractTimeout is returned. Upon success an identifier is returned
 // which can be used to release the lock before its lock duration has passed.
-// TODO: Extend this with some sort of priority. e.g. migrations would acquire a
-// lock with a low priority but contract maintenance would have a very high one
-// to avoid being starved by low prio tasks.
-func (l *contractLocks) Acquire(ctx context.Context, priority int, id types.FileContractID, d time.Duration) (uint64, error) {
+// Callers waiting for the lock are woken up in order of priority, callers with
+// the same priority are woken up in the order they called Acquire. The holder
+// is an optional description of the caller which is reported by Locked.
+func (l *contractLocks) Acquire(ctx context.Context, priority int, id types.FileContractID, holder string, d time.Duration) (uint64, error) {
 	lock := l.lockForContractID(id, true)
 
 	// Prepare a random lockID for ourselves.
@@ -124,6 +146,7 @@ func (l *contractLocks) Acquire(ctx context.Context, priority int, id types.File
 	// the lock after the expiry.
 	if lock.heldByID == 0 {
 		lock.heldByID = ourLockID
+		lock.holder = holder
 		lock.setTimer(l, ourLockID, id, d)
 		lock.mu.Unlock()
 		return ourLockID, nil
@@ -133,10 +156,13 @@ func (l *contractLocks) Acquire(ctx context.Context, priority int, id types.File
 	wakeChan := make(chan struct{})
 	heap.Push(lock.queue, &lockCandidate{
 		lockID:   ourLockID,
+		holder:   holder,
 		wake:     wakeChan,
 		priority: priority,
+		seq:      lock.nextSeq,
 		timedOut: ctx.Done(),
 	})
+	lock.nextSeq++
 
 	lock.mu.Unlock()
 	select {
@@ -154,42 +180,112 @@ func (l *contractLocks) Acquire(ctx context.Context, priority int, id types.File
 	return ourLockID, nil
 }
 
+// AcquireContracts acquires the contract locks for all of the given ids for
+// the provided duration. Unlike Acquire it doesn't wait for locks that are
+// held already, either all locks are acquired or none are. If one of the
+// contracts is locked, a *api.ContractLockedError identifying it is returned.
+// Upon success the lock ids are returned in the order of the given ids.
+func (l *contractLocks) AcquireContracts(ids []types.FileContractID, holder string, d time.Duration) ([]uint64, error) {
+	// Sort the ids to always lock in the same order.
+	sorted := make([]types.FileContractID, 0, len(ids))
+	seen := make(map[types.FileContractID]struct{})
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	// Lock all contract locks before checking whether they are held.
+	locks := make([]*contractLock, len(sorted))
+	for i, id := range sorted {
+		locks[i] = l.lockForContractID(id, true)
+		locks[i].mu.Lock()
+	}
+	defer func() {
+		for _, lock := range locks {
+			lock.mu.Unlock()
+		}
+	}()
+	for i, lock := range locks {
+		if lock.heldByID != 0 {
+			return nil, &api.ContractLockedError{ID: sorted[i]}
+		}
+	}
+
+	// Acquire all of them.
+	lockIDs := make(map[types.FileContractID]uint64)
+	for i, lock := range locks {
+		lockID := frand.Uint64n(math.MaxUint64) + 1
+		lock.heldByID = lockID
+		lock.holder = holder
+		lock.setTimer(l, lockID, sorted[i], d)
+		lockIDs[sorted[i]] = lockID
+	}
+
+	res := make([]uint64, len(ids))
+	for i, id := range ids {
+		res[i] = lockIDs[id]
+	}
+	return res, nil
+}
+
+// ReleaseContracts releases the contract locks for the given ids and lock
+// ids. All locks are released even if releasing one of them fails, the first
+// error is returned.
+func (l *contractLocks) ReleaseContracts(ids []types.FileContractID, lockIDs []uint64) error {
+	if len(ids) != len(lockIDs) {
+		return fmt.Errorf("number of contracts and lock ids don't match: %v != %v", len(ids), len(lockIDs))
+	}
+	var firstErr error
+	for i, id := range ids {
+		if err := l.Release(id, lockIDs[i]); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to release contract %v: %w", id, err)
+		}
+	}
+	return firstErr
+}
+
 // KeepAlive refreshes the timer on a contract lock for a given contract if the
-// lockID matches the one on the lock.
+// lockID matches the one on the lock. The lock is extended to expire after the
+// given duration from now, if the lock isn't held by the given lock id,
+// ErrLockNotHeld is returned.
 func (l *contractLocks) KeepAlive(id types.FileContractID, lockID uint64, d time.Duration) error {
 	lock := l.lockForContractID(id, false)
 	if lock == nil {
-		return errors.New("lock not found")
+		return fmt.Errorf("%w: lock not found", ErrLockNotHeld)
 	}
 	lock.mu.Lock()
 	defer lock.mu.Unlock()
 	if lock.heldByID != lockID {
-		return fmt.Errorf("lockID doesn't match: %v != %v", lock.heldByID, lockID)
+		return fmt.Errorf("%w: lockID doesn't match: %v != %v", ErrLockNotHeld, lock.heldByID, lockID)
 	}
 	if !lock.wakeupTimer.Stop() {
-		return errors.New("timer has fired already")
+		return fmt.Errorf("%w: lock expired", ErrLockNotHeld)
 	}
 	lock.setTimer(l, lockID, id, d)
 	return nil
 }
 
-// Release releases the contract lock for a given contract and lock id.
+// Release releases the contract lock for a given contract and lock id. If the
+// lock isn't held by the given lock id, e.g. because it expired,
+// ErrLockNotHeld is returned.
 func (l *contractLocks) Release(id types.FileContractID, lockID uint64) error {
 	if lockID == 0 {
 		return errors.New("can't release lock with id 0")
 	}
 	lock := l.lockForContractID(id, false)
 	if lock == nil {
-		return nil // nothing to do
+		return fmt.Errorf("%w: lock not found", ErrLockNotHeld)
 	}
 
 	lock.mu.Lock()
 	defer lock.mu.Unlock()
-	if lock.heldByID == 0 {
-		return nil // nothing to do
-	}
 	if lock.heldByID != lockID {
-		return fmt.Errorf("failed to unlock lock held by lockID %v with lockID %v - potentially due to a timeout", lock.heldByID, lockID)
+		return fmt.Errorf("%w: failed to unlock lock held by lockID %v with lockID %v - potentially due to a timeout", ErrLockNotHeld, lock.heldByID, lockID)
 	}
 
 	// Stop the timer on the lock.
@@ -197,6 +293,8 @@ func (l *contractLocks) Release(id types.FileContractID, lockID uint64) error {
 
 	// Set holder to 0.
 	lock.heldByID = 0
+	lock.holder = ""
+	lock.lockedUntil = time.Time{}
 
 	// If there is no next candidate we are done.
 	if lock.queue.Len() == 0 {
@@ -216,8 +314,35 @@ func (l *contractLocks) Release(id types.FileContractID, lockID uint64) error {
 			}
 		}() {
 			lock.heldByID = next.lockID // acquire lock for woken up thread
+			lock.holder = next.holder
 			return nil
 		}
 	}
 	return nil
 }
+
+// Locked returns the contract locks that are currently held, sorted by contract
+// id. Locks that expired but weren't released yet are not returned.
+func (l *contractLocks) Locked() []api.ContractLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC()
+	locked := make([]api.ContractLock, 0)
+	for id, lock := range l.locks {
+		lock.mu.Lock()
+		if lock.heldByID != 0 && lock.lockedUntil.After(now) {
+			locked = append(locked, api.ContractLock{
+				ID:          id,
+				Holder:      lock.holder,
+				LockedUntil: lock.lockedUntil,
+				Waiting:     lock.queue.Len(),
+			})
+		}
+		lock.mu.Unlock()
+	}
+	sort.Slice(locked, func(i, j int) bool {
+		return bytes.Compare(locked[i].ID[:], locked[j].ID[:]) < 0
+	})
+	return locked
+}
@@ -5,10 +5,12 @@ import (
 	"errors"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
 )
 
 // TestContractAcquire is a unit test for contractLocks.Acquire.
@@ -28,7 +30,7 @@ func TestContractAcquire(t *testing.T) {
 
 	// Acquire contract.
 	fcid := types.FileContractID{1}
-	lockID, err := locks.Acquire(context.Background(), 0, fcid, time.Minute)
+	lockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,13 +39,13 @@ func TestContractAcquire(t *testing.T) {
 	// Acquire another contract but this time it has been acquired already
 	// and the lock expired.
 	fcid = types.FileContractID{2}
-	_, err = locks.Acquire(context.Background(), 0, fcid, time.Millisecond)
+	_, err = locks.Acquire(context.Background(), 0, fcid, "", time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}
 	time.Sleep(5 * time.Millisecond) // wait for lock to expire
 
-	lockID, err = locks.Acquire(context.Background(), 0, fcid, time.Minute)
+	lockID, err = locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +62,7 @@ func TestContractAcquire(t *testing.T) {
 	threadIndices := []int{}
 	lockIDs := []uint64{}
 	start := time.Now()
-	_, err = locks.Acquire(context.Background(), 0, fcid, 100*time.Millisecond)
+	_, err = locks.Acquire(context.Background(), 0, fcid, "", 100*time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,7 +70,7 @@ func TestContractAcquire(t *testing.T) {
 		wg.Add(1)
 		go func(threadIndex int) {
 			defer wg.Done()
-			lockID, err := locks.Acquire(context.Background(), threadIndex, fcid, 100*time.Millisecond)
+			lockID, err := locks.Acquire(context.Background(), threadIndex, fcid, "", 100*time.Millisecond)
 			if err != nil {
 				t.Error(err)
 				return
@@ -96,14 +98,14 @@ func TestContractAcquire(t *testing.T) {
 
 	// Test timing out while trying to acquire a lock.
 	fcid = types.FileContractID{4}
-	lockID, err = locks.Acquire(context.Background(), 0, fcid, time.Hour)
+	lockID, err = locks.Acquire(context.Background(), 0, fcid, "", time.Hour)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
-	_, err = locks.Acquire(ctx, 0, fcid, 100*time.Millisecond)
+	_, err = locks.Acquire(ctx, 0, fcid, "", 100*time.Millisecond)
 	if !errors.Is(err, ErrAcquireContractTimeout) {
 		t.Fatal("acquire should time out", err)
 		return
@@ -111,6 +113,143 @@ func TestContractAcquire(t *testing.T) {
 	verify(fcid, lockID)
 }
 
+// TestContractAcquireFIFO verifies that waiters with the same priority acquire
+// a contract in the order they started waiting and that waiters time out.
+func TestContractAcquireFIFO(t *testing.T) {
+	t.Parallel()
+
+	locks := newContractLocks()
+	fcid := types.FileContractID{1}
+
+	// Acquire contract.
+	lockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waitForQueue is a helper to wait until n waiters are queued.
+	waitForQueue := func(n int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			lock := locks.lockForContractID(fcid, false)
+			lock.mu.Lock()
+			queued := lock.queue.Len()
+			lock.mu.Unlock()
+			if queued == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %v waiters", n)
+	}
+
+	// Queue up two waiters with the same priority, one after the other.
+	acquired := make(chan int, 2)
+	lockIDs := make([]uint64, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			lockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lockIDs[i] = lockID
+			acquired <- i
+		}(i)
+		waitForQueue(i + 1)
+	}
+
+	// Queue up a third waiter that times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := locks.Acquire(ctx, 0, fcid, "", time.Minute); !errors.Is(err, ErrAcquireContractTimeout) {
+		t.Fatal("unexpected error", err)
+	} else if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("acquire returned before timing out")
+	}
+
+	// Release the contract, the first waiter should acquire it.
+	if err := locks.Release(fcid, lockID); err != nil {
+		t.Fatal(err)
+	}
+	if i := <-acquired; i != 0 {
+		t.Fatal("wrong waiter acquired the lock", i)
+	}
+
+	// Hand off to the second waiter.
+	if err := locks.Release(fcid, lockIDs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if i := <-acquired; i != 1 {
+		t.Fatal("wrong waiter acquired the lock", i)
+	}
+	if err := locks.Release(fcid, lockIDs[1]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestContractAcquireConcurrent acquires the same contract from many
+// goroutines at once and asserts that the lock is never held by more than one
+// of them at the same time.
+func TestContractAcquireConcurrent(t *testing.T) {
+	locks := newContractLocks()
+	fcid := types.FileContractID{1}
+	const n = 100
+
+	// Acquire the contract from all goroutines with a context that expires
+	// before the lock does, only one of them should win.
+	var wg sync.WaitGroup
+	var winners int64
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := locks.Acquire(ctx, 0, fcid, "", time.Minute)
+			if err == nil {
+				atomic.AddInt64(&winners, 1)
+			} else if !errors.Is(err, ErrAcquireContractTimeout) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatal("expected exactly one winner", winners)
+	}
+
+	// Acquire another contract from all goroutines and hold it for a bit
+	// before releasing it, all of them should acquire it one after another.
+	fcid = types.FileContractID{2}
+	var holders, acquired int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if atomic.AddInt64(&holders, 1) != 1 {
+				t.Error("lock is held by more than one caller")
+			}
+			atomic.AddInt64(&acquired, 1)
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&holders, -1)
+			if err := locks.Release(fcid, lockID); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != n {
+		t.Fatal("not all callers acquired the lock", acquired)
+	}
+}
+
 // TestContractKeepalive verifies that calling KeepAlive will extend the
 // duration of a lock.
 func TestContractKeepalive(t *testing.T) {
@@ -121,7 +260,7 @@ func TestContractKeepalive(t *testing.T) {
 
 	// Acquire a contract.
 	fcid := types.FileContractID{1}
-	lockID, err := locks.Acquire(context.Background(), 0, fcid, 500*time.Millisecond)
+	lockID, err := locks.Acquire(context.Background(), 0, fcid, "", 500*time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -140,7 +279,7 @@ func TestContractKeepalive(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		_, _ = locks.Acquire(context.Background(), 0, fcid, 500*time.Millisecond)
+		_, _ = locks.Acquire(context.Background(), 0, fcid, "", 500*time.Millisecond)
 	}()
 
 	select {
@@ -150,6 +289,49 @@ func TestContractKeepalive(t *testing.T) {
 	}
 }
 
+// TestContractKeepaliveStale verifies that a lock can't be kept alive by a
+// holder whose lock expired.
+func TestContractKeepaliveStale(t *testing.T) {
+	t.Parallel()
+
+	locks := newContractLocks()
+	fcid := types.FileContractID{1}
+
+	// Acquire a contract and keep it alive past its initial duration.
+	lockID, err := locks.Acquire(context.Background(), 0, fcid, "", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if err := locks.KeepAlive(fcid, lockID, 200*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lock := locks.lockForContractID(fcid, false); lock.heldByID != lockID {
+		t.Fatal("lock should still be held")
+	}
+
+	// Let the lock expire and acquire it with another holder.
+	time.Sleep(300 * time.Millisecond)
+	newLockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale holder shouldn't be able to keep the lock alive.
+	if err := locks.KeepAlive(fcid, lockID, time.Minute); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	} else if lock := locks.lockForContractID(fcid, false); lock.heldByID != newLockID {
+		t.Fatal("lock should be held by the new holder")
+	}
+
+	// Keeping alive an unknown lock should fail too.
+	if err := locks.KeepAlive(types.FileContractID{2}, lockID, time.Minute); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
 // TestContractRelease is a unit test for contractLocks.Release.
 func TestContractRelease(t *testing.T) {
 	locks := newContractLocks()
@@ -164,7 +346,7 @@ func TestContractRelease(t *testing.T) {
 
 	// Acquire contract.
 	fcid := types.FileContractID{1}
-	lockID, err := locks.Acquire(context.Background(), 0, fcid, time.Minute)
+	lockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -181,7 +363,7 @@ func TestContractRelease(t *testing.T) {
 		}
 	}()
 
-	lockID, err = locks.Acquire(context.Background(), 0, fcid, time.Minute)
+	lockID, err = locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -194,13 +376,228 @@ func TestContractRelease(t *testing.T) {
 	}
 	verify(fcid, 0, time.Time{}, 0)
 
-	// Try to release lock again. Is a no-op.
+	// Try to release lock again. Should fail since the lock isn't held.
+	if err := locks.Release(fcid, lockID); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// Try to release lock for another contract. Should fail.
+	if err := locks.Release(types.FileContractID{2}, lockID); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// TestContractReleaseLockID verifies that a contract lock can only be released
+// by its holder.
+func TestContractReleaseLockID(t *testing.T) {
+	t.Parallel()
+
+	locks := newContractLocks()
+	fcid := types.FileContractID{1}
+
+	// Acquire contract.
+	lockID, err := locks.Acquire(context.Background(), 0, fcid, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Release with a mismatched lock id. Should fail and leave the lock held.
+	if err := locks.Release(fcid, lockID+1); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	} else if err := locks.KeepAlive(fcid, lockID+1, time.Minute); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	} else if lock := locks.lockForContractID(fcid, false); lock.heldByID != lockID {
+		t.Fatal("lock should still be held")
+	}
+
+	// Release and re-acquire the contract.
 	if err := locks.Release(fcid, lockID); err != nil {
 		t.Fatal(err)
 	}
+	newLockID, err := locks.Acquire(context.Background(), 0, fcid, "", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	} else if newLockID == lockID {
+		t.Fatal("lock id should be regenerated")
+	}
 
-	// Try to release lock for another contract. Should fail.
-	if err := locks.Release(types.FileContractID{2}, lockID); err != nil {
+	// Let the lock expire and release it. Should fail.
+	time.Sleep(200 * time.Millisecond)
+	if err := locks.Release(fcid, newLockID); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// The expired lock should be acquirable right away.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := locks.Acquire(ctx, 0, fcid, "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestContractLocked is a unit test for contractLocks.Locked.
+func TestContractLocked(t *testing.T) {
+	locks := newContractLocks()
+
+	// Acquire two contracts and queue up a caller for the second one.
+	fcid1, fcid2 := types.FileContractID{1}, types.FileContractID{2}
+	lockID1, err := locks.Acquire(context.Background(), 0, fcid1, "worker-1:renew", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockID2, err := locks.Acquire(context.Background(), 0, fcid2, "worker-1:upload", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		locks.Acquire(ctx, 0, fcid2, "worker-2:upload", time.Minute)
+	}()
+	for {
+		lock := locks.lockForContractID(fcid2, false)
+		lock.mu.Lock()
+		waiting := lock.queue.Len()
+		lock.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Both locks should be reported.
+	locked := locks.Locked()
+	if len(locked) != 2 {
+		t.Fatal("unexpected number of locks", len(locked))
+	} else if locked[0].ID != fcid1 || locked[0].Holder != "worker-1:renew" || locked[0].Waiting != 0 {
+		t.Fatal("unexpected lock", locked[0])
+	} else if locked[1].ID != fcid2 || locked[1].Holder != "worker-1:upload" || locked[1].Waiting != 1 {
+		t.Fatal("unexpected lock", locked[1])
+	} else if locked[0].LockedUntil.Location() != time.UTC || time.Until(locked[0].LockedUntil) <= 0 {
+		t.Fatal("unexpected expiry", locked[0].LockedUntil)
+	}
+
+	// A lock that expired but wasn't released yet reads as unlocked.
+	lock := locks.lockForContractID(fcid1, false)
+	lock.mu.Lock()
+	lock.lockedUntil = time.Now().UTC().Add(-time.Second)
+	lock.mu.Unlock()
+	if locked := locks.Locked(); len(locked) != 1 || locked[0].ID != fcid2 {
+		t.Fatal("unexpected locks", locked)
+	}
+
+	// Released locks aren't reported.
+	if err := locks.Release(fcid1, lockID1); err != nil {
 		t.Fatal(err)
 	}
+	cancel()
+	<-done
+	if err := locks.Release(fcid2, lockID2); err != nil {
+		t.Fatal(err)
+	}
+	if locked := locks.Locked(); len(locked) != 0 {
+		t.Fatal("unexpected locks", locked)
+	}
+
+	// A waiting caller takes over the holder when woken up.
+	lockID1, err = locks.Acquire(context.Background(), 0, fcid1, "worker-1:renew", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan uint64)
+	go func() {
+		lockID, _ := locks.Acquire(context.Background(), 0, fcid1, "worker-2:funding", 100*time.Millisecond)
+		acquired <- lockID
+	}()
+	for {
+		lock := locks.lockForContractID(fcid1, false)
+		lock.mu.Lock()
+		waiting := lock.queue.Len()
+		lock.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := locks.Release(fcid1, lockID1); err != nil {
+		t.Fatal(err)
+	}
+	<-acquired
+	if locked := locks.Locked(); len(locked) != 1 || locked[0].Holder != "worker-2:funding" {
+		t.Fatal("unexpected locks", locked)
+	}
+
+	// Once it expires the lock disappears without being released.
+	time.Sleep(200 * time.Millisecond)
+	if locked := locks.Locked(); len(locked) != 0 {
+		t.Fatal("unexpected locks", locked)
+	}
+}
+
+// TestContractAcquireContracts is a unit test for
+// contractLocks.AcquireContracts and contractLocks.ReleaseContracts.
+func TestContractAcquireContracts(t *testing.T) {
+	locks := newContractLocks()
+
+	// Acquire one of the contracts of the batch.
+	fcids := []types.FileContractID{{4}, {1}, {3}, {2}}
+	lockID, err := locks.Acquire(context.Background(), 0, fcids[2], "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Acquiring the batch should fail and identify the contended contract.
+	_, err = locks.AcquireContracts(fcids, "", time.Minute)
+	var lockedErr *api.ContractLockedError
+	if !errors.As(err, &lockedErr) {
+		t.Fatal("expected ContractLockedError", err)
+	} else if lockedErr.ID != fcids[2] {
+		t.Fatal("unexpected contract", lockedErr.ID)
+	} else if !errors.Is(err, api.ErrContractLocked) {
+		t.Fatal("expected ErrContractLocked", err)
+	}
+
+	// None of the other contracts should be locked.
+	for _, fcid := range fcids {
+		if lock := locks.lockForContractID(fcid, false); fcid != fcids[2] && lock != nil && lock.heldByID != 0 {
+			t.Fatal("contract shouldn't be locked", fcid)
+		}
+	}
+
+	// Release the contract and try again.
+	if err := locks.Release(fcids[2], lockID); err != nil {
+		t.Fatal(err)
+	}
+	lockIDs, err := locks.AcquireContracts(fcids, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(lockIDs) != len(fcids) {
+		t.Fatal("unexpected number of lock ids", len(lockIDs))
+	}
+	for i, fcid := range fcids {
+		if lock := locks.lockForContractID(fcid, false); lock.heldByID != lockIDs[i] {
+			t.Fatal("contract not locked with the returned lock id", fcid)
+		}
+	}
+
+	// Acquiring one of the contracts should time out.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := locks.Acquire(ctx, 0, fcids[0], "", time.Minute); !errors.Is(err, ErrAcquireContractTimeout) {
+		t.Fatal("expected timeout", err)
+	}
+
+	// Release all of them.
+	if err := locks.ReleaseContracts(fcids, lockIDs); err != nil {
+		t.Fatal(err)
+	} else if locked := locks.Locked(); len(locked) != 0 {
+		t.Fatal("expected no locked contracts", len(locked))
+	}
+
+	// Releasing them again should fail.
+	if err := locks.ReleaseContracts(fcids, lockIDs); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatal("expected ErrLockNotHeld", err)
+	}
 }
@@ -172,13 +172,18 @@ func main() {
 	flag.StringVar(&busCfg.apiPassword, "bus.apiPassword", "", "API password for remote bus service - can be overwritten using RENTERD_BUS_API_PASSWORD environment variable")
 	flag.StringVar(&busCfg.remoteAddr, "bus.remoteAddr", "", "URL of remote bus service - can be overwritten using RENTERD_BUS_REMOTE_ADDR environment variable")
 	flag.DurationVar(&busCfg.UsedUTXOExpiry, "bus.usedUTXOExpiry", 24*time.Hour, "time after which a used UTXO that hasn't been included in a transaction becomes spendable again")
+	flag.DurationVar(&busCfg.SpendingHistoryInterval, "bus.spendingHistoryInterval", time.Hour, "length of the periods contract spending is recorded in, 0 disables the spending history")
 
 	// worker
 	flag.BoolVar(&workerCfg.AllowPrivateIPs, "worker.allowPrivateIPs", false, "allow hosts with private IPs")
 	flag.DurationVar(&workerCfg.BusFlushInterval, "worker.busFlushInterval", 5*time.Second, "time after which the worker flushes buffered data to bus for persisting")
 	flag.Uint64Var(&workerCfg.DownloadMaxOverdrive, "worker.downloadMaxOverdrive", 5, "maximum number of active overdrive workers when downloading a slab")
+	flag.Uint64Var(&workerCfg.DownloadReadAhead, "worker.downloadReadAhead", 0, "number of slabs following a downloaded range that are downloaded speculatively to speed up sequential reads, 0 disables read-ahead")
 	flag.StringVar(&workerCfg.WorkerConfig.ID, "worker.id", "worker", "unique identifier of worker used internally - can be overwritten using the RENTERD_WORKER_ID environment variable")
+	flag.DurationVar(&workerCfg.DownloadHedgeDelay, "worker.downloadHedgeDelay", 0, "delay after which spare shards are requested from unused hosts while the final shard of a slab is outstanding, 0 disables hedging")
+	flag.DurationVar(&workerCfg.DownloadLaunchStagger, "worker.downloadLaunchStagger", 0, "delay between the initial sector launches of a slab download to hosts without latency history, 0 disables staggering")
 	flag.DurationVar(&workerCfg.DownloadOverdriveTimeout, "worker.downloadOverdriveTimeout", 3*time.Second, "timeout applied to slab downloads that decides when we start overdriving")
+	flag.DurationVar(&workerCfg.DownloadStatsMaxAge, "worker.downloadStatsMaxAge", 0, "persist download stats across restarts, persisted stats older than the given age are ignored, 0 disables persistence")
 	flag.Uint64Var(&workerCfg.UploadMaxOverdrive, "worker.uploadMaxOverdrive", 5, "maximum number of active overdrive workers when uploading a slab")
 	flag.DurationVar(&workerCfg.UploadOverdriveTimeout, "worker.uploadOverdriveTimeout", 3*time.Second, "timeout applied to slab uploads that decides when we start overdriving")
 	flag.StringVar(&workerCfg.apiPassword, "worker.apiPassword", "", "API password for remote worker service")
@@ -189,6 +194,8 @@ func main() {
 	flag.DurationVar(&autopilotCfg.AccountsRefillInterval, "autopilot.accountRefillInterval", defaultAccountRefillInterval, "interval at which the autopilot checks the workers' accounts balance and refills them if necessary")
 	flag.DurationVar(&autopilotCfg.Heartbeat, "autopilot.heartbeat", 30*time.Minute, "interval at which autopilot loop runs")
 	flag.Float64Var(&autopilotCfg.MigrationHealthCutoff, "autopilot.migrationHealthCutoff", 0.75, "health threshold below which slabs are migrated to new hosts")
+	flag.Float64Var(&autopilotCfg.MigrationCriticalHealthCutoff, "autopilot.migrationCriticalHealthCutoff", 0.25, "health threshold below which slabs are migrated before all other slabs")
+	flag.Uint64Var(&autopilotCfg.MigratorBatchSize, "autopilot.migratorBatchSize", 1000, "size of the batch with which slabs are fetched for migration")
 	flag.Uint64Var(&autopilotCfg.ScannerBatchSize, "autopilot.scannerBatchSize", 1000, "size of the batch with which hosts are scanned")
 	flag.DurationVar(&autopilotCfg.ScannerInterval, "autopilot.scannerInterval", 24*time.Hour, "interval at which hosts are scanned")
 	flag.Uint64Var(&autopilotCfg.ScannerMinRecentFailures, "autopilot.scannerMinRecentFailures", 10, "minimum amount of consesutive failed scans a host must have before it is removed for exceeding the max downtime")
@@ -314,6 +321,7 @@ func main() {
 	workerAddrs, workerPassword := workerCfg.remoteAddrs, workerCfg.apiPassword
 	if workerAddrs == "" {
 		if workerCfg.enabled {
+			workerCfg.DownloadStatsPath = filepath.Join(*dir, "worker", workerCfg.ID, "downloadstats.json")
 			w, shutdownFn, err := node.NewWorker(workerCfg.WorkerConfig, bc, getSeed(), logger)
 			if err != nil {
 				log.Fatal("failed to create worker", err)
@@ -37,9 +37,14 @@ type WorkerConfig struct {
 	AllowPrivateIPs          bool
 	BusFlushInterval         time.Duration
 	ContractLockTimeout      time.Duration
+	DownloadHedgeDelay       time.Duration
+	DownloadLaunchStagger    time.Duration
 	DownloadOverdriveTimeout time.Duration
+	DownloadStatsMaxAge      time.Duration
+	DownloadStatsPath        string
 	UploadOverdriveTimeout   time.Duration
 	DownloadMaxOverdrive     uint64
+	DownloadReadAhead        uint64
 	UploadMaxOverdrive       uint64
 }
 
@@ -51,20 +56,24 @@ type BusConfig struct {
 	PersistInterval time.Duration
 	UsedUTXOExpiry  time.Duration
 
+	SpendingHistoryInterval time.Duration
+
 	DBLoggerConfig stores.LoggerConfig
 	DBDialector    gorm.Dialector
 }
 
 type AutopilotConfig struct {
-	ID                       string
-	AccountsRefillInterval   time.Duration
-	Heartbeat                time.Duration
-	MigrationHealthCutoff    float64
-	RevisionSubmissionBuffer uint64
-	ScannerInterval          time.Duration
-	ScannerBatchSize         uint64
-	ScannerMinRecentFailures uint64
-	ScannerNumThreads        uint64
+	ID                            string
+	AccountsRefillInterval        time.Duration
+	Heartbeat                     time.Duration
+	MigrationHealthCutoff         float64
+	MigrationCriticalHealthCutoff float64
+	MigratorBatchSize             uint64
+	RevisionSubmissionBuffer      uint64
+	ScannerInterval               time.Duration
+	ScannerBatchSize              uint64
+	ScannerMinRecentFailures      uint64
+	ScannerNumThreads             uint64
 }
 
 type ShutdownFn = func(context.Context) error
@@ -247,7 +256,7 @@ func NewBus(cfg BusConfig, dir string, seed types.PrivateKey, l *zap.Logger) (ht
 
 	sqlLogger := stores.NewSQLLogger(l.Named("db"), cfg.DBLoggerConfig)
 	walletAddr := wallet.StandardAddress(seed.PublicKey())
-	sqlStore, ccid, err := stores.NewSQLStore(dbConn, true, cfg.PersistInterval, walletAddr, sqlLogger)
+	sqlStore, ccid, err := stores.NewSQLStore(dbConn, true, cfg.PersistInterval, cfg.SpendingHistoryInterval, walletAddr, sqlLogger)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -302,7 +311,7 @@ func NewBus(cfg BusConfig, dir string, seed types.PrivateKey, l *zap.Logger) (ht
 
 func NewWorker(cfg WorkerConfig, b worker.Bus, seed types.PrivateKey, l *zap.Logger) (http.Handler, ShutdownFn, error) {
 	workerKey := blake2b.Sum256(append([]byte("worker"), seed...))
-	w, err := worker.New(workerKey, cfg.ID, b, cfg.ContractLockTimeout, cfg.BusFlushInterval, cfg.DownloadOverdriveTimeout, cfg.UploadOverdriveTimeout, cfg.DownloadMaxOverdrive, cfg.UploadMaxOverdrive, cfg.AllowPrivateIPs, l)
+	w, err := worker.New(workerKey, cfg.ID, b, cfg.ContractLockTimeout, cfg.BusFlushInterval, cfg.DownloadHedgeDelay, cfg.DownloadLaunchStagger, cfg.DownloadOverdriveTimeout, cfg.DownloadStatsMaxAge, cfg.UploadOverdriveTimeout, cfg.DownloadMaxOverdrive, cfg.DownloadReadAhead, cfg.UploadMaxOverdrive, cfg.DownloadStatsPath, cfg.AllowPrivateIPs, l)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -311,7 +320,7 @@ func NewWorker(cfg WorkerConfig, b worker.Bus, seed types.PrivateKey, l *zap.Log
 }
 
 func NewAutopilot(cfg AutopilotConfig, b autopilot.Bus, workers []autopilot.Worker, l *zap.Logger) (http.Handler, func() error, ShutdownFn, error) {
-	ap, err := autopilot.New(cfg.ID, b, workers, l, cfg.Heartbeat, cfg.ScannerInterval, cfg.ScannerBatchSize, cfg.ScannerMinRecentFailures, cfg.ScannerNumThreads, cfg.MigrationHealthCutoff, cfg.AccountsRefillInterval, cfg.RevisionSubmissionBuffer)
+	ap, err := autopilot.New(cfg.ID, b, workers, l, cfg.Heartbeat, cfg.ScannerInterval, cfg.ScannerBatchSize, cfg.ScannerMinRecentFailures, cfg.ScannerNumThreads, cfg.MigrationHealthCutoff, cfg.MigrationCriticalHealthCutoff, cfg.MigratorBatchSize, cfg.AccountsRefillInterval, cfg.RevisionSubmissionBuffer)
 	if err != nil {
 		return nil, nil, nil, err
 	}
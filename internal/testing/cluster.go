@@ -796,6 +796,8 @@ func testBusCfg() node.BusConfig {
 		Network:         testNetwork(),
 		PersistInterval: testPersistInterval,
 		UsedUTXOExpiry:  time.Minute,
+
+		SpendingHistoryInterval: time.Hour,
 	}
 }
 
@@ -813,14 +815,16 @@ func testWorkerCfg() node.WorkerConfig {
 
 func testApCfg() node.AutopilotConfig {
 	return node.AutopilotConfig{
-		ID:                       api.DefaultAutopilotID,
-		AccountsRefillInterval:   time.Second,
-		Heartbeat:                time.Second,
-		MigrationHealthCutoff:    0.99,
-		RevisionSubmissionBuffer: 0,
-		ScannerInterval:          time.Second,
-		ScannerBatchSize:         10,
-		ScannerNumThreads:        1,
-		ScannerMinRecentFailures: 5,
+		ID:                            api.DefaultAutopilotID,
+		AccountsRefillInterval:        time.Second,
+		Heartbeat:                     time.Second,
+		MigrationHealthCutoff:         0.99,
+		MigrationCriticalHealthCutoff: 0.25,
+		MigratorBatchSize:             10,
+		RevisionSubmissionBuffer:      0,
+		ScannerInterval:               time.Second,
+		ScannerBatchSize:              10,
+		ScannerNumThreads:             1,
+		ScannerMinRecentFailures:      5,
 	}
 }
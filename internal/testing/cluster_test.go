@@ -97,11 +97,11 @@ func TestNewTestCluster(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(sets) != 1 {
+	if len(sets) != 2 {
 		t.Fatal("invalid number of setse", len(sets))
 	}
-	if sets[0] != "autopilot" {
-		t.Fatal("set name should be 'autopilot' but was", sets[0])
+	if sets[1].Name != "autopilot" {
+		t.Fatal("set name should be 'autopilot' but was", sets[1].Name)
 	}
 
 	// Verify startHeight and endHeight of the contract.
@@ -673,7 +673,7 @@ func TestUploadDownloadExtended(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = b.SetContractSet(context.Background(), t.Name(), nil)
+	_, _, _, err = b.SetContractSet(context.Background(), t.Name(), nil, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1401,7 +1401,7 @@ func TestUploadDownloadSameHost(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c2, err := cluster.Bus.AddContract(context.Background(), rev2, c.TotalCost, c.StartHeight)
+	c2, err := cluster.Bus.AddContract(context.Background(), rev2, c.TotalCost, c.StartHeight, c.HostIP, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1409,13 +1409,13 @@ func TestUploadDownloadSameHost(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c3, err := cluster.Bus.AddContract(context.Background(), rev3, c.TotalCost, c.StartHeight)
+	c3, err := cluster.Bus.AddContract(context.Background(), rev3, c.TotalCost, c.StartHeight, c.HostIP, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// create a contract set with all 3 contracts
-	err = cluster.Bus.SetContractSet(context.Background(), "autopilot", []types.FileContractID{c.ID, c2.ID, c3.ID})
+	_, _, _, err = cluster.Bus.SetContractSet(context.Background(), "autopilot", []types.FileContractID{c.ID, c2.ID, c3.ID}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -562,7 +562,8 @@ func (ss *SQLStore) RemoveOfflineHosts(ctx context.Context, minRecentFailures ui
 	// remove every host one by one
 	var errs []error
 	for _, h := range hosts {
-		if err := ss.retryTransaction(func(tx *gorm.DB) error {
+		var changes []api.ContractSetChange
+		if err := ss.retryTransaction(ctx, func(tx *gorm.DB) error {
 			// fetch host contracts
 			hcs, err := contractsForHost(tx, h)
 			if err != nil {
@@ -576,7 +577,7 @@ func (ss *SQLStore) RemoveOfflineHosts(ctx context.Context, minRecentFailures ui
 			}
 
 			// archive host contracts
-			if err := archiveContracts(tx, hcs, toArchive); err != nil {
+			if changes, err = archiveContracts(tx, hcs, toArchive); err != nil {
 				return err
 			}
 
@@ -588,6 +589,8 @@ func (ss *SQLStore) RemoveOfflineHosts(ctx context.Context, minRecentFailures ui
 			return nil
 		}); err != nil {
 			errs = append(errs, err)
+		} else {
+			ss.notifyContractSetChanges(changes)
 		}
 	}
 
@@ -610,7 +613,7 @@ func (ss *SQLStore) UpdateHostAllowlistEntries(ctx context.Context, add, remove
 
 	// clear allowlist
 	if clear {
-		return ss.retryTransaction(func(tx *gorm.DB) error {
+		return ss.retryTransaction(ctx, func(tx *gorm.DB) error {
 			return tx.Where("TRUE").Delete(&dbAllowlistEntry{}).Error
 		})
 	}
@@ -625,7 +628,7 @@ func (ss *SQLStore) UpdateHostAllowlistEntries(ctx context.Context, add, remove
 		toDelete[i] = publicKey(entry)
 	}
 
-	return ss.retryTransaction(func(tx *gorm.DB) error {
+	return ss.retryTransaction(ctx, func(tx *gorm.DB) error {
 		if len(toInsert) > 0 {
 			if err := tx.Create(&toInsert).Error; err != nil {
 				return err
@@ -649,7 +652,7 @@ func (ss *SQLStore) UpdateHostBlocklistEntries(ctx context.Context, add, remove
 
 	// clear blocklist
 	if clear {
-		return ss.retryTransaction(func(tx *gorm.DB) error {
+		return ss.retryTransaction(ctx, func(tx *gorm.DB) error {
 			return tx.Where("TRUE").Delete(&dbBlocklistEntry{}).Error
 		})
 	}
@@ -659,7 +662,7 @@ func (ss *SQLStore) UpdateHostBlocklistEntries(ctx context.Context, add, remove
 		toInsert = append(toInsert, dbBlocklistEntry{Entry: entry})
 	}
 
-	return ss.retryTransaction(func(tx *gorm.DB) error {
+	return ss.retryTransaction(ctx, func(tx *gorm.DB) error {
 		if len(toInsert) > 0 {
 			if err := tx.Create(&toInsert).Error; err != nil {
 				return err
@@ -740,7 +743,7 @@ func (ss *SQLStore) RecordInteractions(ctx context.Context, interactions []hostd
 
 	// Write the interactions and update to the hosts atomically within a single
 	// transaction.
-	return ss.retryTransaction(func(tx *gorm.DB) error {
+	return ss.retryTransaction(ctx, func(tx *gorm.DB) error {
 		// Apply all the interactions to the hosts.
 		dbInteractions := make([]dbInteraction, 0, len(interactions))
 		for _, interaction := range interactions {
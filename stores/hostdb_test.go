@@ -146,7 +146,7 @@ func TestSQLHostDB(t *testing.T) {
 
 	// Connect to the same DB again.
 	conn2 := NewEphemeralSQLiteConnection(dbName)
-	hdb2, ccid, err := NewSQLStore(conn2, false, time.Second, types.Address{}, nil)
+	hdb2, ccid, err := NewSQLStore(conn2, false, time.Second, time.Hour, types.Address{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -9,6 +9,8 @@ import (
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -121,11 +123,22 @@ func (l gormLogger) Trace(ctx context.Context, start time.Time, fc func() (sql s
 
 	if l.SlowThreshold != 0 && time.Since(start) > l.SlowThreshold && l.LogLevel >= logger.Warn {
 		sql, rows := fc()
-		if rows == -1 {
-			ll.Warnw(fmt.Sprintf("SLOW SQL >= %v", l.SlowThreshold), "elapsed", elapsedMS(start), "sql", sql)
-		} else {
-			ll.Warnw(fmt.Sprintf("SLOW SQL >= %v", l.SlowThreshold), "elapsed", elapsedMS(start), "rows", rows, "sql", sql)
+		fields := []interface{}{"elapsed", elapsedMS(start)}
+		if rows != -1 {
+			fields = append(fields, "rows", rows)
+		}
+		fields = append(fields, "sql", sql)
+
+		// attach the query to the trace of the operation it was part of
+		if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+			fields = append(fields, "traceID", sc.TraceID().String())
+			trace.SpanFromContext(ctx).AddEvent("slow query", trace.WithAttributes(
+				attribute.String("sql", sql),
+				attribute.Int64("rows", rows),
+				attribute.String("elapsed", elapsedMS(start)),
+			))
 		}
+		ll.Warnw(fmt.Sprintf("SLOW SQL >= %v", l.SlowThreshold), fields...)
 		return
 	}
 
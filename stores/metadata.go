@@ -9,6 +9,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/attribute"
 	rhpv2 "go.sia.tech/core/rhp/v2"
 	"go.sia.tech/core/types"
 	"go.sia.tech/renterd/api"
@@ -16,10 +17,52 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	// archivedContractsPruneBatchSize is the number of archived contracts
+	// that are deleted per transaction when pruning the archive.
+	archivedContractsPruneBatchSize = 1000
+
+	// danglingSectorsPruneBatchSize is the number of dangling sectors that
+	// are deleted per transaction when pruning sectors.
+	danglingSectorsPruneBatchSize = 1000
+
+	// spendingHistoryPruneBatchSize is the number of spending periods that
+	// are deleted per transaction when pruning the spending history.
+	spendingHistoryPruneBatchSize = 1000
+
+	// contractSetChangesPruneBatchSize is the number of contract set changes
+	// that are deleted per transaction when pruning them.
+	contractSetChangesPruneBatchSize = 1000
+
+	// maxAncestorDepth is the maximum number of renewals AncestorContracts
+	// follows before giving up.
+	maxAncestorDepth = 10000
+
+	// maxDescendantDepth is the maximum number of renewals Descendant and
+	// RenewalChain follow forwards before giving up.
+	maxDescendantDepth = 10000
+)
+
 var (
 	// ErrContractNotFound is returned when a contract can't be retrieved from
 	// the database.
 	ErrContractNotFound = errors.New("couldn't find contract")
+
+	// ErrRevisionNumberRegressed is returned when a contract's revision is
+	// updated with a revision number lower than the one in the database.
+	ErrRevisionNumberRegressed = errors.New("revision number can't be lower than the current one")
+
+	// ErrArchivedContractNotFound is returned when an archived contract can't
+	// be retrieved from the database.
+	ErrArchivedContractNotFound = errors.New("couldn't find archived contract")
+
+	// ErrAncestorDepthExceeded is returned when a contract has more ancestors
+	// than AncestorContracts and PruneArchivedContracts are willing to follow.
+	ErrAncestorDepthExceeded = errors.New("contract has too many ancestors")
+
+	// ErrDescendantDepthExceeded is returned when a contract was renewed more
+	// often than Descendant and RenewalChain are willing to follow.
+	ErrDescendantDepthExceeded = errors.New("contract has too many descendants")
 )
 
 type (
@@ -31,6 +74,14 @@ type (
 
 		Host   publicKey `gorm:"index;NOT NULL;size:32"`
 		Reason string
+
+		// NetAddress is the host's net address at the time the contract was
+		// archived, it's empty for contracts archived before it was recorded.
+		NetAddress string
+
+		// ArchivedAt is the time the contract was archived, CreatedAt is the
+		// time the contract itself was created.
+		ArchivedAt time.Time `gorm:"index"`
 	}
 
 	dbContract struct {
@@ -40,6 +91,24 @@ type (
 
 		HostID uint `gorm:"index"`
 		Host   dbHost
+
+		// NetAddress is the last known address of the host, it's used to dial
+		// the host when the host's own address is unknown. It's set to the
+		// host's address when the contract is formed and refreshed from the
+		// host on every renewal, if the host's address is unknown at that time
+		// the renewed contract keeps the previous one.
+		NetAddress string
+
+		// HostAddress is the address the contract was originally formed with.
+		// Renewals copy it from the contract that was renewed so it's never
+		// updated. Unlike NetAddress it doesn't follow a host that moved, which
+		// makes such hosts easy to spot, and it's never used to dial the host.
+		HostAddress string
+
+		// budget fields, a budget of zero means the spending is unlimited
+		UploadBudget      currency
+		DownloadBudget    currency
+		FundAccountBudget currency
 	}
 
 	ContractCommon struct {
@@ -59,6 +128,16 @@ type (
 		UploadSpending      currency
 		DownloadSpending    currency
 		FundAccountSpending currency
+
+		// data transfer counters
+		UploadedBytes   uint64 `gorm:"NOT NULL;default:0"`
+		DownloadedBytes uint64 `gorm:"NOT NULL;default:0"`
+
+		// host settings snapshot, the settings are opaque to the store and
+		// only the prices are stored in separate columns
+		SettingsSnapshot      []byte
+		SnapshotContractPrice currency `gorm:"index;size:64;NOT NULL;default:'0'"`
+		SnapshotStoragePrice  currency `gorm:"index;size:64;NOT NULL;default:'0'"`
 	}
 
 	dbContractSet struct {
@@ -108,7 +187,7 @@ type (
 
 		Complete    bool `gorm:"index"`
 		Data        []byte
-		LockedUntil int64 // unix timestamp
+		LockedUntil int64 // unix timestamp in milliseconds
 		MinShards   uint8 `gorm:"index"`
 		TotalShards uint8 `gorm:"index"`
 	}
@@ -123,6 +202,31 @@ type (
 		Contracts []dbContract `gorm:"many2many:contract_sectors;constraint:OnDelete:CASCADE"`
 	}
 
+	// dbContractSpendingPeriod contains the spending of a contract during
+	// the period starting at PeriodStart.
+	dbContractSpendingPeriod struct {
+		Model
+
+		FCID        fileContractID `gorm:"uniqueIndex:idx_contract_spending_period;NOT NULL;column:fcid;size:32"`
+		PeriodStart int64          `gorm:"uniqueIndex:idx_contract_spending_period;index;NOT NULL"` // unix timestamp
+
+		Uploads     currency
+		Downloads   currency
+		FundAccount currency
+	}
+
+	// dbContractSetChange records a contract entering or leaving a contract
+	// set.
+	dbContractSetChange struct {
+		Model
+
+		Name      string         `gorm:"index;NOT NULL"`
+		FCID      fileContractID `gorm:"index;NOT NULL;column:fcid;size:32"`
+		Added     bool           `gorm:"NOT NULL"`
+		Reason    string
+		Timestamp time.Time `gorm:"index;NOT NULL"`
+	}
+
 	// dbContractSector is a join table between dbContract and dbSector.
 	dbContractSector struct {
 		DBContractID uint `gorm:"primaryKey"`
@@ -162,9 +266,15 @@ func (dbContract) TableName() string { return "contracts" }
 // TableName implements the gorm.Tabler interface.
 func (dbContractSector) TableName() string { return "contract_sectors" }
 
+// TableName implements the gorm.Tabler interface.
+func (dbContractSpendingPeriod) TableName() string { return "contract_spending_history" }
+
 // TableName implements the gorm.Tabler interface.
 func (dbContractSet) TableName() string { return "contract_sets" }
 
+// TableName implements the gorm.Tabler interface.
+func (dbContractSetChange) TableName() string { return "contract_set_changes" }
+
 // TableName implements the gorm.Tabler interface.
 func (dbObject) TableName() string { return "objects" }
 
@@ -188,6 +298,14 @@ func (c dbArchivedContract) convert() api.ArchivedContract {
 		ID:        types.FileContractID(c.FCID),
 		HostKey:   types.PublicKey(c.Host),
 		RenewedTo: types.FileContractID(c.RenewedTo),
+		Reason:    c.Reason,
+		HostIP:    c.NetAddress,
+		TotalCost: types.Currency(c.TotalCost),
+
+		CreatedAt:  c.CreatedAt.UTC(),
+		ArchivedAt: c.ArchivedAt.UTC(),
+
+		SettingsSnapshot: c.settingsSnapshot(),
 
 		ProofHeight:    c.ProofHeight,
 		RevisionHeight: c.RevisionHeight,
@@ -202,6 +320,20 @@ func (c dbArchivedContract) convert() api.ArchivedContract {
 			Downloads:   types.Currency(c.DownloadSpending),
 			FundAccount: types.Currency(c.FundAccountSpending),
 		},
+		UploadedBytes:   c.UploadedBytes,
+		DownloadedBytes: c.DownloadedBytes,
+	}
+}
+
+// convert converts a dbContractSpendingPeriod to a ContractSpendingPeriod.
+func (p dbContractSpendingPeriod) convert() api.ContractSpendingPeriod {
+	return api.ContractSpendingPeriod{
+		Start: time.Unix(p.PeriodStart, 0).UTC(),
+		ContractSpending: api.ContractSpending{
+			Uploads:     types.Currency(p.Uploads),
+			Downloads:   types.Currency(p.Downloads),
+			FundAccount: types.Currency(p.FundAccount),
+		},
 	}
 }
 
@@ -209,11 +341,20 @@ func (c dbArchivedContract) convert() api.ArchivedContract {
 func (c dbContract) convert() api.ContractMetadata {
 	var revisionNumber uint64
 	_, _ = fmt.Sscan(c.RevisionNumber, &revisionNumber)
+	hostIP, hostIPSource := c.Host.NetAddress, api.HostIPSourceHost
+	if hostIP == "" && c.NetAddress != "" {
+		hostIP, hostIPSource = c.NetAddress, api.HostIPSourceContract
+	} else if hostIP == "" {
+		hostIPSource = ""
+	}
 	return api.ContractMetadata{
-		ID:         types.FileContractID(c.FCID),
-		HostIP:     c.Host.NetAddress,
-		HostKey:    types.PublicKey(c.Host.PublicKey),
-		SiamuxAddr: c.Host.Settings.convert().SiamuxAddr(),
+		ID:           types.FileContractID(c.FCID),
+		CreatedAt:    c.CreatedAt.UTC(),
+		HostAddress:  c.HostAddress,
+		HostIP:       hostIP,
+		HostIPSource: hostIPSource,
+		HostKey:      types.PublicKey(c.Host.PublicKey),
+		SiamuxAddr:   c.Host.Settings.convert().SiamuxAddr(),
 
 		RenewedFrom: types.FileContractID(c.RenewedFrom),
 		TotalCost:   types.Currency(c.TotalCost),
@@ -222,6 +363,7 @@ func (c dbContract) convert() api.ContractMetadata {
 			Downloads:   types.Currency(c.DownloadSpending),
 			FundAccount: types.Currency(c.FundAccountSpending),
 		},
+		Budget:         c.budget(),
 		ProofHeight:    c.ProofHeight,
 		RevisionHeight: c.RevisionHeight,
 		RevisionNumber: revisionNumber,
@@ -229,6 +371,56 @@ func (c dbContract) convert() api.ContractMetadata {
 		StartHeight:    c.StartHeight,
 		WindowStart:    c.WindowStart,
 		WindowEnd:      c.WindowEnd,
+
+		UploadedBytes:   c.UploadedBytes,
+		DownloadedBytes: c.DownloadedBytes,
+
+		SettingsSnapshot: c.settingsSnapshot(),
+	}
+}
+
+// netAddress returns the host's net address, falling back to the address the
+// contract was formed or renewed with if the host's address is unknown.
+func (c dbContract) netAddress() string {
+	if c.Host.NetAddress != "" {
+		return c.Host.NetAddress
+	}
+	return c.NetAddress
+}
+
+// settingsSnapshot returns the snapshot of the host settings the contract was
+// formed or renewed with, nil if there is none.
+func (c ContractCommon) settingsSnapshot() *api.HostSettingsSnapshot {
+	if c.SettingsSnapshot == nil {
+		return nil
+	}
+	return &api.HostSettingsSnapshot{
+		ContractPrice: types.Currency(c.SnapshotContractPrice),
+		StoragePrice:  types.Currency(c.SnapshotStoragePrice),
+		Data:          c.SettingsSnapshot,
+	}
+}
+
+// setSettingsSnapshot sets the snapshot of the host settings the contract was
+// formed or renewed with.
+func (c *ContractCommon) setSettingsSnapshot(snapshot *api.HostSettingsSnapshot) {
+	if snapshot == nil {
+		c.SettingsSnapshot = nil
+		c.SnapshotContractPrice = zeroCurrency
+		c.SnapshotStoragePrice = zeroCurrency
+		return
+	}
+	c.SettingsSnapshot = append([]byte{}, snapshot.Data...)
+	c.SnapshotContractPrice = currency(snapshot.ContractPrice)
+	c.SnapshotStoragePrice = currency(snapshot.StoragePrice)
+}
+
+// budget returns the contract's spending budget.
+func (c dbContract) budget() api.ContractSpending {
+	return api.ContractSpending{
+		Uploads:     types.Currency(c.UploadBudget),
+		Downloads:   types.Currency(c.DownloadBudget),
+		FundAccount: types.Currency(c.FundAccountBudget),
 	}
 }
 
@@ -393,10 +585,13 @@ func (s *SQLStore) ObjectsStats(ctx context.Context) (api.ObjectsStats, error) {
 	})
 }
 
-func (s *SQLStore) AddContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64) (_ api.ContractMetadata, err error) {
+func (s *SQLStore) AddContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, hostAddress string, snapshot *api.HostSettingsSnapshot) (_ api.ContractMetadata, err error) {
+	ctx, span := startSpan(ctx, "AddContract", attribute.Stringer("fcid", c.ID()))
+	defer func() { endSpan(span, err) }()
+
 	var added dbContract
-	if err = s.retryTransaction(func(tx *gorm.DB) error {
-		added, err = addContract(tx, c, totalCost, startHeight, types.FileContractID{})
+	if err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		added, err = addContract(tx, c, totalCost, startHeight, hostAddress, snapshot)
 		return err
 	}); err != nil {
 		return
@@ -406,14 +601,190 @@ func (s *SQLStore) AddContract(ctx context.Context, c rhpv2.ContractRevision, to
 	return added.convert(), nil
 }
 
-func (s *SQLStore) Contracts(ctx context.Context) ([]api.ContractMetadata, error) {
+func (s *SQLStore) Contracts(ctx context.Context) (_ []api.ContractMetadata, err error) {
+	ctx, span := startSpan(ctx, "Contracts")
+	defer func() { endSpan(span, err) }()
+
 	var dbContracts []dbContract
-	err := s.db.
+	err = s.db.WithContext(ctx).
 		Model(&dbContract{}).
-		Preload("Host").
+		Preload("Host", preloadContractHost).
+		Order("id").
+		Find(&dbContracts).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("contracts", len(dbContracts)))
+
+	contracts := make([]api.ContractMetadata, len(dbContracts))
+	for i, c := range dbContracts {
+		contracts[i] = c.convert()
+	}
+	return contracts, nil
+}
+
+// ExportContracts exports all active contracts in a format that can be
+// imported using ImportContracts.
+func (s *SQLStore) ExportContracts(ctx context.Context) (api.ContractsExport, error) {
+	var dbContracts []dbContract
+	err := s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Preload("Host", preloadContractHost).
+		Order("id").
 		Find(&dbContracts).
 		Error
 	if err != nil {
+		return api.ContractsExport{}, err
+	}
+
+	contracts := make([]api.ExportedContract, len(dbContracts))
+	for i, c := range dbContracts {
+		md := c.convert()
+		contracts[i] = api.ExportedContract{
+			ID:          md.ID,
+			CreatedAt:   md.CreatedAt,
+			HostAddress: md.HostAddress,
+			HostIP:      c.netAddress(),
+			HostKey:     md.HostKey,
+
+			ProofHeight:    md.ProofHeight,
+			RevisionHeight: md.RevisionHeight,
+			RevisionNumber: md.RevisionNumber,
+			Size:           md.Size,
+			StartHeight:    md.StartHeight,
+			WindowStart:    md.WindowStart,
+			WindowEnd:      md.WindowEnd,
+
+			RenewedFrom: md.RenewedFrom,
+			Spending:    md.Spending,
+			Budget:      md.Budget,
+			TotalCost:   md.TotalCost,
+
+			UploadedBytes:   md.UploadedBytes,
+			DownloadedBytes: md.DownloadedBytes,
+
+			SettingsSnapshot: md.SettingsSnapshot,
+		}
+	}
+	return api.ContractsExport{
+		Version:    api.ContractsExportVersion,
+		ExportedAt: time.Now().UTC(),
+		Contracts:  contracts,
+	}, nil
+}
+
+// ImportContracts recreates the contracts of an export created by
+// ExportContracts. Contracts that exist already, either as active or archived
+// contracts, are skipped and hosts that are unknown are created.
+func (s *SQLStore) ImportContracts(ctx context.Context, export api.ContractsExport) (resp api.ContractsImportResponse, err error) {
+	if export.Version != api.ContractsExportVersion {
+		return api.ContractsImportResponse{}, fmt.Errorf("unsupported export version %v, expected %v", export.Version, api.ContractsExportVersion)
+	}
+
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		resp = api.ContractsImportResponse{
+			Imported: make([]types.FileContractID, 0),
+			Skipped:  make([]types.FileContractID, 0),
+		}
+		for _, c := range export.Contracts {
+			// skip contracts that exist already
+			var count int64
+			if err := tx.Raw("SELECT COUNT(*) FROM contracts WHERE fcid = ?", fileContractID(c.ID)).Scan(&count).Error; err != nil {
+				return err
+			} else if count == 0 {
+				if err := tx.Raw("SELECT COUNT(*) FROM archived_contracts WHERE fcid = ?", fileContractID(c.ID)).Scan(&count).Error; err != nil {
+					return err
+				}
+			}
+			if count > 0 {
+				resp.Skipped = append(resp.Skipped, c.ID)
+				continue
+			}
+
+			// find the host or create it if it's unknown
+			var host dbHost
+			if err := tx.Where(&dbHost{PublicKey: publicKey(c.HostKey)}).Find(&host).Error; err != nil {
+				return err
+			} else if host.ID == 0 {
+				host = dbHost{PublicKey: publicKey(c.HostKey), NetAddress: c.HostIP}
+				if err := tx.Create(&host).Error; err != nil {
+					return err
+				}
+			}
+
+			// recreate the contract
+			contract := newContract(host.ID, c.ID, c.RenewedFrom, c.TotalCost, c.StartHeight, c.WindowStart, c.WindowEnd, c.RevisionNumber, c.Size)
+			contract.CreatedAt = c.CreatedAt.UTC()
+			contract.NetAddress = c.HostIP
+			contract.HostAddress = c.HostAddress
+			contract.ProofHeight = c.ProofHeight
+			contract.RevisionHeight = c.RevisionHeight
+			contract.UploadSpending = currency(c.Spending.Uploads)
+			contract.DownloadSpending = currency(c.Spending.Downloads)
+			contract.FundAccountSpending = currency(c.Spending.FundAccount)
+			contract.UploadBudget = currency(c.Budget.Uploads)
+			contract.DownloadBudget = currency(c.Budget.Downloads)
+			contract.FundAccountBudget = currency(c.Budget.FundAccount)
+			contract.UploadedBytes = c.UploadedBytes
+			contract.DownloadedBytes = c.DownloadedBytes
+			contract.setSettingsSnapshot(c.SettingsSnapshot)
+			if err := tx.Create(&contract).Error; err != nil {
+				return fmt.Errorf("failed to import contract %v: %w", c.ID, err)
+			}
+			resp.Imported = append(resp.Imported, c.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.ContractsImportResponse{}, err
+	}
+
+	for _, fcid := range resp.Imported {
+		s.addKnownContract(fcid)
+	}
+	return resp, nil
+}
+
+// ContractsForHost returns the active contracts with the given host. If a set is
+// given only the contracts in that set are returned.
+func (s *SQLStore) ContractsForHost(ctx context.Context, hk types.PublicKey, set string) ([]api.ContractMetadata, error) {
+	query := s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Joins("INNER JOIN hosts h ON h.id = contracts.host_id").
+		Where("h.public_key = ?", publicKey(hk))
+	query, err := joinContractSet(query, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbContracts []dbContract
+	if err := query.
+		Preload("Host").
+		Order("contracts.id").
+		Find(&dbContracts).
+		Error; err != nil {
+		return nil, err
+	}
+
+	contracts := make([]api.ContractMetadata, len(dbContracts))
+	for i, c := range dbContracts {
+		contracts[i] = c.convert()
+	}
+	return contracts, nil
+}
+
+// ContractsExpiringBefore returns the active contracts whose proof window
+// starts before the given height, sorted by window start.
+func (s *SQLStore) ContractsExpiringBefore(ctx context.Context, height uint64) ([]api.ContractMetadata, error) {
+	var dbContracts []dbContract
+	if err := s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Where("window_start < ?", height).
+		Preload("Host").
+		Order("window_start, id").
+		Find(&dbContracts).
+		Error; err != nil {
 		return nil, err
 	}
 
@@ -424,14 +795,118 @@ func (s *SQLStore) Contracts(ctx context.Context) ([]api.ContractMetadata, error
 	return contracts, nil
 }
 
+// ContractsToRenew returns a page of the active contracts whose proof window
+// starts within horizon blocks of the current height, sorted by window start.
+// Contracts whose window started already are included and flagged. If a set is
+// given only the contracts in that set are considered.
+func (s *SQLStore) ContractsToRenew(ctx context.Context, set string, currentHeight, horizon uint64, offset, limit int) ([]api.ContractToRenew, error) {
+	if limit <= -1 {
+		limit = math.MaxInt
+	}
+
+	query := s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Where("contracts.window_start <= ?", currentHeight+horizon)
+	query, err := joinContractSet(query, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbContracts []dbContract
+	if err := query.
+		Preload("Host", preloadContractHost).
+		Order("contracts.window_start, contracts.id").
+		Offset(offset).
+		Limit(limit).
+		Find(&dbContracts).
+		Error; err != nil {
+		return nil, err
+	}
+
+	contracts := make([]api.ContractToRenew, len(dbContracts))
+	for i, c := range dbContracts {
+		contracts[i] = api.ContractToRenew{
+			ContractMetadata: c.convert(),
+			PastWindowStart:  c.WindowStart <= currentHeight,
+		}
+	}
+	return contracts, nil
+}
+
+// ContractsPage returns a page of the contracts matching the given filter,
+// sorted by the filter's sort key. Contracts with equal sort keys are ordered
+// by the order in which they were added. The total number of contracts
+// matching the filter is returned alongside the page.
+func (s *SQLStore) ContractsPage(ctx context.Context, filter api.ContractsPageFilter) ([]api.ContractMetadata, int64, error) {
+	var order string
+	switch filter.SortBy {
+	case "":
+		order = "contracts.id"
+	case api.ContractSortStartHeight:
+		order = "contracts.start_height, contracts.id"
+	case api.ContractSortTotalCost:
+		// the total cost is stored as a decimal string, comparing the length
+		// first makes sure the strings are sorted numerically
+		order = "LENGTH(contracts.total_cost), contracts.total_cost, contracts.id"
+	case api.ContractSortHostKey:
+		order = "h.public_key, contracts.id"
+	default:
+		return nil, 0, fmt.Errorf("%w '%s'", api.ErrInvalidContractSortKey, filter.SortBy)
+	}
+
+	query := s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Joins("INNER JOIN hosts h ON h.id = contracts.host_id")
+	query, err := joinContractSet(query, filter.Set)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !filter.CreatedFrom.IsZero() {
+		query = query.Where("contracts.created_at >= ?", filter.CreatedFrom.UTC())
+	}
+	if !filter.CreatedTo.IsZero() {
+		query = query.Where("contracts.created_at < ?", filter.CreatedTo.UTC())
+	}
+
+	var total int64
+	if err := query.
+		Session(&gorm.Session{}).
+		Count(&total).
+		Error; err != nil {
+		return nil, 0, err
+	}
+
+	var dbContracts []dbContract
+	if err := query.
+		Preload("Host", preloadContractHost).
+		Order(order).
+		Offset(filter.Offset).
+		Limit(filter.Limit).
+		Find(&dbContracts).
+		Error; err != nil {
+		return nil, 0, err
+	}
+
+	contracts := make([]api.ContractMetadata, len(dbContracts))
+	for i, c := range dbContracts {
+		contracts[i] = c.convert()
+	}
+	return contracts, total, nil
+}
+
 // AddRenewedContract adds a new contract which was created as the result of a renewal to the store.
 // The old contract specified as 'renewedFrom' will be deleted from the active
 // contracts and moved to the archive. Both new and old contract will be linked
 // to each other through the RenewedFrom and RenewedTo fields respectively.
-func (s *SQLStore) AddRenewedContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID) (api.ContractMetadata, error) {
+func (s *SQLStore) AddRenewedContract(ctx context.Context, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID, snapshot *api.HostSettingsSnapshot) (_ api.ContractMetadata, err error) {
+	ctx, span := startSpan(ctx, "AddRenewedContract", attribute.Stringer("fcid", c.ID()), attribute.Stringer("renewedFrom", renewedFrom))
+	defer func() { endSpan(span, err) }()
+
 	var renewed dbContract
+	var changes []api.ContractSetChange
+	if err := s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		changes = changes[:0]
 
-	if err := s.retryTransaction(func(tx *gorm.DB) error {
 		// Fetch contract we renew from.
 		oldContract, err := contract(tx, fileContractID(renewedFrom))
 		if err != nil {
@@ -440,9 +915,12 @@ func (s *SQLStore) AddRenewedContract(ctx context.Context, c rhpv2.ContractRevis
 
 		// Create copy in archive.
 		err = tx.Create(&dbArchivedContract{
-			Host:      publicKey(oldContract.Host.PublicKey),
-			Reason:    api.ContractArchivalReasonRenewed,
-			RenewedTo: fileContractID(c.ID()),
+			Model:      Model{CreatedAt: oldContract.CreatedAt.UTC()},
+			ArchivedAt: time.Now().UTC(),
+			Host:       publicKey(oldContract.Host.PublicKey),
+			NetAddress: oldContract.netAddress(),
+			Reason:     api.ContractArchivalReasonRenewed,
+			RenewedTo:  fileContractID(c.ID()),
 
 			ContractCommon: oldContract.ContractCommon,
 		}).Error
@@ -450,13 +928,40 @@ func (s *SQLStore) AddRenewedContract(ctx context.Context, c rhpv2.ContractRevis
 			return err
 		}
 
-		// Overwrite the old contract with the new one.
-		newContract := newContract(oldContract.HostID, c.ID(), renewedFrom, totalCost, startHeight, c.Revision.WindowStart, c.Revision.WindowEnd)
-		newContract.Model = oldContract.Model
+		// Record the renewal in the sets the contract is part of.
+		sets, err := contractSetNames(tx, oldContract.ID)
+		if err != nil {
+			return err
+		}
+		for _, set := range sets {
+			change := api.ContractSetChange{
+				Name:    set,
+				Added:   []types.FileContractID{c.ID()},
+				Removed: []types.FileContractID{renewedFrom},
+			}
+			if err := recordContractSetChanges(tx, set, change.Added, change.Removed, api.ContractSetChangeReasonRenewed); err != nil {
+				return err
+			} else if change.Size, err = contractSetSize(tx, set); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+
+		// Overwrite the old contract with the new one, keeping the old
+		// contract's net address if the host's address is unknown.
+		newContract := newContract(oldContract.HostID, c.ID(), renewedFrom, totalCost, startHeight, c.Revision.WindowStart, c.Revision.WindowEnd, c.Revision.RevisionNumber, c.Revision.Filesize)
+		newContract.ID = oldContract.ID
+		newContract.NetAddress = oldContract.netAddress()
+		newContract.HostAddress = oldContract.HostAddress
+		newContract.UploadBudget = oldContract.UploadBudget
+		newContract.DownloadBudget = oldContract.DownloadBudget
+		newContract.FundAccountBudget = oldContract.FundAccountBudget
+		newContract.setSettingsSnapshot(snapshot)
 		err = tx.Save(&newContract).Error
 		if err != nil {
 			return err
 		}
+		newContract.Host = oldContract.Host
 
 		s.addKnownContract(c.ID())
 		renewed = newContract
@@ -464,137 +969,1218 @@ func (s *SQLStore) AddRenewedContract(ctx context.Context, c rhpv2.ContractRevis
 	}); err != nil {
 		return api.ContractMetadata{}, err
 	}
+	s.notifyContractSetChanges(changes)
 
 	return renewed.convert(), nil
 }
 
+// AncestorContracts returns the archived contracts the given contract was
+// renewed from, starting with its direct ancestor. Only ancestors with a start
+// height of at least startHeight are returned. Renewal links are followed one
+// level at a time, loops in the links are ignored.
 func (s *SQLStore) AncestorContracts(ctx context.Context, id types.FileContractID, startHeight uint64) ([]api.ArchivedContract, error) {
-	var ancestors []dbArchivedContract
-	err := s.db.Raw("WITH RECURSIVE ancestors AS (SELECT * FROM archived_contracts WHERE renewed_to = ? UNION ALL SELECT archived_contracts.* FROM ancestors, archived_contracts WHERE archived_contracts.renewed_to = ancestors.fcid) SELECT * FROM ancestors WHERE start_height >= ?", fileContractID(id), startHeight).
-		Scan(&ancestors).
-		Error
-	if err != nil {
-		return nil, err
-	}
-	contracts := make([]api.ArchivedContract, len(ancestors))
-	for i, ancestor := range ancestors {
-		contracts[i] = ancestor.convert()
-	}
-	return contracts, nil
+	return s.ancestorContracts(ctx, id, startHeight, maxAncestorDepth)
 }
 
-func (s *SQLStore) ArchiveContract(ctx context.Context, id types.FileContractID, reason string) error {
-	return s.ArchiveContracts(ctx, map[types.FileContractID]string{id: reason})
-}
+func (s *SQLStore) ancestorContracts(ctx context.Context, id types.FileContractID, startHeight uint64, maxDepth int) ([]api.ArchivedContract, error) {
+	visited := map[types.FileContractID]struct{}{id: {}}
+	var contracts []api.ArchivedContract
+	for depth, renewedTo := 0, []fileContractID{fileContractID(id)}; len(renewedTo) > 0; depth++ {
+		var ancestors []dbArchivedContract
+		if err := s.db.
+			WithContext(ctx).
+			Where("renewed_to IN (?)", renewedTo).
+			Order("id").
+			Find(&ancestors).
+			Error; err != nil {
+			return nil, err
+		} else if len(ancestors) > 0 && depth == maxDepth {
+			return nil, fmt.Errorf("%w: %v has more than %v", ErrAncestorDepthExceeded, id, maxDepth)
+		}
 
-func (s *SQLStore) ArchiveContracts(ctx context.Context, toArchive map[types.FileContractID]string) error {
-	// fetch ids
-	var ids []types.FileContractID
-	for id := range toArchive {
-		ids = append(ids, id)
+		renewedTo = renewedTo[:0]
+		for _, ancestor := range ancestors {
+			if _, ok := visited[types.FileContractID(ancestor.FCID)]; ok {
+				continue // loop
+			}
+			visited[types.FileContractID(ancestor.FCID)] = struct{}{}
+			renewedTo = append(renewedTo, ancestor.FCID)
+			if ancestor.StartHeight >= startHeight {
+				contracts = append(contracts, ancestor.convert())
+			}
+		}
 	}
+	return contracts, nil
+}
 
-	// fetch contracts
-	cs, err := contracts(s.db, ids)
+// RenewalChainSpending returns the summed spending and total cost of the active
+// contract with the given id and all of its ancestors.
+func (s *SQLStore) RenewalChainSpending(ctx context.Context, id types.FileContractID) (api.RenewalChainSpending, error) {
+	c, err := s.contract(ctx, fileContractID(id))
 	if err != nil {
-		return err
+		return api.RenewalChainSpending{}, err
 	}
-
-	// archive them
-	if err := s.retryTransaction(func(tx *gorm.DB) error {
-		return archiveContracts(tx, cs, toArchive)
-	}); err != nil {
-		return err
+	ancestors, err := s.AncestorContracts(ctx, id, 0)
+	if err != nil {
+		return api.RenewalChainSpending{}, err
+	}
+
+	contract := c.convert()
+	res := api.RenewalChainSpending{
+		ID:               id,
+		Contracts:        len(ancestors) + 1,
+		FirstStartHeight: contract.StartHeight,
+		TotalCost:        contract.TotalCost,
+		Spending:         contract.Spending,
+	}
+	for _, ancestor := range ancestors {
+		var overflow bool
+		res.TotalCost, overflow = res.TotalCost.AddWithOverflow(ancestor.TotalCost)
+		if overflow {
+			return api.RenewalChainSpending{}, api.ErrCurrencyOverflow
+		}
+		res.Spending, err = addContractSpending(res.Spending, ancestor.Spending)
+		if err != nil {
+			return api.RenewalChainSpending{}, err
+		}
+		if ancestor.StartHeight < res.FirstStartHeight {
+			res.FirstStartHeight = ancestor.StartHeight
+		}
 	}
-
-	return nil
+	return res, nil
 }
 
-func (s *SQLStore) ArchiveAllContracts(ctx context.Context, reason string) error {
-	// fetch contract ids
-	var fcids []fileContractID
-	if err := s.db.
-		Model(&dbContract{}).
-		Pluck("fcid", &fcids).
-		Error; err != nil {
-		return err
+// ArchivedContracts returns the archived contracts matching the given filter,
+// sorted by start height in descending order.
+func (s *SQLStore) ArchivedContracts(ctx context.Context, filter api.ArchivedContractsFilter) ([]api.ArchivedContract, error) {
+	limit := filter.Limit
+	if limit <= -1 {
+		limit = math.MaxInt
 	}
 
-	// create map
-	toArchive := make(map[types.FileContractID]string)
-	for _, fcid := range fcids {
-		toArchive[types.FileContractID(fcid)] = reason
+	query := s.db.WithContext(ctx).Model(&dbArchivedContract{})
+	if filter.HostKey != (types.PublicKey{}) {
+		query = query.Where("host = ?", publicKey(filter.HostKey))
 	}
-
-	return s.ArchiveContracts(ctx, toArchive)
-}
-
-func (s *SQLStore) Contract(ctx context.Context, id types.FileContractID) (api.ContractMetadata, error) {
-	contract, err := s.contract(ctx, fileContractID(id))
-	if err != nil {
-		return api.ContractMetadata{}, err
+	if filter.Reason != "" {
+		query = query.Where("reason = ?", filter.Reason)
+	}
+	if filter.MinStartHeight > 0 {
+		query = query.Where("start_height >= ?", filter.MinStartHeight)
+	}
+	if filter.MaxStartHeight > 0 {
+		query = query.Where("start_height <= ?", filter.MaxStartHeight)
+	}
+	if !filter.ArchivedFrom.IsZero() {
+		query = query.Where("archived_at >= ?", filter.ArchivedFrom.UTC())
+	}
+	if !filter.ArchivedTo.IsZero() {
+		query = query.Where("archived_at < ?", filter.ArchivedTo.UTC())
 	}
-	return contract.convert(), nil
-}
 
-func (s *SQLStore) ContractSetContracts(ctx context.Context, set string) ([]api.ContractMetadata, error) {
-	dbContracts, err := s.contracts(ctx, set)
+	var archived []dbArchivedContract
+	err := query.
+		Order("start_height DESC, id DESC").
+		Offset(filter.Offset).
+		Limit(limit).
+		Find(&archived).
+		Error
 	if err != nil {
 		return nil, err
 	}
-	contracts := make([]api.ContractMetadata, len(dbContracts))
-	for i, c := range dbContracts {
+
+	contracts := make([]api.ArchivedContract, len(archived))
+	for i, c := range archived {
 		contracts[i] = c.convert()
 	}
 	return contracts, nil
 }
 
-func (s *SQLStore) ContractSets(ctx context.Context) ([]string, error) {
-	var sets []string
-	err := s.db.Raw("SELECT name FROM contract_sets").
-		Scan(&sets).
+// ArchivedContract returns the archived contract with the given id.
+func (s *SQLStore) ArchivedContract(ctx context.Context, id types.FileContractID) (api.ArchivedContract, error) {
+	var archived []dbArchivedContract
+	err := s.db.
+		WithContext(ctx).
+		Where("fcid = ?", fileContractID(id)).
+		Limit(1).
+		Find(&archived).
 		Error
-	return sets, err
+	if err != nil {
+		return api.ArchivedContract{}, err
+	} else if len(archived) == 0 {
+		return api.ArchivedContract{}, fmt.Errorf("%w %v", ErrArchivedContractNotFound, id)
+	}
+	return archived[0].convert(), nil
 }
 
-func (s *SQLStore) SetContractSet(ctx context.Context, name string, contractIds []types.FileContractID) error {
-	fcids := make([]fileContractID, len(contractIds))
-	for i, fcid := range contractIds {
-		fcids[i] = fileContractID(fcid)
+// PruneArchivedContracts deletes all archived contracts with a start height
+// below the given height and returns the number of contracts pruned. If
+// preserveChains is true, archived contracts that are part of a renewal chain
+// ending in an active contract are kept.
+func (s *SQLStore) PruneArchivedContracts(ctx context.Context, minStartHeight uint64, preserveChains bool) (int64, error) {
+	return s.pruneArchivedContracts(ctx, minStartHeight, preserveChains, archivedContractsPruneBatchSize)
+}
+
+func (s *SQLStore) pruneArchivedContracts(ctx context.Context, minStartHeight uint64, preserveChains bool, batchSize int) (int64, error) {
+	return s.pruneInBatches(ctx, batchSize, func(tx *gorm.DB) (ids []uint, err error) {
+		if preserveChains {
+			chained, err := chainedArchivedContracts(tx, maxAncestorDepth)
+			if err != nil {
+				return nil, err
+			}
+			for after := uint(0); len(ids) < batchSize; {
+				var candidates []uint
+				if err := tx.
+					Model(&dbArchivedContract{}).
+					Where("start_height < ? AND id > ?", minStartHeight, after).
+					Order("id").
+					Limit(batchSize).
+					Pluck("id", &candidates).
+					Error; err != nil {
+					return nil, err
+				} else if len(candidates) == 0 {
+					break
+				}
+				for _, id := range candidates {
+					if _, ok := chained[id]; !ok && len(ids) < batchSize {
+						ids = append(ids, id)
+					}
+				}
+				after = candidates[len(candidates)-1]
+			}
+		} else if err := tx.
+			Model(&dbArchivedContract{}).
+			Where("start_height < ?", minStartHeight).
+			Order("id").
+			Limit(batchSize).
+			Pluck("id", &ids).
+			Error; err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+
+		// delete their spending history before the contracts are deleted
+		if err := tx.
+			Where("fcid IN (?)", tx.Model(&dbArchivedContract{}).Select("fcid").Where("id IN (?)", ids)).
+			Delete(&dbContractSpendingPeriod{}).
+			Error; err != nil {
+			return nil, err
+		}
+		return ids, nil
+	}, &dbArchivedContract{})
+}
+
+// pruneInBatches deletes rows of the given model in batches of batchSize, every
+// batch in its own transaction, and returns the number of rows deleted. The ids
+// of a batch are fetched with fetchIDs before deleting them since MySQL doesn't
+// support LIMIT in subqueries. Pruning stops once a batch is smaller than
+// batchSize.
+func (s *SQLStore) pruneInBatches(ctx context.Context, batchSize int, fetchIDs func(tx *gorm.DB) ([]uint, error), model interface{}) (pruned int64, err error) {
+	for {
+		var n int64
+		err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+			ids, err := fetchIDs(tx)
+			if err != nil {
+				return err
+			} else if len(ids) == 0 {
+				n = 0
+				return nil
+			}
+
+			res := tx.Where("id IN (?)", ids).Delete(model)
+			n = res.RowsAffected
+			return res.Error
+		})
+		if err != nil {
+			return
+		}
+		pruned += n
+		if n < int64(batchSize) {
+			return
+		}
+	}
+}
+
+// chainedArchivedContracts returns the ids of the archived contracts that are
+// part of a renewal chain ending in an active contract. The chains are walked
+// backwards from the active contracts one level at a time, loops in the renewal
+// links are ignored.
+func chainedArchivedContracts(tx *gorm.DB, maxDepth int) (map[uint]struct{}, error) {
+	type link struct {
+		ID   uint
+		FCID fileContractID
+	}
+	var links []link
+	if err := tx.
+		Raw("SELECT ac.id, ac.fcid FROM archived_contracts ac INNER JOIN contracts c ON c.fcid = ac.renewed_to").
+		Scan(&links).
+		Error; err != nil {
+		return nil, err
+	}
+
+	chained := make(map[uint]struct{})
+	visited := make(map[fileContractID]struct{})
+	for depth := 0; ; depth++ {
+		var renewedTo []fileContractID
+		for _, l := range links {
+			if _, ok := visited[l.FCID]; ok {
+				continue // loop
+			}
+			visited[l.FCID] = struct{}{}
+			chained[l.ID] = struct{}{}
+			renewedTo = append(renewedTo, l.FCID)
+		}
+		if len(renewedTo) == 0 {
+			return chained, nil
+		} else if depth == maxDepth {
+			return nil, fmt.Errorf("%w: renewal chain has more than %v archived contracts", ErrAncestorDepthExceeded, maxDepth)
+		}
+
+		links = links[:0]
+		for i := 0; i < len(renewedTo); i += maxSQLVars {
+			end := i + maxSQLVars
+			if end > len(renewedTo) {
+				end = len(renewedTo)
+			}
+			var batch []link
+			if err := tx.
+				Model(&dbArchivedContract{}).
+				Select("id, fcid").
+				Where("renewed_to IN (?)", renewedTo[i:end]).
+				Scan(&batch).
+				Error; err != nil {
+				return nil, err
+			}
+			links = append(links, batch...)
+		}
+	}
+}
+
+// RenewalChain returns the renewal chain the contract with the given id is
+// part of, ordered from the oldest to the most recent contract. The chain
+// contains both active and archived contracts. If a contract in the chain
+// refers to a contract that can't be found, the chain found so far is returned
+// and truncated is set to true. If the contract was renewed more than
+// maxDescendantDepth times, ErrDescendantDepthExceeded is returned.
+func (s *SQLStore) RenewalChain(ctx context.Context, id types.FileContractID) (chain []api.RenewalChainEntry, truncated bool, err error) {
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		chain, truncated = nil, false
+
+		// fetch the contract itself
+		entry, found, err := renewalChainEntry(tx, id)
+		if err != nil {
+			return err
+		} else if !found {
+			return fmt.Errorf("%w %v", ErrContractNotFound, id)
+		}
+		visited := map[types.FileContractID]struct{}{id: {}}
+
+		// walk backwards
+		var ancestors []api.RenewalChainEntry
+		for cur := entry; cur.RenewedFrom != (types.FileContractID{}); {
+			if _, ok := visited[cur.RenewedFrom]; ok {
+				break // sanity check against loops
+			}
+			next, found, err := renewalChainEntry(tx, cur.RenewedFrom)
+			if err != nil {
+				return err
+			} else if !found {
+				truncated = true
+				break
+			}
+			visited[next.ID] = struct{}{}
+			ancestors = append(ancestors, next)
+			cur = next
+		}
+		for i := len(ancestors) - 1; i >= 0; i-- {
+			chain = append(chain, ancestors[i])
+		}
+		chain = append(chain, entry)
+
+		// walk forwards
+		dangling, err := followRenewals(tx, entry, visited, maxDescendantDepth, func(next api.RenewalChainEntry) bool {
+			chain = append(chain, next)
+			return true
+		})
+		truncated = truncated || dangling
+		return err
+	})
+	return
+}
+
+// ContractRenewedFrom returns the active or archived contract that was renewed
+// from the contract with the given id.
+func (s *SQLStore) ContractRenewedFrom(ctx context.Context, id types.FileContractID) (api.RenewalChainEntry, error) {
+	entry, found, err := renewalChainSuccessor(s.db.WithContext(ctx), id)
+	if err != nil {
+		return api.RenewalChainEntry{}, err
+	} else if !found {
+		return api.RenewalChainEntry{}, fmt.Errorf("%w renewed from %v", ErrContractNotFound, id)
+	}
+	return entry, nil
+}
+
+// Descendant returns the active contract the contract with the given id was
+// eventually renewed into by following its renewals. If the renewals end before
+// an active contract is reached, the last archived contract is returned and
+// DeadEnd is set. Loops in the renewals are treated as a dead end.
+func (s *SQLStore) Descendant(ctx context.Context, id types.FileContractID) (api.ContractDescendant, error) {
+	return s.descendant(ctx, id, maxDescendantDepth)
+}
+
+func (s *SQLStore) descendant(ctx context.Context, id types.FileContractID, maxDepth int) (d api.ContractDescendant, err error) {
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		d = api.ContractDescendant{}
+
+		// fetch the contract itself
+		last, found, err := renewalChainEntry(tx, id)
+		if err != nil {
+			return err
+		} else if !found {
+			return fmt.Errorf("%w %v", ErrContractNotFound, id)
+		}
+
+		// follow the renewals until we reach an active contract
+		if last.Archived {
+			visited := map[types.FileContractID]struct{}{id: {}}
+			if _, err := followRenewals(tx, last, visited, maxDepth, func(next api.RenewalChainEntry) bool {
+				d.Renewals++
+				last = next
+				return last.Archived
+			}); err != nil {
+				return err
+			}
+		}
+
+		// fetch the contract the renewals ended in
+		if !last.Archived {
+			var c dbContract
+			if err := tx.
+				Where("fcid = ?", fileContractID(last.ID)).
+				Preload("Host").
+				Take(&c).
+				Error; err != nil {
+				return err
+			}
+			contract := c.convert()
+			d.Contract = &contract
+			return nil
+		}
+		var ac dbArchivedContract
+		if err := tx.
+			Where("fcid = ?", fileContractID(last.ID)).
+			Take(&ac).
+			Error; err != nil {
+			return err
+		}
+		archived := ac.convert()
+		d.Archived = &archived
+		d.DeadEnd = true
+		return nil
+	})
+	return
+}
+
+func (s *SQLStore) ArchiveContract(ctx context.Context, id types.FileContractID, reason string) error {
+	return s.ArchiveContracts(ctx, map[types.FileContractID]string{id: reason})
+}
+
+func (s *SQLStore) ArchiveContracts(ctx context.Context, toArchive map[types.FileContractID]string) (err error) {
+	ctx, span := startSpan(ctx, "ArchiveContracts", attribute.Int("contracts", len(toArchive)))
+	defer func() { endSpan(span, err) }()
+
+	// fetch ids
+	var ids []types.FileContractID
+	for id := range toArchive {
+		ids = append(ids, id)
+	}
+
+	var changes []api.ContractSetChange
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		// fetch contracts
+		cs, err := contracts(tx, ids)
+		if err != nil {
+			return err
+		}
+
+		// archive them
+		changes, err = archiveContracts(tx, cs, toArchive)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyContractSetChanges(changes)
+	return nil
+}
+
+// RemoveContracts archives the active contracts with the given ids using the
+// given reason, defaulting to the contracts being removed, and removes them
+// from their contract sets. Ids that don't belong to an active contract, e.g.
+// because the contract was archived already, are skipped and returned.
+func (s *SQLStore) RemoveContracts(ctx context.Context, ids []types.FileContractID, reason string) (removed, unknown []types.FileContractID, err error) {
+	if reason == "" {
+		reason = api.ContractArchivalReasonRemoved
+	}
+	fcids := make([]fileContractID, len(ids))
+	for i, fcid := range ids {
+		fcids[i] = fileContractID(fcid)
+	}
+
+	var changes []api.ContractSetChange
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		removed, unknown = nil, nil
+
+		// fetch contracts
+		var dbContracts []dbContract
+		if err := tx.
+			Where("fcid IN (?)", fcids).
+			Preload("Host").
+			Find(&dbContracts).
+			Error; err != nil {
+			return err
+		}
+
+		// archive the ones that were found
+		toArchive := make(map[types.FileContractID]string, len(dbContracts))
+		for _, c := range dbContracts {
+			toArchive[types.FileContractID(c.FCID)] = reason
+		}
+		seen := make(map[types.FileContractID]struct{}, len(ids))
+		for _, fcid := range ids {
+			if _, ok := seen[fcid]; ok {
+				continue
+			}
+			seen[fcid] = struct{}{}
+			if _, ok := toArchive[fcid]; ok {
+				removed = append(removed, fcid)
+			} else {
+				unknown = append(unknown, fcid)
+			}
+		}
+		changes, err = archiveContracts(tx, dbContracts, toArchive)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	s.notifyContractSetChanges(changes)
+	return
+}
+
+// ArchiveContractsForHost archives all active contracts with the given host
+// and returns their ids. If no reason is given, the contracts are archived
+// because the host was blocked.
+func (s *SQLStore) ArchiveContractsForHost(ctx context.Context, hk types.PublicKey, reason string) (archived []types.FileContractID, err error) {
+	if reason == "" {
+		reason = api.ContractArchivalReasonHostBlocked
+	}
+	var changes []api.ContractSetChange
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		archived = nil
+
+		// fetch the host
+		var host dbHost
+		err := tx.
+			Where(&dbHost{PublicKey: publicKey(hk)}).
+			Take(&host).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrHostNotFound
+		} else if err != nil {
+			return err
+		}
+
+		// fetch its contracts
+		hcs, err := contractsForHost(tx, host)
+		if err != nil {
+			return err
+		}
+
+		// archive them
+		toArchive := make(map[types.FileContractID]string)
+		for _, c := range hcs {
+			toArchive[types.FileContractID(c.FCID)] = reason
+			archived = append(archived, types.FileContractID(c.FCID))
+		}
+		changes, err = archiveContracts(tx, hcs, toArchive)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.notifyContractSetChanges(changes)
+	return
+}
+
+func (s *SQLStore) ArchiveAllContracts(ctx context.Context, reason string) error {
+	// fetch contract ids
+	var fcids []fileContractID
+	if err := s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Pluck("fcid", &fcids).
+		Error; err != nil {
+		return err
+	}
+
+	// create map
+	toArchive := make(map[types.FileContractID]string)
+	for _, fcid := range fcids {
+		toArchive[types.FileContractID(fcid)] = reason
+	}
+
+	return s.ArchiveContracts(ctx, toArchive)
+}
+
+func (s *SQLStore) Contract(ctx context.Context, id types.FileContractID) (_ api.ContractMetadata, err error) {
+	ctx, span := startSpan(ctx, "Contract", attribute.Stringer("fcid", id))
+	defer func() { endSpan(span, err) }()
+
+	contract, err := s.contract(ctx, fileContractID(id))
+	if err != nil {
+		return api.ContractMetadata{}, err
+	}
+	return contract.convert(), nil
+}
+
+// ContractSize returns the number of sectors stored in the contract with the
+// given id and the amount of data they make up.
+func (s *SQLStore) ContractSize(ctx context.Context, id types.FileContractID) (api.ContractSize, error) {
+	sizes, err := s.contractSizes(ctx, s.db.WithContext(ctx).Where("c.fcid = ?", fileContractID(id)))
+	if err != nil {
+		return api.ContractSize{}, err
+	} else if len(sizes) == 0 {
+		return api.ContractSize{}, fmt.Errorf("%w %v", ErrContractNotFound, id)
+	}
+	return sizes[0], nil
+}
+
+// ContractRoots returns a page of the roots of the sectors stored in the
+// contract with the given id, ordered by the time they were first stored.
+// ContractSize can be used to fetch the number of roots without fetching the
+// roots themselves.
+func (s *SQLStore) ContractRoots(ctx context.Context, id types.FileContractID, offset, limit int) ([]types.Hash256, error) {
+	if limit <= -1 {
+		limit = math.MaxInt
+	}
+
+	var roots []types.Hash256
+	err := s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		c, err := contract(tx, fileContractID(id))
+		if err != nil {
+			return err
+		}
+
+		var rows [][]byte
+		if err := tx.
+			Table("contract_sectors cs").
+			Joins("INNER JOIN sectors s ON s.id = cs.db_sector_id").
+			Where("cs.db_contract_id = ?", c.ID).
+			Order("cs.db_sector_id").
+			Offset(offset).
+			Limit(limit).
+			Pluck("s.root", &rows).
+			Error; err != nil {
+			return err
+		}
+
+		roots = make([]types.Hash256, len(rows))
+		for i, root := range rows {
+			if len(root) != len(types.Hash256{}) {
+				return fmt.Errorf("sector root has invalid length %v", len(root))
+			}
+			copy(roots[i][:], root)
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// ContractSizes returns the number of sectors stored in every active contract
+// and the amount of data they make up.
+func (s *SQLStore) ContractSizes(ctx context.Context) ([]api.ContractSize, error) {
+	return s.contractSizes(ctx, s.db.WithContext(ctx))
+}
+
+func (s *SQLStore) contractSizes(ctx context.Context, query *gorm.DB) ([]api.ContractSize, error) {
+	var rows []struct {
+		FCID    fileContractID `gorm:"column:fcid"`
+		Sectors uint64
+	}
+	if err := query.
+		Table("contracts c").
+		Select("c.fcid as fcid, COUNT(cs.db_sector_id) as sectors").
+		Joins("LEFT JOIN contract_sectors cs ON cs.db_contract_id = c.id").
+		Group("c.id").
+		Order("c.id").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, err
+	}
+
+	sizes := make([]api.ContractSize, len(rows))
+	for i, row := range rows {
+		sizes[i] = api.ContractSize{
+			ID:      types.FileContractID(row.FCID),
+			Sectors: row.Sectors,
+			Size:    row.Sectors * rhpv2.SectorSize,
+		}
+	}
+	return sizes, nil
+}
+
+// ContractPrunableData returns the number of sectors stored in the contract
+// with the given id that are no longer referenced by a slab.
+func (s *SQLStore) ContractPrunableData(ctx context.Context, id types.FileContractID) (api.ContractPrunableData, error) {
+	data, err := s.contractsPrunableData(ctx, s.db.WithContext(ctx).Where("c.fcid = ?", fileContractID(id)))
+	if err != nil {
+		return api.ContractPrunableData{}, err
+	} else if len(data) == 0 {
+		return api.ContractPrunableData{}, fmt.Errorf("%w %v", ErrContractNotFound, id)
+	}
+	return data[0], nil
+}
+
+// ContractsPrunableData returns the number of sectors stored in every active
+// contract that are no longer referenced by a slab.
+func (s *SQLStore) ContractsPrunableData(ctx context.Context) ([]api.ContractPrunableData, error) {
+	return s.contractsPrunableData(ctx, s.db.WithContext(ctx))
+}
+
+func (s *SQLStore) contractsPrunableData(ctx context.Context, query *gorm.DB) ([]api.ContractPrunableData, error) {
+	var rows []struct {
+		FCID     fileContractID `gorm:"column:fcid"`
+		Sectors  uint64
+		Prunable uint64
+	}
+	if err := query.
+		Table("contracts c").
+		Select("c.fcid as fcid, COUNT(cs.db_sector_id) as sectors, COALESCE(SUM(CASE WHEN cs.db_sector_id IS NOT NULL AND sla.id IS NULL THEN 1 ELSE 0 END), 0) as prunable").
+		Joins("LEFT JOIN contract_sectors cs ON cs.db_contract_id = c.id").
+		Joins("LEFT JOIN sectors sec ON sec.id = cs.db_sector_id").
+		Joins("LEFT JOIN slabs sla ON sla.id = sec.db_slab_id").
+		Group("c.id").
+		Order("c.id").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, err
+	}
+
+	data := make([]api.ContractPrunableData, len(rows))
+	for i, row := range rows {
+		data[i] = api.ContractPrunableData{
+			ID:       types.FileContractID(row.FCID),
+			Sectors:  row.Sectors,
+			Prunable: row.Prunable,
+			Size:     row.Prunable * rhpv2.SectorSize,
+		}
+	}
+	return data, nil
+}
+
+func (s *SQLStore) ContractSetContracts(ctx context.Context, set string) (_ []api.ContractMetadata, err error) {
+	ctx, span := startSpan(ctx, "ContractSetContracts", attribute.String("set", set))
+	defer func() { endSpan(span, err) }()
+
+	dbContracts, err := s.contracts(ctx, set)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("contracts", len(dbContracts)))
+	contracts := make([]api.ContractMetadata, len(dbContracts))
+	for i, c := range dbContracts {
+		contracts[i] = c.convert()
+	}
+	return contracts, nil
+}
+
+// ContractSets returns all contract sets together with the number of contracts
+// they contain. The virtual set containing all active contracts is returned
+// first.
+func (s *SQLStore) ContractSets(ctx context.Context) ([]api.ContractSet, error) {
+	var sets []api.ContractSet
+	err := s.db.WithContext(ctx).
+		Raw(`SELECT cs.name AS name, COUNT(csc.db_contract_id) AS contracts
+FROM contract_sets cs
+LEFT JOIN contract_set_contracts csc ON csc.db_contract_set_id = cs.id
+GROUP BY cs.id, cs.name
+ORDER BY cs.name ASC`).
+		Scan(&sets).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := s.db.WithContext(ctx).Model(&dbContract{}).Count(&total).Error; err != nil {
+		return nil, err
+	}
+	return append([]api.ContractSet{{
+		Name:      api.ContractSetAll,
+		Contracts: total,
+		Virtual:   true,
+	}}, sets...), nil
+}
+
+// ContractsSummary returns the number of active and archived contracts, the
+// number of contracts in every contract set and the total cost, spending and
+// height range of the active contracts. The number of locked contracts isn't
+// known to the store and is left at zero.
+func (s *SQLStore) ContractsSummary(ctx context.Context) (summary api.ContractsSummary, err error) {
+	var active struct {
+		Count           int64
+		MinStartHeight  uint64
+		MaxWindowEnd    uint64
+		UploadedBytes   uint64
+		DownloadedBytes uint64
+	}
+	if err := s.db.
+		WithContext(ctx).
+		Raw("SELECT COUNT(*) AS count, COALESCE(MIN(start_height), 0) AS min_start_height, COALESCE(MAX(window_end), 0) AS max_window_end, COALESCE(SUM(uploaded_bytes), 0) AS uploaded_bytes, COALESCE(SUM(downloaded_bytes), 0) AS downloaded_bytes FROM contracts").
+		Scan(&active).
+		Error; err != nil {
+		return api.ContractsSummary{}, err
+	}
+	summary.Active = active.Count
+	summary.MinStartHeight = active.MinStartHeight
+	summary.MaxWindowEnd = active.MaxWindowEnd
+	summary.UploadedBytes = active.UploadedBytes
+	summary.DownloadedBytes = active.DownloadedBytes
+
+	if err := s.db.
+		WithContext(ctx).
+		Model(&dbArchivedContract{}).
+		Count(&summary.Archived).
+		Error; err != nil {
+		return api.ContractsSummary{}, err
+	}
+
+	summary.Sets, err = s.ContractSets(ctx)
+	if err != nil {
+		return api.ContractsSummary{}, err
+	}
+
+	// currencies are stored as strings so they are summed up here rather
+	// than in the query
+	var costs []struct {
+		TotalCost           currency
+		UploadSpending      currency
+		DownloadSpending    currency
+		FundAccountSpending currency
+	}
+	if err := s.db.
+		WithContext(ctx).
+		Model(&dbContract{}).
+		Select("total_cost, upload_spending, download_spending, fund_account_spending").
+		Find(&costs).
+		Error; err != nil {
+		return api.ContractsSummary{}, err
+	}
+	for _, c := range costs {
+		var overflow bool
+		summary.TotalCost, overflow = summary.TotalCost.AddWithOverflow(types.Currency(c.TotalCost))
+		if overflow {
+			return api.ContractsSummary{}, api.ErrCurrencyOverflow
+		}
+		summary.Spending, err = addContractSpending(summary.Spending, api.ContractSpending{
+			Uploads:     types.Currency(c.UploadSpending),
+			Downloads:   types.Currency(c.DownloadSpending),
+			FundAccount: types.Currency(c.FundAccountSpending),
+		})
+		if err != nil {
+			return api.ContractsSummary{}, err
+		}
+	}
+	return summary, nil
+}
+
+// SetContractSet updates the contract set with the given name to contain
+// exactly the given contracts, creating it if it doesn't exist yet. Only the
+// memberships that changed are updated and the contracts that were added to
+// and removed from the set are returned. If any of the given contracts can't
+// be found an api.MissingContractsError is returned, unless allowMissing is
+// set, in which case the set is updated without them and the missing
+// contracts are returned.
+func (s *SQLStore) SetContractSet(ctx context.Context, name string, contractIds []types.FileContractID, allowMissing bool) (added, removed, missing []types.FileContractID, err error) {
+	ctx, span := startSpan(ctx, "SetContractSet", attribute.String("set", name), attribute.Int("contracts", len(contractIds)))
+	defer func() {
+		span.SetAttributes(attribute.Int("added", len(added)), attribute.Int("removed", len(removed)), attribute.Int("missing", len(missing)))
+		endSpan(span, err)
+	}()
+
+	fcids := make([]fileContractID, len(contractIds))
+	for i, fcid := range contractIds {
+		fcids[i] = fileContractID(fcid)
+	}
+
+	var size int
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		added, removed, missing = nil, nil, nil
+
+		// fetch contracts
+		var dbContracts []dbContract
+		err := tx.
+			Model(&dbContract{}).
+			Where("fcid IN (?)", fcids).
+			Find(&dbContracts).
+			Error
+		if err != nil {
+			return err
+		}
+
+		// check for missing contracts
+		found := make(map[types.FileContractID]struct{}, len(dbContracts))
+		for _, c := range dbContracts {
+			found[types.FileContractID(c.FCID)] = struct{}{}
+		}
+		for _, fcid := range contractIds {
+			if _, ok := found[fcid]; !ok {
+				missing = append(missing, fcid)
+				found[fcid] = struct{}{}
+			}
+		}
+		if len(missing) > 0 && !allowMissing {
+			return &api.MissingContractsError{Missing: missing}
+		}
+
+		// create contract set
+		var contractset dbContractSet
+		err = tx.
+			Where(dbContractSet{Name: name}).
+			FirstOrCreate(&contractset).
+			Error
+		if err != nil {
+			return err
+		}
+
+		// fetch current contracts
+		var current []dbContract
+		err = tx.Model(&contractset).Association("Contracts").Find(&current)
+		if err != nil {
+			return err
+		}
+
+		// compute the diff
+		wanted := make(map[uint]struct{}, len(dbContracts))
+		for _, c := range dbContracts {
+			wanted[c.ID] = struct{}{}
+		}
+		existing := make(map[uint]struct{}, len(current))
+		var toRemove []dbContract
+		for _, c := range current {
+			existing[c.ID] = struct{}{}
+			if _, ok := wanted[c.ID]; !ok {
+				toRemove = append(toRemove, c)
+				removed = append(removed, types.FileContractID(c.FCID))
+			}
+		}
+		var toAdd []dbContract
+		for _, c := range dbContracts {
+			if _, ok := existing[c.ID]; !ok {
+				toAdd = append(toAdd, c)
+				added = append(added, types.FileContractID(c.FCID))
+			}
+		}
+
+		// update contracts
+		size = len(current) + len(toAdd) - len(toRemove)
+		if len(toAdd) > 0 {
+			if err := tx.Model(&contractset).Association("Contracts").Append(&toAdd); err != nil {
+				return err
+			}
+		}
+		if len(toRemove) > 0 {
+			if err := tx.Model(&contractset).Association("Contracts").Delete(&toRemove); err != nil {
+				return err
+			}
+		}
+		return recordContractSetChanges(tx, name, added, removed, api.ContractSetChangeReasonUpdated)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.notifyContractSetChange(api.ContractSetChange{
+		Name:    name,
+		Added:   added,
+		Removed: removed,
+		Size:    size,
+	})
+	return
+}
+
+// SubscribeContractSetChanges registers a function that is called whenever
+// the contracts in a contract set change. The function is called after the
+// change was committed and shouldn't block. Calling the returned function
+// unsubscribes.
+func (s *SQLStore) SubscribeContractSetChanges(fn func(api.ContractSetChange)) (unsubscribe func()) {
+	s.contractSetSubsMu.Lock()
+	defer s.contractSetSubsMu.Unlock()
+	id := s.contractSetSubsNextID
+	s.contractSetSubsNextID++
+	s.contractSetSubs[id] = fn
+	return func() {
+		s.contractSetSubsMu.Lock()
+		defer s.contractSetSubsMu.Unlock()
+		delete(s.contractSetSubs, id)
+	}
+}
+
+// notifyContractSetChange calls the contract set change subscribers if the
+// given change modified the set.
+func (s *SQLStore) notifyContractSetChange(change api.ContractSetChange) {
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+
+	s.contractSetSubsMu.Lock()
+	subs := make([]func(api.ContractSetChange), 0, len(s.contractSetSubs))
+	for _, fn := range s.contractSetSubs {
+		subs = append(subs, fn)
+	}
+	s.contractSetSubsMu.Unlock()
+
+	for _, fn := range subs {
+		fn(change)
+	}
+}
+
+// notifyContractSetChanges calls notifyContractSetChange for every change.
+func (s *SQLStore) notifyContractSetChanges(changes []api.ContractSetChange) {
+	for _, change := range changes {
+		s.notifyContractSetChange(change)
+	}
+}
+
+// AddContractsToSet adds the given contracts to the contract set with the given
+// name, creating the set if it doesn't exist yet. Contracts that are already in
+// the set are left untouched.
+func (s *SQLStore) AddContractsToSet(ctx context.Context, name string, contractIds []types.FileContractID) error {
+	var change api.ContractSetChange
+	err := s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		change = api.ContractSetChange{Name: name}
+
+		// fetch contracts
+		dbContracts, err := contractsForSet(tx, contractIds)
+		if err != nil {
+			return err
+		}
+
+		// create contract set
+		var contractset dbContractSet
+		err = tx.
+			Where(dbContractSet{Name: name}).
+			FirstOrCreate(&contractset).
+			Error
+		if err != nil {
+			return err
+		}
+
+		// fetch current contracts
+		var current []dbContract
+		err = tx.Model(&contractset).Association("Contracts").Find(&current)
+		if err != nil {
+			return err
+		}
+		existing := make(map[uint]struct{}, len(current))
+		for _, c := range current {
+			existing[c.ID] = struct{}{}
+		}
+
+		// add contracts
+		var toAdd []dbContract
+		for _, c := range dbContracts {
+			if _, ok := existing[c.ID]; !ok {
+				toAdd = append(toAdd, c)
+				change.Added = append(change.Added, types.FileContractID(c.FCID))
+			}
+		}
+		change.Size = len(current) + len(toAdd)
+		if len(toAdd) == 0 {
+			return nil
+		}
+		if err := tx.Model(&contractset).Association("Contracts").Append(&toAdd); err != nil {
+			return err
+		}
+		return recordContractSetChanges(tx, name, change.Added, nil, api.ContractSetChangeReasonAdded)
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyContractSetChange(change)
+	return nil
+}
+
+// RemoveContractsFromSet removes the given contracts from the contract set with
+// the given name. Contracts that aren't part of the set are ignored.
+func (s *SQLStore) RemoveContractsFromSet(ctx context.Context, name string, contractIds []types.FileContractID) error {
+	var change api.ContractSetChange
+	err := s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		change = api.ContractSetChange{Name: name}
+
+		// fetch contracts
+		dbContracts, err := contractsForSet(tx, contractIds)
+		if err != nil {
+			return err
+		}
+
+		// fetch contract set
+		var contractset dbContractSet
+		err = tx.
+			Where(dbContractSet{Name: name}).
+			Take(&contractset).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w '%s'", api.ErrContractSetNotFound, name)
+		} else if err != nil {
+			return err
+		}
+
+		// fetch current contracts
+		var current []dbContract
+		err = tx.Model(&contractset).Association("Contracts").Find(&current)
+		if err != nil {
+			return err
+		}
+		existing := make(map[uint]struct{}, len(current))
+		for _, c := range current {
+			existing[c.ID] = struct{}{}
+		}
+
+		// remove contracts
+		var toRemove []dbContract
+		for _, c := range dbContracts {
+			if _, ok := existing[c.ID]; ok {
+				toRemove = append(toRemove, c)
+				change.Removed = append(change.Removed, types.FileContractID(c.FCID))
+			}
+		}
+		change.Size = len(current) - len(toRemove)
+		if len(toRemove) == 0 {
+			return nil
+		}
+		if err := tx.Model(&contractset).Association("Contracts").Delete(&toRemove); err != nil {
+			return err
+		}
+		return recordContractSetChanges(tx, name, nil, change.Removed, api.ContractSetChangeReasonRemoved)
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyContractSetChange(change)
+	return nil
+}
+
+// RemoveContractSet removes the contract set with the given name. The contracts
+// in the set are not removed, only their membership in the set.
+func (s *SQLStore) RemoveContractSet(ctx context.Context, name string) error {
+	if name == api.ContractSetAll {
+		return fmt.Errorf("%w '%s'", api.ErrReservedSetName, name)
 	}
 
-	return s.retryTransaction(func(tx *gorm.DB) error {
-		// fetch contracts
-		var dbContracts []dbContract
+	var change api.ContractSetChange
+	err := s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		change = api.ContractSetChange{Name: name}
+
+		// fetch contract set
+		var contractset dbContractSet
 		err := tx.
-			Model(&dbContract{}).
-			Where("fcid IN (?)", fcids).
-			Find(&dbContracts).
+			Where(dbContractSet{Name: name}).
+			Take(&contractset).
 			Error
-		if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w '%s'", api.ErrContractSetNotFound, name)
+		} else if err != nil {
 			return err
 		}
 
-		// create contract set
-		var contractset dbContractSet
-		err = tx.
-			Where(dbContractSet{Name: name}).
-			FirstOrCreate(&contractset).
-			Error
-		if err != nil {
+		// remove the set's contracts from the set
+		var current []dbContract
+		if err := tx.Model(&contractset).Association("Contracts").Find(&current); err != nil {
+			return err
+		}
+		for _, c := range current {
+			change.Removed = append(change.Removed, types.FileContractID(c.FCID))
+		}
+		if err := tx.Model(&contractset).Association("Contracts").Clear(); err != nil {
+			return err
+		} else if err := recordContractSetChanges(tx, name, nil, change.Removed, api.ContractSetChangeReasonSetRemoved); err != nil {
 			return err
 		}
 
-		// update contracts
-		return tx.Model(&contractset).Association("Contracts").Replace(&dbContracts)
+		// remove the set
+		return tx.Delete(&contractset).Error
 	})
+	if err != nil {
+		return err
+	}
+	s.notifyContractSetChange(change)
+	return nil
 }
 
-func (s *SQLStore) RemoveContractSet(ctx context.Context, name string) error {
-	return s.db.
-		Where(dbContractSet{Name: name}).
-		Delete(&dbContractSet{}).
-		Error
+// ContractSetChanges returns the recorded contract set membership changes
+// matching the given filter, sorted from oldest to newest.
+func (s *SQLStore) ContractSetChanges(ctx context.Context, filter api.ContractSetChangesFilter) ([]api.ContractSetMembershipChange, error) {
+	limit := filter.Limit
+	if limit <= -1 {
+		limit = math.MaxInt
+	}
+
+	query := s.db.WithContext(ctx).Model(&dbContractSetChange{})
+	if filter.Set != "" {
+		query = query.Where("name = ?", filter.Set)
+	}
+	if filter.ContractID != (types.FileContractID{}) {
+		query = query.Where("fcid = ?", fileContractID(filter.ContractID))
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("timestamp >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("timestamp < ?", filter.To.UTC())
+	}
+
+	var changes []dbContractSetChange
+	if err := query.
+		Order("timestamp, id").
+		Offset(filter.Offset).
+		Limit(limit).
+		Find(&changes).
+		Error; err != nil {
+		return nil, err
+	}
+
+	resp := make([]api.ContractSetMembershipChange, len(changes))
+	for i, c := range changes {
+		resp[i] = api.ContractSetMembershipChange{
+			Set:        c.Name,
+			ContractID: types.FileContractID(c.FCID),
+			Added:      c.Added,
+			Reason:     c.Reason,
+			Timestamp:  c.Timestamp.UTC(),
+		}
+	}
+	return resp, nil
+}
+
+// PruneContractSetChanges deletes all contract set membership changes recorded
+// before the given time and returns the number of changes pruned.
+func (s *SQLStore) PruneContractSetChanges(ctx context.Context, before time.Time) (int64, error) {
+	return s.pruneContractSetChanges(ctx, before, contractSetChangesPruneBatchSize)
+}
+
+func (s *SQLStore) pruneContractSetChanges(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	return s.pruneInBatches(ctx, batchSize, func(tx *gorm.DB) (ids []uint, err error) {
+		err = tx.
+			Model(&dbContractSetChange{}).
+			Where("timestamp < ?", before.UTC()).
+			Order("id").
+			Limit(batchSize).
+			Pluck("id", &ids).
+			Error
+		return
+	}, &dbContractSetChange{})
 }
 
 func (s *SQLStore) SearchObjects(ctx context.Context, substring string, offset, limit int) ([]api.ObjectMetadata, error) {
@@ -670,55 +2256,287 @@ func (s *SQLStore) Object(ctx context.Context, path string) (object.Object, erro
 	return obj.convert()
 }
 
-func (s *SQLStore) RecordContractSpending(ctx context.Context, records []api.ContractSpendingRecord) error {
+// UpdateContractRevision updates the revision number and size of a contract.
+// Updating a contract with a revision number lower than its current one fails
+// with ErrRevisionNumberRegressed.
+func (s *SQLStore) UpdateContractRevision(ctx context.Context, fcid types.FileContractID, revisionNumber, size uint64) error {
+	return s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		c, err := contract(tx, fileContractID(fcid))
+		if err != nil {
+			return err
+		}
+
+		var current uint64
+		if _, err := fmt.Sscan(c.RevisionNumber, &current); err != nil {
+			return err
+		} else if revisionNumber < current {
+			return fmt.Errorf("%w: %v < %v", ErrRevisionNumberRegressed, revisionNumber, current)
+		}
+
+		return tx.
+			Model(&dbContract{}).
+			Where("id = ?", c.ID).
+			Updates(map[string]interface{}{
+				"revision_number": fmt.Sprint(revisionNumber),
+				"size":            size,
+			}).
+			Error
+	})
+}
+
+// RecordContractSpending adds the given spending to the spending of the
+// contracts. Spending that pushes a contract past its budget is recorded all
+// the same, since the money was already spent, but an api.BudgetExceededError
+// listing those contracts is returned. The batch is applied in a single
+// transaction, if the spending of any contract overflows none of it is
+// recorded.
+func (s *SQLStore) RecordContractSpending(ctx context.Context, records []api.ContractSpendingRecord) (err error) {
 	if len(records) == 0 {
 		return nil // nothing to do
 	}
+	ctx, span := startSpan(ctx, "RecordContractSpending", attribute.Int("records", len(records)))
+	defer func() { endSpan(span, err) }()
 
 	// Only allow for applying one batch of spending records at a time.
 	s.spendingMu.Lock()
 	defer s.spendingMu.Unlock()
 
 	squashedRecords := make(map[types.FileContractID]api.ContractSpending)
+	uploadedBytes := make(map[types.FileContractID]uint64)
+	downloadedBytes := make(map[types.FileContractID]uint64)
 	latestRevision := make(map[types.FileContractID]uint64)
 	latestSize := make(map[types.FileContractID]uint64)
 	for _, r := range records {
-		squashedRecords[r.ContractID] = squashedRecords[r.ContractID].Add(r.ContractSpending)
+		squashed, err := addContractSpending(squashedRecords[r.ContractID], r.ContractSpending)
+		if err != nil {
+			return fmt.Errorf("failed to record spending for contract %v: %w", r.ContractID, err)
+		}
+		squashedRecords[r.ContractID] = squashed
+		uploadedBytes[r.ContractID] += r.UploadedBytes
+		downloadedBytes[r.ContractID] += r.DownloadedBytes
 		if r.RevisionNumber > latestRevision[r.ContractID] {
 			latestRevision[r.ContractID] = r.RevisionNumber
 			latestSize[r.ContractID] = r.Size
 		}
 	}
-	for fcid, newSpending := range squashedRecords {
-		err := s.retryTransaction(func(tx *gorm.DB) error {
+	now := time.Now().UTC()
+	var exceeded []types.FileContractID
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		exceeded = exceeded[:0]
+		for fcid, newSpending := range squashedRecords {
 			var contract dbContract
 			err := tx.Model(&dbContract{}).
 				Where("fcid = ?", fileContractID(fcid)).
 				Take(&contract).Error
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return nil // contract not found, continue with next one
+				continue // contract not found, continue with next one
 			} else if err != nil {
 				return err
 			}
+			spending, err := addContractSpending(api.ContractSpending{
+				Uploads:     types.Currency(contract.UploadSpending),
+				Downloads:   types.Currency(contract.DownloadSpending),
+				FundAccount: types.Currency(contract.FundAccountSpending),
+			}, newSpending)
+			if err != nil {
+				return fmt.Errorf("failed to record spending for contract %v: %w", fcid, err)
+			}
+			if exceedsBudget(contract.budget(), spending, newSpending) {
+				exceeded = append(exceeded, fcid)
+			}
 			updates := make(map[string]interface{})
 			if !newSpending.Uploads.IsZero() {
-				updates["upload_spending"] = currency(types.Currency(contract.UploadSpending).Add(newSpending.Uploads))
+				updates["upload_spending"] = currency(spending.Uploads)
 			}
 			if !newSpending.Downloads.IsZero() {
-				updates["download_spending"] = currency(types.Currency(contract.DownloadSpending).Add(newSpending.Downloads))
+				updates["download_spending"] = currency(spending.Downloads)
 			}
 			if !newSpending.FundAccount.IsZero() {
-				updates["fund_account_spending"] = currency(types.Currency(contract.FundAccountSpending).Add(newSpending.FundAccount))
+				updates["fund_account_spending"] = currency(spending.FundAccount)
 			}
-			updates["revision_number"] = latestRevision[fcid]
-			updates["size"] = latestSize[fcid]
-			return tx.Model(&contract).Updates(updates).Error
-		})
+			if n := uploadedBytes[fcid]; n > 0 {
+				updates["uploaded_bytes"] = gorm.Expr("uploaded_bytes + ?", n)
+			}
+			if n := downloadedBytes[fcid]; n > 0 {
+				updates["downloaded_bytes"] = gorm.Expr("downloaded_bytes + ?", n)
+			}
+			if rev, ok := latestRevision[fcid]; ok {
+				// ignore revisions older than the one we already know about,
+				// the spending was recorded out of order
+				var current uint64
+				if _, err := fmt.Sscan(contract.RevisionNumber, &current); err != nil {
+					return err
+				} else if rev >= current {
+					updates["revision_number"] = fmt.Sprint(rev)
+					updates["size"] = latestSize[fcid]
+				}
+			}
+			if len(updates) == 0 {
+				continue
+			}
+			if err := tx.Model(&contract).Updates(updates).Error; err != nil {
+				return err
+			}
+			if s.spendingHistoryInterval > 0 && newSpending != (api.ContractSpending{}) {
+				if err := recordContractSpendingPeriod(tx, fcid, now.Truncate(s.spendingHistoryInterval), newSpending); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(exceeded) > 0 {
+		return &api.BudgetExceededError{Contracts: exceeded}
+	}
+	return nil
+}
+
+// exceedsBudget returns true if the given increment pushed the spending of any
+// category with a budget past that budget.
+func exceedsBudget(budget, spending, increment api.ContractSpending) bool {
+	exceeds := func(budget, spending, increment types.Currency) bool {
+		return !budget.IsZero() && !increment.IsZero() && spending.Cmp(budget) > 0
+	}
+	return exceeds(budget.Uploads, spending.Uploads, increment.Uploads) ||
+		exceeds(budget.Downloads, spending.Downloads, increment.Downloads) ||
+		exceeds(budget.FundAccount, spending.FundAccount, increment.FundAccount)
+}
+
+// UpdateContractBudget sets the spending budget of the contract with the given
+// id, a budget of zero means the spending in that category is unlimited.
+func (s *SQLStore) UpdateContractBudget(ctx context.Context, id types.FileContractID, budget api.ContractSpending) error {
+	return s.retryTransaction(ctx, func(tx *gorm.DB) error {
+		c, err := contract(tx, fileContractID(id))
 		if err != nil {
 			return err
 		}
+		return tx.
+			Model(&c).
+			Updates(map[string]interface{}{
+				"upload_budget":       currency(budget.Uploads),
+				"download_budget":     currency(budget.Downloads),
+				"fund_account_budget": currency(budget.FundAccount),
+			}).
+			Error
+	})
+}
+
+// recordContractSpendingPeriod adds the given spending to the contract's
+// spending in the period starting at the given time.
+func recordContractSpendingPeriod(tx *gorm.DB, fcid types.FileContractID, periodStart time.Time, spending api.ContractSpending) error {
+	var period dbContractSpendingPeriod
+	err := tx.
+		Where("fcid = ? AND period_start = ?", fileContractID(fcid), periodStart.Unix()).
+		Take(&period).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tx.Create(&dbContractSpendingPeriod{
+			FCID:        fileContractID(fcid),
+			PeriodStart: periodStart.Unix(),
+			Uploads:     currency(spending.Uploads),
+			Downloads:   currency(spending.Downloads),
+			FundAccount: currency(spending.FundAccount),
+		}).Error
+	} else if err != nil {
+		return err
 	}
-	return nil
+
+	spending, err = addContractSpending(period.convert().ContractSpending, spending)
+	if err != nil {
+		return fmt.Errorf("failed to record spending history for contract %v: %w", fcid, err)
+	}
+	return tx.Model(&period).Updates(map[string]interface{}{
+		"uploads":      currency(spending.Uploads),
+		"downloads":    currency(spending.Downloads),
+		"fund_account": currency(spending.FundAccount),
+	}).Error
+}
+
+// ContractSpendingHistory returns the spending of the given contract in all
+// periods that start in [from, to), sorted by period start.
+func (s *SQLStore) ContractSpendingHistory(ctx context.Context, fcid types.FileContractID, from, to time.Time) ([]api.ContractSpendingPeriod, error) {
+	var periods []dbContractSpendingPeriod
+	if err := s.db.
+		WithContext(ctx).
+		Where("fcid = ? AND period_start >= ? AND period_start < ?", fileContractID(fcid), from.Unix(), to.Unix()).
+		Order("period_start").
+		Find(&periods).
+		Error; err != nil {
+		return nil, err
+	}
+
+	history := make([]api.ContractSpendingPeriod, len(periods))
+	for i, period := range periods {
+		history[i] = period.convert()
+	}
+	return history, nil
+}
+
+// SpendingHistory returns the spending across all contracts in all periods
+// that start in [from, to), sorted by period start.
+func (s *SQLStore) SpendingHistory(ctx context.Context, from, to time.Time) ([]api.ContractSpendingPeriod, error) {
+	// currencies are stored as strings so they are summed up here rather
+	// than in the query
+	var periods []dbContractSpendingPeriod
+	if err := s.db.
+		WithContext(ctx).
+		Where("period_start >= ? AND period_start < ?", from.Unix(), to.Unix()).
+		Order("period_start").
+		Find(&periods).
+		Error; err != nil {
+		return nil, err
+	}
+
+	var history []api.ContractSpendingPeriod
+	for _, period := range periods {
+		p := period.convert()
+		if len(history) == 0 || !history[len(history)-1].Start.Equal(p.Start) {
+			history = append(history, api.ContractSpendingPeriod{Start: p.Start})
+		}
+		last := &history[len(history)-1]
+		spending, err := addContractSpending(last.ContractSpending, p.ContractSpending)
+		if err != nil {
+			return nil, err
+		}
+		last.ContractSpending = spending
+	}
+	return history, nil
+}
+
+// PruneSpendingHistory deletes the spending history of all periods that start
+// before the given time and returns the number of periods pruned.
+func (s *SQLStore) PruneSpendingHistory(ctx context.Context, before time.Time) (int64, error) {
+	return s.pruneSpendingHistory(ctx, before, spendingHistoryPruneBatchSize)
+}
+
+func (s *SQLStore) pruneSpendingHistory(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	return s.pruneInBatches(ctx, batchSize, func(tx *gorm.DB) (ids []uint, err error) {
+		err = tx.
+			Model(&dbContractSpendingPeriod{}).
+			Where("period_start < ?", before.Unix()).
+			Order("id").
+			Limit(batchSize).
+			Pluck("id", &ids).
+			Error
+		return
+	}, &dbContractSpendingPeriod{})
+}
+
+// addContractSpending adds up the given spending, it returns
+// api.ErrCurrencyOverflow rather than panicking if any of the sums doesn't fit
+// into a types.Currency.
+func addContractSpending(x, y api.ContractSpending) (z api.ContractSpending, err error) {
+	var overflow [3]bool
+	z.Uploads, overflow[0] = x.Uploads.AddWithOverflow(y.Uploads)
+	z.Downloads, overflow[1] = x.Downloads.AddWithOverflow(y.Downloads)
+	z.FundAccount, overflow[2] = x.FundAccount.AddWithOverflow(y.FundAccount)
+	if overflow[0] || overflow[1] || overflow[2] {
+		return api.ContractSpending{}, api.ErrCurrencyOverflow
+	}
+	return z, nil
 }
 
 func (s *SQLStore) addKnownContract(fcid types.FileContractID) {
@@ -740,6 +2558,27 @@ func pruneSlabs(tx *gorm.DB) error {
 		WHERE db_object_id IS NULL) toDelete)`).Error
 }
 
+// PruneDanglingSectors deletes all sectors that are neither stored in a
+// contract nor part of a slab and returns the number of sectors pruned.
+func (s *SQLStore) PruneDanglingSectors(ctx context.Context) (int64, error) {
+	return s.pruneDanglingSectors(ctx, danglingSectorsPruneBatchSize)
+}
+
+func (s *SQLStore) pruneDanglingSectors(ctx context.Context, batchSize int) (int64, error) {
+	return s.pruneInBatches(ctx, batchSize, func(tx *gorm.DB) (ids []uint, err error) {
+		err = tx.
+			Table("sectors sec").
+			Joins("LEFT JOIN contract_sectors cs ON cs.db_sector_id = sec.id").
+			Joins("LEFT JOIN slabs sla ON sla.id = sec.db_slab_id").
+			Where("cs.db_sector_id IS NULL AND sla.id IS NULL").
+			Order("sec.id").
+			Limit(batchSize).
+			Pluck("sec.id", &ids).
+			Error
+		return
+	}, &dbSector{})
+}
+
 func fetchUsedContracts(tx *gorm.DB, usedContracts map[types.PublicKey]types.FileContractID) (map[types.PublicKey]dbContract, error) {
 	fcids := make([]fileContractID, 0, len(usedContracts))
 	hostForFCID := make(map[types.FileContractID]types.PublicKey, len(usedContracts))
@@ -774,7 +2613,7 @@ func (s *SQLStore) UpdateObject(ctx context.Context, path, contractSet string, o
 	}
 
 	// UpdateObject is ACID.
-	return s.retryTransaction(func(tx *gorm.DB) error {
+	return s.retryTransaction(ctx, func(tx *gorm.DB) error {
 		// Fetch contract set.
 		var cs dbContractSet
 		if err := tx.Take(&cs, "name = ?", contractSet).Error; err != nil {
@@ -982,7 +2821,7 @@ func createSlabBuffer(tx *gorm.DB, objectID, contractSetID uint, partialSlab obj
 func (s *SQLStore) RemoveObject(ctx context.Context, key string) error {
 	var rowsAffected int64
 	var err error
-	err = s.retryTransaction(func(tx *gorm.DB) error {
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
 		rowsAffected, err = deleteObject(tx, key)
 		return err
 	})
@@ -998,7 +2837,7 @@ func (s *SQLStore) RemoveObject(ctx context.Context, key string) error {
 func (s *SQLStore) RemoveObjects(ctx context.Context, prefix string) error {
 	var rowsAffected int64
 	var err error
-	err = s.retryTransaction(func(tx *gorm.DB) error {
+	err = s.retryTransaction(ctx, func(tx *gorm.DB) error {
 		rowsAffected, err = deleteObjects(tx, prefix)
 		return err
 	})
@@ -1049,7 +2888,7 @@ func (ss *SQLStore) UpdateSlab(ctx context.Context, s object.Slab, contractSet s
 	}
 
 	// Update slab.
-	return ss.retryTransaction(func(tx *gorm.DB) (err error) {
+	return ss.retryTransaction(ctx, func(tx *gorm.DB) (err error) {
 		// Fetch contract set.
 		var cs dbContractSet
 		if err := tx.Take(&cs, "name = ?", contractSet).Error; err != nil {
@@ -1109,9 +2948,10 @@ func (ss *SQLStore) UpdateSlab(ctx context.Context, s object.Slab, contractSet s
 }
 
 // UnhealthySlabs returns up to 'limit' slabs that do not reach full redundancy
-// in the given contract set. These slabs need to be migrated to good contracts
-// so they are restored to full health.
-func (s *SQLStore) UnhealthySlabs(ctx context.Context, healthCutoff float64, set string, limit int) ([]api.UnhealthySlab, error) {
+// in the given contract set, starting at 'offset'. These slabs need to be
+// migrated to good contracts so they are restored to full health. The slabs
+// are ordered by health, slabs with the same health are ordered by id.
+func (s *SQLStore) UnhealthySlabs(ctx context.Context, healthCutoff float64, set string, offset, limit int) ([]api.UnhealthySlab, error) {
 	if limit <= -1 {
 		limit = math.MaxInt
 	}
@@ -1139,7 +2979,8 @@ END AS health`).
 		Joins("LEFT JOIN contract_sets cs ON cs.id = csc.db_contract_set_id").
 		Group("slabs.id").
 		Having("health <= ? AND slabs.db_contract_set_id = (SELECT id FROM contract_sets cs WHERE cs.name = ?)", healthCutoff, set).
-		Order("health ASC").
+		Order("health ASC, slabs.id ASC").
+		Offset(offset).
 		Limit(limit).
 		Find(&rows).
 		Error; err != nil {
@@ -1190,34 +3031,74 @@ func (s *SQLStore) object(ctx context.Context, path string) (rawObject, error) {
 
 // contract retrieves a contract from the store.
 func (s *SQLStore) contract(ctx context.Context, id fileContractID) (dbContract, error) {
-	return contract(s.db, id)
+	return contract(s.db.WithContext(ctx), id)
 }
 
 // contracts retrieves all contracts in the given set.
 func (s *SQLStore) contracts(ctx context.Context, set string) ([]dbContract, error) {
 	var cs dbContractSet
-	err := s.db.
+	err := s.db.WithContext(ctx).
 		Where(&dbContractSet{Name: set}).
-		Preload("Contracts.Host").
 		Take(&cs).
 		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w '%s'", api.ErrContractSetNotFound, set)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var contracts []dbContract
+	err = s.db.WithContext(ctx).
+		Model(&dbContract{}).
+		Joins("INNER JOIN contract_set_contracts csc ON csc.db_contract_id = contracts.id AND csc.db_contract_set_id = ?", cs.ID).
+		Preload("Host", preloadContractHost).
+		Order("contracts.id").
+		Find(&contracts).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return contracts, nil
+}
+
+// joinContractSet restricts the contracts matched by the given query to the ones
+// in the contract set with the given name. An empty name and the virtual set
+// containing all contracts leave the query untouched.
+func joinContractSet(query *gorm.DB, set string) (*gorm.DB, error) {
+	if set == "" || set == api.ContractSetAll {
+		return query, nil
+	}
 
+	var cs dbContractSet
+	err := query.
+		Session(&gorm.Session{NewDB: true}).
+		Where(&dbContractSet{Name: set}).
+		Take(&cs).
+		Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, fmt.Errorf("%w '%s'", api.ErrContractSetNotFound, set)
 	} else if err != nil {
 		return nil, err
 	}
+	return query.Joins("INNER JOIN contract_set_contracts csc ON csc.db_contract_id = contracts.id AND csc.db_contract_set_id = ?", cs.ID), nil
+}
 
-	return cs.Contracts, nil
+// preloadContractHost limits the preloaded host of a contract to the fields
+// needed to convert it, loading the full host is expensive when listing a
+// large number of contracts.
+func preloadContractHost(tx *gorm.DB) *gorm.DB {
+	return tx.Select("id", "public_key", "net_address", "settings")
 }
 
 // packedSlabsForUpload retrieves up to 'limit' dbSlabBuffers that have their
-// 'Complete' flag set to true and locks them using the 'LockedUntil' field
+// 'Complete' flag set to true and locks them using the 'LockedUntil' field.
+// Lock expiries are stored in unix milliseconds since a precision of seconds
+// would turn sub-second locking durations into locks that expire immediately.
 func (s *SQLStore) packedSlabsForUpload(lockingDuration time.Duration, limit int) ([]dbSlabBuffer, error) {
 	var buffers []dbSlabBuffer
-	now := time.Now().Unix()
+	now := time.Now().UnixMilli()
 	err := s.db.Raw(`UPDATE buffered_slabs SET locked_until = ? WHERE id IN (
-		SELECT id FROM buffered_slabs WHERE complete = ? AND locked_until < ? LIMIT ?) RETURNING *`, now+int64(lockingDuration.Seconds()), true, now, limit).
+		SELECT id FROM buffered_slabs WHERE complete = ? AND locked_until < ? LIMIT ?) RETURNING *`, now+lockingDuration.Milliseconds(), true, now, limit).
 		Scan(&buffers).
 		Error
 	if err != nil {
@@ -1259,7 +3140,7 @@ func (s *SQLStore) MarkPackedSlabsUploaded(slabs []api.UploadedPackedSlab, usedC
 			}
 		}
 	}
-	return s.retryTransaction(func(tx *gorm.DB) error {
+	return s.retryTransaction(context.Background(), func(tx *gorm.DB) error {
 		contracts, err := fetchUsedContracts(tx, usedContracts)
 		if err != nil {
 			return err
@@ -1353,6 +3234,180 @@ func contracts(tx *gorm.DB, ids []types.FileContractID) (dbContracts []dbContrac
 	return
 }
 
+// contractsForSet retrieves all contracts for the given ids from the store and
+// returns an error if any of them are missing.
+func contractsForSet(tx *gorm.DB, ids []types.FileContractID) ([]dbContract, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	fcids := make([]fileContractID, len(ids))
+	for i, fcid := range ids {
+		fcids[i] = fileContractID(fcid)
+	}
+
+	var dbContracts []dbContract
+	err := tx.
+		Model(&dbContract{}).
+		Where("fcid IN (?)", fcids).
+		Find(&dbContracts).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[types.FileContractID]struct{}, len(dbContracts))
+	for _, c := range dbContracts {
+		found[types.FileContractID(c.FCID)] = struct{}{}
+	}
+	for _, fcid := range ids {
+		if _, ok := found[fcid]; !ok {
+			return nil, fmt.Errorf("%w %v", ErrContractNotFound, fcid)
+		}
+	}
+	return dbContracts, nil
+}
+
+// contractSetNames returns the names of the contract sets the contract with
+// the given id is part of.
+func contractSetNames(tx *gorm.DB, id uint) (names []string, err error) {
+	err = tx.
+		Raw("SELECT cs.name FROM contract_sets cs INNER JOIN contract_set_contracts csc ON csc.db_contract_set_id = cs.id WHERE csc.db_contract_id = ? ORDER BY cs.name", id).
+		Scan(&names).
+		Error
+	return
+}
+
+// contractSetSize returns the number of contracts in the contract set with the
+// given name.
+func contractSetSize(tx *gorm.DB, name string) (int, error) {
+	var size int64
+	err := tx.
+		Raw("SELECT COUNT(*) FROM contract_set_contracts csc INNER JOIN contract_sets cs ON cs.id = csc.db_contract_set_id WHERE cs.name = ?", name).
+		Scan(&size).
+		Error
+	return int(size), err
+}
+
+// recordContractSetChanges records the given contracts entering and leaving
+// the contract set with the given name.
+func recordContractSetChanges(tx *gorm.DB, name string, added, removed []types.FileContractID, reason string) error {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	changes := make([]dbContractSetChange, 0, len(added)+len(removed))
+	for _, fcid := range removed {
+		changes = append(changes, dbContractSetChange{Name: name, FCID: fileContractID(fcid), Reason: reason, Timestamp: now})
+	}
+	for _, fcid := range added {
+		changes = append(changes, dbContractSetChange{Name: name, FCID: fileContractID(fcid), Added: true, Reason: reason, Timestamp: now})
+	}
+	return tx.CreateInBatches(&changes, 100).Error
+}
+
+// renewalChainEntry retrieves the active or archived contract with the given
+// id as an entry of a renewal chain.
+func renewalChainEntry(tx *gorm.DB, id types.FileContractID) (api.RenewalChainEntry, bool, error) {
+	return fetchRenewalChainEntry(tx, "fcid = ?", fileContractID(id))
+}
+
+// renewalChainSuccessor retrieves the active or archived contract that was
+// renewed from the contract with the given id as an entry of a renewal chain.
+func renewalChainSuccessor(tx *gorm.DB, id types.FileContractID) (api.RenewalChainEntry, bool, error) {
+	return fetchRenewalChainEntry(tx, "renewed_from = ?", fileContractID(id))
+}
+
+// followRenewals calls fn for every contract the contract described by the
+// given entry was renewed into, in order, until fn returns false. Contracts
+// with a RenewedTo link are followed through it, for other contracts the
+// successor is looked up by its RenewedFrom field. The walk stops at a contract
+// that is in visited already and returns ErrDescendantDepthExceeded if the
+// contract was renewed more than maxDepth times. If a contract links to a
+// successor that can't be found, dangling is set to true.
+func followRenewals(tx *gorm.DB, from api.RenewalChainEntry, visited map[types.FileContractID]struct{}, maxDepth int, fn func(next api.RenewalChainEntry) bool) (dangling bool, err error) {
+	for cur, depth := from, 1; ; depth++ {
+		var next api.RenewalChainEntry
+		var found bool
+		if cur.RenewedTo != (types.FileContractID{}) {
+			next, found, err = renewalChainEntry(tx, cur.RenewedTo)
+			if err != nil {
+				return false, err
+			} else if !found {
+				return true, nil
+			}
+		} else {
+			next, found, err = renewalChainSuccessor(tx, cur.ID)
+			if err != nil {
+				return false, err
+			} else if !found {
+				return false, nil
+			}
+		}
+		if _, ok := visited[next.ID]; ok {
+			return false, nil // sanity check against loops
+		} else if depth > maxDepth {
+			return false, fmt.Errorf("%w: %v has more than %v", ErrDescendantDepthExceeded, from.ID, maxDepth)
+		}
+		visited[next.ID] = struct{}{}
+		if !fn(next) {
+			return false, nil
+		}
+		cur = next
+	}
+}
+
+func fetchRenewalChainEntry(tx *gorm.DB, query string, args ...interface{}) (api.RenewalChainEntry, bool, error) {
+	var contracts []dbContract
+	if err := tx.
+		Where(query, args...).
+		Preload("Host").
+		Limit(1).
+		Find(&contracts).
+		Error; err != nil {
+		return api.RenewalChainEntry{}, false, err
+	} else if len(contracts) > 0 {
+		c := contracts[0].convert()
+		return api.RenewalChainEntry{
+			ID:          c.ID,
+			HostKey:     c.HostKey,
+			RenewedFrom: c.RenewedFrom,
+
+			RevisionNumber: c.RevisionNumber,
+			Size:           c.Size,
+			StartHeight:    c.StartHeight,
+			WindowStart:    c.WindowStart,
+			WindowEnd:      c.WindowEnd,
+		}, true, nil
+	}
+
+	var archived []dbArchivedContract
+	if err := tx.
+		Where(query, args...).
+		Limit(1).
+		Find(&archived).
+		Error; err != nil {
+		return api.RenewalChainEntry{}, false, err
+	} else if len(archived) > 0 {
+		c := archived[0].convert()
+		return api.RenewalChainEntry{
+			ID:          c.ID,
+			HostKey:     c.HostKey,
+			RenewedFrom: types.FileContractID(archived[0].RenewedFrom),
+			RenewedTo:   c.RenewedTo,
+
+			Archived: true,
+			Reason:   c.Reason,
+
+			RevisionNumber: c.RevisionNumber,
+			Size:           c.Size,
+			StartHeight:    c.StartHeight,
+			WindowStart:    c.WindowStart,
+			WindowEnd:      c.WindowEnd,
+		}, true, nil
+	}
+	return api.RenewalChainEntry{}, false, nil
+}
+
 // contractsForHost retrieves all contracts for the given host
 func contractsForHost(tx *gorm.DB, host dbHost) (contracts []dbContract, err error) {
 	err = tx.
@@ -1363,8 +3418,9 @@ func contractsForHost(tx *gorm.DB, host dbHost) (contracts []dbContract, err err
 	return
 }
 
-func newContract(hostID uint, fcid, renewedFrom types.FileContractID, totalCost types.Currency, startHeight, windowStart, windowEnd uint64) dbContract {
+func newContract(hostID uint, fcid, renewedFrom types.FileContractID, totalCost types.Currency, startHeight, windowStart, windowEnd, revisionNumber, size uint64) dbContract {
 	return dbContract{
+		Model:  Model{CreatedAt: time.Now().UTC()},
 		HostID: hostID,
 
 		ContractCommon: ContractCommon{
@@ -1372,8 +3428,8 @@ func newContract(hostID uint, fcid, renewedFrom types.FileContractID, totalCost
 			RenewedFrom: fileContractID(renewedFrom),
 
 			TotalCost:      currency(totalCost),
-			RevisionNumber: "0",
-			Size:           0,
+			RevisionNumber: fmt.Sprint(revisionNumber),
+			Size:           size,
 			StartHeight:    startHeight,
 			WindowStart:    windowStart,
 			WindowEnd:      windowEnd,
@@ -1381,12 +3437,20 @@ func newContract(hostID uint, fcid, renewedFrom types.FileContractID, totalCost
 			UploadSpending:      zeroCurrency,
 			DownloadSpending:    zeroCurrency,
 			FundAccountSpending: zeroCurrency,
+
+			SnapshotContractPrice: zeroCurrency,
+			SnapshotStoragePrice:  zeroCurrency,
 		},
+
+		UploadBudget:      zeroCurrency,
+		DownloadBudget:    zeroCurrency,
+		FundAccountBudget: zeroCurrency,
 	}
 }
 
-// addContract adds a contract to the store.
-func addContract(tx *gorm.DB, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, renewedFrom types.FileContractID) (dbContract, error) {
+// addContract adds a contract to the store, hostAddress is the address the
+// contract was formed with and defaults to the host's current address.
+func addContract(tx *gorm.DB, c rhpv2.ContractRevision, totalCost types.Currency, startHeight uint64, hostAddress string, snapshot *api.HostSettingsSnapshot) (dbContract, error) {
 	fcid := c.ID()
 
 	// Find host.
@@ -1398,7 +3462,13 @@ func addContract(tx *gorm.DB, c rhpv2.ContractRevision, totalCost types.Currency
 	}
 
 	// Create contract.
-	contract := newContract(host.ID, fcid, renewedFrom, totalCost, startHeight, c.Revision.WindowStart, c.Revision.WindowEnd)
+	contract := newContract(host.ID, fcid, types.FileContractID{}, totalCost, startHeight, c.Revision.WindowStart, c.Revision.WindowEnd, c.Revision.RevisionNumber, c.Revision.Filesize)
+	contract.NetAddress = host.NetAddress
+	contract.HostAddress = hostAddress
+	if contract.HostAddress == "" {
+		contract.HostAddress = host.NetAddress
+	}
+	contract.setSettingsSnapshot(snapshot)
 
 	// Insert contract.
 	err = tx.Create(&contract).Error
@@ -1411,36 +3481,86 @@ func addContract(tx *gorm.DB, c rhpv2.ContractRevision, totalCost types.Currency
 }
 
 // archiveContracts archives the given contracts and uses the given reason as
-// archival reason
+// archival reason. It returns the resulting changes to the contract sets, the
+// caller is expected to notify the subscribers once the transaction commits.
 //
 // NOTE: this function archives the contracts without setting a renewed ID
-func archiveContracts(tx *gorm.DB, contracts []dbContract, toArchive map[types.FileContractID]string) error {
+func archiveContracts(tx *gorm.DB, contracts []dbContract, toArchive map[types.FileContractID]string) ([]api.ContractSetChange, error) {
+	var names []string
+	removed := make(map[string][]types.FileContractID)
 	for _, contract := range contracts {
 		// sanity check the host is populated
 		if contract.Host.ID == 0 {
-			return fmt.Errorf("host not populated for contract %v", contract.FCID)
+			return nil, fmt.Errorf("host not populated for contract %v", contract.FCID)
+		}
+
+		// default to the contract being removed if no reason is given
+		reason := toArchive[types.FileContractID(contract.FCID)]
+		if reason == "" {
+			reason = api.ContractArchivalReasonRemoved
 		}
 
 		// create a copy in the archive
 		if err := tx.Create(&dbArchivedContract{
-			Host:   publicKey(contract.Host.PublicKey),
-			Reason: toArchive[types.FileContractID(contract.FCID)],
+			Model:      Model{CreatedAt: contract.CreatedAt.UTC()},
+			ArchivedAt: time.Now().UTC(),
+			Host:       publicKey(contract.Host.PublicKey),
+			NetAddress: contract.netAddress(),
+			Reason:     reason,
 
 			ContractCommon: contract.ContractCommon,
 		}).Error; err != nil {
-			return err
+			return nil, err
+		}
+
+		// remove the contract from its sets and its sectors from the join
+		// table, the foreign keys take care of this too but we don't want to
+		// rely on them being enforced
+		sets, err := contractSetNames(tx, contract.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range sets {
+			if err := recordContractSetChanges(tx, set, nil, []types.FileContractID{types.FileContractID(contract.FCID)}, fmt.Sprintf("%s: %s", api.ContractSetChangeReasonArchived, reason)); err != nil {
+				return nil, err
+			}
+			if _, ok := removed[set]; !ok {
+				names = append(names, set)
+			}
+			removed[set] = append(removed[set], types.FileContractID(contract.FCID))
+		}
+		if err := tx.
+			Exec("DELETE FROM contract_set_contracts WHERE db_contract_id = ?", contract.ID).
+			Error; err != nil {
+			return nil, err
+		}
+		if err := tx.
+			Where("db_contract_id = ?", contract.ID).
+			Delete(&dbContractSector{}).
+			Error; err != nil {
+			return nil, err
 		}
 
 		// remove the contract
 		res := tx.Delete(&contract)
 		if err := res.Error; err != nil {
-			return err
+			return nil, err
 		}
 		if res.RowsAffected != 1 {
-			return fmt.Errorf("expected to delete 1 row, deleted %d", res.RowsAffected)
+			return nil, fmt.Errorf("expected to delete 1 row, deleted %d", res.RowsAffected)
 		}
 	}
-	return nil
+
+	// describe the changes to the contract sets
+	changes := make([]api.ContractSetChange, 0, len(names))
+	for _, name := range names {
+		size, err := contractSetSize(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, api.ContractSetChange{Name: name, Removed: removed[name], Size: size})
+	}
+	return changes, nil
 }
 
 // deleteObject deletes an object from the store and prunes all slabs which are
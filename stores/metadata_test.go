@@ -3,10 +3,16 @@ package stores
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -231,18 +237,22 @@ func TestSQLContractStore(t *testing.T) {
 	// Insert it.
 	totalCost := types.NewCurrency64(456)
 	startHeight := uint64(100)
-	returned, err := cs.AddContract(ctx, c, totalCost, startHeight)
+	returned, err := cs.AddContract(ctx, c, totalCost, startHeight, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	expected := api.ContractMetadata{
-		ID:          fcid,
-		HostIP:      "address",
-		HostKey:     hk,
-		StartHeight: 100,
-		WindowStart: 400,
-		WindowEnd:   500,
-		RenewedFrom: types.FileContractID{},
+		ID:             fcid,
+		HostAddress:    "address",
+		HostIP:         "address",
+		HostIPSource:   api.HostIPSourceHost,
+		HostKey:        hk,
+		RevisionNumber: 200,
+		Size:           4096,
+		StartHeight:    100,
+		WindowStart:    400,
+		WindowEnd:      500,
+		RenewedFrom:    types.FileContractID{},
 		Spending: api.ContractSpending{
 			Uploads:     types.ZeroCurrency,
 			Downloads:   types.ZeroCurrency,
@@ -250,6 +260,10 @@ func TestSQLContractStore(t *testing.T) {
 		},
 		TotalCost: totalCost,
 	}
+	if returned.CreatedAt.IsZero() || returned.CreatedAt.Location() != time.UTC {
+		t.Fatal("unexpected creation time", returned.CreatedAt)
+	}
+	expected.CreatedAt = returned.CreatedAt
 	if !reflect.DeepEqual(returned, expected) {
 		t.Fatal("contract mismatch")
 	}
@@ -274,7 +288,7 @@ func TestSQLContractStore(t *testing.T) {
 	}
 
 	// Add a contract set with our contract and assert we can fetch it using the set name
-	if err := cs.SetContractSet(ctx, "foo", []types.FileContractID{contracts[0].ID}); err != nil {
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", []types.FileContractID{contracts[0].ID}, false); err != nil {
 		t.Fatal(err)
 	}
 	if contracts, err := cs.ContractSetContracts(ctx, "foo"); err != nil {
@@ -286,8 +300,15 @@ func TestSQLContractStore(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// Fetching an existing but empty set returns no contracts.
+	if contracts, err := cs.ContractSetContracts(ctx, testContractSet); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatalf("should have 0 contracts but got %v", len(contracts))
+	}
+
 	// Add another contract set.
-	if err := cs.SetContractSet(ctx, "foo2", []types.FileContractID{contracts[0].ID}); err != nil {
+	if _, _, _, err := cs.SetContractSet(ctx, "foo2", []types.FileContractID{contracts[0].ID}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -296,10 +317,10 @@ func TestSQLContractStore(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(sets) != 3 { // 2 sets + default set
+	if len(sets) != 4 { // 2 sets + default set + virtual set
 		t.Fatal("wrong number of sets")
 	}
-	if sets[0] != "foo" || sets[1] != "foo2" || sets[2] != testContractSet {
+	if sets[0].Name != api.ContractSetAll || sets[1].Name != "foo" || sets[2].Name != "foo2" || sets[3].Name != testContractSet {
 		t.Fatal("wrong sets returned", sets)
 	}
 
@@ -346,6 +367,174 @@ func TestSQLContractStore(t *testing.T) {
 	}
 }
 
+// TestContractNetAddressFallback asserts the net address a host had when a
+// contract was formed is used if the host's address is unknown.
+func TestContractNetAddressFallback(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host with an address and one without
+	hk1, hk2 := types.PublicKey{1}, types.PublicKey{2}
+	if err := cs.addCustomTestHost(hk1, "address"); err != nil {
+		t.Fatal(err)
+	} else if err := cs.addCustomTestHost(hk2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a contract with each of them
+	fcid1, fcid2 := types.FileContractID{1}, types.FileContractID{2}
+	if c, err := cs.addTestContract(fcid1, hk1); err != nil {
+		t.Fatal(err)
+	} else if c.HostIP != "address" || c.HostIPSource != api.HostIPSourceHost {
+		t.Fatal("unexpected host ip", c.HostIP, c.HostIPSource)
+	}
+	if c, err := cs.addTestContract(fcid2, hk2); err != nil {
+		t.Fatal(err)
+	} else if c.HostIP != "" || c.HostIPSource != "" {
+		t.Fatal("unexpected host ip", c.HostIP, c.HostIPSource)
+	}
+
+	// clear the address of the first host
+	if err := cs.db.Model(&dbHost{}).Where("public_key = ?", publicKey(hk1)).Update("net_address", "").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the contract falls back to the address at formation
+	if c, err := cs.Contract(ctx, fcid1); err != nil {
+		t.Fatal(err)
+	} else if c.HostIP != "address" || c.HostIPSource != api.HostIPSourceContract {
+		t.Fatal("unexpected host ip", c.HostIP, c.HostIPSource)
+	}
+
+	// assert the address is carried over when the contract is renewed
+	renewedID := types.FileContractID{3}
+	if c, err := cs.addTestRenewedContract(renewedID, fcid1, hk1, 1); err != nil {
+		t.Fatal(err)
+	} else if c.HostIP != "address" || c.HostIPSource != api.HostIPSourceContract {
+		t.Fatal("unexpected host ip", c.HostIP, c.HostIPSource)
+	}
+}
+
+// TestContractHostAddress asserts the address a contract was formed with is
+// kept when the host announces a new address and when it's renewed.
+func TestContractHostAddress(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host
+	hk := types.PublicKey{1}
+	if err := cs.addCustomTestHost(hk, "announced:1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a contract formed with a different address and one without an
+	// address
+	fcid1, fcid2 := types.FileContractID{1}, types.FileContractID{2}
+	if c, err := cs.AddContract(ctx, testContractRevision(fcid1, hk), types.ZeroCurrency, 1, "formed:1234", nil); err != nil {
+		t.Fatal(err)
+	} else if c.HostAddress != "formed:1234" || c.HostIP != "announced:1234" {
+		t.Fatal("unexpected addresses", c.HostAddress, c.HostIP)
+	}
+	if c, err := cs.AddContract(ctx, testContractRevision(fcid2, hk), types.ZeroCurrency, 1, "", nil); err != nil {
+		t.Fatal(err)
+	} else if c.HostAddress != "announced:1234" {
+		t.Fatal("expected host address to default to the announced address", c.HostAddress)
+	}
+
+	// announce a new address
+	if err := cs.addCustomTestHost(hk, "moved:1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert only the current address changed
+	if c, err := cs.Contract(ctx, fcid1); err != nil {
+		t.Fatal(err)
+	} else if c.HostAddress != "formed:1234" || c.HostIP != "moved:1234" {
+		t.Fatal("unexpected addresses", c.HostAddress, c.HostIP)
+	}
+
+	// assert the address survives a renewal
+	if c, err := cs.addTestRenewedContract(types.FileContractID{3}, fcid1, hk, 2); err != nil {
+		t.Fatal(err)
+	} else if c.HostAddress != "formed:1234" || c.HostIP != "moved:1234" {
+		t.Fatal("unexpected addresses", c.HostAddress, c.HostIP)
+	}
+}
+
+func TestContractSettingsSnapshot(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hks, err := cs.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk := hks[0]
+
+	// form a contract with a snapshot
+	formed := &api.HostSettingsSnapshot{
+		ContractPrice: types.Siacoins(1),
+		StoragePrice:  types.NewCurrency64(2),
+		Data:          []byte(`{"formed":true}`),
+	}
+	fcid1, fcid2 := types.FileContractID{1}, types.FileContractID{2}
+	if c, err := cs.AddContract(ctx, testContractRevision(fcid1, hk), types.ZeroCurrency, 1, "", formed); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(c.SettingsSnapshot, formed) {
+		t.Fatalf("unexpected snapshot %+v", c.SettingsSnapshot)
+	}
+	if c, err := cs.Contract(ctx, fcid1); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(c.SettingsSnapshot, formed) {
+		t.Fatalf("unexpected snapshot %+v", c.SettingsSnapshot)
+	}
+
+	// renew it with a different snapshot
+	renewed := &api.HostSettingsSnapshot{
+		ContractPrice: types.Siacoins(3),
+		StoragePrice:  types.NewCurrency64(4),
+		Data:          []byte(`{"renewed":true}`),
+	}
+	if c, err := cs.AddRenewedContract(ctx, testContractRevision(fcid2, hk), types.ZeroCurrency, 2, fcid1, renewed); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(c.SettingsSnapshot, renewed) {
+		t.Fatalf("unexpected snapshot %+v", c.SettingsSnapshot)
+	}
+
+	// the archived contract should keep the snapshot it was formed with
+	if ac, err := cs.ArchivedContract(ctx, fcid1); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ac.SettingsSnapshot, formed) {
+		t.Fatalf("unexpected snapshot %+v", ac.SettingsSnapshot)
+	}
+
+	// archive the renewed contract and assert its snapshot is carried over
+	if err := cs.ArchiveContract(ctx, fcid2, api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
+	}
+	if ac, err := cs.ArchivedContract(ctx, fcid2); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ac.SettingsSnapshot, renewed) {
+		t.Fatalf("unexpected snapshot %+v", ac.SettingsSnapshot)
+	}
+
+	// contracts without a snapshot don't have one
+	if c, err := cs.AddContract(ctx, testContractRevision(types.FileContractID{3}, hk), types.ZeroCurrency, 1, "", nil); err != nil {
+		t.Fatal(err)
+	} else if c.SettingsSnapshot != nil {
+		t.Fatal("unexpected snapshot")
+	}
+}
+
 func TestContractsForHost(t *testing.T) {
 	// create a SQL store
 	cs, _, _, err := newTestSQLStore()
@@ -388,1142 +577,3848 @@ func TestContractsForHost(t *testing.T) {
 	}
 }
 
-// TestRenewContract is a test for AddRenewedContract.
-func TestRenewedContract(t *testing.T) {
+func TestSQLContractsForHost(t *testing.T) {
 	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// Create a host for the contract and another one for redundancy.
-	hks, err := cs.addTestHosts(2)
+	// add 3 hosts
+	hks, err := cs.addTestHosts(3)
 	if err != nil {
 		t.Fatal(err)
 	}
-	hk, hk2 := hks[0], hks[1]
+	hk1, hk2, hk3 := hks[0], hks[1], hks[2]
 
-	// Add announcements.
-	err = cs.insertTestAnnouncement(hk, hostdb.Announcement{NetAddress: "address"})
+	// add two contracts with the first host that overlap, e.g. because one
+	// was renewed early, and one with the second host
+	fcids := []types.FileContractID{{1}, {2}, {3}}
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[0], hk1), types.ZeroCurrency, 100, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.AddContract(ctx, testContractRevision(fcids[1], hk1), types.ZeroCurrency, 150, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.AddContract(ctx, testContractRevision(fcids[2], hk2), types.ZeroCurrency, 100, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// add one contract of each host to a set
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", []types.FileContractID{fcids[1], fcids[2]}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert all contracts with a host are returned, regardless of the set
+	contracts, err := cs.ContractsForHost(ctx, hk1, "")
 	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 2 || contracts[0].ID != fcids[0] || contracts[1].ID != fcids[1] {
+		t.Fatal("unexpected contracts", contracts)
 	}
-	err = cs.insertTestAnnouncement(hk2, hostdb.Announcement{NetAddress: "address2"})
+	for _, c := range contracts {
+		if c.HostKey != hk1 {
+			t.Fatal("unexpected host", c.HostKey)
+		}
+	}
+	contracts, err = cs.ContractsForHost(ctx, hk2, "")
 	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcids[2] {
+		t.Fatal("unexpected contracts", contracts)
 	}
 
-	// Create random unlock conditions for the hosts.
-	uc := generateMultisigUC(1, 2, "salt")
-	uc.PublicKeys[1].Key = hk[:]
-	uc.Timelock = 192837
-
-	uc2 := generateMultisigUC(1, 2, "salt")
-	uc2.PublicKeys[1].Key = hk2[:]
-	uc2.Timelock = 192837
-
-	// Insert the contracts.
-	fcid1 := types.FileContractID{1, 1, 1, 1, 1}
-	c := rhpv2.ContractRevision{
-		Revision: types.FileContractRevision{
-			ParentID:         fcid1,
-			UnlockConditions: uc,
-			FileContract: types.FileContract{
-				Filesize:       1,
-				WindowStart:    2,
-				WindowEnd:      3,
-				RevisionNumber: 4,
-			},
-		},
+	// assert a host without contracts has none
+	contracts, err = cs.ContractsForHost(ctx, hk3, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("unexpected contracts", contracts)
 	}
-	oldContractTotal := types.NewCurrency64(111)
-	oldContractStartHeight := uint64(100)
-	ctx := context.Background()
-	added, err := cs.AddContract(ctx, c, oldContractTotal, oldContractStartHeight)
+	contracts, err = cs.ContractsForHost(ctx, types.PublicKey{1}, "")
 	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("unexpected contracts", contracts)
 	}
 
-	// Assert the contract is returned.
-	if added.RenewedFrom != (types.FileContractID{}) {
-		t.Fatal("unexpected")
+	// assert the set filter can be combined with the host filter
+	contracts, err = cs.ContractsForHost(ctx, hk1, "foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcids[1] {
+		t.Fatal("unexpected contracts", contracts)
 	}
-
-	fcid2 := types.FileContractID{9, 9, 9, 9, 9}
-	c2 := c
-	c2.Revision.ParentID = fcid2
-	c2.Revision.UnlockConditions = uc2
-	_, err = cs.AddContract(ctx, c2, oldContractTotal, oldContractStartHeight)
+	contracts, err = cs.ContractsForHost(ctx, hk3, "foo")
 	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("unexpected contracts", contracts)
 	}
-
-	// add an object for that contract.
-	obj := object.Object{
-		Key: object.GenerateEncryptionKey(),
-		Slabs: []object.SlabSlice{
-			// good slab
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk,
-							Root: types.Hash256{1},
-						},
-						{
-							Host: hk2,
-							Root: types.Hash256{2},
-						},
-					},
-				},
-			},
-		},
+	if _, err := cs.ContractsForHost(ctx, hk1, "bar"); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("unexpected error", err)
 	}
 
-	// create a contract set with both contracts.
-	if err := cs.SetContractSet(context.Background(), "test", []types.FileContractID{fcid1, fcid2}); err != nil {
+	// assert the virtual set containing all contracts is supported
+	contracts, err = cs.ContractsForHost(ctx, hk1, api.ContractSetAll)
+	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 2 {
+		t.Fatal("unexpected contracts", contracts)
 	}
+}
 
-	// add the object.
-	if err := cs.UpdateObject(context.Background(), "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
-		hk:  fcid1,
-		hk2: fcid2,
-	}); err != nil {
+// TestContractSetIncremental is a test for AddContractsToSet and
+// RemoveContractsFromSet.
+func TestContractSetIncremental(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// no slabs should be unhealthy.
-	slabs, err := cs.UnhealthySlabs(context.Background(), 0.99, "test", 10)
+	// add 4 hosts with a contract each
+	hks, err := cs.addTestHosts(4)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) > 0 {
-		t.Fatal("shouldn't return any slabs", len(slabs))
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// Renew it.
-	fcid1Renewed := types.FileContractID{2, 2, 2, 2, 2}
-	renewed := rhpv2.ContractRevision{
-		Revision: types.FileContractRevision{
-			ParentID:         fcid1Renewed,
-			UnlockConditions: uc,
-			FileContract: types.FileContract{
-				MissedProofOutputs: []types.SiacoinOutput{},
-				ValidProofOutputs:  []types.SiacoinOutput{},
-			},
-		},
+	// assertSet is a helper to assert the contracts in a set
+	assertSet := func(set string, expected ...types.FileContractID) {
+		t.Helper()
+		contracts, err := cs.ContractSetContracts(ctx, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[types.FileContractID]struct{})
+		for _, c := range contracts {
+			ids[c.ID] = struct{}{}
+		}
+		if len(ids) != len(contracts) || len(ids) != len(expected) {
+			t.Fatalf("expected %v contracts, got %v", len(expected), len(contracts))
+		}
+		for _, fcid := range expected {
+			if _, ok := ids[fcid]; !ok {
+				t.Fatalf("contract %v not in set", fcid)
+			}
+		}
 	}
-	newContractTotal := types.NewCurrency64(222)
-	newContractStartHeight := uint64(200)
-	if _, err := cs.AddRenewedContract(ctx, renewed, newContractTotal, newContractStartHeight, fcid1); err != nil {
+
+	// adding to an unknown set creates it
+	if err := cs.AddContractsToSet(ctx, "foo", fcids[:2]); err != nil {
 		t.Fatal(err)
 	}
+	assertSet("foo", fcids[0], fcids[1])
 
-	// make sure the contract set was updated.
-	setContracts, err := cs.ContractSetContracts(context.Background(), "test")
-	if err != nil {
+	// adding is idempotent and doesn't drop existing contracts
+	if err := cs.AddContractsToSet(ctx, "foo", fcids[1:3]); err != nil {
 		t.Fatal(err)
 	}
-	if len(setContracts) != 2 || (setContracts[0].ID != fcid1Renewed && setContracts[1].ID != fcid1Renewed) {
-		t.Fatal("contract set wasn't updated", setContracts)
-	}
+	assertSet("foo", fcids[0], fcids[1], fcids[2])
 
-	// slab should still be in good shape.
-	slabs, err = cs.UnhealthySlabs(context.Background(), 0.99, "test", 10)
-	if err != nil {
+	// removing only removes the given contracts
+	if err := cs.RemoveContractsFromSet(ctx, "foo", []types.FileContractID{fcids[1], fcids[3]}); err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) > 0 {
-		t.Fatal("shouldn't return any slabs", len(slabs))
-	}
+	assertSet("foo", fcids[0], fcids[2])
 
-	// Contract should be gone from active contracts.
-	_, err = cs.Contract(ctx, fcid1)
-	if !errors.Is(err, ErrContractNotFound) {
+	// replacing the set is still possible
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[2:], false); err != nil {
 		t.Fatal(err)
 	}
+	assertSet("foo", fcids[2], fcids[3])
 
-	// New contract should exist.
-	newContract, err := cs.Contract(ctx, fcid1Renewed)
-	if err != nil {
+	// incremental updates apply on top of the replaced set
+	if err := cs.AddContractsToSet(ctx, "foo", fcids[:1]); err != nil {
+		t.Fatal(err)
+	} else if err := cs.RemoveContractsFromSet(ctx, "foo", fcids[3:]); err != nil {
 		t.Fatal(err)
 	}
-	expected := api.ContractMetadata{
-		ID:          fcid1Renewed,
-		HostIP:      "address",
-		HostKey:     hk,
-		StartHeight: newContractStartHeight,
-		RenewedFrom: fcid1,
-		Spending: api.ContractSpending{
-			Uploads:     types.ZeroCurrency,
-			Downloads:   types.ZeroCurrency,
-			FundAccount: types.ZeroCurrency,
-		},
-		TotalCost: newContractTotal,
+	assertSet("foo", fcids[0], fcids[2])
+
+	// other sets are not affected
+	assertSet(testContractSet)
+
+	// unknown contracts are rejected and leave the set untouched
+	unknown := types.FileContractID{9}
+	if err := cs.AddContractsToSet(ctx, "foo", []types.FileContractID{fcids[1], unknown}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
+	} else if err := cs.RemoveContractsFromSet(ctx, "foo", []types.FileContractID{fcids[0], unknown}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
 	}
-	if !reflect.DeepEqual(newContract, expected) {
-		t.Fatal("mismatch")
+	assertSet("foo", fcids[0], fcids[2])
+
+	// removing from an unknown set fails
+	if err := cs.RemoveContractsFromSet(ctx, "bar", fcids[:1]); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	if err := cs.AddContractsToSet(ctx, "bar", nil); err != nil {
+		t.Fatal(err)
 	}
+	assertSet("bar")
+}
 
-	// Archived contract should exist.
-	var ac dbArchivedContract
-	err = cs.db.Model(&dbArchivedContract{}).
-		Where("fcid", fileContractID(fcid1)).
-		Take(&ac).
-		Error
+// TestContractSetsCount is a test for ContractSets.
+func TestContractSetsCount(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	ac.Model = Model{}
-	expectedContract := dbArchivedContract{
-		Host:      publicKey(c.HostKey()),
-		RenewedTo: fileContractID(fcid1Renewed),
-		Reason:    api.ContractArchivalReasonRenewed,
-
-		ContractCommon: ContractCommon{
-			FCID: fileContractID(fcid1),
-
-			TotalCost:      currency(oldContractTotal),
-			ProofHeight:    0,
-			RevisionHeight: 0,
-			RevisionNumber: "0",
-			StartHeight:    100,
-			WindowStart:    2,
-			WindowEnd:      3,
-
-			UploadSpending:      zeroCurrency,
-			DownloadSpending:    zeroCurrency,
-			FundAccountSpending: zeroCurrency,
-		},
-	}
-	if !reflect.DeepEqual(ac, expectedContract) {
-		t.Fatal("mismatch", cmp.Diff(ac, expectedContract))
-	}
-
-	// Renew it once more.
-	fcid3 := types.FileContractID{3, 3, 3, 3, 3}
-	renewed = rhpv2.ContractRevision{
-		Revision: types.FileContractRevision{
-			ParentID:         fcid3,
-			UnlockConditions: uc,
-			FileContract: types.FileContract{
-				MissedProofOutputs: []types.SiacoinOutput{},
-				ValidProofOutputs:  []types.SiacoinOutput{},
-			},
-		},
-	}
-	newContractTotal = types.NewCurrency64(333)
-	newContractStartHeight = uint64(300)
-
-	// Assert the renewed contract is returned
-	renewedContract, err := cs.AddRenewedContract(ctx, renewed, newContractTotal, newContractStartHeight, fcid1Renewed)
+	// add 3 hosts with a contract each
+	hks, err := cs.addTestHosts(3)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if renewedContract.RenewedFrom != fcid1Renewed {
-		t.Fatal("unexpected")
-	}
-}
-
-// TestAncestorsContracts verifies that AncestorContracts returns the right
-// ancestors in the correct order.
-func TestAncestorsContracts(t *testing.T) {
-	cs, _, _, err := newTestSQLStore()
+	fcids, _, err := cs.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	hk := types.PublicKey{1, 2, 3}
-	if err := cs.addTestHost(hk); err != nil {
+	// create two sets, one of them empty
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[:2], false); err != nil {
 		t.Fatal(err)
-	}
-
-	// Create a chain of 4 contracts.
-	// Their start heights are 0, 1, 2, 3.
-	fcids := []types.FileContractID{{1}, {2}, {3}, {4}}
-	if _, err := cs.addTestContract(fcids[0], hk); err != nil {
+	} else if _, _, _, err := cs.SetContractSet(ctx, "bar", nil, false); err != nil {
 		t.Fatal(err)
 	}
-	for i := 1; i < len(fcids); i++ {
-		if _, err := cs.addTestRenewedContract(fcids[i], fcids[i-1], hk, uint64(i)); err != nil {
+
+	// assertSets is a helper to assert the sets and their counts
+	assertSets := func(expected []api.ContractSet) {
+		t.Helper()
+		sets, err := cs.ContractSets(ctx)
+		if err != nil {
 			t.Fatal(err)
+		} else if !reflect.DeepEqual(sets, expected) {
+			t.Fatalf("unexpected sets, %+v != %+v", sets, expected)
 		}
 	}
+	assertSets([]api.ContractSet{
+		{Name: api.ContractSetAll, Contracts: 3, Virtual: true},
+		{Name: "bar", Contracts: 0},
+		{Name: "foo", Contracts: 2},
+		{Name: testContractSet, Contracts: 0},
+	})
 
-	// Fetch the ancestors but only the ones with a startHeight >= 1. That
-	// should return 2 contracts. The active one with height 3 isn't
-	// returned and the one with height 0 is also not returned.
-	contracts, err := cs.AncestorContracts(context.Background(), fcids[len(fcids)-1], 1)
-	if err != nil {
+	// archive a contract in the set, the set should still be returned
+	if err := cs.ArchiveContract(ctx, fcids[0], api.ContractArchivalReasonRemoved); err != nil {
 		t.Fatal(err)
 	}
-	if len(contracts) != len(fcids)-2 {
-		t.Fatal("wrong number of contracts returned", len(contracts))
-	}
-	for i := 0; i < len(contracts)-1; i++ {
-		if !reflect.DeepEqual(contracts[i], api.ArchivedContract{
-			ID:          fcids[len(fcids)-2-i],
-			HostKey:     hk,
-			RenewedTo:   fcids[len(fcids)-1-i],
-			StartHeight: 2,
-			WindowStart: 400,
-			WindowEnd:   500,
-		}) {
-			t.Fatal("wrong contract", i)
-		}
+	assertSets([]api.ContractSet{
+		{Name: api.ContractSetAll, Contracts: 2, Virtual: true},
+		{Name: "bar", Contracts: 0},
+		{Name: "foo", Contracts: 1},
+		{Name: testContractSet, Contracts: 0},
+	})
+
+	// archive the last contract in the set
+	if err := cs.ArchiveContract(ctx, fcids[1], api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
 	}
+	assertSets([]api.ContractSet{
+		{Name: api.ContractSetAll, Contracts: 1, Virtual: true},
+		{Name: "bar", Contracts: 0},
+		{Name: "foo", Contracts: 0},
+		{Name: testContractSet, Contracts: 0},
+	})
 }
 
-func TestArchiveContracts(t *testing.T) {
+// TestRemoveContractSet is a test for RemoveContractSet.
+func TestRemoveContractSet(t *testing.T) {
 	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// add 3 hosts
+	// add 3 hosts with a contract each
 	hks, err := cs.addTestHosts(3)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// add 3 contracts
 	fcids, _, err := cs.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// archive 2 of them
-	toArchive := map[types.FileContractID]string{
-		fcids[1]: "foo",
-		fcids[2]: "bar",
+	// create two overlapping sets
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[:2], false); err != nil {
+		t.Fatal(err)
+	} else if _, _, _, err := cs.SetContractSet(ctx, "bar", fcids[1:], false); err != nil {
+		t.Fatal(err)
 	}
-	if err := cs.ArchiveContracts(context.Background(), toArchive); err != nil {
+
+	// remove the first set
+	if err := cs.RemoveContractSet(ctx, "foo"); err != nil {
 		t.Fatal(err)
 	}
 
-	// assert the first one is still active
-	active, err := cs.Contracts(context.Background())
-	if err != nil {
+	// assert the set is gone, including its join rows
+	if _, err := cs.ContractSetContracts(ctx, "foo"); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	var cnt int64
+	if err := cs.db.Table("contract_set_contracts").Count(&cnt).Error; err != nil {
 		t.Fatal(err)
+	} else if cnt != 2 {
+		t.Fatal("unexpected number of join rows", cnt)
 	}
-	if len(active) != 1 || active[0].ID != fcids[0] {
-		t.Fatal("wrong contracts", active)
+
+	// assert the contracts survived
+	if contracts, err := cs.Contracts(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 3 {
+		t.Fatal("unexpected number of contracts", len(contracts))
 	}
 
-	// assert the two others were archived
-	ffcids := make([]fileContractID, 2)
-	ffcids[0] = fileContractID(fcids[1])
-	ffcids[1] = fileContractID(fcids[2])
-	var acs []dbArchivedContract
-	err = cs.db.Model(&dbArchivedContract{}).
-		Where("fcid IN (?)", ffcids).
-		Find(&acs).
-		Error
-	if err != nil {
+	// assert the other set is untouched
+	if contracts, err := cs.ContractSetContracts(ctx, "bar"); err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 2 {
+		t.Fatal("unexpected number of contracts", len(contracts))
 	}
-	if len(acs) != 2 {
-		t.Fatal("wrong number of archived contracts", len(acs))
+
+	// assert the set can be recreated
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[:1], false); err != nil {
+		t.Fatal(err)
+	} else if contracts, err := cs.ContractSetContracts(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcids[0] {
+		t.Fatal("unexpected contracts", contracts)
 	}
-	if acs[0].Reason != "foo" || acs[1].Reason != "bar" {
-		t.Fatal("unexpected reason", acs[0].Reason, acs[1].Reason)
+
+	// assert unknown and reserved sets can't be removed
+	if err := cs.RemoveContractSet(ctx, "baz"); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("unexpected error", err)
+	} else if err := cs.RemoveContractSet(ctx, api.ContractSetAll); !errors.Is(err, api.ErrReservedSetName) {
+		t.Fatal("unexpected error", err)
 	}
 }
 
-func (s *SQLStore) addTestContracts(keys []types.PublicKey) (fcids []types.FileContractID, contracts []api.ContractMetadata, err error) {
-	cnt, err := s.contractsCount()
+// TestSetContractSetDiff asserts SetContractSet only updates the memberships
+// that changed and returns the diff.
+func TestSetContractSetDiff(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
 	if err != nil {
-		return nil, nil, err
+		t.Fatal(err)
 	}
-	for i, key := range keys {
-		fcids = append(fcids, types.FileContractID{byte(int(cnt) + i + 1)})
-		contract, err := s.addTestContract(fcids[len(fcids)-1], key)
+	ctx := context.Background()
+
+	// add 4 hosts with a contract each
+	hks, err := cs.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assertDiff is a helper to assert the diff returned by SetContractSet
+	assertDiff := func(contracts, expectedAdded, expectedRemoved []types.FileContractID) {
+		t.Helper()
+		added, removed, _, err := cs.SetContractSet(ctx, "foo", contracts, false)
 		if err != nil {
-			return nil, nil, err
+			t.Fatal(err)
+		} else if len(added) != len(expectedAdded) || len(removed) != len(expectedRemoved) {
+			t.Fatalf("unexpected diff, added %v removed %v", added, removed)
+		}
+		for i := range added {
+			if added[i] != expectedAdded[i] {
+				t.Fatal("unexpected added contract", added[i])
+			}
+		}
+		for i := range removed {
+			if removed[i] != expectedRemoved[i] {
+				t.Fatal("unexpected removed contract", removed[i])
+			}
 		}
-		contracts = append(contracts, contract)
 	}
-	return
-}
 
-func (s *SQLStore) addTestContract(fcid types.FileContractID, hk types.PublicKey) (api.ContractMetadata, error) {
-	rev := testContractRevision(fcid, hk)
-	return s.AddContract(context.Background(), rev, types.ZeroCurrency, 0)
-}
+	// rowID is a helper to fetch the row id of a contract's membership
+	rowID := func(fcid types.FileContractID) (id int64) {
+		t.Helper()
+		err := cs.db.
+			Raw("SELECT csc.rowid FROM contract_set_contracts csc INNER JOIN contracts c ON c.id = csc.db_contract_id WHERE c.fcid = ?", fileContractID(fcid)).
+			Scan(&id).
+			Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
 
-func (s *SQLStore) addTestRenewedContract(fcid, renewedFrom types.FileContractID, hk types.PublicKey, startHeight uint64) (api.ContractMetadata, error) {
-	rev := testContractRevision(fcid, hk)
-	return s.AddRenewedContract(context.Background(), rev, types.ZeroCurrency, startHeight, renewedFrom)
-}
+	// create the set
+	assertDiff(fcids[:3], fcids[:3], nil)
+	id1, id2 := rowID(fcids[1]), rowID(fcids[2])
 
-func (s *SQLStore) contractsCount() (cnt int64, err error) {
-	err = s.db.
-		Model(&dbContract{}).
-		Count(&cnt).
-		Error
-	return
-}
+	// setting the same contracts is a no-op
+	assertDiff(fcids[:3], nil, nil)
 
-func testContractRevision(fcid types.FileContractID, hk types.PublicKey) rhpv2.ContractRevision {
-	uc := generateMultisigUC(1, 2, "salt")
-	uc.PublicKeys[1].Key = hk[:]
-	uc.Timelock = 192837
-	return rhpv2.ContractRevision{
-		Revision: types.FileContractRevision{
-			ParentID:         fcid,
-			UnlockConditions: uc,
-			FileContract: types.FileContract{
-				RevisionNumber: 200,
-				Filesize:       4096,
-				FileMerkleRoot: types.Hash256{222},
-				WindowStart:    400,
-				WindowEnd:      500,
-				ValidProofOutputs: []types.SiacoinOutput{
-					{
-						Value:   types.NewCurrency64(121),
-						Address: types.Address{2, 1, 2},
-					},
-				},
-				MissedProofOutputs: []types.SiacoinOutput{
-					{
-						Value:   types.NewCurrency64(323),
-						Address: types.Address{2, 3, 2},
-					},
-				},
-				UnlockHash: types.Hash256{6, 6, 6},
-			},
-		},
-		Signatures: [2]types.TransactionSignature{
-			{
-				ParentID:       types.Hash256(fcid),
-				PublicKeyIndex: 0,
-				Timelock:       100000,
-				CoveredFields:  types.CoveredFields{WholeTransaction: true},
-				Signature:      []byte("signature1"),
-			},
-			{
-				ParentID:       types.Hash256(fcid),
-				PublicKeyIndex: 1,
-				Timelock:       200000,
-				CoveredFields:  types.CoveredFields{WholeTransaction: true},
-				Signature:      []byte("signature2"),
-			},
-		},
+	// swap out the first contract for the last one
+	assertDiff(fcids[1:], fcids[3:], fcids[:1])
+
+	// assert the memberships of the unchanged contracts were preserved
+	if rowID(fcids[1]) != id1 || rowID(fcids[2]) != id2 {
+		t.Fatal("memberships of unchanged contracts were recreated")
 	}
-}
 
-// TestSQLMetadataStore tests basic MetadataStore functionality.
-func TestSQLMetadataStore(t *testing.T) {
-	db, _, _, err := newTestSQLStore()
+	// unknown contracts are rejected and the set is left untouched
+	unknown := types.FileContractID{9}
+	var mce *api.MissingContractsError
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", append(fcids[2:], unknown, unknown), false); !errors.As(err, &mce) {
+		t.Fatal("expected MissingContractsError", err)
+	} else if !errors.Is(err, api.ErrContractsNotFound) {
+		t.Fatal("expected ErrContractsNotFound", err)
+	} else if len(mce.Missing) != 1 || mce.Missing[0] != unknown {
+		t.Fatal("unexpected missing contracts", mce.Missing)
+	} else if contracts, err := cs.ContractSetContracts(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 3 {
+		t.Fatal("set was updated", len(contracts))
+	}
+
+	// unless missing contracts are allowed, in which case they are returned
+	added, removed, missing, err := cs.SetContractSet(ctx, "foo", append(fcids[1:], unknown), true)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(added) != 0 || len(removed) != 0 {
+		t.Fatalf("unexpected diff, added %v removed %v", added, removed)
+	} else if len(missing) != 1 || missing[0] != unknown {
+		t.Fatal("unexpected missing contracts", missing)
 	}
 
-	// Create 2 hosts
-	hks, err := db.addTestHosts(2)
+	// clear the set
+	assertDiff(nil, nil, fcids[1:])
+	if contracts, err := cs.ContractSetContracts(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("unexpected contracts", contracts)
+	}
+}
+
+// TestContractSetChangeLog asserts contract set membership changes are recorded
+// alongside the changes themselves and can be queried and pruned.
+func TestContractSetChangeLog(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
-	hk1, hk2 := hks[0], hks[1]
+	ctx := context.Background()
 
-	// Create 2 contracts
-	fcids, contracts, err := db.addTestContracts(hks)
+	// add 4 hosts with a contract each
+	hks, err := cs.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := cs.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fcid1, fcid2 := fcids[0], fcids[1]
 
-	// Extract start height and total cost
-	startHeight1, totalCost1 := contracts[0].StartHeight, contracts[0].TotalCost
-	startHeight2, totalCost2 := contracts[1].StartHeight, contracts[1].TotalCost
+	// update the set twice
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[:3], false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mid := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[1:], false); err != nil {
+		t.Fatal(err)
+	}
 
-	// Define usedHosts.
-	usedHosts := map[types.PublicKey]types.FileContractID{
-		hk1: fcid1,
-		hk2: fcid2,
+	// remove, renew and archive a contract
+	renewed := types.FileContractID{9}
+	if err := cs.RemoveContractsFromSet(ctx, "foo", fcids[1:2]); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(renewed, fcids[2], hks[2], 1); err != nil {
+		t.Fatal(err)
+	} else if err := cs.ArchiveContract(ctx, fcids[3], api.ContractArchivalReasonHostPruned); err != nil {
+		t.Fatal(err)
 	}
 
-	// Create an object with 2 slabs pointing to 2 different sectors.
-	obj1 := object.Object{
-		Key: object.GenerateEncryptionKey(),
-		Slabs: []object.SlabSlice{
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{1},
-						},
-					},
-				},
-				Offset: 10,
-				Length: 100,
-			},
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 2,
-					Shards: []object.Sector{
-						{
-							Host: hk2,
-							Root: types.Hash256{2},
-						},
-					},
-				},
-				Offset: 20,
-				Length: 200,
-			},
-		},
+	// assert the changes were recorded in order
+	type change struct {
+		fcid   types.FileContractID
+		added  bool
+		reason string
 	}
-
-	// Store it.
-	ctx := context.Background()
-	objID := "key1"
-	if err := db.UpdateObject(ctx, objID, testContractSet, obj1, nil, usedHosts); err != nil {
+	expected := []change{
+		{fcids[0], true, api.ContractSetChangeReasonUpdated},
+		{fcids[1], true, api.ContractSetChangeReasonUpdated},
+		{fcids[2], true, api.ContractSetChangeReasonUpdated},
+		{fcids[0], false, api.ContractSetChangeReasonUpdated},
+		{fcids[3], true, api.ContractSetChangeReasonUpdated},
+		{fcids[1], false, api.ContractSetChangeReasonRemoved},
+		{fcids[2], false, api.ContractSetChangeReasonRenewed},
+		{renewed, true, api.ContractSetChangeReasonRenewed},
+		{fcids[3], false, "archived: hostpruned"},
+	}
+	changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{Set: "foo", Limit: -1})
+	if err != nil {
 		t.Fatal(err)
+	} else if len(changes) != len(expected) {
+		t.Fatal("unexpected number of changes", len(changes))
+	}
+	for i, c := range changes {
+		if c.Set != "foo" || c.ContractID != expected[i].fcid || c.Added != expected[i].added || c.Reason != expected[i].reason {
+			t.Fatalf("unexpected change at index %v: %+v", i, c)
+		} else if c.Timestamp.IsZero() || c.Timestamp.Location() != time.UTC {
+			t.Fatal("unexpected timestamp", c.Timestamp)
+		}
 	}
 
-	// Try to store it again. Should work.
-	if err := db.UpdateObject(ctx, objID, testContractSet, obj1, nil, usedHosts); err != nil {
+	// assert the filters are applied
+	if changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{ContractID: fcids[0], Limit: -1}); err != nil {
 		t.Fatal(err)
+	} else if len(changes) != 2 || !changes[0].Added || changes[1].Added {
+		t.Fatal("unexpected changes", changes)
 	}
-
-	// Fetch it using get and verify every field.
-	obj, err := db.dbObject(objID)
-	if err != nil {
+	if changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{To: mid, Limit: -1}); err != nil {
 		t.Fatal(err)
+	} else if len(changes) != 3 {
+		t.Fatal("unexpected number of changes", len(changes))
 	}
-
-	obj1Key, err := obj1.Key.MarshalText()
-	if err != nil {
+	if changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{From: mid, Offset: 1, Limit: 2}); err != nil {
 		t.Fatal(err)
+	} else if len(changes) != 2 || changes[0].ContractID != fcids[3] || changes[1].ContractID != fcids[1] {
+		t.Fatal("unexpected changes", changes)
 	}
-	obj1Slab0Key, err := obj1.Slabs[0].Key.MarshalText()
-	if err != nil {
+	if changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{Set: "bar", Limit: -1}); err != nil {
 		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Fatal("unexpected changes", changes)
 	}
-	obj1Slab1Key, err := obj1.Slabs[1].Key.MarshalText()
-	if err != nil {
+
+	// assert failed updates don't record anything
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", []types.FileContractID{{8}}, false); !errors.Is(err, api.ErrContractsNotFound) {
+		t.Fatal("expected ErrContractsNotFound", err)
+	}
+	errRollback := errors.New("rollback")
+	if err := cs.db.Transaction(func(tx *gorm.DB) error {
+		if err := recordContractSetChanges(tx, "foo", fcids, nil, api.ContractSetChangeReasonAdded); err != nil {
+			return err
+		}
+		return errRollback
+	}); !errors.Is(err, errRollback) {
+		t.Fatal("expected rollback", err)
+	}
+	if changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{Limit: -1}); err != nil {
 		t.Fatal(err)
+	} else if len(changes) != len(expected) {
+		t.Fatal("unexpected number of changes", len(changes))
 	}
 
-	// Set the Model fields to zero before comparing. These are set by gorm
-	// itself and contain a few timestamps which would make the following
-	// code a lot more verbose.
-	obj.Model = Model{}
-	for i := range obj.Slabs {
-		obj.Slabs[i].Model = Model{}
+	// prune the changes of the first update
+	if pruned, err := cs.pruneContractSetChanges(ctx, mid, 1); err != nil {
+		t.Fatal(err)
+	} else if pruned != 3 {
+		t.Fatal("unexpected number of pruned changes", pruned)
+	} else if changes, err := cs.ContractSetChanges(ctx, api.ContractSetChangesFilter{Limit: -1}); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != len(expected)-3 {
+		t.Fatal("unexpected number of changes", len(changes))
 	}
+}
 
-	expectedObj := dbObject{
-		ObjectID: objID,
-		Key:      obj1Key,
-		Size:     obj1.Size(),
-		Slabs: []dbSlice{
-			{
-				DBObjectID: 1,
-				DBSlabID:   1,
-				Offset:     10,
-				Length:     100,
-			},
-			{
-				DBObjectID: 1,
-				DBSlabID:   2,
-				Offset:     20,
-				Length:     200,
-			},
-		},
+// TestUpdateContractRevision is a test for UpdateContractRevision.
+func TestUpdateContractRevision(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(obj, expectedObj) {
-		t.Fatal("object mismatch", cmp.Diff(obj, expectedObj))
+	ctx := context.Background()
+
+	// add a host
+	hk := types.GeneratePrivateKey().PublicKey()
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
 	}
 
-	// Fetch it and verify again.
-	fullObj, err := db.Object(ctx, objID)
+	// add a contract, assert the revision number and size are taken from the
+	// revision
+	fcid := types.FileContractID{1}
+	rev := testContractRevision(fcid, hk)
+	rev.Revision.RevisionNumber = 10
+	rev.Revision.Filesize = 1 << 22
+	c, err := cs.AddContract(ctx, rev, types.ZeroCurrency, 100, "", nil)
 	if err != nil {
 		t.Fatal(err)
-	}
-	if !reflect.DeepEqual(fullObj, obj1) {
-		t.Fatal("object mismatch")
+	} else if c.RevisionNumber != 10 || c.Size != 1<<22 {
+		t.Fatal("unexpected revision", c.RevisionNumber, c.Size)
 	}
 
-	expectedObjSlab1 := dbSlab{
-		DBContractSetID: 1,
-		Key:             obj1Slab0Key,
-		MinShards:       1,
-		TotalShards:     1,
-		Shards: []dbSector{
-			{
-				DBSlabID:   1,
-				Root:       obj1.Slabs[0].Shards[0].Root[:],
-				LatestHost: publicKey(obj1.Slabs[0].Shards[0].Host),
-				Contracts: []dbContract{
-					{
-						HostID: 1,
-						Host: dbHost{
-							PublicKey: publicKey(hk1),
-						},
+	// assertRevision is a helper to assert the revision of a contract
+	assertRevision := func(fcid types.FileContractID, revisionNumber, size uint64) {
+		t.Helper()
+		c, err := cs.Contract(ctx, fcid)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.RevisionNumber != revisionNumber || c.Size != size {
+			t.Fatalf("unexpected revision, %v != %v or %v != %v", c.RevisionNumber, revisionNumber, c.Size, size)
+		}
+	}
 
-						ContractCommon: ContractCommon{
-							FCID: fileContractID(fcid1),
+	// update the revision
+	if err := cs.UpdateContractRevision(ctx, fcid, 11, 1<<23); err != nil {
+		t.Fatal(err)
+	}
+	assertRevision(fcid, 11, 1<<23)
 
-							TotalCost:      currency(totalCost1),
-							RevisionNumber: "0",
-							StartHeight:    startHeight1,
-							WindowStart:    400,
-							WindowEnd:      500,
+	// updating with the same revision number is allowed
+	if err := cs.UpdateContractRevision(ctx, fcid, 11, 1<<23); err != nil {
+		t.Fatal(err)
+	}
+	assertRevision(fcid, 11, 1<<23)
 
-							UploadSpending:      zeroCurrency,
-							DownloadSpending:    zeroCurrency,
-							FundAccountSpending: zeroCurrency,
-						},
-					},
-				},
-			},
-		},
+	// updating with a lower revision number is not
+	if err := cs.UpdateContractRevision(ctx, fcid, 10, 1<<22); !errors.Is(err, ErrRevisionNumberRegressed) {
+		t.Fatal("unexpected error", err)
 	}
+	assertRevision(fcid, 11, 1<<23)
 
-	expectedObjSlab2 := dbSlab{
-		DBContractSetID: 1,
-		Key:             obj1Slab1Key,
-		MinShards:       2,
-		TotalShards:     1,
-		Shards: []dbSector{
-			{
-				DBSlabID:   2,
-				Root:       obj1.Slabs[1].Shards[0].Root[:],
-				LatestHost: publicKey(obj1.Slabs[1].Shards[0].Host),
-				Contracts: []dbContract{
-					{
-						HostID: 2,
-						Host: dbHost{
-							PublicKey: publicKey(hk2),
-						},
-						ContractCommon: ContractCommon{
-							FCID: fileContractID(fcid2),
+	// revision numbers that don't fit in an int64 are supported
+	if err := cs.UpdateContractRevision(ctx, fcid, math.MaxUint64, 1<<23); err != nil {
+		t.Fatal(err)
+	}
+	assertRevision(fcid, math.MaxUint64, 1<<23)
 
-							TotalCost:      currency(totalCost2),
-							RevisionNumber: "0",
-							StartHeight:    startHeight2,
-							WindowStart:    400,
-							WindowEnd:      500,
+	// updating an unknown contract fails
+	if err := cs.UpdateContractRevision(ctx, types.FileContractID{2}, 1, 1); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
+	}
 
-							UploadSpending:      zeroCurrency,
-							DownloadSpending:    zeroCurrency,
-							FundAccountSpending: zeroCurrency,
-						},
-					},
-				},
-			},
-		},
+	// renew the contract, the renewed contract should carry the values of
+	// its initial revision
+	renewal := testContractRevision(types.FileContractID{3}, hk)
+	renewal.Revision.RevisionNumber = 1
+	renewal.Revision.Filesize = 1 << 23
+	if renewed, err := cs.AddRenewedContract(ctx, renewal, types.ZeroCurrency, 200, fcid, nil); err != nil {
+		t.Fatal(err)
+	} else if renewed.RevisionNumber != 1 || renewed.Size != 1<<23 {
+		t.Fatal("unexpected revision", renewed.RevisionNumber, renewed.Size)
 	}
+	assertRevision(types.FileContractID{3}, 1, 1<<23)
 
-	// Compare slabs.
-	slab1, err := db.dbSlab(obj1Slab0Key)
+	// the archived contract should carry the latest values of the old one
+	ancestors, err := cs.AncestorContracts(ctx, types.FileContractID{3}, 0)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(ancestors) != 1 || ancestors[0].RevisionNumber != math.MaxUint64 || ancestors[0].Size != 1<<23 {
+		t.Fatal("unexpected ancestors", ancestors)
 	}
-	slab2, err := db.dbSlab(obj1Slab1Key)
+}
+
+// TestContractSetChanges asserts contract set changes are emitted after they
+// were committed.
+func TestContractSetChanges(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
-	slabs := []*dbSlab{&slab1, &slab2}
-	for i := range slabs {
-		slabs[i].Model = Model{}
-		slabs[i].Shards[0].Model = Model{}
-		slabs[i].Shards[0].Contracts[0].Model = Model{}
-		slabs[i].Shards[0].Contracts[0].Host.Model = Model{}
-	}
-	if !reflect.DeepEqual(slab1, expectedObjSlab1) {
-		t.Fatal("mismatch", cmp.Diff(slab1, expectedObjSlab1))
-	}
-	if !reflect.DeepEqual(slab2, expectedObjSlab2) {
-		t.Fatal("mismatch", cmp.Diff(slab2, expectedObjSlab2))
-	}
+	ctx := context.Background()
 
-	// Remove the first slab of the object.
-	obj1.Slabs = obj1.Slabs[1:]
-	if err := db.UpdateObject(ctx, objID, testContractSet, obj1, nil, usedHosts); err != nil {
+	// add 3 hosts with a contract each
+	hks, err := cs.addTestHosts(3)
+	if err != nil {
 		t.Fatal(err)
 	}
-	fullObj, err = db.Object(ctx, objID)
+	fcids, _, err := cs.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(fullObj, obj1) {
-		t.Fatal("object mismatch")
-	}
 
-	// Sanity check the db at the end of the test. We expect:
-	// - 1 element in the object table since we only stored and overwrote a single object
-	// - 1 element in the slabs table since we updated the object to only have 1 slab
-	// - 1 element in the slices table for the same reason
-	// - 1 element in the sectors table for the same reason
-	countCheck := func(objCount, sliceCount, slabCount, sectorCount int64) error {
-		tableCountCheck := func(table interface{}, tblCount int64) error {
-			var count int64
-			if err := db.db.Model(table).Count(&count).Error; err != nil {
-				return err
-			}
-			if count != tblCount {
-				return fmt.Errorf("expected %v objects in table %v but got %v", tblCount, table.(schema.Tabler).TableName(), count)
-			}
-			return nil
+	// subscribe to changes, the subscriber asserts the change was committed
+	var changes []api.ContractSetChange
+	unsubscribe := cs.SubscribeContractSetChanges(func(change api.ContractSetChange) {
+		contracts, err := cs.ContractSetContracts(ctx, change.Name)
+		if errors.Is(err, api.ErrContractSetNotFound) {
+			contracts = nil // set was removed
+		} else if err != nil {
+			t.Error(err)
 		}
-		// Check all tables.
-		if err := tableCountCheck(&dbObject{}, objCount); err != nil {
-			return err
+		if len(contracts) != change.Size {
+			t.Errorf("change emitted before it was committed, %v != %v", len(contracts), change.Size)
 		}
-		if err := tableCountCheck(&dbSlice{}, sliceCount); err != nil {
-			return err
+		changes = append(changes, change)
+	})
+
+	// assertChange is a helper to assert the last emitted change
+	assertChange := func(n int, added, removed []types.FileContractID, size int) {
+		t.Helper()
+		if len(changes) != n {
+			t.Fatalf("expected %v changes, got %v", n, len(changes))
 		}
-		if err := tableCountCheck(&dbSlab{}, slabCount); err != nil {
-			return err
+		change := changes[n-1]
+		if change.Name != "foo" || change.Size != size {
+			t.Fatalf("unexpected change %+v", change)
+		} else if len(change.Added) != len(added) || len(change.Removed) != len(removed) {
+			t.Fatalf("unexpected change %+v", change)
 		}
-		if err := tableCountCheck(&dbSector{}, sectorCount); err != nil {
-			return err
+		for i := range added {
+			if change.Added[i] != added[i] {
+				t.Fatalf("unexpected change %+v", change)
+			}
+		}
+		for i := range removed {
+			if change.Removed[i] != removed[i] {
+				t.Fatalf("unexpected change %+v", change)
+			}
 		}
-		return nil
 	}
-	if err := countCheck(1, 1, 1, 1); err != nil {
+
+	// update the set in all possible ways
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[:2], false); err != nil {
 		t.Fatal(err)
 	}
-
-	// Delete the object. Due to the cascade this should delete everything
-	// but the sectors.
-	if err := db.RemoveObject(ctx, objID); err != nil {
+	assertChange(1, fcids[:2], nil, 2)
+	if err := cs.AddContractsToSet(ctx, "foo", fcids[1:]); err != nil {
 		t.Fatal(err)
 	}
-	if err := countCheck(0, 0, 0, 0); err != nil {
+	assertChange(2, fcids[2:], nil, 3)
+	if err := cs.RemoveContractsFromSet(ctx, "foo", fcids[:1]); err != nil {
 		t.Fatal(err)
 	}
-}
+	assertChange(3, nil, fcids[:1], 2)
 
-// TestObjectEntries is a test for the ObjectEntries method.
-func TestObjectEntries(t *testing.T) {
-	os, _, _, err := newTestSQLStore()
-	if err != nil {
+	// updates that don't change the set don't emit a change
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[1:], false); err != nil {
+		t.Fatal(err)
+	} else if err := cs.AddContractsToSet(ctx, "foo", fcids[1:2]); err != nil {
+		t.Fatal(err)
+	} else if err := cs.RemoveContractsFromSet(ctx, "foo", fcids[:1]); err != nil {
 		t.Fatal(err)
 	}
-	objects := []struct {
-		path string
-		size int64
-	}{
-		{"/foo/bar", 1},
-		{"/foo/bat", 2},
-		{"/foo/baz/quux", 3},
-		{"/foo/baz/quuz", 4},
-		{"/gab/guub", 5},
-		{"/fileś/śpecial", 6}, // utf8
+	assertChange(3, nil, fcids[:1], 2)
+
+	// updates that are rolled back don't emit a change
+	unknown := types.FileContractID{9}
+	if err := cs.AddContractsToSet(ctx, "foo", []types.FileContractID{fcids[0], unknown}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
+	} else if err := cs.RemoveContractsFromSet(ctx, "foo", []types.FileContractID{fcids[1], unknown}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
 	}
-	ctx := context.Background()
-	for _, o := range objects {
-		obj, ucs := newTestObject(frand.Intn(9) + 1)
-		obj.Slabs = obj.Slabs[:1]
+	assertChange(3, nil, fcids[:1], 2)
+
+	// renewing a contract in the set emits a change
+	renewed := types.FileContractID{10}
+	if _, err := cs.addTestRenewedContract(renewed, fcids[1], hks[1], 2); err != nil {
+		t.Fatal(err)
+	}
+	assertChange(4, []types.FileContractID{renewed}, fcids[1:2], 2)
+
+	// archiving a contract in the set emits a change
+	if err := cs.ArchiveContracts(ctx, map[types.FileContractID]string{fcids[2]: api.ContractArchivalReasonRemoved}); err != nil {
+		t.Fatal(err)
+	}
+	assertChange(5, nil, fcids[2:], 1)
+
+	// renewals and archivals that are rolled back don't emit a change
+	if _, err := cs.addTestRenewedContract(types.FileContractID{11}, unknown, hks[1], 3); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
+	} else if _, err := cs.ArchiveContractsForHost(ctx, types.PublicKey{9}, ""); !errors.Is(err, ErrHostNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	assertChange(5, nil, fcids[2:], 1)
+
+	// removing the set emits a change, unless it's rolled back
+	if err := cs.RemoveContractSet(ctx, "bar"); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	assertChange(5, nil, fcids[2:], 1)
+	if err := cs.RemoveContractSet(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	assertChange(6, nil, []types.FileContractID{renewed}, 0)
+
+	// unsubscribe and assert no more changes are received
+	unsubscribe()
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", []types.FileContractID{renewed}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertChange(6, nil, []types.FileContractID{renewed}, 0)
+}
+
+// TestRenewContract is a test for AddRenewedContract.
+func TestRenewedContract(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a host for the contract and another one for redundancy.
+	hks, err := cs.addTestHosts(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk, hk2 := hks[0], hks[1]
+
+	// Add announcements.
+	err = cs.insertTestAnnouncement(hk, hostdb.Announcement{NetAddress: "address"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cs.insertTestAnnouncement(hk2, hostdb.Announcement{NetAddress: "address2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create random unlock conditions for the hosts.
+	uc := generateMultisigUC(1, 2, "salt")
+	uc.PublicKeys[1].Key = hk[:]
+	uc.Timelock = 192837
+
+	uc2 := generateMultisigUC(1, 2, "salt")
+	uc2.PublicKeys[1].Key = hk2[:]
+	uc2.Timelock = 192837
+
+	// Insert the contracts.
+	fcid1 := types.FileContractID{1, 1, 1, 1, 1}
+	c := rhpv2.ContractRevision{
+		Revision: types.FileContractRevision{
+			ParentID:         fcid1,
+			UnlockConditions: uc,
+			FileContract: types.FileContract{
+				Filesize:       1,
+				WindowStart:    2,
+				WindowEnd:      3,
+				RevisionNumber: 4,
+			},
+		},
+	}
+	oldContractTotal := types.NewCurrency64(111)
+	oldContractStartHeight := uint64(100)
+	ctx := context.Background()
+	added, err := cs.AddContract(ctx, c, oldContractTotal, oldContractStartHeight, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert the contract is returned.
+	if added.RenewedFrom != (types.FileContractID{}) {
+		t.Fatal("unexpected")
+	}
+
+	fcid2 := types.FileContractID{9, 9, 9, 9, 9}
+	c2 := c
+	c2.Revision.ParentID = fcid2
+	c2.Revision.UnlockConditions = uc2
+	_, err = cs.AddContract(ctx, c2, oldContractTotal, oldContractStartHeight, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add an object for that contract.
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			// good slab
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk,
+							Root: types.Hash256{1},
+						},
+						{
+							Host: hk2,
+							Root: types.Hash256{2},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// create a contract set with both contracts.
+	if _, _, _, err := cs.SetContractSet(context.Background(), "test", []types.FileContractID{fcid1, fcid2}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// add the object.
+	if err := cs.UpdateObject(context.Background(), "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
+		hk:  fcid1,
+		hk2: fcid2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// no slabs should be unhealthy.
+	slabs, err := cs.UnhealthySlabs(context.Background(), 0.99, "test", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) > 0 {
+		t.Fatal("shouldn't return any slabs", len(slabs))
+	}
+
+	// Renew it.
+	fcid1Renewed := types.FileContractID{2, 2, 2, 2, 2}
+	renewed := rhpv2.ContractRevision{
+		Revision: types.FileContractRevision{
+			ParentID:         fcid1Renewed,
+			UnlockConditions: uc,
+			FileContract: types.FileContract{
+				MissedProofOutputs: []types.SiacoinOutput{},
+				ValidProofOutputs:  []types.SiacoinOutput{},
+			},
+		},
+	}
+	newContractTotal := types.NewCurrency64(222)
+	newContractStartHeight := uint64(200)
+	if _, err := cs.AddRenewedContract(ctx, renewed, newContractTotal, newContractStartHeight, fcid1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the contract set was updated.
+	setContracts, err := cs.ContractSetContracts(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setContracts) != 2 || (setContracts[0].ID != fcid1Renewed && setContracts[1].ID != fcid1Renewed) {
+		t.Fatal("contract set wasn't updated", setContracts)
+	}
+
+	// slab should still be in good shape.
+	slabs, err = cs.UnhealthySlabs(context.Background(), 0.99, "test", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) > 0 {
+		t.Fatal("shouldn't return any slabs", len(slabs))
+	}
+
+	// Contract should be gone from active contracts.
+	_, err = cs.Contract(ctx, fcid1)
+	if !errors.Is(err, ErrContractNotFound) {
+		t.Fatal(err)
+	}
+
+	// New contract should exist.
+	newContract, err := cs.Contract(ctx, fcid1Renewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := api.ContractMetadata{
+		ID:           fcid1Renewed,
+		HostAddress:  "address",
+		HostIP:       "address",
+		HostIPSource: api.HostIPSourceHost,
+		HostKey:      hk,
+		StartHeight:  newContractStartHeight,
+		RenewedFrom:  fcid1,
+		Spending: api.ContractSpending{
+			Uploads:     types.ZeroCurrency,
+			Downloads:   types.ZeroCurrency,
+			FundAccount: types.ZeroCurrency,
+		},
+		TotalCost: newContractTotal,
+	}
+	if newContract.CreatedAt.IsZero() {
+		t.Fatal("creation time not set")
+	}
+	expected.CreatedAt = newContract.CreatedAt
+	if !reflect.DeepEqual(newContract, expected) {
+		t.Fatal("mismatch")
+	}
+
+	// Archived contract should exist.
+	var ac dbArchivedContract
+	err = cs.db.Model(&dbArchivedContract{}).
+		Where("fcid", fileContractID(fcid1)).
+		Take(&ac).
+		Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ac.ArchivedAt.IsZero() || ac.ArchivedAt.Before(ac.CreatedAt) {
+		t.Fatal("unexpected archival time", ac.CreatedAt, ac.ArchivedAt)
+	}
+	ac.Model = Model{}
+	ac.ArchivedAt = time.Time{}
+	expectedContract := dbArchivedContract{
+		Host:       publicKey(c.HostKey()),
+		NetAddress: "address",
+		RenewedTo:  fileContractID(fcid1Renewed),
+		Reason:     api.ContractArchivalReasonRenewed,
+
+		ContractCommon: ContractCommon{
+			FCID: fileContractID(fcid1),
+
+			TotalCost:      currency(oldContractTotal),
+			ProofHeight:    0,
+			RevisionHeight: 0,
+			RevisionNumber: "4",
+			Size:           1,
+			StartHeight:    100,
+			WindowStart:    2,
+			WindowEnd:      3,
+
+			UploadSpending:      zeroCurrency,
+			DownloadSpending:    zeroCurrency,
+			FundAccountSpending: zeroCurrency,
+		},
+	}
+	if !reflect.DeepEqual(ac, expectedContract) {
+		t.Fatal("mismatch", cmp.Diff(ac, expectedContract))
+	}
+
+	// Assert the total cost and host address are exposed.
+	archived, err := cs.ArchivedContract(ctx, fcid1)
+	if err != nil {
+		t.Fatal(err)
+	} else if archived.TotalCost.Cmp(oldContractTotal) != 0 {
+		t.Fatal("unexpected total cost", archived.TotalCost)
+	} else if archived.HostIP != "address" {
+		t.Fatal("unexpected host ip", archived.HostIP)
+	}
+
+	// Renew it once more.
+	fcid3 := types.FileContractID{3, 3, 3, 3, 3}
+	renewed = rhpv2.ContractRevision{
+		Revision: types.FileContractRevision{
+			ParentID:         fcid3,
+			UnlockConditions: uc,
+			FileContract: types.FileContract{
+				MissedProofOutputs: []types.SiacoinOutput{},
+				ValidProofOutputs:  []types.SiacoinOutput{},
+			},
+		},
+	}
+	newContractTotal = types.NewCurrency64(333)
+	newContractStartHeight = uint64(300)
+
+	// Assert the renewed contract is returned
+	renewedContract, err := cs.AddRenewedContract(ctx, renewed, newContractTotal, newContractStartHeight, fcid1Renewed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewedContract.RenewedFrom != fcid1Renewed {
+		t.Fatal("unexpected")
+	}
+}
+
+// TestAncestorsContracts verifies that AncestorContracts returns the right
+// ancestors in the correct order.
+func TestAncestorsContracts(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hk := types.PublicKey{1, 2, 3}
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a chain of 4 contracts.
+	// Their start heights are 0, 1, 2, 3.
+	fcids := []types.FileContractID{{1}, {2}, {3}, {4}}
+	if _, err := cs.addTestContract(fcids[0], hk); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(fcids); i++ {
+		if _, err := cs.addTestRenewedContract(fcids[i], fcids[i-1], hk, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fetch the ancestors but only the ones with a startHeight >= 1. That
+	// should return 2 contracts. The active one with height 3 isn't
+	// returned and the one with height 0 is also not returned.
+	contracts, err := cs.AncestorContracts(context.Background(), fcids[len(fcids)-1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contracts) != len(fcids)-2 {
+		t.Fatal("wrong number of contracts returned", len(contracts))
+	}
+	for i := 0; i < len(contracts)-1; i++ {
+		if !reflect.DeepEqual(contracts[i], api.ArchivedContract{
+			ID:             fcids[len(fcids)-2-i],
+			HostKey:        hk,
+			RenewedTo:      fcids[len(fcids)-1-i],
+			Reason:         api.ContractArchivalReasonRenewed,
+			RevisionNumber: 200,
+			Size:           4096,
+			StartHeight:    2,
+			WindowStart:    400,
+			WindowEnd:      500,
+			CreatedAt:      contracts[i].CreatedAt,
+			ArchivedAt:     contracts[i].ArchivedAt,
+		}) {
+			t.Fatal("wrong contract", i)
+		}
+	}
+}
+
+// TestAncestorContractsDepth asserts AncestorContracts follows long renewal
+// chains, stops at loops and gives up on chains that are too long.
+func TestAncestorContractsDepth(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hk := types.PublicKey{1}
+	addArchived := func(fcid, renewedTo types.FileContractID, startHeight uint64) {
+		t.Helper()
+		if err := cs.db.Create(&dbArchivedContract{
+			ContractCommon: ContractCommon{
+				FCID:        fileContractID(fcid),
+				StartHeight: startHeight,
+			},
+			RenewedTo: fileContractID(renewedTo),
+			Host:      publicKey(hk),
+			Reason:    api.ContractArchivalReasonRenewed,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// create a chain of 100 archived contracts
+	chainID := func(i int) types.FileContractID { return types.FileContractID{1, byte(i)} }
+	for i := 1; i <= 100; i++ {
+		addArchived(chainID(i), chainID(i+1), uint64(i))
+	}
+
+	// assert all ancestors are returned, closest first
+	ancestors, err := cs.AncestorContracts(ctx, chainID(101), 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 100 {
+		t.Fatal("unexpected number of ancestors", len(ancestors))
+	}
+	for i, ancestor := range ancestors {
+		if ancestor.ID != chainID(100-i) {
+			t.Fatalf("unexpected ancestor at index %v, %v", i, ancestor.ID)
+		}
+	}
+
+	// assert the start height is respected
+	if ancestors, err := cs.AncestorContracts(ctx, chainID(101), 51); err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 50 {
+		t.Fatal("unexpected number of ancestors", len(ancestors))
+	}
+
+	// assert the depth limit is enforced
+	if _, err := cs.ancestorContracts(ctx, chainID(101), 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.ancestorContracts(ctx, chainID(101), 0, 99); !errors.Is(err, ErrAncestorDepthExceeded) {
+		t.Fatal("expected ErrAncestorDepthExceeded", err)
+	}
+
+	// create a loop and assert the walk stops
+	addArchived(types.FileContractID{2, 1}, types.FileContractID{2, 2}, 1)
+	addArchived(types.FileContractID{2, 2}, types.FileContractID{2, 3}, 2)
+	addArchived(types.FileContractID{2, 3}, types.FileContractID{2, 1}, 3)
+	ancestors, err = cs.AncestorContracts(ctx, types.FileContractID{2, 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 2 || ancestors[0].ID != (types.FileContractID{2, 3}) || ancestors[1].ID != (types.FileContractID{2, 2}) {
+		t.Fatal("unexpected ancestors", ancestors)
+	}
+}
+
+func TestRenewalChainSpending(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hks, err := cs.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk := hks[0]
+
+	// record spending for the given contract
+	recordSpending := func(fcid types.FileContractID, uploads, downloads, fundAccount uint64) {
+		t.Helper()
+		if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{
+			ContractID: fcid,
+			ContractSpending: api.ContractSpending{
+				Uploads:     types.NewCurrency64(uploads),
+				Downloads:   types.NewCurrency64(downloads),
+				FundAccount: types.NewCurrency64(fundAccount),
+			},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// form a contract and renew it twice, recording spending along the way
+	fcid1, fcid2, fcid3 := types.FileContractID{1}, types.FileContractID{2}, types.FileContractID{3}
+	if _, err := cs.AddContract(ctx, testContractRevision(fcid1, hk), types.NewCurrency64(100), 10, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	recordSpending(fcid1, 1, 2, 3)
+	if _, err := cs.AddRenewedContract(ctx, testContractRevision(fcid2, hk), types.NewCurrency64(200), 20, fcid1, nil); err != nil {
+		t.Fatal(err)
+	}
+	recordSpending(fcid2, 10, 20, 30)
+	if _, err := cs.AddRenewedContract(ctx, testContractRevision(fcid3, hk), types.NewCurrency64(300), 30, fcid2, nil); err != nil {
+		t.Fatal(err)
+	}
+	recordSpending(fcid3, 100, 200, 300)
+
+	// assert the spending is summed across the chain
+	spending, err := cs.RenewalChainSpending(ctx, fcid3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := api.RenewalChainSpending{
+		ID:               fcid3,
+		Contracts:        3,
+		FirstStartHeight: 10,
+		TotalCost:        types.NewCurrency64(600),
+		Spending: api.ContractSpending{
+			Uploads:     types.NewCurrency64(111),
+			Downloads:   types.NewCurrency64(222),
+			FundAccount: types.NewCurrency64(333),
+		},
+	}
+	if !reflect.DeepEqual(spending, expected) {
+		t.Fatalf("unexpected spending %+v", spending)
+	}
+
+	// assert archived contracts aren't accepted
+	if _, err := cs.RenewalChainSpending(ctx, fcid2); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
+	}
+}
+
+// TestRenewalChain is a test for RenewalChain.
+func TestRenewalChain(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host
+	hk := types.GeneratePrivateKey().PublicKey()
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a contract and renew it three times
+	fcids := []types.FileContractID{{1}, {2}, {3}, {4}}
+	if _, err := cs.addTestContract(fcids[0], hk); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(fcids); i++ {
+		if _, err := cs.addTestRenewedContract(fcids[i], fcids[i-1], hk, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assertChain is a helper to assert the chain returned for a contract
+	assertChain := func(fcid types.FileContractID, expectedTruncated bool, expected ...types.FileContractID) {
+		t.Helper()
+		chain, truncated, err := cs.RenewalChain(ctx, fcid)
+		if err != nil {
+			t.Fatal(err)
+		} else if truncated != expectedTruncated {
+			t.Fatalf("expected truncated to be %v", expectedTruncated)
+		} else if len(chain) != len(expected) {
+			t.Fatalf("expected %v contracts, got %v", len(expected), len(chain))
+		}
+		for i, c := range chain {
+			if c.ID != expected[i] {
+				t.Fatalf("unexpected contract at index %v, %v != %v", i, c.ID, expected[i])
+			} else if c.HostKey != hk {
+				t.Fatal("unexpected host key", c.HostKey)
+			} else if archived := c.ID != fcids[len(fcids)-1]; c.Archived != archived {
+				t.Fatalf("expected archived to be %v for contract %v", archived, c.ID)
+			}
+		}
+	}
+
+	// assert the whole chain is returned from every position
+	for _, fcid := range fcids {
+		assertChain(fcid, false, fcids...)
+	}
+
+	// assert the links
+	chain, _, err := cs.RenewalChain(ctx, fcids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range chain {
+		if i > 0 && c.RenewedFrom != fcids[i-1] {
+			t.Fatal("unexpected renewed from", i, c.RenewedFrom)
+		} else if i < len(chain)-1 && (c.RenewedTo != fcids[i+1] || c.Reason != api.ContractArchivalReasonRenewed) {
+			t.Fatal("unexpected renewed to", i, c.RenewedTo, c.Reason)
+		}
+	}
+
+	// assert unknown contracts are not found
+	if _, _, err := cs.RenewalChain(ctx, types.FileContractID{5}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// break the chain by deleting the second contract from the archive
+	if err := cs.db.
+		Where("fcid = ?", fileContractID(fcids[1])).
+		Delete(&dbArchivedContract{}).
+		Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the partial chain is returned and marked as truncated
+	assertChain(fcids[0], true, fcids[0])
+	assertChain(fcids[2], true, fcids[2], fcids[3])
+	assertChain(fcids[3], true, fcids[2], fcids[3])
+}
+
+// TestArchivedContractLookups tests ArchivedContract and ContractRenewedFrom.
+func TestArchivedContractLookups(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host
+	hk := types.GeneratePrivateKey().PublicKey()
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a contract and renew it twice
+	fcids := []types.FileContractID{{1}, {2}, {3}}
+	if _, err := cs.addTestContract(fcids[0], hk); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(fcids); i++ {
+		if _, err := cs.addTestRenewedContract(fcids[i], fcids[i-1], hk, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the archived contracts can be looked up
+	for i, fcid := range fcids[:2] {
+		c, err := cs.ArchivedContract(ctx, fcid)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.ID != fcid || c.HostKey != hk {
+			t.Fatal("unexpected contract", c)
+		} else if c.RenewedTo != fcids[i+1] || c.Reason != api.ContractArchivalReasonRenewed {
+			t.Fatal("unexpected renewal", c.RenewedTo, c.Reason)
+		} else if c.StartHeight != uint64(i) {
+			t.Fatal("unexpected start height", c.StartHeight)
+		}
+	}
+
+	// assert the active and unknown contracts aren't found
+	if _, err := cs.ArchivedContract(ctx, fcids[2]); !errors.Is(err, ErrArchivedContractNotFound) {
+		t.Fatal("expected ErrArchivedContractNotFound", err)
+	} else if _, err := cs.ArchivedContract(ctx, types.FileContractID{9}); !errors.Is(err, ErrArchivedContractNotFound) {
+		t.Fatal("expected ErrArchivedContractNotFound", err)
+	}
+
+	// assert the successors are found, both archived and active
+	for i, fcid := range fcids[:2] {
+		c, err := cs.ContractRenewedFrom(ctx, fcid)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.ID != fcids[i+1] || c.RenewedFrom != fcid {
+			t.Fatal("unexpected successor", c.ID, c.RenewedFrom)
+		} else if archived := i+1 < len(fcids)-1; c.Archived != archived {
+			t.Fatalf("expected archived to be %v", archived)
+		}
+	}
+
+	// assert the most recent and unknown contracts have no successor
+	if _, err := cs.ContractRenewedFrom(ctx, fcids[2]); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
+	} else if _, err := cs.ContractRenewedFrom(ctx, types.FileContractID{9}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
+	}
+}
+
+// TestDescendant is a test for Descendant.
+func TestDescendant(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host
+	hk := types.GeneratePrivateKey().PublicKey()
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a contract and renew it three times
+	fcids := []types.FileContractID{{1}, {2}, {3}, {4}}
+	if _, err := cs.addTestContract(fcids[0], hk); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(fcids); i++ {
+		if _, err := cs.addTestRenewedContract(fcids[i], fcids[i-1], hk, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert every contract in the chain leads to the active contract
+	for i, fcid := range fcids {
+		d, err := cs.Descendant(ctx, fcid)
+		if err != nil {
+			t.Fatal(err)
+		} else if d.DeadEnd || d.Archived != nil || d.Contract == nil {
+			t.Fatal("expected active descendant", d)
+		} else if d.Contract.ID != fcids[3] {
+			t.Fatal("unexpected descendant", d.Contract.ID)
+		} else if d.Renewals != len(fcids)-1-i {
+			t.Fatal("unexpected number of renewals", d.Renewals)
+		}
+	}
+
+	// assert the depth limit is enforced
+	if _, err := cs.descendant(ctx, fcids[0], 3); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.descendant(ctx, fcids[0], 2); !errors.Is(err, ErrDescendantDepthExceeded) {
+		t.Fatal("expected ErrDescendantDepthExceeded", err)
+	}
+
+	// remove the active contract and assert the chain now ends in it
+	if err := cs.ArchiveContract(ctx, fcids[3], api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
+	}
+	d, err := cs.Descendant(ctx, fcids[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if !d.DeadEnd || d.Contract != nil || d.Archived == nil {
+		t.Fatal("expected dead end", d)
+	} else if d.Archived.ID != fcids[3] || d.Archived.Reason != api.ContractArchivalReasonRemoved {
+		t.Fatal("unexpected archived contract", d.Archived.ID, d.Archived.Reason)
+	} else if d.Renewals != 3 {
+		t.Fatal("unexpected number of renewals", d.Renewals)
+	}
+
+	// create a loop and assert it's treated as a dead end
+	for i, fcid := range []types.FileContractID{{5}, {6}} {
+		if err := cs.db.Create(&dbArchivedContract{
+			ContractCommon: ContractCommon{FCID: fileContractID(fcid)},
+			RenewedTo:      fileContractID(types.FileContractID{byte(6 - i)}),
+			Host:           publicKey(hk),
+			Reason:         api.ContractArchivalReasonRenewed,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d, err := cs.Descendant(ctx, types.FileContractID{5}); err != nil {
+		t.Fatal(err)
+	} else if !d.DeadEnd || d.Archived == nil || d.Archived.ID != (types.FileContractID{6}) {
+		t.Fatal("unexpected descendant", d)
+	}
+
+	// assert unknown contracts aren't found
+	if _, err := cs.Descendant(ctx, types.FileContractID{9}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
+	}
+}
+
+// TestContractIDEncoding asserts contract ids are stored as raw 32-byte values
+// which allows for querying and joining them in SQL.
+func TestContractIDEncoding(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hk := types.PublicKey{1, 2, 3}
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a contract and renew it.
+	fcid, renewed := types.FileContractID{1}, types.FileContractID{2}
+	if _, err := cs.addTestContract(fcid, hk); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(renewed, fcid, hk, 1); err != nil {
+		t.Fatal(err)
+	}
+	hexID := func(fcid types.FileContractID) string {
+		return strings.ToUpper(hex.EncodeToString(fcid[:]))
+	}
+
+	// Assert the ids are stored as 32 bytes.
+	var lengths []int
+	if err := cs.db.Raw("SELECT length(fcid) FROM contracts UNION ALL SELECT length(renewed_from) FROM contracts UNION ALL SELECT length(fcid) FROM archived_contracts UNION ALL SELECT length(renewed_to) FROM archived_contracts").
+		Scan(&lengths).
+		Error; err != nil {
+		t.Fatal(err)
+	} else if len(lengths) != 4 {
+		t.Fatal("unexpected number of ids", len(lengths))
+	}
+	for _, l := range lengths {
+		if l != 32 {
+			t.Fatal("unexpected id length", l)
+		}
+	}
+
+	// Assert the ids can be queried without decoding them in Go.
+	var renewedFrom string
+	if err := cs.db.Raw("SELECT hex(renewed_from) FROM contracts WHERE hex(fcid) = ?", hexID(renewed)).
+		Scan(&renewedFrom).
+		Error; err != nil {
+		t.Fatal(err)
+	} else if renewedFrom != hexID(fcid) {
+		t.Fatal("unexpected renewed from", renewedFrom)
+	}
+
+	// Assert the ids can be joined on.
+	var joined []fileContractID
+	if err := cs.db.Raw("SELECT a.fcid FROM archived_contracts a INNER JOIN contracts c ON a.renewed_to = c.fcid AND c.renewed_from = a.fcid").
+		Scan(&joined).
+		Error; err != nil {
+		t.Fatal(err)
+	} else if len(joined) != 1 || types.FileContractID(joined[0]) != fcid {
+		t.Fatal("unexpected join result", joined)
+	}
+}
+
+func TestArchiveContracts(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add 3 hosts
+	hks, err := cs.addTestHosts(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add 3 contracts
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// archive 2 of them
+	toArchive := map[types.FileContractID]string{
+		fcids[1]: "foo",
+		fcids[2]: "bar",
+	}
+	if err := cs.ArchiveContracts(context.Background(), toArchive); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the first one is still active
+	active, err := cs.Contracts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].ID != fcids[0] {
+		t.Fatal("wrong contracts", active)
+	}
+
+	// assert the two others were archived
+	ffcids := make([]fileContractID, 2)
+	ffcids[0] = fileContractID(fcids[1])
+	ffcids[1] = fileContractID(fcids[2])
+	var acs []dbArchivedContract
+	err = cs.db.Model(&dbArchivedContract{}).
+		Where("fcid IN (?)", ffcids).
+		Find(&acs).
+		Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acs) != 2 {
+		t.Fatal("wrong number of archived contracts", len(acs))
+	}
+	if acs[0].Reason != "foo" || acs[1].Reason != "bar" {
+		t.Fatal("unexpected reason", acs[0].Reason, acs[1].Reason)
+	}
+}
+
+// TestArchiveContractsWithoutRenewal asserts that contracts archived without
+// being renewed don't conflict with each other in the archive.
+func TestArchiveContractsWithoutRenewal(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add 3 contracts
+	hks, err := cs.addTestHosts(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// archive two of them one after the other
+	for _, fcid := range fcids[:2] {
+		if err := cs.ArchiveContract(ctx, fcid, api.ContractArchivalReasonRemoved); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert both were archived without a renewal
+	for _, fcid := range fcids[:2] {
+		ac, err := cs.ArchivedContract(ctx, fcid)
+		if err != nil {
+			t.Fatal(err)
+		} else if ac.RenewedTo != (types.FileContractID{}) {
+			t.Fatal("unexpected renewed to", ac.RenewedTo)
+		}
+	}
+
+	// assert they aren't considered ancestors of the remaining contract
+	if ancestors, err := cs.AncestorContracts(ctx, fcids[2], 0); err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 0 {
+		t.Fatal("unexpected ancestors", len(ancestors))
+	}
+}
+
+// TestArchivedContracts is a test for ArchivedContracts.
+func TestArchivedContracts(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add 2 hosts
+	hks, err := cs.addTestHosts(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1, hk2 := hks[0], hks[1]
+
+	// add a contract with the first host and renew it twice
+	fcids := []types.FileContractID{{1}, {2}, {3}, {4}, {5}}
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[0], hk1), types.ZeroCurrency, 100, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcids[1], fcids[0], hk1, 200); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcids[2], fcids[1], hk1, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	// add two contracts with the second host and archive them
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[3], hk2), types.ZeroCurrency, 150, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.AddContract(ctx, testContractRevision(fcids[4], hk2), types.ZeroCurrency, 250, "", nil); err != nil {
+		t.Fatal(err)
+	} else if err := cs.ArchiveContracts(ctx, map[types.FileContractID]string{
+		fcids[3]: api.ContractArchivalReasonRemoved,
+		fcids[4]: api.ContractArchivalReasonHostPruned,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assertArchived is a helper to assert the archived contracts returned
+	// for a filter
+	assertArchived := func(filter api.ArchivedContractsFilter, expected ...types.FileContractID) {
+		t.Helper()
+		contracts, err := cs.ArchivedContracts(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(contracts) != len(expected) {
+			t.Fatalf("expected %v contracts, got %v", len(expected), len(contracts))
+		}
+		for i, c := range contracts {
+			if c.ID != expected[i] {
+				t.Fatalf("unexpected contract at index %v, %v != %v", i, c.ID, expected[i])
+			}
+		}
+	}
+
+	// assert the contracts are sorted by start height
+	assertArchived(api.ArchivedContractsFilter{Limit: -1}, fcids[4], fcids[1], fcids[3], fcids[0])
+
+	// assert the host filter
+	assertArchived(api.ArchivedContractsFilter{HostKey: hk1, Limit: -1}, fcids[1], fcids[0])
+	assertArchived(api.ArchivedContractsFilter{HostKey: types.PublicKey{1}, Limit: -1})
+
+	// assert the reason filter
+	assertArchived(api.ArchivedContractsFilter{Reason: api.ContractArchivalReasonRenewed, Limit: -1}, fcids[1], fcids[0])
+	assertArchived(api.ArchivedContractsFilter{Reason: api.ContractArchivalReasonRemoved, Limit: -1}, fcids[3])
+	assertArchived(api.ArchivedContractsFilter{HostKey: hk2, Reason: api.ContractArchivalReasonHostPruned, Limit: -1}, fcids[4])
+
+	// assert the start height filters
+	assertArchived(api.ArchivedContractsFilter{MinStartHeight: 150, Limit: -1}, fcids[4], fcids[1], fcids[3])
+	assertArchived(api.ArchivedContractsFilter{MaxStartHeight: 200, Limit: -1}, fcids[1], fcids[3], fcids[0])
+	assertArchived(api.ArchivedContractsFilter{MinStartHeight: 150, MaxStartHeight: 200, Limit: -1}, fcids[1], fcids[3])
+
+	// assert pagination
+	assertArchived(api.ArchivedContractsFilter{Offset: 1, Limit: 2}, fcids[1], fcids[3])
+	assertArchived(api.ArchivedContractsFilter{Offset: 4, Limit: -1})
+
+	// assert the reason and start height are returned
+	contracts, err := cs.ArchivedContracts(ctx, api.ArchivedContractsFilter{HostKey: hk2, Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	} else if contracts[0].Reason != api.ContractArchivalReasonHostPruned || contracts[0].StartHeight != 250 {
+		t.Fatal("unexpected contract", contracts[0])
+	} else if contracts[1].Reason != api.ContractArchivalReasonRemoved || contracts[1].StartHeight != 150 {
+		t.Fatal("unexpected contract", contracts[1])
+	}
+}
+
+// TestContractTimestampFilters asserts active and archived contracts can be
+// filtered by their creation and archival time respectively, with inclusive
+// lower and exclusive upper bounds.
+func TestContractTimestampFilters(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add 4 contracts created an hour apart
+	hks, err := cs.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Hour) }
+	for i, fcid := range fcids {
+		if err := cs.db.
+			Model(&dbContract{}).
+			Where("fcid = ?", fileContractID(fcid)).
+			Update("created_at", at(i)).
+			Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the range is [from, to), also when the bounds aren't in UTC
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	for _, filter := range []api.ContractsPageFilter{
+		{CreatedFrom: at(1), CreatedTo: at(3), Limit: -1},
+		{CreatedFrom: at(1).In(loc), CreatedTo: at(3).In(loc), Limit: -1},
+	} {
+		contracts, total, err := cs.ContractsPage(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		} else if total != 2 || len(contracts) != 2 {
+			t.Fatal("unexpected number of contracts", total, len(contracts))
+		}
+		for i, c := range contracts {
+			if c.ID != fcids[i+1] {
+				t.Fatal("unexpected contract", c.ID)
+			} else if !c.CreatedAt.Equal(at(i+1)) || c.CreatedAt.Location() != time.UTC {
+				t.Fatal("unexpected creation time", c.CreatedAt)
+			}
+		}
+	}
+
+	// assert a single bound works too
+	if contracts, _, err := cs.ContractsPage(ctx, api.ContractsPageFilter{CreatedFrom: at(3), Limit: -1}); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcids[3] {
+		t.Fatal("unexpected contracts", contracts)
+	}
+
+	// archive the contracts and spread out their archival times
+	if _, _, err := cs.RemoveContracts(ctx, fcids, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i, fcid := range fcids {
+		if err := cs.db.
+			Model(&dbArchivedContract{}).
+			Where("fcid = ?", fileContractID(fcid)).
+			Update("archived_at", at(10+i)).
+			Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the archived contracts are filtered by archival time and kept
+	// their creation time
+	archived, err := cs.ArchivedContracts(ctx, api.ArchivedContractsFilter{ArchivedFrom: at(11), ArchivedTo: at(13), Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(archived) != 2 {
+		t.Fatal("unexpected number of archived contracts", len(archived))
+	}
+	sort.Slice(archived, func(i, j int) bool { return archived[i].ArchivedAt.Before(archived[j].ArchivedAt) })
+	for i, c := range archived {
+		if c.ID != fcids[i+1] {
+			t.Fatal("unexpected contract", c.ID)
+		} else if !c.ArchivedAt.Equal(at(11+i)) || c.ArchivedAt.Location() != time.UTC {
+			t.Fatal("unexpected archival time", c.ArchivedAt)
+		} else if !c.CreatedAt.Equal(at(i + 1)) {
+			t.Fatal("unexpected creation time", c.CreatedAt)
+		}
+	}
+}
+
+// TestRemoveContracts tests removing a mix of active, archived and unknown
+// contracts in bulk.
+func TestRemoveContracts(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add 4 contracts, put them in a set and archive the last one
+	hks, err := cs.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids, false); err != nil {
+		t.Fatal(err)
+	} else if err := cs.ArchiveContract(ctx, fcids[3], api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove two active contracts, one of them twice, the archived contract
+	// and an unknown one
+	unknown := types.FileContractID{9}
+	removed, skipped, err := cs.RemoveContracts(ctx, []types.FileContractID{fcids[0], fcids[3], unknown, fcids[1], fcids[0]}, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 2 || removed[0] != fcids[0] || removed[1] != fcids[1] {
+		t.Fatal("unexpected removed contracts", removed)
+	} else if len(skipped) != 2 || skipped[0] != fcids[3] || skipped[1] != unknown {
+		t.Fatal("unexpected unknown contracts", skipped)
+	}
+
+	// assert the removed contracts were archived with the default reason
+	for _, fcid := range removed {
+		if c, err := cs.ArchivedContract(ctx, fcid); err != nil {
+			t.Fatal(err)
+		} else if c.Reason != api.ContractArchivalReasonRemoved {
+			t.Fatal("unexpected reason", c.Reason)
+		}
+	}
+
+	// assert only the remaining contract is active and in the set
+	if contracts, err := cs.Contracts(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcids[2] {
+		t.Fatal("unexpected contracts", contracts)
+	} else if contracts, err := cs.ContractSetContracts(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcids[2] {
+		t.Fatal("unexpected set contracts", contracts)
+	}
+
+	// remove the last one with a custom reason
+	if removed, skipped, err := cs.RemoveContracts(ctx, fcids[2:3], api.ContractArchivalReasonHostPruned); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 1 || len(skipped) != 0 {
+		t.Fatal("unexpected result", removed, skipped)
+	} else if c, err := cs.ArchivedContract(ctx, fcids[2]); err != nil {
+		t.Fatal(err)
+	} else if c.Reason != api.ContractArchivalReasonHostPruned {
+		t.Fatal("unexpected reason", c.Reason)
+	}
+}
+
+// TestArchiveContractsForHost is a unit test for ArchiveContractsForHost.
+func TestArchiveContractsForHost(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hks, err := cs.addTestHosts(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1, hk2 := hks[0], hks[1]
+
+	// add a contract with the second host and three with the first host, one
+	// of which is renewed
+	fcid1, fcid2, fcid3, fcid4 := types.FileContractID{1}, types.FileContractID{2}, types.FileContractID{3}, types.FileContractID{4}
+	if _, err := cs.addTestContract(fcid1, hk1); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestContract(fcid2, hk2); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcid3, fcid1, hk1, 1); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestContract(fcid4, hk1); err != nil {
+		t.Fatal(err)
+	}
+
+	// add them to some sets
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", []types.FileContractID{fcid2, fcid3, fcid4}, false); err != nil {
+		t.Fatal(err)
+	} else if _, _, _, err := cs.SetContractSet(ctx, "bar", []types.FileContractID{fcid3}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// archive the first host's contracts
+	archived, err := cs.ArchiveContractsForHost(ctx, hk1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(archived, func(i, j int) bool { return bytes.Compare(archived[i][:], archived[j][:]) < 0 })
+	if !reflect.DeepEqual(archived, []types.FileContractID{fcid3, fcid4}) {
+		t.Fatal("unexpected archived contracts", archived)
+	}
+
+	// assert only the second host's contract is active and in a set
+	if contracts, err := cs.Contracts(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcid2 {
+		t.Fatal("unexpected contracts", contracts)
+	}
+	if contracts, err := cs.ContractSetContracts(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != fcid2 {
+		t.Fatal("unexpected contracts in set", contracts)
+	}
+	if contracts, err := cs.ContractSetContracts(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("unexpected contracts in set", contracts)
+	}
+
+	// assert the contracts were archived with the right reason
+	ac, err := cs.ArchivedContracts(ctx, api.ArchivedContractsFilter{Reason: api.ContractArchivalReasonHostBlocked, Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ac) != 2 {
+		t.Fatal("unexpected number of archived contracts", len(ac))
+	}
+
+	// assert the renewal link is still queryable
+	ancestors, err := cs.AncestorContracts(ctx, fcid3, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 1 || ancestors[0].ID != fcid1 {
+		t.Fatal("unexpected ancestors", ancestors)
+	}
+	chain, _, err := cs.RenewalChain(ctx, fcid1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(chain) != 2 || chain[1].ID != fcid3 || !chain[1].Archived || chain[1].Reason != api.ContractArchivalReasonHostBlocked {
+		t.Fatal("unexpected chain", chain)
+	}
+
+	// assert unknown hosts are reported
+	if _, err := cs.ArchiveContractsForHost(ctx, types.PublicKey{9}, ""); !errors.Is(err, ErrHostNotFound) {
+		t.Fatal("expected ErrHostNotFound", err)
+	}
+}
+
+// TestArchiveContractReason asserts archiving a contract carries over its
+// fields and records the reason.
+func TestArchiveContractReason(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host
+	hk := types.GeneratePrivateKey().PublicKey()
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a contract, renew it and add another one
+	fcids := []types.FileContractID{{1}, {2}, {3}}
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[0], hk), types.ZeroCurrency, 100, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcids[1], fcids[0], hk, 200); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.AddContract(ctx, testContractRevision(fcids[2], hk), types.ZeroCurrency, 300, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// record some spending on the renewed contract
+	spending := api.ContractSpending{
+		Uploads:     types.Siacoins(1),
+		Downloads:   types.Siacoins(2),
+		FundAccount: types.Siacoins(3),
+	}
+	if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{
+		ContractID:       fcids[1],
+		ContractSpending: spending,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// archive the renewed contract with a reason and the other one without
+	if err := cs.ArchiveContracts(ctx, map[types.FileContractID]string{
+		fcids[1]: "host blocked",
+		fcids[2]: "",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the active contracts are gone
+	if contracts, err := cs.Contracts(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("unexpected contracts", contracts)
+	}
+
+	// assert the archived contracts' fields
+	archived, err := cs.ArchivedContracts(ctx, api.ArchivedContractsFilter{Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(archived) != 3 {
+		t.Fatal("unexpected number of archived contracts", len(archived))
+	}
+	if c := archived[0]; c.ID != fcids[2] || c.HostKey != hk || c.StartHeight != 300 || c.Reason != api.ContractArchivalReasonRemoved {
+		t.Fatalf("unexpected archived contract %+v", c)
+	}
+	if c := archived[1]; c.ID != fcids[1] || c.HostKey != hk || c.StartHeight != 200 || c.Reason != "host blocked" || c.Spending != spending {
+		t.Fatalf("unexpected archived contract %+v", c)
+	}
+
+	// assert the ancestors of the removed contract can still be fetched
+	ancestors, err := cs.AncestorContracts(ctx, fcids[1], 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 1 || ancestors[0].ID != fcids[0] || ancestors[0].RenewedTo != fcids[1] || ancestors[0].Reason != api.ContractArchivalReasonRenewed {
+		t.Fatalf("unexpected ancestors %+v", ancestors)
+	}
+}
+
+// TestPruneArchivedContracts is a test for PruneArchivedContracts.
+func TestPruneArchivedContracts(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add a host
+	hk := types.GeneratePrivateKey().PublicKey()
+	if err := cs.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a renewal chain that ends in an active contract
+	fcids := []types.FileContractID{{1}, {2}, {3}, {4}, {5}, {6}, {7}}
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[0], hk), types.ZeroCurrency, 10, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcids[1], fcids[0], hk, 20); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcids[2], fcids[1], hk, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a renewal chain that ends in an archived contract
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[3], hk), types.ZeroCurrency, 10, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcids[4], fcids[3], hk, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// add two contracts that aren't part of a chain
+	if _, err := cs.AddContract(ctx, testContractRevision(fcids[5], hk), types.ZeroCurrency, 15, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.AddContract(ctx, testContractRevision(fcids[6], hk), types.ZeroCurrency, 40, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// archive all contracts but the head of the first chain
+	if err := cs.ArchiveContracts(ctx, map[types.FileContractID]string{
+		fcids[4]: api.ContractArchivalReasonRemoved,
+		fcids[5]: api.ContractArchivalReasonRemoved,
+		fcids[6]: api.ContractArchivalReasonRemoved,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assertArchived is a helper to assert the remaining archived contracts
+	assertArchived := func(expected ...types.FileContractID) {
+		t.Helper()
+		archived, err := cs.ArchivedContracts(ctx, api.ArchivedContractsFilter{Limit: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[types.FileContractID]struct{})
+		for _, c := range archived {
+			ids[c.ID] = struct{}{}
+		}
+		if len(ids) != len(expected) {
+			t.Fatalf("expected %v archived contracts, got %v", len(expected), len(ids))
+		}
+		for _, fcid := range expected {
+			if _, ok := ids[fcid]; !ok {
+				t.Fatalf("contract %v not archived", fcid)
+			}
+		}
+	}
+	assertArchived(fcids[0], fcids[1], fcids[3], fcids[4], fcids[5], fcids[6])
+
+	// prune in batches of 2 while preserving chains, this should leave the
+	// chain ending in the active contract intact
+	if pruned, err := cs.pruneArchivedContracts(ctx, 25, true, 2); err != nil {
+		t.Fatal(err)
+	} else if pruned != 3 {
+		t.Fatal("unexpected number of pruned contracts", pruned)
+	}
+	assertArchived(fcids[0], fcids[1], fcids[6])
+
+	// assert the chain's ancestors are still available
+	if ancestors, err := cs.AncestorContracts(ctx, fcids[2], 0); err != nil {
+		t.Fatal(err)
+	} else if len(ancestors) != 2 {
+		t.Fatal("unexpected number of ancestors", len(ancestors))
+	}
+
+	// prune again in batches of 1 without preserving chains
+	if pruned, err := cs.pruneArchivedContracts(ctx, 25, false, 1); err != nil {
+		t.Fatal(err)
+	} else if pruned != 2 {
+		t.Fatal("unexpected number of pruned contracts", pruned)
+	}
+	assertArchived(fcids[6])
+
+	// pruning again is a no-op
+	if pruned, err := cs.PruneArchivedContracts(ctx, 25, false); err != nil {
+		t.Fatal(err)
+	} else if pruned != 0 {
+		t.Fatal("unexpected number of pruned contracts", pruned)
+	}
+	assertArchived(fcids[6])
+
+	// assert the active contract is untouched
+	if _, err := cs.Contract(ctx, fcids[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// re-add the chain's oldest contract and create a loop by archiving a
+	// contract with the active contract's id that was renewed to it
+	for _, c := range []struct {
+		fcid, renewedTo types.FileContractID
+	}{
+		{fcids[0], fcids[2]},
+		{fcids[2], fcids[0]},
+	} {
+		if err := cs.db.Create(&dbArchivedContract{
+			ContractCommon: ContractCommon{
+				FCID:        fileContractID(c.fcid),
+				StartHeight: 5,
+			},
+			RenewedTo: fileContractID(c.renewedTo),
+			Host:      publicKey(hk),
+			Reason:    api.ContractArchivalReasonRenewed,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// re-archive the contract that isn't part of a chain
+	if err := cs.db.Create(&dbArchivedContract{
+		ContractCommon: ContractCommon{
+			FCID:        fileContractID(fcids[5]),
+			StartHeight: 15,
+		},
+		Host:   publicKey(hk),
+		Reason: api.ContractArchivalReasonRemoved,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// prune while preserving chains, the walk should stop at the loop and only
+	// prune the contract that isn't part of the chain
+	if pruned, err := cs.pruneArchivedContracts(ctx, 25, true, 1); err != nil {
+		t.Fatal(err)
+	} else if pruned != 1 {
+		t.Fatal("unexpected number of pruned contracts", pruned)
+	}
+	assertArchived(fcids[0], fcids[2], fcids[6])
+}
+
+// TestContractsExpiringBefore is a unit test for ContractsExpiringBefore.
+func TestContractsExpiringBefore(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hks, err := cs.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add contracts with mixed windows
+	windows := [][2]uint64{{300, 400}, {100, 150}, {200, 250}, {100, 120}, {1000, 1100}}
+	for i, w := range windows {
+		rev := testContractRevision(types.FileContractID{byte(i + 1)}, hks[0])
+		rev.Revision.WindowStart, rev.Revision.WindowEnd = w[0], w[1]
+		if _, err := cs.AddContract(ctx, rev, types.ZeroCurrency, 1, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// renew the first contract, the renewal carries its own window
+	rev := testContractRevision(types.FileContractID{6}, hks[0])
+	rev.Revision.WindowStart, rev.Revision.WindowEnd = 2000, 2100
+	renewed, err := cs.AddRenewedContract(ctx, rev, types.ZeroCurrency, 2, types.FileContractID{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if renewed.WindowStart != 2000 || renewed.WindowEnd != 2100 {
+		t.Fatal("unexpected window", renewed.WindowStart, renewed.WindowEnd)
+	}
+
+	assertExpiring := func(height uint64, expected ...types.FileContractID) {
+		t.Helper()
+		contracts, err := cs.ContractsExpiringBefore(ctx, height)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(contracts) != len(expected) {
+			t.Fatalf("unexpected number of contracts, %v != %v", len(contracts), len(expected))
+		}
+		for i, c := range contracts {
+			if c.ID != expected[i] {
+				t.Fatalf("unexpected contract at index %v, %v != %v", i, c.ID, expected[i])
+			}
+		}
+	}
+
+	assertExpiring(0)
+	assertExpiring(100)
+	assertExpiring(101, types.FileContractID{2}, types.FileContractID{4})
+	assertExpiring(301, types.FileContractID{2}, types.FileContractID{4}, types.FileContractID{3})
+	assertExpiring(2001, types.FileContractID{2}, types.FileContractID{4}, types.FileContractID{3}, types.FileContractID{5}, types.FileContractID{6})
+}
+
+// TestContractsToRenew is a unit test for ContractsToRenew.
+func TestContractsToRenew(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hks, err := cs.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add contracts with mixed window starts
+	windowStarts := []uint64{300, 100, 200, 150, 1000}
+	var fcids []types.FileContractID
+	for i, ws := range windowStarts {
+		fcid := types.FileContractID{byte(i + 1)}
+		rev := testContractRevision(fcid, hks[0])
+		rev.Revision.WindowStart, rev.Revision.WindowEnd = ws, ws+100
+		if _, err := cs.AddContract(ctx, rev, types.ZeroCurrency, 1, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		fcids = append(fcids, fcid)
+	}
+
+	// add all but the one with the lowest window start to the set
+	if _, _, _, err := cs.SetContractSet(ctx, testContractSet, []types.FileContractID{fcids[0], fcids[2], fcids[3], fcids[4]}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	type expected struct {
+		fcid types.FileContractID
+		past bool
+	}
+	assertToRenew := func(set string, height, horizon uint64, offset, limit int, exp ...expected) {
+		t.Helper()
+		contracts, err := cs.ContractsToRenew(ctx, set, height, horizon, offset, limit)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(contracts) != len(exp) {
+			t.Fatalf("unexpected number of contracts, %v != %v", len(contracts), len(exp))
+		}
+		for i, c := range contracts {
+			if c.ID != exp[i].fcid {
+				t.Fatalf("unexpected contract at index %v, %v != %v", i, c.ID, exp[i].fcid)
+			} else if c.PastWindowStart != exp[i].past {
+				t.Fatalf("unexpected flag at index %v, %v != %v", i, c.PastWindowStart, exp[i].past)
+			}
+		}
+	}
+
+	// assert contracts are ordered by window start and flagged if their
+	// window started already
+	assertToRenew("", 50, 10, 0, -1)
+	assertToRenew("", 50, 100, 0, -1, expected{fcids[1], false}, expected{fcids[3], false})
+	assertToRenew("", 150, 100, 0, -1, expected{fcids[1], true}, expected{fcids[3], true}, expected{fcids[2], false})
+	assertToRenew("", 250, 50, 0, -1, expected{fcids[1], true}, expected{fcids[3], true}, expected{fcids[2], true}, expected{fcids[0], false})
+
+	// assert the set is respected
+	assertToRenew(testContractSet, 150, 100, 0, -1, expected{fcids[3], true}, expected{fcids[2], false})
+
+	// assert pagination
+	assertToRenew("", 2000, 0, 1, 2, expected{fcids[3], true}, expected{fcids[2], true})
+	assertToRenew("", 2000, 0, 4, -1, expected{fcids[4], true})
+
+	// assert unknown sets are reported
+	if _, err := cs.ContractsToRenew(ctx, "unknown", 0, 0, 0, -1); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("expected ErrContractSetNotFound", err)
+	}
+}
+
+func TestContractsPage(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// add contracts with varying start heights and costs, the costs are
+	// chosen so that sorting them as strings would yield the wrong order
+	hks, err := cs.addTestHosts(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startHeights := []uint64{3, 1, 2, 1, 3, 2}
+	costs := []types.Currency{types.NewCurrency64(9), types.NewCurrency64(10), types.NewCurrency64(100), types.NewCurrency64(2), types.Siacoins(1), types.ZeroCurrency}
+	var fcids []types.FileContractID
+	for i, hk := range hks {
+		fcid := types.FileContractID{byte(i + 1)}
+		if _, err := cs.AddContract(ctx, testContractRevision(fcid, hk), costs[i], startHeights[i], "", nil); err != nil {
+			t.Fatal(err)
+		}
+		fcids = append(fcids, fcid)
+	}
+
+	// add some of them to a set
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[1:5], false); err != nil {
+		t.Fatal(err)
+	}
+
+	// helper to fetch all contracts page by page
+	fetchPages := func(set, sortBy string, limit int) (contracts []api.ContractMetadata, total int64) {
+		t.Helper()
+		for offset := 0; ; offset += limit {
+			page, n, err := cs.ContractsPage(ctx, api.ContractsPageFilter{Set: set, SortBy: sortBy, Offset: offset, Limit: limit})
+			if err != nil {
+				t.Fatal(err)
+			} else if offset > 0 && n != total {
+				t.Fatalf("total changed across pages, %v != %v", n, total)
+			}
+			total = n
+			contracts = append(contracts, page...)
+			if len(page) < limit {
+				return
+			}
+		}
+	}
+
+	less := map[string]func(a, b api.ContractMetadata) bool{
+		"": func(a, b api.ContractMetadata) bool { return false },
+		api.ContractSortStartHeight: func(a, b api.ContractMetadata) bool {
+			return a.StartHeight < b.StartHeight
+		},
+		api.ContractSortTotalCost: func(a, b api.ContractMetadata) bool {
+			return a.TotalCost.Cmp(b.TotalCost) < 0
+		},
+		api.ContractSortHostKey: func(a, b api.ContractMetadata) bool {
+			return bytes.Compare(a.HostKey[:], b.HostKey[:]) < 0
+		},
+	}
+	for _, set := range []string{"", "foo"} {
+		expectedTotal := int64(len(fcids))
+		if set != "" {
+			expectedTotal = 4
+		}
+		for sortBy, lessFn := range less {
+			// fetch all contracts in one go
+			all, total, err := cs.ContractsPage(ctx, api.ContractsPageFilter{Set: set, SortBy: sortBy, Limit: -1})
+			if err != nil {
+				t.Fatal(err)
+			} else if total != expectedTotal || int64(len(all)) != total {
+				t.Fatalf("unexpected number of contracts, %v %v", total, len(all))
+			}
+
+			// assert they are sorted, ties are broken by insertion order
+			for i := 1; i < len(all); i++ {
+				if lessFn(all[i], all[i-1]) || (!lessFn(all[i-1], all[i]) && all[i-1].ID[0] > all[i].ID[0]) {
+					t.Fatalf("contracts not sorted by '%v'", sortBy)
+				}
+			}
+
+			// assert paginating yields the same order and total
+			for _, limit := range []int{1, 2, 4} {
+				paginated, total := fetchPages(set, sortBy, limit)
+				if total != expectedTotal {
+					t.Fatalf("unexpected total %v", total)
+				} else if !reflect.DeepEqual(paginated, all) {
+					t.Fatalf("pagination with limit %v yielded a different order", limit)
+				}
+			}
+		}
+	}
+
+	// assert an offset past the end returns an empty page but the total
+	page, total, err := cs.ContractsPage(ctx, api.ContractsPageFilter{Offset: 10, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(page) != 0 || total != int64(len(fcids)) {
+		t.Fatal("unexpected page", len(page), total)
+	}
+
+	// assert invalid sort keys and unknown sets are rejected
+	if _, _, err := cs.ContractsPage(ctx, api.ContractsPageFilter{SortBy: "foo", Limit: -1}); !errors.Is(err, api.ErrInvalidContractSortKey) {
+		t.Fatal("unexpected error", err)
+	} else if _, _, err := cs.ContractsPage(ctx, api.ContractsPageFilter{Set: "bar", Limit: -1}); !errors.Is(err, api.ErrContractSetNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func (s *SQLStore) addTestContracts(keys []types.PublicKey) (fcids []types.FileContractID, contracts []api.ContractMetadata, err error) {
+	cnt, err := s.contractsCount()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, key := range keys {
+		fcids = append(fcids, types.FileContractID{byte(int(cnt) + i + 1)})
+		contract, err := s.addTestContract(fcids[len(fcids)-1], key)
+		if err != nil {
+			return nil, nil, err
+		}
+		contracts = append(contracts, contract)
+	}
+	return
+}
+
+func (s *SQLStore) addTestContract(fcid types.FileContractID, hk types.PublicKey) (api.ContractMetadata, error) {
+	rev := testContractRevision(fcid, hk)
+	return s.AddContract(context.Background(), rev, types.ZeroCurrency, 0, "", nil)
+}
+
+func (s *SQLStore) addTestRenewedContract(fcid, renewedFrom types.FileContractID, hk types.PublicKey, startHeight uint64) (api.ContractMetadata, error) {
+	rev := testContractRevision(fcid, hk)
+	return s.AddRenewedContract(context.Background(), rev, types.ZeroCurrency, startHeight, renewedFrom, nil)
+}
+
+func (s *SQLStore) contractsCount() (cnt int64, err error) {
+	err = s.db.
+		Model(&dbContract{}).
+		Count(&cnt).
+		Error
+	return
+}
+
+func testContractRevision(fcid types.FileContractID, hk types.PublicKey) rhpv2.ContractRevision {
+	uc := generateMultisigUC(1, 2, "salt")
+	uc.PublicKeys[1].Key = hk[:]
+	uc.Timelock = 192837
+	return rhpv2.ContractRevision{
+		Revision: types.FileContractRevision{
+			ParentID:         fcid,
+			UnlockConditions: uc,
+			FileContract: types.FileContract{
+				RevisionNumber: 200,
+				Filesize:       4096,
+				FileMerkleRoot: types.Hash256{222},
+				WindowStart:    400,
+				WindowEnd:      500,
+				ValidProofOutputs: []types.SiacoinOutput{
+					{
+						Value:   types.NewCurrency64(121),
+						Address: types.Address{2, 1, 2},
+					},
+				},
+				MissedProofOutputs: []types.SiacoinOutput{
+					{
+						Value:   types.NewCurrency64(323),
+						Address: types.Address{2, 3, 2},
+					},
+				},
+				UnlockHash: types.Hash256{6, 6, 6},
+			},
+		},
+		Signatures: [2]types.TransactionSignature{
+			{
+				ParentID:       types.Hash256(fcid),
+				PublicKeyIndex: 0,
+				Timelock:       100000,
+				CoveredFields:  types.CoveredFields{WholeTransaction: true},
+				Signature:      []byte("signature1"),
+			},
+			{
+				ParentID:       types.Hash256(fcid),
+				PublicKeyIndex: 1,
+				Timelock:       200000,
+				CoveredFields:  types.CoveredFields{WholeTransaction: true},
+				Signature:      []byte("signature2"),
+			},
+		},
+	}
+}
+
+// TestSQLMetadataStore tests basic MetadataStore functionality.
+func TestSQLMetadataStore(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create 2 hosts
+	hks, err := db.addTestHosts(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1, hk2 := hks[0], hks[1]
+
+	// Create 2 contracts
+	fcids, contracts, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcid1, fcid2 := fcids[0], fcids[1]
+
+	// Extract start height and total cost
+	startHeight1, totalCost1 := contracts[0].StartHeight, contracts[0].TotalCost
+	startHeight2, totalCost2 := contracts[1].StartHeight, contracts[1].TotalCost
+
+	// Define usedHosts.
+	usedHosts := map[types.PublicKey]types.FileContractID{
+		hk1: fcid1,
+		hk2: fcid2,
+	}
+
+	// Create an object with 2 slabs pointing to 2 different sectors.
+	obj1 := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{1},
+						},
+					},
+				},
+				Offset: 10,
+				Length: 100,
+			},
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 2,
+					Shards: []object.Sector{
+						{
+							Host: hk2,
+							Root: types.Hash256{2},
+						},
+					},
+				},
+				Offset: 20,
+				Length: 200,
+			},
+		},
+	}
+
+	// Store it.
+	ctx := context.Background()
+	objID := "key1"
+	if err := db.UpdateObject(ctx, objID, testContractSet, obj1, nil, usedHosts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Try to store it again. Should work.
+	if err := db.UpdateObject(ctx, objID, testContractSet, obj1, nil, usedHosts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch it using get and verify every field.
+	obj, err := db.dbObject(objID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj1Key, err := obj1.Key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj1Slab0Key, err := obj1.Slabs[0].Key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj1Slab1Key, err := obj1.Slabs[1].Key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the Model fields to zero before comparing. These are set by gorm
+	// itself and contain a few timestamps which would make the following
+	// code a lot more verbose.
+	obj.Model = Model{}
+	for i := range obj.Slabs {
+		obj.Slabs[i].Model = Model{}
+	}
+
+	expectedObj := dbObject{
+		ObjectID: objID,
+		Key:      obj1Key,
+		Size:     obj1.Size(),
+		Slabs: []dbSlice{
+			{
+				DBObjectID: 1,
+				DBSlabID:   1,
+				Offset:     10,
+				Length:     100,
+			},
+			{
+				DBObjectID: 1,
+				DBSlabID:   2,
+				Offset:     20,
+				Length:     200,
+			},
+		},
+	}
+	if !reflect.DeepEqual(obj, expectedObj) {
+		t.Fatal("object mismatch", cmp.Diff(obj, expectedObj))
+	}
+
+	// Fetch it and verify again.
+	fullObj, err := db.Object(ctx, objID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fullObj, obj1) {
+		t.Fatal("object mismatch")
+	}
+
+	expectedObjSlab1 := dbSlab{
+		DBContractSetID: 1,
+		Key:             obj1Slab0Key,
+		MinShards:       1,
+		TotalShards:     1,
+		Shards: []dbSector{
+			{
+				DBSlabID:   1,
+				Root:       obj1.Slabs[0].Shards[0].Root[:],
+				LatestHost: publicKey(obj1.Slabs[0].Shards[0].Host),
+				Contracts: []dbContract{
+					{
+						HostID: 1,
+						Host: dbHost{
+							PublicKey: publicKey(hk1),
+						},
+
+						ContractCommon: ContractCommon{
+							FCID: fileContractID(fcid1),
+
+							TotalCost:      currency(totalCost1),
+							RevisionNumber: "200",
+							Size:           4096,
+							StartHeight:    startHeight1,
+							WindowStart:    400,
+							WindowEnd:      500,
+
+							UploadSpending:      zeroCurrency,
+							DownloadSpending:    zeroCurrency,
+							FundAccountSpending: zeroCurrency,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	expectedObjSlab2 := dbSlab{
+		DBContractSetID: 1,
+		Key:             obj1Slab1Key,
+		MinShards:       2,
+		TotalShards:     1,
+		Shards: []dbSector{
+			{
+				DBSlabID:   2,
+				Root:       obj1.Slabs[1].Shards[0].Root[:],
+				LatestHost: publicKey(obj1.Slabs[1].Shards[0].Host),
+				Contracts: []dbContract{
+					{
+						HostID: 2,
+						Host: dbHost{
+							PublicKey: publicKey(hk2),
+						},
+						ContractCommon: ContractCommon{
+							FCID: fileContractID(fcid2),
+
+							TotalCost:      currency(totalCost2),
+							RevisionNumber: "200",
+							Size:           4096,
+							StartHeight:    startHeight2,
+							WindowStart:    400,
+							WindowEnd:      500,
+
+							UploadSpending:      zeroCurrency,
+							DownloadSpending:    zeroCurrency,
+							FundAccountSpending: zeroCurrency,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Compare slabs.
+	slab1, err := db.dbSlab(obj1Slab0Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slab2, err := db.dbSlab(obj1Slab1Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slabs := []*dbSlab{&slab1, &slab2}
+	for i := range slabs {
+		slabs[i].Model = Model{}
+		slabs[i].Shards[0].Model = Model{}
+		slabs[i].Shards[0].Contracts[0].Model = Model{}
+		slabs[i].Shards[0].Contracts[0].Host.Model = Model{}
+	}
+	if !reflect.DeepEqual(slab1, expectedObjSlab1) {
+		t.Fatal("mismatch", cmp.Diff(slab1, expectedObjSlab1))
+	}
+	if !reflect.DeepEqual(slab2, expectedObjSlab2) {
+		t.Fatal("mismatch", cmp.Diff(slab2, expectedObjSlab2))
+	}
+
+	// Remove the first slab of the object.
+	obj1.Slabs = obj1.Slabs[1:]
+	if err := db.UpdateObject(ctx, objID, testContractSet, obj1, nil, usedHosts); err != nil {
+		t.Fatal(err)
+	}
+	fullObj, err = db.Object(ctx, objID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fullObj, obj1) {
+		t.Fatal("object mismatch")
+	}
+
+	// Sanity check the db at the end of the test. We expect:
+	// - 1 element in the object table since we only stored and overwrote a single object
+	// - 1 element in the slabs table since we updated the object to only have 1 slab
+	// - 1 element in the slices table for the same reason
+	// - 1 element in the sectors table for the same reason
+	countCheck := func(objCount, sliceCount, slabCount, sectorCount int64) error {
+		tableCountCheck := func(table interface{}, tblCount int64) error {
+			var count int64
+			if err := db.db.Model(table).Count(&count).Error; err != nil {
+				return err
+			}
+			if count != tblCount {
+				return fmt.Errorf("expected %v objects in table %v but got %v", tblCount, table.(schema.Tabler).TableName(), count)
+			}
+			return nil
+		}
+		// Check all tables.
+		if err := tableCountCheck(&dbObject{}, objCount); err != nil {
+			return err
+		}
+		if err := tableCountCheck(&dbSlice{}, sliceCount); err != nil {
+			return err
+		}
+		if err := tableCountCheck(&dbSlab{}, slabCount); err != nil {
+			return err
+		}
+		if err := tableCountCheck(&dbSector{}, sectorCount); err != nil {
+			return err
+		}
+		return nil
+	}
+	if err := countCheck(1, 1, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the object. Due to the cascade this should delete everything
+	// but the sectors.
+	if err := db.RemoveObject(ctx, objID); err != nil {
+		t.Fatal(err)
+	}
+	if err := countCheck(0, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestObjectEntries is a test for the ObjectEntries method.
+func TestObjectEntries(t *testing.T) {
+	os, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := []struct {
+		path string
+		size int64
+	}{
+		{"/foo/bar", 1},
+		{"/foo/bat", 2},
+		{"/foo/baz/quux", 3},
+		{"/foo/baz/quuz", 4},
+		{"/gab/guub", 5},
+		{"/fileś/śpecial", 6}, // utf8
+	}
+	ctx := context.Background()
+	for _, o := range objects {
+		obj, ucs := newTestObject(frand.Intn(9) + 1)
+		obj.Slabs = obj.Slabs[:1]
+		obj.Slabs[0].Length = uint32(o.size)
+		os.UpdateObject(ctx, o.path, testContractSet, obj, nil, ucs)
+	}
+	tests := []struct {
+		path   string
+		prefix string
+		want   []api.ObjectMetadata
+	}{
+		{"/", "", []api.ObjectMetadata{{Name: "/fileś/", Size: 6}, {Name: "/foo/", Size: 10}, {Name: "/gab/", Size: 5}}},
+		{"/foo/", "", []api.ObjectMetadata{{Name: "/foo/bar", Size: 1}, {Name: "/foo/bat", Size: 2}, {Name: "/foo/baz/", Size: 7}}},
+		{"/foo/baz/", "", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}}},
+		{"/gab/", "", []api.ObjectMetadata{{Name: "/gab/guub", Size: 5}}},
+		{"/fileś/", "", []api.ObjectMetadata{{Name: "/fileś/śpecial", Size: 6}}},
+
+		{"/", "f", []api.ObjectMetadata{{Name: "/fileś/", Size: 6}, {Name: "/foo/", Size: 10}}},
+		{"/foo/", "fo", []api.ObjectMetadata{}},
+		{"/foo/baz/", "quux", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}}},
+		{"/gab/", "/guub", []api.ObjectMetadata{}},
+	}
+	for _, test := range tests {
+		got, err := os.ObjectEntries(ctx, test.path, test.prefix, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(len(got) == 0 && len(test.want) == 0) && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("\nlist: %v\nprefix: %v\ngot: %v\nwant: %v", test.path, test.prefix, got, test.want)
+		}
+		for offset := 0; offset < len(test.want); offset++ {
+			got, err := os.ObjectEntries(ctx, test.path, test.prefix, offset, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0] != test.want[offset] {
+				t.Errorf("\nlist: %v\nprefix: %v\ngot: %v\nwant: %v", test.path, test.prefix, got, test.want[offset])
+			}
+		}
+	}
+}
+
+// TestSearchObjects is a test for the SearchObjects method.
+func TestSearchObjects(t *testing.T) {
+	os, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := []struct {
+		path string
+		size int64
+	}{
+		{"/foo/bar", 1},
+		{"/foo/bat", 2},
+		{"/foo/baz/quux", 3},
+		{"/foo/baz/quuz", 4},
+		{"/gab/guub", 5},
+	}
+	ctx := context.Background()
+	for _, o := range objects {
+		obj, ucs := newTestObject(frand.Intn(9) + 1)
+		obj.Slabs = obj.Slabs[:1]
 		obj.Slabs[0].Length = uint32(o.size)
 		os.UpdateObject(ctx, o.path, testContractSet, obj, nil, ucs)
 	}
-	tests := []struct {
-		path   string
-		prefix string
-		want   []api.ObjectMetadata
-	}{
-		{"/", "", []api.ObjectMetadata{{Name: "/fileś/", Size: 6}, {Name: "/foo/", Size: 10}, {Name: "/gab/", Size: 5}}},
-		{"/foo/", "", []api.ObjectMetadata{{Name: "/foo/bar", Size: 1}, {Name: "/foo/bat", Size: 2}, {Name: "/foo/baz/", Size: 7}}},
-		{"/foo/baz/", "", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}}},
-		{"/gab/", "", []api.ObjectMetadata{{Name: "/gab/guub", Size: 5}}},
-		{"/fileś/", "", []api.ObjectMetadata{{Name: "/fileś/śpecial", Size: 6}}},
+	tests := []struct {
+		path string
+		want []api.ObjectMetadata
+	}{
+		{"/", []api.ObjectMetadata{{Name: "/foo/bar", Size: 1}, {Name: "/foo/bat", Size: 2}, {Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}, {Name: "/gab/guub", Size: 5}}},
+		{"/foo/b", []api.ObjectMetadata{{Name: "/foo/bar", Size: 1}, {Name: "/foo/bat", Size: 2}, {Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}}},
+		{"o/baz/quu", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}}},
+		{"uu", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}, {Name: "/gab/guub", Size: 5}}},
+	}
+	for _, test := range tests {
+		got, err := os.SearchObjects(ctx, test.path, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(len(got) == 0 && len(test.want) == 0) && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("\nkey: %v\ngot: %v\nwant: %v", test.path, got, test.want)
+		}
+		for offset := 0; offset < len(test.want); offset++ {
+			got, err := os.SearchObjects(ctx, test.path, offset, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0] != test.want[offset] {
+				t.Errorf("\nkey: %v\ngot: %v\nwant: %v", test.path, got, test.want[offset])
+			}
+		}
+	}
+}
+
+// TestUnhealthySlabs tests the functionality of UnhealthySlabs.
+func TestUnhealthySlabs(t *testing.T) {
+	// create db
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add 4 hosts
+	hks, err := db.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1, hk2, hk3, hk4 := hks[0], hks[1], hks[2], hks[3]
+
+	// add 4 contracts
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcid1, fcid2, fcid3, fcid4 := fcids[0], fcids[1], fcids[2], fcids[3]
+
+	// select the first three contracts as good contracts
+	goodContracts := []types.FileContractID{fcid1, fcid2, fcid3}
+	if _, _, _, err := db.SetContractSet(context.Background(), testContractSet, goodContracts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// add an object
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			// good slab
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{1},
+						},
+						{
+							Host: hk2,
+							Root: types.Hash256{2},
+						},
+						{
+							Host: hk3,
+							Root: types.Hash256{3},
+						},
+					},
+				},
+			},
+			// unhealthy slab - hk4 is bad (1/3)
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{4},
+						},
+						{
+							Host: hk2,
+							Root: types.Hash256{5},
+						},
+						{
+							Host: hk4,
+							Root: types.Hash256{6},
+						},
+					},
+				},
+			},
+			// unhealthy slab - hk4 is bad (2/3)
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{7},
+						},
+						{
+							Host: hk4,
+							Root: types.Hash256{8},
+						},
+						{
+							Host: hk4,
+							Root: types.Hash256{9},
+						},
+					},
+				},
+			},
+			// unhealthy slab - hk5 is deleted (1/3)
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{10},
+						},
+						{
+							Host: hk2,
+							Root: types.Hash256{11},
+						},
+						{
+							Host: types.PublicKey{5},
+							Root: types.Hash256{12},
+						},
+					},
+				},
+			},
+			// unhealthy slab - h1 is reused
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{13},
+						},
+						{
+							Host: hk1,
+							Root: types.Hash256{14},
+						},
+						{
+							Host: hk1,
+							Root: types.Hash256{15},
+						},
+					},
+				},
+			},
+			// lost slab - no good pieces (0/3)
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: types.PublicKey{1},
+							Root: types.Hash256{16},
+						},
+						{
+							Host: types.PublicKey{2},
+							Root: types.Hash256{17},
+						},
+						{
+							Host: types.PublicKey{3},
+							Root: types.Hash256{18},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
+		hk1: fcid1,
+		hk2: fcid2,
+		hk3: fcid3,
+		hk4: fcid4,
+		{5}: {5}, // deleted host and contract
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 4 {
+		t.Fatalf("unexpected amount of slabs to migrate, %v!=4", len(slabs))
+	}
+
+	expected := []api.UnhealthySlab{
+		{Key: obj.Slabs[2].Key, Health: 0},
+		{Key: obj.Slabs[4].Key, Health: 0},
+		{Key: obj.Slabs[1].Key, Health: 0.5},
+		{Key: obj.Slabs[3].Key, Health: 0.5},
+	}
+	if !reflect.DeepEqual(slabs, expected) {
+		t.Fatal("slabs are not returned in the correct order")
+	}
+
+	slabs, err = db.UnhealthySlabs(ctx, 0.49, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 2 {
+		t.Fatalf("unexpected amount of slabs to migrate, %v!=2", len(slabs))
+	}
+
+	expected = []api.UnhealthySlab{
+		{Key: obj.Slabs[2].Key, Health: 0},
+		{Key: obj.Slabs[4].Key, Health: 0},
+	}
+	if !reflect.DeepEqual(slabs, expected) {
+		t.Fatal("slabs are not returned in the correct order", slabs, expected)
+	}
+
+	// Fetch unhealthy slabs again but for different contract set.
+	slabs, err = db.UnhealthySlabs(ctx, 0.49, "foo", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 0 {
+		t.Fatal("expected no slabs to migrate", len(slabs))
+	}
+}
+
+func TestUnhealthySlabsNegHealth(t *testing.T) {
+	// create db
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add a host
+	hks, err := db.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1 := hks[0]
+
+	// add a contract
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcid1 := fcids[0]
+
+	// add it to the contract set
+	if _, _, _, err := db.SetContractSet(context.Background(), testContractSet, fcids, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// create an object
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 2,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{1},
+						},
+						{
+							Host: hk1,
+							Root: types.Hash256{2},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// add the object
+	ctx := context.Background()
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hk1: fcid1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert it's unhealthy
+	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 1 {
+		t.Fatalf("unexpected amount of slabs to migrate, %v!=1", len(slabs))
+	}
+}
+
+func TestUnhealthySlabsNoContracts(t *testing.T) {
+	// create db
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add a host
+	hks, err := db.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1 := hks[0]
+
+	// add a contract
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcid1 := fcids[0]
+
+	// add it to the contract set
+	if _, _, _, err := db.SetContractSet(context.Background(), testContractSet, fcids, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// create an object
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{1},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// add the object
+	ctx := context.Background()
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hk1: fcid1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert it's healthy
+	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 0 {
+		t.Fatalf("unexpected amount of slabs to migrate, %v!=0", len(slabs))
+	}
+
+	// delete the sector
+	if err := db.db.Table("contract_sectors").Where("TRUE").Delete(&dbContractSector{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// assert it's unhealthy
+	slabs, err = db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 1 {
+		t.Fatalf("unexpected amount of slabs to migrate, %v!=1", len(slabs))
+	}
+}
+
+// TestUnhealthySlabs tests the functionality of UnhealthySlabs on slabs that
+// don't have any redundancy.
+func TestUnhealthySlabsNoRedundancy(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add 3 hosts
+	hks, err := db.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk1, hk2, hk3 := hks[0], hks[1], hks[2]
+
+	// add 4 contracts
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcid1, fcid2, fcid3 := fcids[0], fcids[1], fcids[2]
+
+	// select the first two contracts as good contracts
+	goodContracts := []types.FileContractID{fcid1, fcid2}
+	if _, _, _, err := db.SetContractSet(context.Background(), testContractSet, goodContracts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// add an object
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			// hk1 is good so this slab should have full health.
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{
+							Host: hk1,
+							Root: types.Hash256{1},
+						},
+					},
+				},
+			},
+			// hk4 is bad so this slab should have no health.
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 2,
+					Shards: []object.Sector{
+						{
+							Host: hk2,
+							Root: types.Hash256{2},
+						},
+						{
+							Host: hk3,
+							Root: types.Hash256{4},
+						},
+					},
+				},
+			},
+		},
+	}
 
-		{"/", "f", []api.ObjectMetadata{{Name: "/fileś/", Size: 6}, {Name: "/foo/", Size: 10}}},
-		{"/foo/", "fo", []api.ObjectMetadata{}},
-		{"/foo/baz/", "quux", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}}},
-		{"/gab/", "/guub", []api.ObjectMetadata{}},
+	ctx := context.Background()
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
+		hk1: fcid1,
+		hk2: fcid2,
+		hk3: fcid3,
+	}); err != nil {
+		t.Fatal(err)
 	}
-	for _, test := range tests {
-		got, err := os.ObjectEntries(ctx, test.path, test.prefix, 0, -1)
-		if err != nil {
+
+	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slabs) != 1 {
+		t.Fatalf("unexpected amount of slabs to migrate, %v!=1", len(slabs))
+	}
+
+	expected := []api.UnhealthySlab{
+		{Key: obj.Slabs[1].Slab.Key, Health: -1},
+	}
+	if !reflect.DeepEqual(slabs, expected) {
+		t.Fatal("slabs are not returned in the correct order")
+	}
+}
+
+// TestContractSectors is a test for the contract_sectors join table. It
+// verifies that deleting contracts or sectors also cleans up the join table.
+func TestContractSectors(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a host, contract and sector to upload to that host into the
+	// given contract.
+	hk1 := types.PublicKey{1}
+	fcid1 := types.FileContractID{1}
+	err = db.addTestHost(hk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.addTestContract(fcid1, hk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sectorGood := object.Sector{
+		Host: hk1,
+		Root: types.Hash256{1},
+	}
+
+	// Prepare used contracts.
+	usedContracts := map[types.PublicKey]types.FileContractID{
+		hk1: fcid1,
+	}
+
+	// Create object.
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						sectorGood,
+					},
+				},
+			},
+		},
+	}
+	ctx := context.Background()
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, usedContracts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the contract.
+	err = db.ArchiveContract(ctx, fcid1, api.ContractArchivalReasonRemoved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the join table. Should be empty.
+	var css []dbContractSector
+	if err := db.db.Find(&css).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(css) != 0 {
+		t.Fatal("table should be empty", len(css))
+	}
+
+	// Add the contract back.
+	_, err = db.addTestContract(fcid1, hk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add the object again.
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, usedContracts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the object.
+	if err := db.RemoveObject(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the sector.
+	if err := db.db.Delete(&dbSector{Model: Model{ID: 1}}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Find(&css).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(css) != 0 {
+		t.Fatal("table should be empty")
+	}
+}
+
+// TestContractsSummary tests ContractsSummary against a handful of active and
+// archived contracts.
+func TestContractsSummary(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// assert the summary of an empty store
+	if summary, err := cs.ContractsSummary(ctx); err != nil {
+		t.Fatal(err)
+	} else if summary.Active != 0 || summary.Archived != 0 || !summary.TotalCost.IsZero() || summary.MinStartHeight != 0 || summary.MaxWindowEnd != 0 {
+		t.Fatal("unexpected summary", summary)
+	}
+
+	// add 4 contracts with increasing cost, start height and window end
+	hks, err := cs.addTestHosts(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fcids []types.FileContractID
+	for i, hk := range hks {
+		fcid := types.FileContractID{byte(i + 1)}
+		rev := testContractRevision(fcid, hk)
+		rev.Revision.WindowEnd = uint64(500 + i)
+		if _, err := cs.AddContract(ctx, rev, types.Siacoins(uint32(i+1)), uint64(10+i), "", nil); err != nil {
 			t.Fatal(err)
 		}
-		if !(len(got) == 0 && len(test.want) == 0) && !reflect.DeepEqual(got, test.want) {
-			t.Errorf("\nlist: %v\nprefix: %v\ngot: %v\nwant: %v", test.path, test.prefix, got, test.want)
-		}
-		for offset := 0; offset < len(test.want); offset++ {
-			got, err := os.ObjectEntries(ctx, test.path, test.prefix, offset, 1)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if len(got) != 1 || got[0] != test.want[offset] {
-				t.Errorf("\nlist: %v\nprefix: %v\ngot: %v\nwant: %v", test.path, test.prefix, got, test.want[offset])
-			}
-		}
+		fcids = append(fcids, fcid)
+	}
+
+	// record spending for all of them
+	var records []api.ContractSpendingRecord
+	for _, fcid := range fcids {
+		records = append(records, api.ContractSpendingRecord{
+			ContractID: fcid,
+			ContractSpending: api.ContractSpending{
+				Uploads:     types.Siacoins(1),
+				Downloads:   types.Siacoins(2),
+				FundAccount: types.Siacoins(3),
+			},
+		})
+	}
+	if err := cs.RecordContractSpending(ctx, records); err != nil {
+		t.Fatal(err)
 	}
-}
 
-// TestSearchObjects is a test for the SearchObjects method.
-func TestSearchObjects(t *testing.T) {
-	os, _, _, err := newTestSQLStore()
+	// put the first two contracts in a set and archive the last one
+	if _, _, _, err := cs.SetContractSet(ctx, "foo", fcids[:2], false); err != nil {
+		t.Fatal(err)
+	} else if err := cs.ArchiveContract(ctx, fcids[3], api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := cs.ContractsSummary(ctx)
 	if err != nil {
 		t.Fatal(err)
+	} else if summary.Active != 3 || summary.Archived != 1 || summary.Locked != 0 {
+		t.Fatal("unexpected counts", summary.Active, summary.Archived, summary.Locked)
+	} else if !summary.TotalCost.Equals(types.Siacoins(6)) {
+		t.Fatal("unexpected total cost", summary.TotalCost)
+	} else if summary.Spending != (api.ContractSpending{
+		Uploads:     types.Siacoins(3),
+		Downloads:   types.Siacoins(6),
+		FundAccount: types.Siacoins(9),
+	}) {
+		t.Fatal("unexpected spending", summary.Spending)
+	} else if summary.MinStartHeight != 10 || summary.MaxWindowEnd != 502 {
+		t.Fatal("unexpected height range", summary.MinStartHeight, summary.MaxWindowEnd)
 	}
-	objects := []struct {
-		path string
-		size int64
-	}{
-		{"/foo/bar", 1},
-		{"/foo/bat", 2},
-		{"/foo/baz/quux", 3},
-		{"/foo/baz/quuz", 4},
-		{"/gab/guub", 5},
+
+	// assert the sets, including the virtual one
+	sets := make(map[string]int64)
+	for _, set := range summary.Sets {
+		sets[set.Name] = set.Contracts
+	}
+	if len(sets) != 3 || sets[api.ContractSetAll] != 3 || sets[testContractSet] != 0 || sets["foo"] != 2 {
+		t.Fatal("unexpected sets", summary.Sets)
+	}
+}
+
+// TestContractSizes is a unit test for ContractSizes and ContractSize.
+func TestContractSizes(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
 	}
 	ctx := context.Background()
-	for _, o := range objects {
-		obj, ucs := newTestObject(frand.Intn(9) + 1)
-		obj.Slabs = obj.Slabs[:1]
-		obj.Slabs[0].Length = uint32(o.size)
-		os.UpdateObject(ctx, o.path, testContractSet, obj, nil, ucs)
+
+	// add three contracts with three different hosts
+	hks, err := db.addTestHosts(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upload an object with a sector to the first two hosts
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{Host: hks[0], Root: types.Hash256{1}},
+						{Host: hks[1], Root: types.Hash256{2}},
+					},
+				},
+			},
+		},
+	}
+	usedContracts := map[types.PublicKey]types.FileContractID{
+		hks[0]: fcids[0],
+		hks[1]: fcids[1],
+	}
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, usedContracts); err != nil {
+		t.Fatal(err)
+	}
+
+	// share the first sector with the second contract
+	var sector dbSector
+	root := types.Hash256{1}
+	if err := db.db.Where(dbSector{Root: root[:]}).Take(&sector).Error; err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db.contract(ctx, fileContractID(fcids[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Create(&dbContractSector{DBContractID: c2.ID, DBSectorID: sector.ID}).Error; err != nil {
+		t.Fatal(err)
 	}
-	tests := []struct {
-		path string
-		want []api.ObjectMetadata
-	}{
-		{"/", []api.ObjectMetadata{{Name: "/foo/bar", Size: 1}, {Name: "/foo/bat", Size: 2}, {Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}, {Name: "/gab/guub", Size: 5}}},
-		{"/foo/b", []api.ObjectMetadata{{Name: "/foo/bar", Size: 1}, {Name: "/foo/bat", Size: 2}, {Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}}},
-		{"o/baz/quu", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}}},
-		{"uu", []api.ObjectMetadata{{Name: "/foo/baz/quux", Size: 3}, {Name: "/foo/baz/quuz", Size: 4}, {Name: "/gab/guub", Size: 5}}},
+
+	// assert the sizes, the third contract has no sectors
+	expected := []api.ContractSize{
+		{ID: fcids[0], Sectors: 1, Size: rhpv2.SectorSize},
+		{ID: fcids[1], Sectors: 2, Size: 2 * rhpv2.SectorSize},
+		{ID: fcids[2], Sectors: 0, Size: 0},
 	}
-	for _, test := range tests {
-		got, err := os.SearchObjects(ctx, test.path, 0, -1)
+	sizes, err := db.ContractSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sizes, expected) {
+		t.Fatal("unexpected sizes", sizes)
+	}
+	for _, e := range expected {
+		size, err := db.ContractSize(ctx, e.ID)
 		if err != nil {
 			t.Fatal(err)
+		} else if size != e {
+			t.Fatal("unexpected size", size)
 		}
-		if !(len(got) == 0 && len(test.want) == 0) && !reflect.DeepEqual(got, test.want) {
-			t.Errorf("\nkey: %v\ngot: %v\nwant: %v", test.path, got, test.want)
-		}
-		for offset := 0; offset < len(test.want); offset++ {
-			got, err := os.SearchObjects(ctx, test.path, offset, 1)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if len(got) != 1 || got[0] != test.want[offset] {
-				t.Errorf("\nkey: %v\ngot: %v\nwant: %v", test.path, got, test.want[offset])
-			}
-		}
+	}
+
+	// assert an unknown contract is reported as such
+	if _, err := db.ContractSize(ctx, types.FileContractID{9}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
 	}
 }
 
-// TestUnhealthySlabs tests the functionality of UnhealthySlabs.
-func TestUnhealthySlabs(t *testing.T) {
-	// create db
+// TestRenewedContractSectors asserts that a renewed contract keeps the sectors
+// of the contract it was renewed from.
+func TestRenewedContractSectors(t *testing.T) {
 	db, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// add 4 hosts
-	hks, err := db.addTestHosts(4)
+	hks, err := db.addTestHosts(1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	hk1, hk2, hk3, hk4 := hks[0], hks[1], hks[2], hks[3]
-
-	// add 4 contracts
 	fcids, _, err := db.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fcid1, fcid2, fcid3, fcid4 := fcids[0], fcids[1], fcids[2], fcids[3]
 
-	// select the first three contracts as good contracts
-	goodContracts := []types.FileContractID{fcid1, fcid2, fcid3}
-	if err := db.SetContractSet(context.Background(), testContractSet, goodContracts); err != nil {
-		t.Fatal(err)
+	// upload an object with a few sectors to the contract
+	var shards []object.Sector
+	for i := 0; i < 10; i++ {
+		shards = append(shards, object.Sector{Host: hks[0], Root: types.Hash256{byte(i + 1)}})
 	}
-
-	// add an object
 	obj := object.Object{
 		Key: object.GenerateEncryptionKey(),
 		Slabs: []object.SlabSlice{
-			// good slab
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{1},
-						},
-						{
-							Host: hk2,
-							Root: types.Hash256{2},
-						},
-						{
-							Host: hk3,
-							Root: types.Hash256{3},
-						},
-					},
-				},
-			},
-			// unhealthy slab - hk4 is bad (1/3)
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{4},
-						},
-						{
-							Host: hk2,
-							Root: types.Hash256{5},
-						},
-						{
-							Host: hk4,
-							Root: types.Hash256{6},
-						},
-					},
-				},
-			},
-			// unhealthy slab - hk4 is bad (2/3)
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{7},
-						},
-						{
-							Host: hk4,
-							Root: types.Hash256{8},
-						},
-						{
-							Host: hk4,
-							Root: types.Hash256{9},
-						},
-					},
-				},
-			},
-			// unhealthy slab - hk5 is deleted (1/3)
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{10},
-						},
-						{
-							Host: hk2,
-							Root: types.Hash256{11},
-						},
-						{
-							Host: types.PublicKey{5},
-							Root: types.Hash256{12},
-						},
-					},
-				},
-			},
-			// unhealthy slab - h1 is reused
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{13},
-						},
-						{
-							Host: hk1,
-							Root: types.Hash256{14},
-						},
-						{
-							Host: hk1,
-							Root: types.Hash256{15},
-						},
-					},
-				},
-			},
-			// lost slab - no good pieces (0/3)
 			{
 				Slab: object.Slab{
 					Key:       object.GenerateEncryptionKey(),
 					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: types.PublicKey{1},
-							Root: types.Hash256{16},
-						},
-						{
-							Host: types.PublicKey{2},
-							Root: types.Hash256{17},
-						},
-						{
-							Host: types.PublicKey{3},
-							Root: types.Hash256{18},
-						},
-					},
+					Shards:    shards,
 				},
 			},
 		},
 	}
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hks[0]: fcids[0]}); err != nil {
+		t.Fatal(err)
+	}
 
-	ctx := context.Background()
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
-		hk1: fcid1,
-		hk2: fcid2,
-		hk3: fcid3,
-		hk4: fcid4,
-		{5}: {5}, // deleted host and contract
-	}); err != nil {
+	// renew the contract
+	renewedID := types.FileContractID{2}
+	if _, err := db.addTestRenewedContract(renewedID, fcids[0], hks[0], 1); err != nil {
 		t.Fatal(err)
 	}
 
-	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
-	if err != nil {
+	// the renewed contract should report the same sectors
+	if size, err := db.ContractSize(ctx, renewedID); err != nil {
 		t.Fatal(err)
+	} else if size.Sectors != uint64(len(shards)) {
+		t.Fatal("unexpected number of sectors", size.Sectors)
 	}
-	if len(slabs) != 4 {
-		t.Fatalf("unexpected amount of slabs to migrate, %v!=4", len(slabs))
+	if _, err := db.ContractSize(ctx, fcids[0]); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
 	}
 
-	expected := []api.UnhealthySlab{
-		{Key: obj.Slabs[2].Key, Health: 0},
-		{Key: obj.Slabs[4].Key, Health: 0},
-		{Key: obj.Slabs[1].Key, Health: 0.5},
-		{Key: obj.Slabs[3].Key, Health: 0.5},
+	// the object should still be fully available
+	if o, err := db.Object(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(o.Slabs[0].Shards) != len(shards) {
+		t.Fatal("unexpected number of shards", len(o.Slabs[0].Shards))
 	}
-	if !reflect.DeepEqual(slabs, expected) {
-		t.Fatal("slabs are not returned in the correct order")
+}
+
+// TestContractRoots is a test for ContractRoots.
+func TestContractRoots(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	slabs, err = db.UnhealthySlabs(ctx, 0.49, testContractSet, -1)
+	hks, err := db.addTestHosts(2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) != 2 {
-		t.Fatalf("unexpected amount of slabs to migrate, %v!=2", len(slabs))
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	expected = []api.UnhealthySlab{
-		{Key: obj.Slabs[2].Key, Health: 0},
-		{Key: obj.Slabs[4].Key, Health: 0},
+	// upload an object with 10 sectors to the first contract
+	var shards []object.Sector
+	for i := 0; i < 10; i++ {
+		shards = append(shards, object.Sector{Host: hks[0], Root: types.Hash256{byte(i + 1)}})
 	}
-	if !reflect.DeepEqual(slabs, expected) {
-		t.Fatal("slabs are not returned in the correct order", slabs, expected)
+	obj := object.Object{
+		Key: object.GenerateEncryptionKey(),
+		Slabs: []object.SlabSlice{
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards:    shards,
+				},
+			},
+		},
+	}
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hks[0]: fcids[0]}); err != nil {
+		t.Fatal(err)
 	}
 
-	// Fetch unhealthy slabs again but for different contract set.
-	slabs, err = db.UnhealthySlabs(ctx, 0.49, "foo", -1)
+	// assert all roots are returned in order
+	roots, err := db.ContractRoots(ctx, fcids[0], 0, -1)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(roots) != len(shards) {
+		t.Fatal("unexpected number of roots", len(roots))
 	}
-	if len(slabs) != 0 {
-		t.Fatal("expected no slabs to migrate", len(slabs))
+	for i, root := range roots {
+		if root != shards[i].Root {
+			t.Fatalf("unexpected root at index %v", i)
+		}
+	}
+
+	// assert pages add up to the same roots
+	var paginated []types.Hash256
+	for offset := 0; ; offset += 3 {
+		page, err := db.ContractRoots(ctx, fcids[0], offset, 3)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(page) == 0 {
+			break
+		} else if len(page) > 3 {
+			t.Fatal("page too large", len(page))
+		}
+		paginated = append(paginated, page...)
+	}
+	if !reflect.DeepEqual(paginated, roots) {
+		t.Fatal("unexpected roots", paginated)
+	}
+
+	// assert a contract without sectors has no roots and an unknown contract
+	// isn't found
+	if roots, err := db.ContractRoots(ctx, fcids[1], 0, -1); err != nil {
+		t.Fatal(err)
+	} else if len(roots) != 0 {
+		t.Fatal("unexpected roots", roots)
+	} else if _, err := db.ContractRoots(ctx, types.FileContractID{9}, 0, -1); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
 	}
 }
 
-func TestUnhealthySlabsNegHealth(t *testing.T) {
-	// create db
+func TestContractPrunableData(t *testing.T) {
 	db, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// add a host
-	hks, err := db.addTestHosts(1)
+	// add two contracts
+	hks, err := db.addTestHosts(2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	hk1 := hks[0]
-
-	// add a contract
 	fcids, _, err := db.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fcid1 := fcids[0]
-
-	// add it to the contract set
-	if err := db.SetContractSet(context.Background(), testContractSet, fcids); err != nil {
-		t.Fatal(err)
-	}
 
-	// create an object
+	// upload an object with two sectors on the first host
 	obj := object.Object{
 		Key: object.GenerateEncryptionKey(),
 		Slabs: []object.SlabSlice{
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 2,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{1},
-						},
-						{
-							Host: hk1,
-							Root: types.Hash256{2},
-						},
+			{
+				Slab: object.Slab{
+					Key:       object.GenerateEncryptionKey(),
+					MinShards: 1,
+					Shards: []object.Sector{
+						{Host: hks[0], Root: types.Hash256{1}},
+						{Host: hks[0], Root: types.Hash256{2}},
 					},
 				},
 			},
 		},
 	}
-
-	// add the object
-	ctx := context.Background()
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hk1: fcid1}); err != nil {
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hks[0]: fcids[0]}); err != nil {
 		t.Fatal(err)
 	}
 
-	// assert it's unhealthy
-	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
+	// add three sectors to the first contract that aren't part of a slab
+	c, err := db.contract(ctx, fileContractID(fcids[0]))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) != 1 {
-		t.Fatalf("unexpected amount of slabs to migrate, %v!=1", len(slabs))
+	for i := 0; i < 3; i++ {
+		root := types.Hash256{byte(i + 3)}
+		if err := db.db.Exec("INSERT INTO sectors (created_at, db_slab_id, latest_host, root) VALUES (?, NULL, ?, ?)", time.Now(), publicKey(hks[0]), root[:]).Error; err != nil {
+			t.Fatal(err)
+		}
+		var sector dbSector
+		if err := db.db.Where(dbSector{Root: root[:]}).Take(&sector).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.db.Create(&dbContractSector{DBContractID: c.ID, DBSectorID: sector.ID}).Error; err != nil {
+			t.Fatal(err)
+		}
 	}
-}
 
-func TestUnhealthySlabsNoContracts(t *testing.T) {
-	// create db
-	db, _, _, err := newTestSQLStore()
+	// assert the prunable data of both contracts
+	data, err := db.ContractsPrunableData(ctx)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(data) != 2 {
+		t.Fatalf("unexpected number of contracts %v", len(data))
+	} else if !reflect.DeepEqual(data[0], api.ContractPrunableData{ID: fcids[0], Sectors: 5, Prunable: 3, Size: 3 * rhpv2.SectorSize}) {
+		t.Fatalf("unexpected prunable data %+v", data[0])
+	} else if !reflect.DeepEqual(data[1], api.ContractPrunableData{ID: fcids[1]}) {
+		t.Fatalf("unexpected prunable data %+v", data[1])
 	}
 
-	// add a host
-	hks, err := db.addTestHosts(1)
+	// assert the single contract variant matches
+	single, err := db.ContractPrunableData(ctx, fcids[0])
 	if err != nil {
 		t.Fatal(err)
+	} else if !reflect.DeepEqual(single, data[0]) {
+		t.Fatalf("unexpected prunable data %+v", single)
 	}
-	hk1 := hks[0]
 
-	// add a contract
-	fcids, _, err := db.addTestContracts(hks)
+	// assert unknown contracts are reported
+	if _, err := db.ContractPrunableData(ctx, types.FileContractID{9}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
+	}
+}
+
+// TestPruneDanglingSectors is a unit test for PruneDanglingSectors.
+func TestPruneDanglingSectors(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
-	fcid1 := fcids[0]
+	ctx := context.Background()
 
-	// add it to the contract set
-	if err := db.SetContractSet(context.Background(), testContractSet, fcids); err != nil {
+	// add two contracts with two different hosts
+	hks, err := db.addTestHosts(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	// create an object
+	// upload an object with a sector to each host
 	obj := object.Object{
 		Key: object.GenerateEncryptionKey(),
 		Slabs: []object.SlabSlice{
@@ -1532,79 +4427,123 @@ func TestUnhealthySlabsNoContracts(t *testing.T) {
 					Key:       object.GenerateEncryptionKey(),
 					MinShards: 1,
 					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{1},
-						},
+						{Host: hks[0], Root: types.Hash256{1}},
+						{Host: hks[1], Root: types.Hash256{2}},
 					},
 				},
 			},
 		},
 	}
-
-	// add the object
-	ctx := context.Background()
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{hk1: fcid1}); err != nil {
+	usedContracts := map[types.PublicKey]types.FileContractID{
+		hks[0]: fcids[0],
+		hks[1]: fcids[1],
+	}
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, usedContracts); err != nil {
 		t.Fatal(err)
 	}
 
-	// assert it's healthy
-	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
+	// add sectors that aren't part of a slab, one exclusive to the first
+	// contract, one shared by both contracts and one without contracts
+	c1, err := db.contract(ctx, fileContractID(fcids[0]))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) != 0 {
-		t.Fatalf("unexpected amount of slabs to migrate, %v!=0", len(slabs))
+	c2, err := db.contract(ctx, fileContractID(fcids[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, contracts := range [][]uint{{c1.ID}, {c1.ID, c2.ID}, nil} {
+		root := types.Hash256{byte(i + 3)}
+		if err := db.db.Exec("INSERT INTO sectors (created_at, db_slab_id, latest_host, root) VALUES (?, NULL, ?, ?)", time.Now(), publicKey(hks[0]), root[:]).Error; err != nil {
+			t.Fatal(err)
+		}
+		var sector dbSector
+		if err := db.db.Where(dbSector{Root: root[:]}).Take(&sector).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range contracts {
+			if err := db.db.Create(&dbContractSector{DBContractID: id, DBSectorID: sector.ID}).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
 	}
 
-	// delete the sector
-	if err := db.db.Table("contract_sectors").Where("TRUE").Delete(&dbContractSector{}).Error; err != nil {
+	assertSectors := func(expected ...types.Hash256) {
+		t.Helper()
+		var sectors []dbSector
+		if err := db.db.Order("id").Find(&sectors).Error; err != nil {
+			t.Fatal(err)
+		} else if len(sectors) != len(expected) {
+			t.Fatalf("unexpected number of sectors, %v != %v", len(sectors), len(expected))
+		}
+		for i, sector := range sectors {
+			if !bytes.Equal(sector.Root, expected[i][:]) {
+				t.Fatalf("unexpected sector at index %v, %x != %v", i, sector.Root, expected[i])
+			}
+		}
+	}
+
+	// only the sector without contracts is pruned
+	if pruned, err := db.PruneDanglingSectors(ctx); err != nil {
 		t.Fatal(err)
+	} else if pruned != 1 {
+		t.Fatal("unexpected number of pruned sectors", pruned)
 	}
+	assertSectors(types.Hash256{1}, types.Hash256{2}, types.Hash256{3}, types.Hash256{4})
 
-	// assert it's unhealthy
-	slabs, err = db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
-	if err != nil {
+	// archive the first contract, its join rows are removed
+	if err := db.ArchiveContract(ctx, fcids[0], api.ContractArchivalReasonRemoved); err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) != 1 {
-		t.Fatalf("unexpected amount of slabs to migrate, %v!=1", len(slabs))
+	var css []dbContractSector
+	if err := db.db.Where("db_contract_id = ?", c1.ID).Find(&css).Error; err != nil {
+		t.Fatal(err)
+	} else if len(css) != 0 {
+		t.Fatal("expected join rows to be removed", len(css))
+	}
+
+	// the exclusive sector is pruned, the shared sector and the sector that
+	// is part of a slab are kept
+	if pruned, err := db.pruneDanglingSectors(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if pruned != 1 {
+		t.Fatal("unexpected number of pruned sectors", pruned)
+	}
+	assertSectors(types.Hash256{1}, types.Hash256{2}, types.Hash256{4})
+
+	// pruning again is a no-op
+	if pruned, err := db.PruneDanglingSectors(ctx); err != nil {
+		t.Fatal(err)
+	} else if pruned != 0 {
+		t.Fatal("unexpected number of pruned sectors", pruned)
 	}
 }
 
-// TestUnhealthySlabs tests the functionality of UnhealthySlabs on slabs that
-// don't have any redundancy.
-func TestUnhealthySlabsNoRedundancy(t *testing.T) {
+// TestPutSlab verifies the functionality of PutSlab.
+func TestPutSlab(t *testing.T) {
 	db, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// add 3 hosts
-	hks, err := db.addTestHosts(4)
+	hks, err := db.addTestHosts(3)
 	if err != nil {
 		t.Fatal(err)
 	}
 	hk1, hk2, hk3 := hks[0], hks[1], hks[2]
 
-	// add 4 contracts
+	// add 3 contracts
 	fcids, _, err := db.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
 	fcid1, fcid2, fcid3 := fcids[0], fcids[1], fcids[2]
 
-	// select the first two contracts as good contracts
-	goodContracts := []types.FileContractID{fcid1, fcid2}
-	if err := db.SetContractSet(context.Background(), testContractSet, goodContracts); err != nil {
-		t.Fatal(err)
-	}
-
 	// add an object
 	obj := object.Object{
 		Key: object.GenerateEncryptionKey(),
 		Slabs: []object.SlabSlice{
-			// hk1 is good so this slab should have full health.
 			{
 				Slab: object.Slab{
 					Key:       object.GenerateEncryptionKey(),
@@ -1614,421 +4553,816 @@ func TestUnhealthySlabsNoRedundancy(t *testing.T) {
 							Host: hk1,
 							Root: types.Hash256{1},
 						},
-					},
-				},
-			},
-			// hk4 is bad so this slab should have no health.
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 2,
-					Shards: []object.Sector{
 						{
 							Host: hk2,
 							Root: types.Hash256{2},
 						},
-						{
-							Host: hk3,
-							Root: types.Hash256{4},
-						},
 					},
 				},
 			},
 		},
 	}
+	ctx := context.Background()
+	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
+		hk1: fcid1,
+		hk2: fcid2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// extract the slab key
+	key, err := obj.Slabs[0].Key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// helper to fetch a slab from the database
+	fetchSlab := func() (slab dbSlab) {
+		t.Helper()
+		if err = db.db.
+			Where(&dbSlab{Key: key}).
+			Preload("Shards.Contracts").
+			Take(&slab).
+			Error; err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// helper to extract the FCID from a list of contracts
+	contractIds := func(contracts []dbContract) (ids []fileContractID) {
+		for _, c := range contracts {
+			ids = append(ids, fileContractID(c.FCID))
+		}
+		return
+	}
+
+	// fetch inserted slab
+	inserted := fetchSlab()
+
+	// assert both sectors were upload to one contract/host
+	for i := 0; i < 2; i++ {
+		if cids := contractIds(inserted.Shards[i].Contracts); len(cids) != 1 {
+			t.Fatalf("sector %d was uploaded to unexpected amount of contracts, %v!=1", i+1, len(cids))
+		} else if inserted.Shards[i].LatestHost != publicKey(hks[i]) {
+			t.Fatalf("sector %d was uploaded to unexpected amount of hosts, %v!=1", i+1, len(hks))
+		}
+	}
+
+	// select contracts h1 and h3 as good contracts (h2 is bad)
+	goodContracts := []types.FileContractID{fcid1, fcid3}
+	if _, _, _, err := db.SetContractSet(ctx, testContractSet, goodContracts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch slabs for migration and assert there is only one
+	toMigrate, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toMigrate) != 1 {
+		t.Fatal("unexpected number of slabs to migrate", len(toMigrate))
+	}
+
+	// migrate the sector from h2 to h3
+	slab := obj.Slabs[0].Slab
+	slab.Shards[1] = object.Sector{
+		Host: hk3,
+		Root: types.Hash256{2},
+	}
+
+	// update the slab to reflect the migration
+	err = db.UpdateSlab(ctx, slab, testContractSet, map[types.PublicKey]types.FileContractID{
+		hk1: fcid1,
+		hk3: fcid3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch updated slab
+	updated := fetchSlab()
+
+	// assert the first sector is still only on one host, also assert it's h1
+	if cids := contractIds(updated.Shards[0].Contracts); len(cids) != 1 {
+		t.Fatalf("sector 1 was uploaded to unexpected amount of contracts, %v!=1", len(cids))
+	} else if types.FileContractID(cids[0]) != fcid1 {
+		t.Fatal("sector 1 was uploaded to unexpected contract", cids[0])
+	} else if updated.Shards[0].LatestHost != publicKey(hks[0]) {
+		t.Fatal("host key was invalid", updated.Shards[0].LatestHost, publicKey(hks[0]))
+	} else if hks[0] != hk1 {
+		t.Fatal("sector 1 was uploaded to unexpected host", hks[0])
+	}
+
+	// assert the second sector however is uploaded to two hosts, assert it's h2 and h3
+	if cids := contractIds(updated.Shards[1].Contracts); len(cids) != 2 {
+		t.Fatalf("sector 1 was uploaded to unexpected amount of contracts, %v!=2", len(cids))
+	} else if types.FileContractID(cids[0]) != fcid2 || types.FileContractID(cids[1]) != fcid3 {
+		t.Fatal("sector 1 was uploaded to unexpected contracts", cids[0], cids[1])
+	} else if updated.Shards[0].LatestHost != publicKey(hks[0]) {
+		t.Fatal("host key was invalid", updated.Shards[0].LatestHost, publicKey(hks[0]))
+	}
+
+	// assert there's still only one entry in the dbslab table
+	var cnt int64
+	if err := db.db.Model(&dbSlab{}).Count(&cnt).Error; err != nil {
+		t.Fatal(err)
+	} else if cnt != 1 {
+		t.Fatalf("unexpected number of entries in dbslab, %v != 1", cnt)
+	}
+
+	// fetch slabs for migration and assert there are none left
+	toMigrate, err = db.UnhealthySlabs(ctx, 0.99, testContractSet, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toMigrate) != 0 {
+		t.Fatal("unexpected number of slabs to migrate", len(toMigrate))
+	}
+
+	if obj, err := db.dbObject("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(obj.Slabs) != 1 {
+		t.Fatalf("unexpected number of slabs, %v != 1", len(obj.Slabs))
+	} else if obj.Slabs[0].ID != updated.ID {
+		t.Fatalf("unexpected slab, %v != %v", obj.Slabs[0].ID, updated.ID)
+	}
+}
+
+func newTestObject(slabs int) (object.Object, map[types.PublicKey]types.FileContractID) {
+	obj := object.Object{}
+	usedContracts := make(map[types.PublicKey]types.FileContractID)
+
+	obj.Slabs = make([]object.SlabSlice, slabs)
+	obj.Key = object.GenerateEncryptionKey()
+	for i := range obj.Slabs {
+		n := uint8(frand.Uint64n(10) + 1)
+		offset := uint32(frand.Uint64n(1 << 22))
+		length := offset + uint32(frand.Uint64n(1<<22))
+		obj.Slabs[i] = object.SlabSlice{
+			Slab: object.Slab{
+				Key:       object.GenerateEncryptionKey(),
+				MinShards: n,
+				Shards:    make([]object.Sector, n*2),
+			},
+			Offset: offset,
+			Length: length,
+		}
+		for j := range obj.Slabs[i].Shards {
+			var fcid types.FileContractID
+			frand.Read(fcid[:])
+			obj.Slabs[i].Shards[j].Root = frand.Entropy256()
+			obj.Slabs[i].Shards[j].Host = frand.Entropy256()
+			usedContracts[obj.Slabs[i].Shards[j].Host] = fcid
+		}
+	}
+	return obj, usedContracts
+}
 
-	ctx := context.Background()
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
-		hk1: fcid1,
-		hk2: fcid2,
-		hk3: fcid3,
-	}); err != nil {
+// TestContractBudget asserts spending that pushes a contract past its budget is
+// recorded but reported.
+func TestContractBudget(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	slabs, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
+	hks, err := cs.addTestHosts(2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(slabs) != 1 {
-		t.Fatalf("unexpected amount of slabs to migrate, %v!=1", len(slabs))
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	expected := []api.UnhealthySlab{
-		{Key: obj.Slabs[1].Slab.Key, Health: -1},
+	// unknown contracts can't get a budget
+	budget := api.ContractSpending{Downloads: types.Siacoins(10)}
+	if err := cs.UpdateContractBudget(ctx, types.FileContractID{9}, budget); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
 	}
-	if !reflect.DeepEqual(slabs, expected) {
-		t.Fatal("slabs are not returned in the correct order")
+
+	// set a download budget on both contracts
+	for _, fcid := range fcids {
+		if err := cs.UpdateContractBudget(ctx, fcid, budget); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, err := cs.Contract(ctx, fcids[0]); err != nil {
+		t.Fatal(err)
+	} else if c.Budget != budget {
+		t.Fatal("unexpected budget", c.Budget)
 	}
-}
 
-// TestContractSectors is a test for the contract_sectors join table. It
-// verifies that deleting contracts or sectors also cleans up the join table.
-func TestContractSectors(t *testing.T) {
-	db, _, _, err := newTestSQLStore()
-	if err != nil {
+	// record is a helper to record spending for a contract
+	record := func(fcid types.FileContractID, spending api.ContractSpending) error {
+		t.Helper()
+		return cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{ContractID: fcid, ContractSpending: spending}})
+	}
+
+	// spending up to the budget is fine, categories without a budget are
+	// unlimited
+	if err := record(fcids[0], api.ContractSpending{Downloads: types.Siacoins(9), Uploads: types.Siacoins(100)}); err != nil {
+		t.Fatal(err)
+	} else if err := record(fcids[0], api.ContractSpending{Downloads: types.Siacoins(1)}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Create a host, contract and sector to upload to that host into the
-	// given contract.
-	hk1 := types.PublicKey{1}
-	fcid1 := types.FileContractID{1}
-	err = db.addTestHost(hk1)
-	if err != nil {
+	// crossing the budget is reported but recorded
+	var bee *api.BudgetExceededError
+	if err := record(fcids[0], api.ContractSpending{Downloads: types.NewCurrency64(1)}); !errors.As(err, &bee) || !errors.Is(err, api.ErrBudgetExceeded) {
+		t.Fatal("expected BudgetExceededError", err)
+	} else if len(bee.Contracts) != 1 || bee.Contracts[0] != fcids[0] {
+		t.Fatal("unexpected contracts", bee.Contracts)
+	} else if c, err := cs.Contract(ctx, fcids[0]); err != nil {
 		t.Fatal(err)
+	} else if !c.Spending.Downloads.Equals(types.Siacoins(10).Add(types.NewCurrency64(1))) {
+		t.Fatal("spending wasn't recorded", c.Spending.Downloads)
 	}
-	_, err = db.addTestContract(fcid1, hk1)
-	if err != nil {
+
+	// spending in other categories isn't reported
+	if err := record(fcids[0], api.ContractSpending{Uploads: types.Siacoins(1)}); err != nil {
 		t.Fatal(err)
 	}
-	sectorGood := object.Sector{
-		Host: hk1,
-		Root: types.Hash256{1},
+
+	// race towards the budget of the second contract, only the increments
+	// past the budget should be reported
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var exceeded int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{ContractID: fcids[1], ContractSpending: api.ContractSpending{Downloads: types.Siacoins(1)}}})
+			if errors.Is(err, api.ErrBudgetExceeded) {
+				mu.Lock()
+				exceeded++
+				mu.Unlock()
+			} else if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if exceeded != 10 {
+		t.Fatal("expected 10 increments to exceed the budget", exceeded)
+	} else if c, err := cs.Contract(ctx, fcids[1]); err != nil {
+		t.Fatal(err)
+	} else if !c.Spending.Downloads.Equals(types.Siacoins(20)) {
+		t.Fatal("unexpected spending", c.Spending.Downloads)
 	}
 
-	// Prepare used contracts.
-	usedContracts := map[types.PublicKey]types.FileContractID{
-		hk1: fcid1,
+	// the budget is kept when the contract is renewed
+	renewedID := types.FileContractID{9}
+	if c, err := cs.addTestRenewedContract(renewedID, fcids[1], hks[1], 1); err != nil {
+		t.Fatal(err)
+	} else if c.Budget != budget {
+		t.Fatal("budget wasn't carried over", c.Budget)
 	}
+}
 
-	// Create object.
-	obj := object.Object{
-		Key: object.GenerateEncryptionKey(),
-		Slabs: []object.SlabSlice{
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						sectorGood,
-					},
-				},
-			},
-		},
+// TestRecordContractSpending tests RecordContractSpending.
+func TestRecordContractSpending(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
 	}
-	ctx := context.Background()
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, usedContracts); err != nil {
+
+	// Create a host for the contract.
+	hk := types.GeneratePrivateKey().PublicKey()
+	err = cs.addTestHost(hk)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Delete the contract.
-	err = db.ArchiveContract(ctx, fcid1, api.ContractArchivalReasonRemoved)
+	// Add an announcement.
+	err = cs.insertTestAnnouncement(hk, hostdb.Announcement{NetAddress: "address"})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Check the join table. Should be empty.
-	var css []dbContractSector
-	if err := db.db.Find(&css).Error; err != nil {
+	fcid := types.FileContractID{1, 1, 1, 1, 1}
+	cm, err := cs.addTestContract(fcid, hk)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if len(css) != 0 {
-		t.Fatal("table should be empty", len(css))
+	if cm.Spending != (api.ContractSpending{}) {
+		t.Fatal("spending should be all 0")
 	}
 
-	// Add the contract back.
-	_, err = db.addTestContract(fcid1, hk1)
+	// Record some spending.
+	expectedSpending := api.ContractSpending{
+		Uploads:     types.Siacoins(1),
+		Downloads:   types.Siacoins(2),
+		FundAccount: types.Siacoins(3),
+	}
+	err = cs.RecordContractSpending(context.Background(), []api.ContractSpendingRecord{
+		// non-existent contract
+		{
+			ContractID: types.FileContractID{1, 2, 3},
+		},
+		// valid spending
+		{
+			ContractID:       fcid,
+			ContractSpending: expectedSpending,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm2, err := cs.Contract(context.Background(), fcid)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if cm2.Spending != expectedSpending {
+		t.Fatal("invalid spending")
+	}
 
-	// Add the object again.
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, usedContracts); err != nil {
+	// Record the same spending again.
+	err = cs.RecordContractSpending(context.Background(), []api.ContractSpendingRecord{
+		{
+			ContractID:       fcid,
+			ContractSpending: expectedSpending,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSpending = expectedSpending.Add(expectedSpending)
+	cm3, err := cs.Contract(context.Background(), fcid)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if cm3.Spending != expectedSpending {
+		t.Fatal("invalid spending")
+	}
 
-	// Delete the object.
-	if err := db.RemoveObject(ctx, "foo"); err != nil {
+	// Record spending with a revision.
+	err = cs.RecordContractSpending(context.Background(), []api.ContractSpendingRecord{
+		{
+			ContractID:     fcid,
+			RevisionNumber: 10,
+			Size:           rhpv2.SectorSize,
+		},
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Delete the sector.
-	if err := db.db.Delete(&dbSector{Model: Model{ID: 1}}).Error; err != nil {
+	// Record spending with a lower revision, the spending should be recorded
+	// but the revision and size should be left untouched.
+	err = cs.RecordContractSpending(context.Background(), []api.ContractSpendingRecord{
+		{
+			ContractID:       fcid,
+			RevisionNumber:   5,
+			Size:             0,
+			ContractSpending: api.ContractSpending{Uploads: types.Siacoins(1)},
+		},
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := db.db.Find(&css).Error; err != nil {
+	expectedSpending.Uploads = expectedSpending.Uploads.Add(types.Siacoins(1))
+	cm4, err := cs.Contract(context.Background(), fcid)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if len(css) != 0 {
-		t.Fatal("table should be empty")
+	if cm4.Spending != expectedSpending {
+		t.Fatal("invalid spending")
+	} else if cm4.RevisionNumber != 10 || cm4.Size != rhpv2.SectorSize {
+		t.Fatal("unexpected revision", cm4.RevisionNumber, cm4.Size)
 	}
 }
 
-// TestPutSlab verifies the functionality of PutSlab.
-func TestPutSlab(t *testing.T) {
-	db, _, _, err := newTestSQLStore()
+// TestContractTransferCounters asserts the uploaded and downloaded bytes of a
+// contract are counted independently from its spending.
+func TestContractTransferCounters(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// add 3 hosts
-	hks, err := db.addTestHosts(3)
+	hks, err := cs.addTestHosts(1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	hk1, hk2, hk3 := hks[0], hks[1], hks[2]
-
-	// add 3 contracts
-	fcids, _, err := db.addTestContracts(hks)
+	fcids, _, err := cs.addTestContracts(hks)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fcid1, fcid2, fcid3 := fcids[0], fcids[1], fcids[2]
+	fcid := fcids[0]
 
-	// add an object
-	obj := object.Object{
-		Key: object.GenerateEncryptionKey(),
-		Slabs: []object.SlabSlice{
-			{
-				Slab: object.Slab{
-					Key:       object.GenerateEncryptionKey(),
-					MinShards: 1,
-					Shards: []object.Sector{
-						{
-							Host: hk1,
-							Root: types.Hash256{1},
-						},
-						{
-							Host: hk2,
-							Root: types.Hash256{2},
-						},
-					},
-				},
-			},
-		},
-	}
-	ctx := context.Background()
-	if err := db.UpdateObject(ctx, "foo", testContractSet, obj, nil, map[types.PublicKey]types.FileContractID{
-		hk1: fcid1,
-		hk2: fcid2,
+	// record spending and transfers in separate records
+	if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{
+		{ContractID: fcid, RevisionNumber: 300, Size: 8192, ContractSpending: api.ContractSpending{Uploads: types.Siacoins(1)}},
+		{ContractID: fcid, UploadedBytes: 10},
+		{ContractID: fcid, UploadedBytes: 5, DownloadedBytes: 7},
 	}); err != nil {
 		t.Fatal(err)
 	}
+	c, err := cs.Contract(ctx, fcid)
+	if err != nil {
+		t.Fatal(err)
+	} else if c.UploadedBytes != 15 || c.DownloadedBytes != 7 {
+		t.Fatal("unexpected counters", c.UploadedBytes, c.DownloadedBytes)
+	} else if c.Spending != (api.ContractSpending{Uploads: types.Siacoins(1)}) {
+		t.Fatal("unexpected spending", c.Spending)
+	} else if c.RevisionNumber != 300 || c.Size != 8192 {
+		t.Fatal("unexpected revision", c.RevisionNumber, c.Size)
+	}
 
-	// extract the slab key
-	key, err := obj.Slabs[0].Key.MarshalText()
+	// record transfers only, the spending and revision should be untouched
+	if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{
+		{ContractID: fcid, DownloadedBytes: 3},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err = cs.Contract(ctx, fcid)
 	if err != nil {
 		t.Fatal(err)
+	} else if c.UploadedBytes != 15 || c.DownloadedBytes != 10 {
+		t.Fatal("unexpected counters", c.UploadedBytes, c.DownloadedBytes)
+	} else if c.Spending != (api.ContractSpending{Uploads: types.Siacoins(1)}) {
+		t.Fatal("unexpected spending", c.Spending)
+	} else if c.RevisionNumber != 300 || c.Size != 8192 {
+		t.Fatal("unexpected revision", c.RevisionNumber, c.Size)
 	}
 
-	// helper to fetch a slab from the database
-	fetchSlab := func() (slab dbSlab) {
-		t.Helper()
-		if err = db.db.
-			Where(&dbSlab{Key: key}).
-			Preload("Shards.Contracts").
-			Take(&slab).
-			Error; err != nil {
-			t.Fatal(err)
-		}
-		return
+	// assert the summary includes the counters
+	if summary, err := cs.ContractsSummary(ctx); err != nil {
+		t.Fatal(err)
+	} else if summary.UploadedBytes != 15 || summary.DownloadedBytes != 10 {
+		t.Fatal("unexpected counters", summary.UploadedBytes, summary.DownloadedBytes)
 	}
 
-	// helper to extract the FCID from a list of contracts
-	contractIds := func(contracts []dbContract) (ids []fileContractID) {
-		for _, c := range contracts {
-			ids = append(ids, fileContractID(c.FCID))
-		}
-		return
+	// renew the contract, the counters should be archived and reset
+	renewed, err := cs.addTestRenewedContract(types.FileContractID{2}, fcid, hks[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if renewed.UploadedBytes != 0 || renewed.DownloadedBytes != 0 {
+		t.Fatal("unexpected counters", renewed.UploadedBytes, renewed.DownloadedBytes)
+	}
+	if ac, err := cs.ArchivedContract(ctx, fcid); err != nil {
+		t.Fatal(err)
+	} else if ac.UploadedBytes != 15 || ac.DownloadedBytes != 10 {
+		t.Fatal("unexpected counters", ac.UploadedBytes, ac.DownloadedBytes)
 	}
+}
 
-	// fetch inserted slab
-	inserted := fetchSlab()
+// TestExportImportContracts asserts exporting the contracts, wiping the
+// database and importing them again reproduces the contracts.
+func TestExportImportContracts(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
 
-	// assert both sectors were upload to one contract/host
-	for i := 0; i < 2; i++ {
-		if cids := contractIds(inserted.Shards[i].Contracts); len(cids) != 1 {
-			t.Fatalf("sector %d was uploaded to unexpected amount of contracts, %v!=1", i+1, len(cids))
-		} else if inserted.Shards[i].LatestHost != publicKey(hks[i]) {
-			t.Fatalf("sector %d was uploaded to unexpected amount of hosts, %v!=1", i+1, len(hks))
-		}
+	// add two hosts with an address
+	hk1, hk2 := types.PublicKey{1}, types.PublicKey{2}
+	if err := cs.addCustomTestHost(hk1, "host1.com:1234"); err != nil {
+		t.Fatal(err)
+	} else if err := cs.addCustomTestHost(hk2, "host2.com:1234"); err != nil {
+		t.Fatal(err)
 	}
 
-	// select contracts h1 and h3 as good contracts (h2 is bad)
-	goodContracts := []types.FileContractID{fcid1, fcid3}
-	if err := db.SetContractSet(ctx, testContractSet, goodContracts); err != nil {
+	// add a contract with a settings snapshot and renew another one
+	fcid1, fcid2, fcid3 := types.FileContractID{1}, types.FileContractID{2}, types.FileContractID{3}
+	snapshot := &api.HostSettingsSnapshot{ContractPrice: types.Siacoins(1), StoragePrice: types.Siacoins(2), Data: []byte(`{"foo":"bar"}`)}
+	if _, err := cs.AddContract(ctx, testContractRevision(fcid1, hk1), types.Siacoins(3), 10, "", snapshot); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestContract(fcid2, hk2); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.addTestRenewedContract(fcid3, fcid2, hk2, 20); err != nil {
 		t.Fatal(err)
 	}
 
-	// fetch slabs for migration and assert there is only one
-	toMigrate, err := db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
+	// record some spending and set a budget
+	if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{
+		{ContractID: fcid1, RevisionNumber: 300, Size: 8192, UploadedBytes: 10, ContractSpending: api.ContractSpending{Uploads: types.Siacoins(1), FundAccount: types.Siacoins(2)}},
+		{ContractID: fcid3, RevisionNumber: 400, Size: 4096, DownloadedBytes: 20, ContractSpending: api.ContractSpending{Downloads: types.Siacoins(3)}},
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := cs.UpdateContractBudget(ctx, fcid1, api.ContractSpending{Uploads: types.Siacoins(10)}); err != nil {
+		t.Fatal(err)
+	}
+	contracts, err := cs.Contracts(ctx)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 2 {
+		t.Fatal("unexpected number of contracts", len(contracts))
 	}
-	if len(toMigrate) != 1 {
-		t.Fatal("unexpected number of slabs to migrate", len(toMigrate))
+
+	// export the contracts and make sure the export survives a JSON round trip
+	export, err := cs.ExportContracts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if export.Version != api.ContractsExportVersion {
+		t.Fatal("unexpected version", export.Version)
+	} else if len(export.Contracts) != 2 {
+		t.Fatal("unexpected number of contracts", len(export.Contracts))
+	}
+	b, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded api.ContractsExport
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
 	}
 
-	// migrate the sector from h2 to h3
-	slab := obj.Slabs[0].Slab
-	slab.Shards[1] = object.Sector{
-		Host: hk3,
-		Root: types.Hash256{2},
+	// importing into the same database skips all contracts
+	resp, err := cs.ImportContracts(ctx, decoded)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(resp.Imported) != 0 || len(resp.Skipped) != 2 {
+		t.Fatal("unexpected response", resp)
 	}
 
-	// update the slab to reflect the migration
-	err = db.UpdateSlab(ctx, slab, testContractSet, map[types.PublicKey]types.FileContractID{
-		hk1: fcid1,
-		hk3: fcid3,
-	})
+	// import into an empty database
+	cs2, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	resp, err = cs2.ImportContracts(ctx, decoded)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(resp.Imported, []types.FileContractID{fcid1, fcid3}) || len(resp.Skipped) != 0 {
+		t.Fatal("unexpected response", resp)
+	}
+	imported, err := cs2.Contracts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(imported, contracts) {
+		t.Fatal("unexpected contracts", cmp.Diff(imported, contracts))
+	}
 
-	// fetch updated slab
-	updated := fetchSlab()
+	// importing it again skips all contracts
+	resp, err = cs2.ImportContracts(ctx, decoded)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(resp.Imported) != 0 || !reflect.DeepEqual(resp.Skipped, []types.FileContractID{fcid1, fcid3}) {
+		t.Fatal("unexpected response", resp)
+	}
 
-	// assert the first sector is still only on one host, also assert it's h1
-	if cids := contractIds(updated.Shards[0].Contracts); len(cids) != 1 {
-		t.Fatalf("sector 1 was uploaded to unexpected amount of contracts, %v!=1", len(cids))
-	} else if types.FileContractID(cids[0]) != fcid1 {
-		t.Fatal("sector 1 was uploaded to unexpected contract", cids[0])
-	} else if updated.Shards[0].LatestHost != publicKey(hks[0]) {
-		t.Fatal("host key was invalid", updated.Shards[0].LatestHost, publicKey(hks[0]))
-	} else if hks[0] != hk1 {
-		t.Fatal("sector 1 was uploaded to unexpected host", hks[0])
+	// contracts that were archived are skipped too
+	if err := cs2.ArchiveContract(ctx, fcid1, api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
+	} else if resp, err = cs2.ImportContracts(ctx, decoded); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Imported) != 0 || len(resp.Skipped) != 2 {
+		t.Fatal("unexpected response", resp)
 	}
 
-	// assert the second sector however is uploaded to two hosts, assert it's h2 and h3
-	if cids := contractIds(updated.Shards[1].Contracts); len(cids) != 2 {
-		t.Fatalf("sector 1 was uploaded to unexpected amount of contracts, %v!=2", len(cids))
-	} else if types.FileContractID(cids[0]) != fcid2 || types.FileContractID(cids[1]) != fcid3 {
-		t.Fatal("sector 1 was uploaded to unexpected contracts", cids[0], cids[1])
-	} else if updated.Shards[0].LatestHost != publicKey(hks[0]) {
-		t.Fatal("host key was invalid", updated.Shards[0].LatestHost, publicKey(hks[0]))
+	// unsupported versions are rejected
+	decoded.Version++
+	if _, err := cs2.ImportContracts(ctx, decoded); err == nil {
+		t.Fatal("expected error")
 	}
+}
 
-	// assert there's still only one entry in the dbslab table
-	var cnt int64
-	if err := db.db.Model(&dbSlab{}).Count(&cnt).Error; err != nil {
+// TestContractSpendingHistory is a unit test for recording and querying the
+// contract spending history.
+func TestContractSpendingHistory(t *testing.T) {
+	cs, _, _, err := newTestSQLStore()
+	if err != nil {
 		t.Fatal(err)
-	} else if cnt != 1 {
-		t.Fatalf("unexpected number of entries in dbslab, %v != 1", cnt)
 	}
+	ctx := context.Background()
 
-	// fetch slabs for migration and assert there are none left
-	toMigrate, err = db.UnhealthySlabs(ctx, 0.99, testContractSet, -1)
+	hks, err := cs.addTestHosts(2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(toMigrate) != 0 {
-		t.Fatal("unexpected number of slabs to migrate", len(toMigrate))
+	fcids, _, err := cs.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
 	}
+	fcid1, fcid2 := fcids[0], fcids[1]
 
-	if obj, err := db.dbObject("foo"); err != nil {
+	// record spending twice, it should end up in the current period
+	for i := 0; i < 2; i++ {
+		if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{
+			ContractID:       fcid1,
+			ContractSpending: api.ContractSpending{Uploads: types.NewCurrency64(1)},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	history, err := cs.ContractSpendingHistory(ctx, fcid1, now.Add(-2*time.Hour), now.Add(time.Hour))
+	if err != nil {
 		t.Fatal(err)
-	} else if len(obj.Slabs) != 1 {
-		t.Fatalf("unexpected number of slabs, %v != 1", len(obj.Slabs))
-	} else if obj.Slabs[0].ID != updated.ID {
-		t.Fatalf("unexpected slab, %v != %v", obj.Slabs[0].ID, updated.ID)
+	} else if len(history) != 1 {
+		t.Fatal("unexpected number of periods", len(history))
+	} else if !history[0].Start.Equal(now.UTC().Truncate(time.Hour)) {
+		t.Fatal("unexpected period start", history[0].Start)
+	} else if !history[0].Uploads.Equals(types.NewCurrency64(2)) {
+		t.Fatal("unexpected spending", history[0].ContractSpending)
+	}
+
+	// record several past periods, the first contract only spends in every
+	// other period
+	base := time.Unix(0, 0).Add(1000 * time.Hour).UTC()
+	period := func(i int) time.Time { return base.Add(time.Duration(i) * time.Hour) }
+	for i := 0; i < 5; i++ {
+		spending := api.ContractSpending{Downloads: types.NewCurrency64(uint64(i + 1))}
+		if err := recordContractSpendingPeriod(cs.db, fcid2, period(i), spending); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := recordContractSpendingPeriod(cs.db, fcid1, period(i), spending); err != nil {
+				t.Fatal(err)
+			}
+		}
 	}
-}
 
-func newTestObject(slabs int) (object.Object, map[types.PublicKey]types.FileContractID) {
-	obj := object.Object{}
-	usedContracts := make(map[types.PublicKey]types.FileContractID)
+	// query a sub-range for a single contract
+	history, err = cs.ContractSpendingHistory(ctx, fcid2, period(1), period(3))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(history) != 2 {
+		t.Fatal("unexpected number of periods", len(history))
+	}
+	for i, p := range history {
+		if !p.Start.Equal(period(i+1)) || !p.Downloads.Equals(types.NewCurrency64(uint64(i+2))) {
+			t.Fatal("unexpected period", p)
+		}
+	}
 
-	obj.Slabs = make([]object.SlabSlice, slabs)
-	obj.Key = object.GenerateEncryptionKey()
-	for i := range obj.Slabs {
-		n := uint8(frand.Uint64n(10) + 1)
-		offset := uint32(frand.Uint64n(1 << 22))
-		length := offset + uint32(frand.Uint64n(1<<22))
-		obj.Slabs[i] = object.SlabSlice{
-			Slab: object.Slab{
-				Key:       object.GenerateEncryptionKey(),
-				MinShards: n,
-				Shards:    make([]object.Sector, n*2),
-			},
-			Offset: offset,
-			Length: length,
+	// query the aggregate across contracts
+	history, err = cs.SpendingHistory(ctx, period(0), period(5))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(history) != 5 {
+		t.Fatal("unexpected number of periods", len(history))
+	}
+	for i, p := range history {
+		expected := types.NewCurrency64(uint64(i + 1))
+		if i%2 == 0 {
+			expected = expected.Mul64(2)
 		}
-		for j := range obj.Slabs[i].Shards {
-			var fcid types.FileContractID
-			frand.Read(fcid[:])
-			obj.Slabs[i].Shards[j].Root = frand.Entropy256()
-			obj.Slabs[i].Shards[j].Host = frand.Entropy256()
-			usedContracts[obj.Slabs[i].Shards[j].Host] = fcid
+		if !p.Start.Equal(period(i)) || !p.Downloads.Equals(expected) {
+			t.Fatal("unexpected period", i, p)
 		}
 	}
-	return obj, usedContracts
+
+	// prune the first two periods
+	if pruned, err := cs.pruneSpendingHistory(ctx, period(2), 1); err != nil {
+		t.Fatal(err)
+	} else if pruned != 3 {
+		t.Fatal("unexpected number of pruned periods", pruned)
+	}
+	if history, err := cs.SpendingHistory(ctx, period(0), period(5)); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 3 || !history[0].Start.Equal(period(2)) {
+		t.Fatal("unexpected history", history)
+	}
+
+	// archive the second contract and prune the archive, its history should
+	// be pruned alongside
+	if err := cs.ArchiveContract(ctx, fcid2, api.ContractArchivalReasonRemoved); err != nil {
+		t.Fatal(err)
+	} else if _, err := cs.PruneArchivedContracts(ctx, 1000, false); err != nil {
+		t.Fatal(err)
+	}
+	if history, err := cs.ContractSpendingHistory(ctx, fcid2, period(0), period(5)); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 0 {
+		t.Fatal("expected history to be pruned", history)
+	}
+	if history, err := cs.ContractSpendingHistory(ctx, fcid1, period(0), period(5)); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 2 {
+		t.Fatal("unexpected history", history)
+	}
 }
 
-// TestRecordContractSpending tests RecordContractSpending.
-func TestRecordContractSpending(t *testing.T) {
+// TestContractCurrencyRoundTrip asserts that extreme currency values survive
+// being written to and read from the contracts and archived contracts tables,
+// that they are sorted numerically and that spending overflowing 128 bits is
+// rejected.
+func TestContractCurrencyRoundTrip(t *testing.T) {
 	cs, _, _, err := newTestSQLStore()
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	// Create a host for the contract.
-	hk := types.GeneratePrivateKey().PublicKey()
-	err = cs.addTestHost(hk)
+	hks, err := cs.addTestHosts(1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Add an announcement.
-	err = cs.insertTestAnnouncement(hk, hostdb.Announcement{NetAddress: "address"})
-	if err != nil {
-		t.Fatal(err)
+	// add a contract for every value, in reverse order
+	values := []types.Currency{
+		types.ZeroCurrency,
+		types.NewCurrency64(1),
+		types.NewCurrency64(math.MaxUint64),
+		types.NewCurrency(0, 1),
+		types.NewCurrency(math.MaxUint64, math.MaxUint64-1),
+		types.MaxCurrency,
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		fcid := types.FileContractID{byte(i + 1)}
+		if _, err := cs.AddContract(ctx, testContractRevision(fcid, hks[0]), values[i], 1, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{
+			ContractID: fcid,
+			ContractSpending: api.ContractSpending{
+				Uploads:     values[i],
+				Downloads:   values[i],
+				FundAccount: values[i],
+			},
+		}}); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	fcid := types.FileContractID{1, 1, 1, 1, 1}
-	cm, err := cs.addTestContract(fcid, hk)
+	// assert the values are sorted numerically and round-trip
+	contracts, _, err := cs.ContractsPage(ctx, api.ContractsPageFilter{SortBy: api.ContractSortTotalCost, Limit: -1})
 	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != len(values) {
+		t.Fatalf("unexpected number of contracts, %v != %v", len(contracts), len(values))
 	}
-	if cm.Spending != (api.ContractSpending{}) {
-		t.Fatal("spending should be all 0")
+	for i, c := range contracts {
+		if c.ID != (types.FileContractID{byte(i + 1)}) {
+			t.Fatalf("contracts not sorted by total cost, %v at index %v", c.ID, i)
+		} else if !c.TotalCost.Equals(values[i]) {
+			t.Fatalf("unexpected total cost, %v != %v", c.TotalCost, values[i])
+		} else if c.Spending != (api.ContractSpending{Uploads: values[i], Downloads: values[i], FundAccount: values[i]}) {
+			t.Fatalf("unexpected spending, %+v", c.Spending)
+		}
 	}
 
-	// Record some spending.
-	expectedSpending := api.ContractSpending{
-		Uploads:     types.Siacoins(1),
-		Downloads:   types.Siacoins(2),
-		FundAccount: types.Siacoins(3),
+	// assert spending that overflows is rejected and doesn't change the
+	// contract
+	maxID := types.FileContractID{byte(len(values))}
+	err = cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{{
+		ContractID:       maxID,
+		ContractSpending: api.ContractSpending{Uploads: types.NewCurrency64(1)},
+	}})
+	if !errors.Is(err, api.ErrCurrencyOverflow) {
+		t.Fatal("expected ErrCurrencyOverflow", err)
 	}
-	err = cs.RecordContractSpending(context.Background(), []api.ContractSpendingRecord{
-		// non-existent contract
-		{
-			ContractID: types.FileContractID{1, 2, 3},
-		},
-		// valid spending
-		{
-			ContractID:       fcid,
-			ContractSpending: expectedSpending,
-		},
+	err = cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{
+		{ContractID: types.FileContractID{1}, ContractSpending: api.ContractSpending{Downloads: types.MaxCurrency}},
+		{ContractID: types.FileContractID{1}, ContractSpending: api.ContractSpending{Downloads: types.MaxCurrency}},
 	})
+	if !errors.Is(err, api.ErrCurrencyOverflow) {
+		t.Fatal("expected ErrCurrencyOverflow", err)
+	}
+	c, err := cs.Contract(ctx, maxID)
 	if err != nil {
 		t.Fatal(err)
+	} else if !c.Spending.Uploads.Equals(types.MaxCurrency) {
+		t.Fatal("unexpected upload spending", c.Spending.Uploads)
 	}
-	cm2, err := cs.Contract(context.Background(), fcid)
+	c, err = cs.Contract(ctx, types.FileContractID{1})
 	if err != nil {
 		t.Fatal(err)
-	}
-	if cm2.Spending != expectedSpending {
-		t.Fatal("invalid spending")
+	} else if !c.Spending.Downloads.IsZero() {
+		t.Fatal("unexpected download spending", c.Spending.Downloads)
 	}
 
-	// Record the same spending again.
-	err = cs.RecordContractSpending(context.Background(), []api.ContractSpendingRecord{
-		{
-			ContractID:       fcid,
-			ContractSpending: expectedSpending,
-		},
+	// assert a batch is rejected as a whole if the spending of one of its
+	// contracts overflows
+	err = cs.RecordContractSpending(ctx, []api.ContractSpendingRecord{
+		{ContractID: types.FileContractID{1}, ContractSpending: api.ContractSpending{Downloads: types.NewCurrency64(1)}},
+		{ContractID: maxID, ContractSpending: api.ContractSpending{Uploads: types.NewCurrency64(1)}},
 	})
+	if !errors.Is(err, api.ErrCurrencyOverflow) {
+		t.Fatal("expected ErrCurrencyOverflow", err)
+	}
+	c, err = cs.Contract(ctx, types.FileContractID{1})
 	if err != nil {
 		t.Fatal(err)
+	} else if !c.Spending.Downloads.IsZero() {
+		t.Fatal("unexpected download spending", c.Spending.Downloads)
 	}
-	expectedSpending = expectedSpending.Add(expectedSpending)
-	cm3, err := cs.Contract(context.Background(), fcid)
+
+	// archive the contracts and assert the spending round-trips
+	for _, c := range contracts {
+		if err := cs.ArchiveContract(ctx, c.ID, api.ContractArchivalReasonRemoved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archived, err := cs.ArchivedContracts(ctx, api.ArchivedContractsFilter{Limit: -1})
 	if err != nil {
 		t.Fatal(err)
+	} else if len(archived) != len(values) {
+		t.Fatalf("unexpected number of archived contracts, %v != %v", len(archived), len(values))
 	}
-	if cm3.Spending != expectedSpending {
-		t.Fatal("invalid spending")
+	for _, ac := range archived {
+		v := values[ac.ID[0]-1]
+		if ac.Spending != (api.ContractSpending{Uploads: v, Downloads: v, FundAccount: v}) {
+			t.Fatalf("unexpected archived spending, %+v", ac.Spending)
+		}
 	}
 }
 
@@ -2313,7 +5647,7 @@ func TestPartialSlab(t *testing.T) {
 	}
 
 	// fetch the buffer for uploading
-	now := time.Now().Unix()
+	now := time.Now().UnixMilli()
 	buffers, err := db.packedSlabsForUpload(time.Hour, 100)
 	if err != nil {
 		t.Fatal(err)
@@ -2323,8 +5657,8 @@ func TestPartialSlab(t *testing.T) {
 	}
 	completedBuffer := buffers[0]
 	completedBufferID := completedBuffer.ID
-	if completedBuffer.LockedUntil < now+int64(time.Hour.Seconds()) {
-		t.Fatal("buffer should be locked for at least an hour", completedBuffer.LockedUntil, now+int64(time.Hour.Seconds()))
+	if completedBuffer.LockedUntil < now+time.Hour.Milliseconds() {
+		t.Fatal("buffer should be locked for at least an hour", completedBuffer.LockedUntil, now+time.Hour.Milliseconds())
 	}
 	completedBuffer.LockedUntil = 0
 	completedBuffer.Model = Model{}
@@ -2381,6 +5715,65 @@ func TestPartialSlab(t *testing.T) {
 	}
 }
 
+// TestPackedSlabsSubSecondLock asserts packed slabs can be locked for less than
+// a second.
+func TestPackedSlabsSubSecondLock(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a complete buffer
+	cs := dbContractSet{Name: testContractSet}
+	if err := db.db.Create(&cs).Error; err != nil {
+		t.Fatal(err)
+	}
+	key, err := object.GenerateEncryptionKey().MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Create(&dbSlabBuffer{
+		DBSlab: dbSlab{
+			DBContractSetID: cs.ID,
+			Key:             key,
+			MinShards:       1,
+			TotalShards:     2,
+		},
+		Complete:    true,
+		Data:        frand.Bytes(10),
+		MinShards:   1,
+		TotalShards: 2,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// lock it for half a second
+	lockingDuration := 500 * time.Millisecond
+	buffers, err := db.packedSlabsForUpload(lockingDuration, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(buffers) != 1 {
+		t.Fatal("expected 1 buffer to be returned", len(buffers))
+	}
+
+	// fetching it again should return nothing
+	buffers, err = db.packedSlabsForUpload(lockingDuration, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(buffers) != 0 {
+		t.Fatal("expected 0 buffers to be returned", len(buffers))
+	}
+
+	// after the lock expired the buffer should be returned again
+	time.Sleep(lockingDuration + 100*time.Millisecond)
+	buffers, err = db.packedSlabsForUpload(lockingDuration, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(buffers) != 1 {
+		t.Fatal("expected 1 buffer to be returned", len(buffers))
+	}
+}
+
 // dbObject retrieves a dbObject from the store.
 func (s *SQLStore) dbObject(key string) (dbObject, error) {
 	var obj dbObject
@@ -2404,3 +5797,81 @@ func (s *SQLStore) dbSlab(key []byte) (dbSlab, error) {
 	}
 	return slab, nil
 }
+
+// BenchmarkContracts compares fetching the contracts of a set by preloading
+// the full hosts through the set with fetching them through a join and only
+// preloading the host fields needed for the conversion.
+func BenchmarkContracts(b *testing.B) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// seed the store with 5k contracts spread over 500 hosts
+	hosts := make([]dbHost, 500)
+	for i := range hosts {
+		var hk types.PublicKey
+		binary.BigEndian.PutUint64(hk[:], uint64(i+1))
+		hosts[i] = dbHost{PublicKey: publicKey(hk), NetAddress: fmt.Sprintf("host%d.com", i)}
+	}
+	if err := db.db.CreateInBatches(&hosts, 100).Error; err != nil {
+		b.Fatal(err)
+	}
+	contracts := make([]dbContract, 5000)
+	for i := range contracts {
+		var fcid types.FileContractID
+		binary.BigEndian.PutUint64(fcid[:], uint64(i+1))
+		contracts[i] = newContract(hosts[i%len(hosts)].ID, fcid, types.FileContractID{}, types.NewCurrency64(uint64(i)), uint64(i), 100, 200, uint64(i), 0)
+	}
+	if err := db.db.CreateInBatches(&contracts, 100).Error; err != nil {
+		b.Fatal(err)
+	}
+	fcids := make([]types.FileContractID, len(contracts))
+	for i, c := range contracts {
+		fcids[i] = types.FileContractID(c.FCID)
+	}
+	if _, _, _, err := db.SetContractSet(ctx, testContractSet, fcids, false); err != nil {
+		b.Fatal(err)
+	}
+
+	// the previous implementation preloaded the contracts through the set
+	preloaded := func() []api.ContractMetadata {
+		var cs dbContractSet
+		if err := db.db.
+			Where(&dbContractSet{Name: testContractSet}).
+			Preload("Contracts.Host").
+			Take(&cs).
+			Error; err != nil {
+			b.Fatal(err)
+		}
+		contracts := make([]api.ContractMetadata, len(cs.Contracts))
+		for i, c := range cs.Contracts {
+			contracts[i] = c.convert()
+		}
+		return contracts
+	}
+	joined := func() []api.ContractMetadata {
+		contracts, err := db.ContractSetContracts(ctx, testContractSet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return contracts
+	}
+
+	// assert both return the same contracts
+	if !reflect.DeepEqual(preloaded(), joined()) {
+		b.Fatal("contracts don't match")
+	}
+
+	b.Run("preload", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			preloaded()
+		}
+	})
+	b.Run("join", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			joined()
+		}
+	})
+}
@@ -16,6 +16,8 @@ var (
 		&dbArchivedContract{},
 		&dbContract{},
 		&dbContractSet{},
+		&dbContractSetChange{},
+		&dbContractSpendingPeriod{},
 		&dbObject{},
 		&dbSlab{},
 		&dbSector{},
@@ -142,6 +144,76 @@ func performMigrations(db *gorm.DB, logger glogger.Interface) error {
 			},
 			Rollback: nil,
 		},
+		{
+			ID: "00002_contractSpendingHistory",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00002_contractSpendingHistory(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00003_contractNetAddress",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00003_contractNetAddress(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00004_contractBudgets",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00004_contractBudgets(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00005_archivedContractNetAddress",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00005_archivedContractNetAddress(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00006_archivedContractArchivedAt",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00006_archivedContractArchivedAt(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00007_contractHostAddress",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00007_contractHostAddress(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00008_contractSetChanges",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00008_contractSetChanges(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00009_contractSettingsSnapshot",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00009_contractSettingsSnapshot(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00010_contractTransferCounters",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00010_contractTransferCounters(tx, logger)
+			},
+			Rollback: nil,
+		},
+		{
+			ID: "00011_bufferedSlabsLockedUntilMillis",
+			Migrate: func(tx *gorm.DB) error {
+				return performMigration00011_bufferedSlabsLockedUntilMillis(tx, logger)
+			},
+			Rollback: nil,
+		},
 	}
 
 	// Create migrator.
@@ -258,3 +330,159 @@ func performMigration00001_gormigrate(txn *gorm.DB, logger glogger.Interface) er
 	}
 	return nil
 }
+
+// performMigration00002_contractSpendingHistory adds the table the contract
+// spending history is recorded in.
+func performMigration00002_contractSpendingHistory(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	if m.HasTable(&dbContractSpendingPeriod{}) {
+		return nil
+	}
+	logger.Info(context.Background(), "creating table 'contract_spending_history'")
+	return m.CreateTable(&dbContractSpendingPeriod{})
+}
+
+// performMigration00003_contractNetAddress adds the column the host's net
+// address at formation time is stored in and populates it with the current
+// addresses of the hosts.
+func performMigration00003_contractNetAddress(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	if m.HasColumn(&dbContract{}, "net_address") {
+		return nil
+	}
+	logger.Info(context.Background(), "adding column net_address to table 'contracts'")
+	if err := m.AddColumn(&dbContract{}, "net_address"); err != nil {
+		return err
+	}
+	return txn.Exec("UPDATE contracts SET net_address = (SELECT net_address FROM hosts WHERE hosts.id = contracts.host_id)").Error
+}
+
+// performMigration00004_contractBudgets adds the columns the spending budgets of
+// contracts are stored in, existing contracts don't have a budget.
+func performMigration00004_contractBudgets(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	for _, column := range []string{"upload_budget", "download_budget", "fund_account_budget"} {
+		if m.HasColumn(&dbContract{}, column) {
+			continue
+		}
+		logger.Info(context.Background(), fmt.Sprintf("adding column %s to table 'contracts'", column))
+		if err := m.AddColumn(&dbContract{}, column); err != nil {
+			return err
+		} else if err := txn.Exec(fmt.Sprintf("UPDATE contracts SET %s = ?", column), "0").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// performMigration00005_archivedContractNetAddress adds the column the host's
+// net address at archival time is stored in, the address of contracts that
+// were archived before is unknown.
+func performMigration00005_archivedContractNetAddress(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	if m.HasColumn(&dbArchivedContract{}, "net_address") {
+		return nil
+	}
+	logger.Info(context.Background(), "adding column net_address to table 'archived_contracts'")
+	if err := m.AddColumn(&dbArchivedContract{}, "net_address"); err != nil {
+		return err
+	}
+	return txn.Exec("UPDATE archived_contracts SET net_address = ''").Error
+}
+
+// performMigration00006_archivedContractArchivedAt adds the column the time a
+// contract was archived at is stored in. Until now archived contracts were
+// created when the contract was archived, so their creation time is used.
+func performMigration00006_archivedContractArchivedAt(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	if m.HasColumn(&dbArchivedContract{}, "archived_at") {
+		return nil
+	}
+	logger.Info(context.Background(), "adding column archived_at to table 'archived_contracts'")
+	if err := m.AddColumn(&dbArchivedContract{}, "archived_at"); err != nil {
+		return err
+	} else if err := txn.Exec("UPDATE archived_contracts SET archived_at = created_at").Error; err != nil {
+		return err
+	}
+	return m.CreateIndex(&dbArchivedContract{}, "ArchivedAt")
+}
+
+// performMigration00007_contractHostAddress adds the column the address a
+// contract was formed with is stored in. The address isn't known for existing
+// contracts, so it's backfilled with net_address, the host's address at the
+// contract's last renewal, which is the closest we have.
+func performMigration00007_contractHostAddress(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	if m.HasColumn(&dbContract{}, "host_address") {
+		return nil
+	}
+	logger.Info(context.Background(), "adding column host_address to table 'contracts'")
+	if err := m.AddColumn(&dbContract{}, "host_address"); err != nil {
+		return err
+	}
+	return txn.Exec("UPDATE contracts SET host_address = COALESCE(net_address, '')").Error
+}
+
+// performMigration00008_contractSetChanges adds the table contract set
+// membership changes are recorded in.
+func performMigration00008_contractSetChanges(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	if m.HasTable(&dbContractSetChange{}) {
+		return nil
+	}
+	logger.Info(context.Background(), "creating table 'contract_set_changes'")
+	return m.CreateTable(&dbContractSetChange{})
+}
+
+// performMigration00009_contractSettingsSnapshot adds the columns the snapshot
+// of the host settings a contract was formed or renewed with is stored in to
+// both the contracts and the archived contracts.
+func performMigration00009_contractSettingsSnapshot(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	for _, table := range []interface{}{&dbContract{}, &dbArchivedContract{}} {
+		for _, column := range []string{"settings_snapshot", "snapshot_contract_price", "snapshot_storage_price"} {
+			if m.HasColumn(table, column) {
+				continue
+			}
+			logger.Info(context.Background(), fmt.Sprintf("adding column %s", column))
+			if err := m.AddColumn(table, column); err != nil {
+				return err
+			}
+		}
+		for _, index := range []string{"SnapshotContractPrice", "SnapshotStoragePrice"} {
+			if m.HasIndex(table, index) {
+				continue
+			}
+			if err := m.CreateIndex(table, index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// performMigration00010_contractTransferCounters adds the columns the number of
+// bytes uploaded and downloaded with a contract are counted in to both the
+// contracts and the archived contracts.
+func performMigration00010_contractTransferCounters(txn *gorm.DB, logger glogger.Interface) error {
+	m := txn.Migrator()
+	for _, table := range []interface{}{&dbContract{}, &dbArchivedContract{}} {
+		for _, column := range []string{"uploaded_bytes", "downloaded_bytes"} {
+			if m.HasColumn(table, column) {
+				continue
+			}
+			logger.Info(context.Background(), fmt.Sprintf("adding column %s", column))
+			if err := m.AddColumn(table, column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// performMigration00011_bufferedSlabsLockedUntilMillis converts the lock
+// expiries of the buffered slabs from unix seconds to unix milliseconds.
+func performMigration00011_bufferedSlabsLockedUntilMillis(txn *gorm.DB, logger glogger.Interface) error {
+	logger.Info(context.Background(), "converting 'locked_until' of table 'buffered_slabs' to milliseconds")
+	return txn.Exec("UPDATE buffered_slabs SET locked_until = locked_until * 1000 WHERE locked_until > 0").Error
+}
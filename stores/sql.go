@@ -3,12 +3,18 @@ package stores
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/tracing"
 	"go.sia.tech/siad/modules"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/sqlite"
@@ -66,6 +72,15 @@ type (
 
 		knownContracts map[types.FileContractID]struct{}
 
+		// Contract set change subscribers.
+		contractSetSubsMu     sync.Mutex
+		contractSetSubs       map[uint64]func(api.ContractSetChange)
+		contractSetSubsNextID uint64
+
+		// spendingHistoryInterval is the length of the periods the contract
+		// spending history is recorded in, 0 disables the history.
+		spendingHistoryInterval time.Duration
+
 		spendingMu     sync.Mutex
 		interactionsMu sync.Mutex
 	}
@@ -118,7 +133,7 @@ func DBConfigFromEnv() (uri, user, password, dbName string) {
 // NewSQLStore uses a given Dialector to connect to a SQL database.  NOTE: Only
 // pass migrate=true for the first instance of SQLHostDB if you connect via the
 // same Dialector multiple times.
-func NewSQLStore(conn gorm.Dialector, migrate bool, persistInterval time.Duration, walletAddress types.Address, logger glogger.Interface) (*SQLStore, modules.ConsensusChangeID, error) {
+func NewSQLStore(conn gorm.Dialector, migrate bool, persistInterval, spendingHistoryInterval time.Duration, walletAddress types.Address, logger glogger.Interface) (*SQLStore, modules.ConsensusChangeID, error) {
 	db, err := gorm.Open(conn, &gorm.Config{
 		DisableNestedTransaction: true,   // disable nesting transactions
 		Logger:                   logger, // custom logger
@@ -179,6 +194,9 @@ func NewSQLStore(conn gorm.Dialector, migrate bool, persistInterval time.Duratio
 		unappliedHostKeys:  make(map[types.PublicKey]struct{}),
 		unappliedRevisions: make(map[types.FileContractID]revisionUpdate),
 		unappliedProofs:    make(map[types.FileContractID]uint64),
+		contractSetSubs:    make(map[uint64]func(api.ContractSetChange)),
+
+		spendingHistoryInterval: spendingHistoryInterval,
 
 		walletAddress: walletAddress,
 		chainIndex: types.ChainIndex{
@@ -329,7 +347,7 @@ func (ss *SQLStore) applyUpdates(force bool) (err error) {
 		ss.logger.Error(context.Background(), fmt.Sprintf("failed to fetch blocklist, err: %v", err))
 	}
 
-	err = ss.retryTransaction(func(tx *gorm.DB) (err error) {
+	err = ss.retryTransaction(context.Background(), func(tx *gorm.DB) (err error) {
 		if len(ss.unappliedAnnouncements) > 0 {
 			if err = insertAnnouncements(tx, ss.unappliedAnnouncements); err != nil {
 				return fmt.Errorf("%w; failed to insert %d announcements", err, len(ss.unappliedAnnouncements))
@@ -385,16 +403,56 @@ func (ss *SQLStore) applyUpdates(force bool) (err error) {
 	return
 }
 
-func (s *SQLStore) retryTransaction(fc func(tx *gorm.DB) error, opts ...*sql.TxOptions) error {
+// startSpan starts a span for the store operation with the given name. The
+// span joins the trace of the given context and the returned context should be
+// used for the queries of the operation.
+func startSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := tracing.Tracer.Start(ctx, "stores."+op)
+	span.SetAttributes(attrs...)
+	return ctx, span
+}
+
+// endSpan records the given error on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// retryTransaction executes the given function in a transaction and retries it
+// if it fails. Errors that won't go away by retrying, e.g. because a contract
+// wasn't found, are returned right away. If the context is cancelled the
+// transaction is rolled back and the context's error is returned.
+func (s *SQLStore) retryTransaction(ctx context.Context, fc func(tx *gorm.DB) error, opts ...*sql.TxOptions) error {
+	abortRetry := func(err error) bool {
+		return err == nil ||
+			errors.Is(err, ErrContractNotFound) ||
+			errors.Is(err, ErrRevisionNumberRegressed) ||
+			errors.Is(err, ErrHostNotFound) ||
+			errors.Is(err, ErrAncestorDepthExceeded) ||
+			errors.Is(err, ErrDescendantDepthExceeded) ||
+			errors.Is(err, api.ErrContractSetNotFound) ||
+			errors.Is(err, api.ErrCurrencyOverflow) ||
+			errors.Is(err, api.ErrContractsNotFound)
+	}
+
 	var err error
 	timeoutIntervals := []time.Duration{200 * time.Millisecond, 500 * time.Millisecond, time.Second, 3 * time.Second, 10 * time.Second}
 	for i := 0; i < len(timeoutIntervals); i++ {
-		err = s.db.Transaction(fc, opts...)
-		if err == nil {
-			return nil
+		err = s.db.WithContext(ctx).Transaction(fc, opts...)
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("transaction interrupted: %w", ctx.Err())
+		} else if abortRetry(err) {
+			return err
 		}
 		s.logger.Warn(context.Background(), fmt.Sprintf("transaction attempt %d/%d failed, retry in %v,  err: %v", i+1, 5, timeoutIntervals[i], err))
-		time.Sleep(timeoutIntervals[i])
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("transaction interrupted: %w", ctx.Err())
+		case <-time.After(timeoutIntervals[i]):
+		}
 	}
 	return fmt.Errorf("retryTransaction failed: %w", err)
 }
@@ -4,14 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"os"
 	"testing"
 	"time"
 
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/tracing"
 	"go.sia.tech/siad/modules"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"lukechampine.com/frand"
 )
@@ -26,11 +31,11 @@ func newTestSQLStore() (*SQLStore, string, modules.ConsensusChangeID, error) {
 	dbName := hex.EncodeToString(frand.Bytes(32)) // random name for db
 	conn := NewEphemeralSQLiteConnection(dbName)
 	walletAddrs := types.Address(frand.Entropy256())
-	sqlStore, ccid, err := NewSQLStore(conn, true, time.Second, walletAddrs, newTestLogger())
+	sqlStore, ccid, err := NewSQLStore(conn, true, time.Second, time.Hour, walletAddrs, newTestLogger())
 	if err != nil {
 		return nil, "", modules.ConsensusChangeID{}, err
 	}
-	err = sqlStore.SetContractSet(context.Background(), testContractSet, []types.FileContractID{})
+	_, _, _, err = sqlStore.SetContractSet(context.Background(), testContractSet, []types.FileContractID{}, false)
 	return sqlStore, dbName, ccid, err
 }
 
@@ -108,3 +113,116 @@ func TestConsensusReset(t *testing.T) {
 		t.Fatal("wrong id", db.chainIndex.ID, types.BlockID{})
 	}
 }
+
+// TestRetryTransactionCancelled asserts that a transaction is rolled back and
+// the context's error is returned if the context is cancelled.
+func TestRetryTransactionCancelled(t *testing.T) {
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel the context mid-transaction
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.retryTransaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Create(&dbContractSet{Name: "foo"}).Error; err != nil {
+			return err
+		}
+		cancel()
+		return tx.Create(&dbContractSet{Name: "bar"}).Error
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled", err)
+	}
+
+	// assert neither set was created
+	var count int64
+	if err := db.db.Model(&dbContractSet{}).Where("name IN (?)", []string{"foo", "bar"}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatal("transaction wasn't rolled back", count)
+	}
+
+	// assert adding a contract with a cancelled context fails cleanly
+	hk := types.PublicKey{1}
+	if err := db.addTestHost(hk); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddContract(ctx, testContractRevision(types.FileContractID{1}, hk), types.ZeroCurrency, 1, "", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if n, err := db.contractsCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("contract shouldn't have been added", n)
+	}
+}
+
+// TestContractStoreTracing asserts the contract store operations are traced as
+// part of the caller's trace and that slow queries are attached to it.
+func TestContractStoreTracing(t *testing.T) {
+	// record spans
+	sr := tracetest.NewSpanRecorder()
+	tracer := tracing.Tracer
+	tracing.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+	defer func() { tracing.Tracer = tracer }()
+
+	db, _, _, err := newTestSQLStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hks, err := db.addTestHosts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcids, _, err := db.addTestContracts(hks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch a known and an unknown contract as part of a trace
+	ctx, parent := tracing.Tracer.Start(context.Background(), "parent")
+	if _, err := db.Contract(ctx, fcids[0]); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Contract(ctx, types.FileContractID{9}); !errors.Is(err, ErrContractNotFound) {
+		t.Fatal("expected ErrContractNotFound", err)
+	}
+	if _, _, _, err := db.SetContractSet(ctx, "foo", fcids, false); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	// assert the spans joined the trace and carry the expected attributes
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range sr.Ended() {
+		if span.Parent().SpanID() == parent.SpanContext().SpanID() {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 3 {
+		t.Fatal("expected 3 spans", len(spans))
+	}
+	attrs := func(span sdktrace.ReadOnlySpan) map[string]string {
+		m := make(map[string]string)
+		for _, kv := range span.Attributes() {
+			m[string(kv.Key)] = kv.Value.Emit()
+		}
+		return m
+	}
+	if spans[0].Name() != "stores.Contract" || attrs(spans[0])["fcid"] != fcids[0].String() || len(spans[0].Events()) != 0 {
+		t.Fatal("unexpected span", spans[0].Name(), attrs(spans[0]))
+	} else if spans[1].Name() != "stores.Contract" || attrs(spans[1])["fcid"] != (types.FileContractID{9}).String() || len(spans[1].Events()) == 0 {
+		t.Fatal("expected an error to be recorded", spans[1].Name(), attrs(spans[1]))
+	} else if a := attrs(spans[2]); spans[2].Name() != "stores.SetContractSet" || a["set"] != "foo" || a["added"] != "1" || a["missing"] != "0" {
+		t.Fatal("unexpected span", spans[2].Name(), a)
+	}
+
+	// assert slow queries are added to the span of the operation
+	ctx, span := tracing.Tracer.Start(context.Background(), "slow")
+	newTestLogger().Trace(ctx, time.Now().Add(-time.Second), func() (string, int64) { return "SELECT 1", 1 }, nil)
+	span.End()
+	if events := span.(sdktrace.ReadOnlySpan).Events(); len(events) != 1 || events[0].Name != "slow query" {
+		t.Fatal("expected a slow query event", events)
+	}
+}
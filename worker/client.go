@@ -143,6 +143,42 @@ func (c *Client) DownloadStats() (resp api.DownloadStatsResponse, err error) {
 	return
 }
 
+// PriceTables returns the price tables cached by the worker, if a host key is
+// given only the price table of that host is returned.
+func (c *Client) PriceTables(hostKey types.PublicKey) (cpts []api.CachedPriceTable, err error) {
+	values := url.Values{}
+	if hostKey != (types.PublicKey{}) {
+		values.Set("hostkey", hostKey.String())
+	}
+	err = c.c.GET("/pricetables?"+values.Encode(), &cpts)
+	return
+}
+
+// PriceTablesPrices returns the key prices of the price tables cached by the
+// worker.
+func (c *Client) PriceTablesPrices() (prices []api.HostPrices, err error) {
+	err = c.c.GET("/pricetables/prices", &prices)
+	return
+}
+
+// PriceTableUpdate forces an update of the price table of the given host and
+// returns the fresh price table. If a contract is given it's used to pay for the
+// price table if paying by account fails.
+func (c *Client) PriceTableUpdate(ctx context.Context, hostKey types.PublicKey, contractID types.FileContractID) (hpt hostdb.HostPriceTable, err error) {
+	req := api.PriceTableUpdateRequest{
+		HostKey:    hostKey,
+		ContractID: contractID,
+	}
+	err = c.c.WithContext(ctx).POST("/pricetables/update", req, &hpt)
+	return
+}
+
+// PriceTablesStats returns the price table stats.
+func (c *Client) PriceTablesStats() (resp api.PriceTablesStatsResponse, err error) {
+	err = c.c.GET("/stats/pricetables", &resp)
+	return
+}
+
 // UploadStats returns the upload stats.
 func (c *Client) UploadStats() (resp api.UploadStatsResponse, err error) {
 	err = c.c.GET("/stats/uploads", &resp)
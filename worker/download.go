@@ -8,7 +8,6 @@ import (
 	"io"
 	"math"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -26,32 +25,89 @@ const (
 	downloadOverheadB             = 284
 	maxConcurrentSectorsPerHost   = 3
 	maxConcurrentSlabsPerDownload = 3
+	maxRecoveredSlabsPerDownload  = 6
+
+	// downloadPriceTableMinValidity is the minimum validity of the price
+	// table that is leased while a downloader works through its queue.
+	downloadPriceTableMinValidity = 2 * time.Minute
+
+	// maxFundRetriesPerSlab is the maximum number of sector downloads that
+	// are retried after funding the account of a host with an insufficient
+	// balance, per slab download.
+	maxFundRetriesPerSlab = 3
+
+	// maxHedgedRequestsPerSlab is the maximum number of requests for spare
+	// shards that are launched when the final shard of a slab download is
+	// outstanding.
+	maxHedgedRequestsPerSlab = 2
+
+	// readAheadCacheMaxSize is the maximum amount of slab data that is kept
+	// in memory by the read-ahead cache.
+	readAheadCacheMaxSize = 1 << 30 // 1 GiB
+
+	// readAheadCacheTTL is the time after which slabs that were downloaded
+	// speculatively are evicted from the read-ahead cache.
+	readAheadCacheTTL = 30 * time.Second
+
+	// readAheadTimeout is the timeout applied to speculative slab downloads.
+	readAheadTimeout = time.Minute
 )
 
+// ErrInsufficientHosts is returned when a slab can't be downloaded because we
+// don't have contracts with enough of the hosts that store its shards.
+type ErrInsufficientHosts struct {
+	SlabIndex    int
+	MinShards    uint8
+	Available    uint8
+	MissingHosts []types.PublicKey
+}
+
+// Error implements error.
+func (e *ErrInsufficientHosts) Error() string {
+	return fmt.Sprintf("not enough hosts available to download slab %v: %v/%v, no contracts with hosts %v", e.SlabIndex, e.Available, e.MinShards, e.MissingHosts)
+}
+
 type (
 	// id is a unique identifier used for debugging
 	id [8]byte
 
 	downloadManager struct {
+		af     accountFunder
 		hp     hostProvider
 		logger *zap.SugaredLogger
+		ptr    priceTableFailureReporter
+		sap    siamuxAddrProvider
 
+		clock            clock
+		hedgeDelay       time.Duration
+		launchStagger    time.Duration
 		maxOverdrive     uint64
 		overdriveTimeout time.Duration
+		readAhead        uint64
 
 		statsOverdrivePct                *dataPoints
 		statsSlabDownloadSpeedBytesPerMS *dataPoints
 
+		statsPath     string
+		statsMaxAge   time.Duration
+		statsSnapshot *downloadStatsSnapshot
+
+		cache    *slabCache
 		stopChan chan struct{}
 
-		mu            sync.Mutex
-		ongoing       map[slabID]struct{}
-		downloaders   map[types.PublicKey]*downloader
-		lastRecompute time.Time
+		mu                  sync.Mutex
+		ongoing             map[slabID]struct{}
+		downloaders         map[types.PublicKey]*downloader
+		lastRecompute       time.Time
+		statsHedgedLaunches uint64
 	}
 
 	downloader struct {
-		host hostV3
+		clock                   clock
+		fundAccount             func(context.Context) error
+		host                    hostV3
+		launchStagger           time.Duration
+		reportPriceTableExpired func()
 
 		statsDownloadSpeedBytesPerMS    *dataPoints // keep track of this separately for stats (no decay is applied)
 		statsSectorDownloadEstimateInMS *dataPoints
@@ -63,12 +119,19 @@ type (
 		consecutiveFailures uint64
 		queue               []*sectorDownloadReq
 		numDownloads        uint64
+		numFundRetries      uint64
+
+		lastLaunch       time.Time
+		statsConcurrent  int64
+		statsDownloadedB int64
+		statsStart       time.Time
 	}
 
 	downloaderStats struct {
-		avgSpeedMBPS float64
-		healthy      bool
-		numDownloads uint64
+		avgSpeedMBPS   float64
+		healthy        bool
+		numDownloads   uint64
+		numFundRetries uint64
 	}
 
 	slabDownload struct {
@@ -86,23 +149,33 @@ type (
 		lastOverdrive  time.Time
 		numCompleted   int
 		numInflight    uint64
+		numFundRetries int
+		numHedged      uint64
 		numLaunched    uint64
 		numOverdriving uint64
 
-		curr          types.PublicKey
-		hostToSectors map[types.PublicKey][]sectorInfo
-		used          map[types.PublicKey]struct{}
+		curr            types.PublicKey
+		hostToSectors   map[types.PublicKey][]sectorInfo
+		inflightSectors map[int]sectorInfo
+		used            map[types.PublicKey]struct{}
 
 		sectors [][]byte
 		errs    HostErrorSet
 	}
 
 	slabDownloadResponse struct {
+		data   []byte // recovered data, set if the slab was cached
 		shards [][]byte
 		index  int
 		err    error
 	}
 
+	slabRecoveryResponse struct {
+		data  []byte
+		index int
+		err   error
+	}
+
 	sectorDownloadReq struct {
 		ctx context.Context
 
@@ -111,9 +184,16 @@ type (
 		root   types.Hash256
 		hk     types.PublicKey
 
+		hedged       bool
 		overdrive    bool
 		sectorIndex  int
 		responseChan chan sectorDownloadResp
+
+		// allowFundRetry is called when the download failed due to an
+		// insufficient balance, it returns whether the request may be retried
+		// after funding the account, nil disables retries.
+		allowFundRetry func() bool
+		fundRetried    bool
 	}
 
 	sectorDownloadResp struct {
@@ -129,32 +209,67 @@ type (
 		index int
 	}
 
+	// slabCache is a short-lived cache for the recovered data of slabs that
+	// were downloaded speculatively.
+	slabCache struct {
+		maxSize int
+		ttl     time.Duration
+
+		mu      sync.Mutex
+		entries map[slabCacheKey]*slabCacheEntry
+		size    int
+	}
+
+	slabCacheKey struct {
+		key   string
+		index int
+	}
+
+	slabCacheEntry struct {
+		done   chan struct{}
+		data   []byte
+		expiry time.Time
+	}
+
 	downloadManagerStats struct {
 		avgDownloadSpeedMBPS float64
 		avgOverdrivePct      float64
+		numHedgedLaunches    uint64
 		downloaders          map[types.PublicKey]downloaderStats
 	}
 )
 
-func (w *worker) initDownloadManager(maxOverdrive uint64, overdriveTimeout time.Duration, logger *zap.SugaredLogger) {
+func (w *worker) initDownloadManager(maxOverdrive uint64, overdriveTimeout, hedgeDelay, launchStagger time.Duration, readAhead uint64, statsPath string, statsMaxAge time.Duration, logger *zap.SugaredLogger) error {
 	if w.downloadManager != nil {
 		panic("download manager already initialized") // developer error
 	}
 
-	w.downloadManager = newDownloadManager(w, maxOverdrive, overdriveTimeout, logger)
+	w.downloadManager = newDownloadManager(w, w, maxOverdrive, overdriveTimeout, hedgeDelay, launchStagger, readAhead, logger)
+	w.downloadManager.ptr = w.priceTables
+	w.downloadManager.sap = w.priceTables
+	if statsPath != "" && statsMaxAge > 0 {
+		return w.downloadManager.enableStatsPersistence(statsPath, statsMaxAge)
+	}
+	return nil
 }
 
-func newDownloadManager(hp hostProvider, maxOverdrive uint64, overdriveTimeout time.Duration, logger *zap.SugaredLogger) *downloadManager {
+func newDownloadManager(hp hostProvider, af accountFunder, maxOverdrive uint64, overdriveTimeout, hedgeDelay, launchStagger time.Duration, readAhead uint64, logger *zap.SugaredLogger) *downloadManager {
 	return &downloadManager{
+		af:     af,
 		hp:     hp,
 		logger: logger,
 
+		clock:            systemClock{},
+		hedgeDelay:       hedgeDelay,
+		launchStagger:    launchStagger,
 		maxOverdrive:     maxOverdrive,
 		overdriveTimeout: overdriveTimeout,
+		readAhead:        readAhead,
 
 		statsOverdrivePct:                newDataPoints(0),
 		statsSlabDownloadSpeedBytesPerMS: newDataPoints(0),
 
+		cache:    newSlabCache(readAheadCacheMaxSize, readAheadCacheTTL),
 		stopChan: make(chan struct{}),
 
 		ongoing:     make(map[slabID]struct{}),
@@ -162,9 +277,11 @@ func newDownloadManager(hp hostProvider, maxOverdrive uint64, overdriveTimeout t
 	}
 }
 
-func newDownloader(host hostV3) *downloader {
+func newDownloader(host hostV3, launchStagger time.Duration, c clock) *downloader {
 	return &downloader{
-		host: host,
+		clock:         c,
+		host:          host,
+		launchStagger: launchStagger,
 
 		statsSectorDownloadEstimateInMS: newDataPoints(statsDecayHalfTime),
 		statsDownloadSpeedBytesPerMS:    newDataPoints(0), // no decay for exposed stats
@@ -188,7 +305,7 @@ func (mgr *downloadManager) DownloadObject(ctx context.Context, w io.Writer, o o
 	id := newID()
 
 	// calculate what slabs we need
-	slabs := slabsForDownload(o.Slabs, offset, length)
+	slabs, firstSlabIndex := slabsForDownload(o.Slabs, offset, length)
 	if len(slabs) == 0 {
 		return nil
 	}
@@ -209,13 +326,19 @@ func (mgr *downloadManager) DownloadObject(ctx context.Context, w io.Writer, o o
 	// create the cipher writer
 	cw := o.Key.Decrypt(w, offset)
 
+	// speculatively download the slabs following the requested range
+	if mgr.readAhead > 0 {
+		for i := firstSlabIndex + len(slabs); i < len(o.Slabs) && i < firstSlabIndex+len(slabs)+int(mgr.readAhead); i++ {
+			go mgr.readAheadSlab(ctx, slabCacheKey{o.Key.String(), i}, o.Slabs[i])
+		}
+	}
+
 	// create the trigger chan
 	nextSlabChan := make(chan struct{}, 1)
 	nextSlabChan <- struct{}{}
 
 	// launch a goroutine to launch consecutive slab downloads
 	responseChan := make(chan *slabDownloadResponse)
-	defer close(responseChan)
 	go func() {
 		var slabIndex int
 
@@ -223,15 +346,27 @@ func (mgr *downloadManager) DownloadObject(ctx context.Context, w io.Writer, o o
 			if slabIndex < len(slabs) {
 				next := slabs[slabIndex]
 
-				// check if we have enough downloaders
-				var available uint8
-				for _, s := range next.Shards {
-					if _, exists := hosts[s.Host]; exists {
-						available++
+				// serve the slab from the cache if it was read ahead
+				if mgr.readAhead > 0 {
+					full := o.Slabs[firstSlabIndex+slabIndex]
+					if data, found := mgr.cache.Get(ctx, slabCacheKey{o.Key.String(), firstSlabIndex + slabIndex}); found {
+						start := next.Offset - full.Offset
+						select {
+						case <-ctx.Done():
+							return
+						case responseChan <- &slabDownloadResponse{index: slabIndex, data: data[start : start+next.Length]}:
+						}
+						slabIndex++
+						continue
 					}
 				}
-				if available < next.MinShards {
-					responseChan <- &slabDownloadResponse{err: fmt.Errorf("not enough hosts available to download the slab: %v/%v", available, next.MinShards)}
+
+				// check if we have enough downloaders
+				if err := checkAvailableHosts(next.Slab, slabIndex, hosts); err != nil {
+					select {
+					case <-ctx.Done():
+					case responseChan <- &slabDownloadResponse{index: slabIndex, err: err}:
+					}
 					return
 				}
 
@@ -249,10 +384,54 @@ func (mgr *downloadManager) DownloadObject(ctx context.Context, w io.Writer, o o
 		}
 	}()
 
-	// collect the response, responses might come in out of order so we keep
-	// them in a map and return what we can when we can
+	// launch a goroutine per slab to decrypt and recover the slab's data into a
+	// buffer, this allows recovering multiple slabs in parallel
+	recoveredChan := make(chan *slabRecoveryResponse)
+	recoverSlab := func(index int, shards [][]byte) {
+		resp := &slabRecoveryResponse{index: index}
+		resp.data, resp.err = recoverSlabData(slabs[index], shards)
+		select {
+		case <-ctx.Done():
+		case recoveredChan <- resp:
+		}
+	}
+
+	// launch a goroutine that writes the recovered slabs to the cipher writer,
+	// the recovered slabs are handed over in order through a buffered channel
+	// which is large enough to never block the response loop
+	writeChan := make(chan []byte, maxRecoveredSlabsPerDownload)
+	writtenChan := make(chan error)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for data := range writeChan {
+			_, err := cw.Write(data)
+			select {
+			case <-ctx.Done():
+				return
+			case writtenChan <- err:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// make sure the writer is done before we return
+	defer func() {
+		cancel()
+		close(writeChan)
+		<-writerDone
+	}()
+
+	// collect the responses, responses might come in out of order so we keep
+	// them in a map and recover what we can, the recovered slabs are passed to
+	// the writer in order, to keep memory in check we only recover slabs that
+	// are within 'maxRecoveredSlabsPerDownload' of the next slab that needs to
+	// be written
 	responses := make(map[int]*slabDownloadResponse)
-	var respIndex int
+	recovered := make(map[int][]byte)
+	var recoveredIndex, writtenIndex int
 outer:
 	for {
 		select {
@@ -265,30 +444,48 @@ outer:
 				mgr.logger.Errorf("download slab %v failed: %v", resp.index, resp.err)
 				return resp.err
 			}
-
 			responses[resp.index] = resp
-			for {
-				if next, exists := responses[respIndex]; exists {
-					slabs[respIndex].Decrypt(next.shards)
-					err := slabs[respIndex].Recover(cw, next.shards)
-					if err != nil {
-						mgr.logger.Errorf("failed to recover slab %v: %v", respIndex, err)
-						return err
-					}
-					next = nil
-					delete(responses, respIndex)
-					respIndex++
-					continue
-				} else {
-					break
-				}
+		case resp := <-recoveredChan:
+			if resp.err != nil {
+				mgr.logger.Errorf("failed to recover slab %v: %v", resp.index, resp.err)
+				return resp.err
 			}
+			recovered[resp.index] = resp.data
+		case err := <-writtenChan:
+			if err != nil {
+				mgr.logger.Errorf("failed to write slab %v: %v", writtenIndex, err)
+				return err
+			}
+			writtenIndex++
 
 			// exit condition
-			if respIndex == len(slabs) {
+			if writtenIndex == len(slabs) {
 				break outer
 			}
 		}
+
+		// launch the recovery of all slabs within the window
+		for index, resp := range responses {
+			if index >= writtenIndex+maxRecoveredSlabsPerDownload {
+				continue
+			} else if resp.data != nil {
+				recovered[index] = resp.data
+			} else {
+				go recoverSlab(index, resp.shards)
+			}
+			delete(responses, index)
+		}
+
+		// pass the recovered slabs to the writer in order
+		for {
+			data, exists := recovered[recoveredIndex]
+			if !exists {
+				break
+			}
+			writeChan <- data
+			delete(recovered, recoveredIndex)
+			recoveredIndex++
+		}
 	}
 
 	return nil
@@ -304,17 +501,9 @@ func (mgr *downloadManager) DownloadSlab(ctx context.Context, slab object.Slab,
 		available[c.HostKey] = struct{}{}
 	}
 
-	// count how many shards we can download (best-case)
-	var availableShards uint8
-	for _, shard := range slab.Shards {
-		if _, exists := available[shard.Host]; exists {
-			availableShards++
-		}
-	}
-
 	// check if we have enough shards
-	if availableShards < slab.MinShards {
-		return nil, fmt.Errorf("not enough hosts available to download the slab: %v/%v", availableShards, slab.MinShards)
+	if err := checkAvailableHosts(slab, 0, available); err != nil {
+		return nil, err
 	}
 
 	// create identifier
@@ -351,6 +540,130 @@ func (mgr *downloadManager) DownloadSlab(ctx context.Context, slab object.Slab,
 	return resp.shards, err
 }
 
+// DownloadShards downloads the shards at the given indices of a slab. Contrary
+// to DownloadSlab, the shards are not recovered and no overdrive is applied,
+// if any of the requested shards fails to download the call fails. The
+// returned shards are positioned by index, shards that weren't requested are
+// left empty.
+func (mgr *downloadManager) DownloadShards(ctx context.Context, slab object.Slab, indices []int, decrypt bool, contracts []api.ContractMetadata) (_ [][]byte, err error) {
+	// add tracing
+	ctx, span := tracing.Tracer.Start(ctx, "downloadShards")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	// cancel any sector downloads once we're done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// refresh the downloaders
+	mgr.refreshDownloaders(contracts)
+
+	// launch a request for every index
+	respChan := make(chan sectorDownloadResp)
+	requested := make(map[int]struct{})
+	var errs HostErrorSet
+	var inflight int
+	for _, index := range indices {
+		if index < 0 || index >= len(slab.Shards) {
+			return nil, fmt.Errorf("shard index %v out of bounds, slab has %v shards", index, len(slab.Shards))
+		} else if _, exists := requested[index]; exists {
+			continue
+		}
+		requested[index] = struct{}{}
+
+		sector := slab.Shards[index]
+		err := mgr.launch(&sectorDownloadReq{
+			ctx: ctx,
+
+			offset: 0,
+			length: rhpv2.SectorSize,
+			root:   sector.Root,
+			hk:     sector.Host,
+
+			sectorIndex:  index,
+			responseChan: respChan,
+		})
+		if err != nil {
+			errs = append(errs, &HostError{sector.Host, err})
+			continue
+		}
+		inflight++
+	}
+
+	// collect the responses
+	shards := make([][]byte, len(slab.Shards))
+	for ; inflight > 0; inflight-- {
+		var resp sectorDownloadResp
+		select {
+		case <-mgr.stopChan:
+			return nil, errors.New("manager was stopped")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case resp = <-respChan:
+		}
+
+		if resp.err != nil {
+			errs = append(errs, &HostError{resp.hk, resp.err})
+			continue
+		}
+		shards[resp.sectorIndex] = resp.sector
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to download shards: %w", errs)
+	}
+
+	// decrypt the shards if requested
+	if decrypt {
+		object.SlabSlice{Slab: slab}.Decrypt(shards)
+	}
+	return shards, nil
+}
+
+// readAheadSlab downloads the given slab and stores its recovered data in the
+// read-ahead cache. The download is detached from the given context so that it
+// outlives the download that triggered it.
+func (mgr *downloadManager) readAheadSlab(ctx context.Context, key slabCacheKey, slice object.SlabSlice) {
+	// reserve the cache entry, if the slab is already cached or being read
+	// ahead there's nothing to do
+	if !mgr.cache.Reserve(key) {
+		return
+	}
+
+	// detach the context
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, readAheadTimeout)
+	defer cancel()
+
+	// cancel the download if the manager is stopped
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-mgr.stopChan:
+			cancel()
+		}
+	}()
+
+	// download the slab
+	slab, finishFn := mgr.newSlabDownload(ctx, newID(), slice, key.index)
+	shards, err := slab.downloadShards(ctx, make(chan struct{}, 1))
+	finishFn()
+	if err != nil {
+		mgr.logger.Debugf("failed to read ahead slab %v: %v", key.index, err)
+		mgr.cache.Remove(key)
+		return
+	}
+
+	// recover the data and cache it
+	data, err := recoverSlabData(slice, shards)
+	if err != nil {
+		mgr.logger.Debugf("failed to recover slab %v that was read ahead: %v", key.index, err)
+		mgr.cache.Remove(key)
+		return
+	}
+	mgr.cache.Set(key, data)
+}
+
 func (mgr *downloadManager) Stats() downloadManagerStats {
 	// recompute stats
 	mgr.tryRecomputeStats()
@@ -367,11 +680,16 @@ func (mgr *downloadManager) Stats() downloadManagerStats {
 	return downloadManagerStats{
 		avgDownloadSpeedMBPS: mgr.statsSlabDownloadSpeedBytesPerMS.Average() * 0.008, // convert bytes per ms to mbps,
 		avgOverdrivePct:      mgr.statsOverdrivePct.Average(),
+		numHedgedLaunches:    mgr.statsHedgedLaunches,
 		downloaders:          stats,
 	}
 }
 
 func (mgr *downloadManager) Stop() {
+	if err := mgr.persistStats(); err != nil {
+		mgr.logger.Errorf("failed to persist download stats, err: %v", err)
+	}
+
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
 	close(mgr.stopChan)
@@ -394,6 +712,12 @@ func (mgr *downloadManager) tryRecomputeStats() {
 	mgr.lastRecompute = time.Now()
 }
 
+func (mgr *downloadManager) trackHedgedLaunches(n uint64) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.statsHedgedLaunches += n
+}
+
 func (mgr *downloadManager) numDownloaders() int {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
@@ -424,9 +748,30 @@ func (mgr *downloadManager) refreshDownloaders(contracts []api.ContractMetadata)
 
 	// update downloaders
 	for _, c := range want {
+		// prefer the address the host was last reachable on
+		siamuxAddr := c.SiamuxAddr
+		if mgr.sap != nil {
+			if addr, ok := mgr.sap.SiamuxAddr(c.HostKey); ok {
+				siamuxAddr = addr
+			}
+		}
+
 		// create a host
-		host := mgr.hp.newHostV3(c.ID, c.HostKey, c.SiamuxAddr)
-		downloader := newDownloader(host)
+		host := mgr.hp.newHostV3(c.ID, c.HostKey, siamuxAddr)
+		downloader := newDownloader(host, mgr.launchStagger, mgr.clock)
+		if mgr.af != nil {
+			c := c
+			downloader.fundAccount = func(ctx context.Context) error {
+				return mgr.af.fundAccount(ctx, c.ID, c.HostKey, siamuxAddr)
+			}
+		}
+		if mgr.ptr != nil {
+			hk := c.HostKey
+			downloader.reportPriceTableExpired = func() {
+				mgr.ptr.ReportPriceTableExpired(hk)
+			}
+		}
+		mgr.seedDownloader(c.HostKey, downloader)
 		mgr.downloaders[c.HostKey] = downloader
 		go downloader.processQueue(mgr.hp)
 	}
@@ -470,8 +815,9 @@ func (mgr *downloadManager) newSlabDownload(ctx context.Context, dID id, slice o
 		offset:    offset,
 		length:    length,
 
-		hostToSectors: hostToSectors,
-		used:          make(map[types.PublicKey]struct{}),
+		hostToSectors:   hostToSectors,
+		inflightSectors: make(map[int]sectorInfo),
+		used:            make(map[types.PublicKey]struct{}),
 
 		sectors: make([][]byte, len(slice.Shards)),
 	}, finishFn
@@ -513,10 +859,35 @@ func (d *downloader) stats() downloaderStats {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	return downloaderStats{
-		avgSpeedMBPS: d.statsDownloadSpeedBytesPerMS.Average() * 0.008,
-		healthy:      d.consecutiveFailures == 0,
-		numDownloads: d.numDownloads,
+		avgSpeedMBPS:   d.statsDownloadSpeedBytesPerMS.Average() * 0.008,
+		healthy:        d.consecutiveFailures == 0,
+		numDownloads:   d.numDownloads,
+		numFundRetries: d.numFundRetries,
+	}
+}
+
+func (d *downloader) isCold() bool {
+	return d.statsSectorDownloadEstimateInMS.Len() == 0
+}
+
+// launchDelay returns the time to wait before executing the next request. Only
+// cold downloaders stagger their requests, for every request a new launch slot
+// is reserved.
+func (d *downloader) launchDelay() time.Duration {
+	if d.launchStagger == 0 || !d.isCold() {
+		return 0
 	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clock.Now()
+	next := d.lastLaunch.Add(d.launchStagger)
+	if d.lastLaunch.IsZero() || !now.Before(next) {
+		d.lastLaunch = now
+		return 0
+	}
+	d.lastLaunch = next
+	return next.Sub(now)
 }
 
 func (d *downloader) isStopped() bool {
@@ -528,135 +899,132 @@ func (d *downloader) isStopped() bool {
 	return false
 }
 
-func (d *downloader) fillBatch() (batch []*sectorDownloadReq) {
-	for len(batch) < maxConcurrentSectorsPerHost {
-		if req := d.pop(); req == nil {
-			break
-		} else if req.done() {
-			continue
-		} else {
-			batch = append(batch, req)
+func (d *downloader) processQueue(hp hostProvider) {
+	// launch a fixed set of workers that process the queue
+	var wg sync.WaitGroup
+	for i := 0; i < maxConcurrentSectorsPerHost; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.processRequests()
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *downloader) processRequests() {
+	for {
+		// wait for work
+		select {
+		case <-d.signalWorkChan:
+		case <-d.stopChan:
+			return
+		}
+
+		if stopped := d.processBatch(); stopped {
+			return
 		}
 	}
-	return
 }
 
-func (d *downloader) processBatch(batch []*sectorDownloadReq) chan struct{} {
-	doneChan := make(chan struct{})
+// processBatch processes requests until the queue is empty, the host's price
+// table is leased for the duration of the batch so all sectors are downloaded
+// using the same price table. It returns true if the downloader was stopped.
+func (d *downloader) processBatch() (stopped bool) {
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
 
-	// define some state to keep track of stats
-	var mu sync.Mutex
-	var start time.Time
-	var concurrent int64
-	var downloadedB int64
-	trackStatsFn := func() {
-		if start.IsZero() || time.Since(start).Milliseconds() == 0 || downloadedB == 0 {
-			return
+	for {
+		if d.isStopped() {
+			return true
 		}
-		durationMS := time.Since(start).Milliseconds()
-		d.statsDownloadSpeedBytesPerMS.Track(float64(downloadedB / durationMS))
-		d.statsSectorDownloadEstimateInMS.Track(float64(durationMS))
-		start = time.Time{}
-		downloadedB = 0
-	}
-
-	// define a worker to process download requests
-	inflight := uint64(len(batch))
-	reqsChan := make(chan *sectorDownloadReq)
-	workerFn := func() {
-		for req := range reqsChan {
-			if d.isStopped() {
-				break
-			}
 
-			// update state
-			mu.Lock()
-			if start.IsZero() {
-				start = time.Now()
-			}
-			concurrent++
-			mu.Unlock()
-
-			// execute the request
-			err := d.execute(req)
-			d.trackFailure(err)
-
-			// update state + potentially track stats
-			mu.Lock()
-			if err == nil {
-				downloadedB += int64(req.length) + downloadOverheadB
-				if downloadedB >= maxConcurrentSectorsPerHost*rhpv2.SectorSize || concurrent == maxConcurrentSectorsPerHost {
-					trackStatsFn()
-				}
-			}
-			concurrent--
-			if concurrent < 0 {
-				panic("concurrent can never be less than zero") // developer error
-			}
-			mu.Unlock()
+		// pop the next request
+		req := d.pop()
+		if req == nil {
+			return false
 		}
 
-		// last worker that's done closes the channel and flushes the stats
-		if atomic.AddUint64(&inflight, ^uint64(0)) == 0 {
-			close(doneChan)
-			trackStatsFn()
+		// make sure idle workers pick up the remaining requests
+		if d.queueLen() > 0 {
+			d.signalWork()
 		}
-	}
 
-	// launch workers
-	for i := 0; i < len(batch); i++ {
-		go workerFn()
-	}
-	for _, req := range batch {
-		reqsChan <- req
-	}
+		// skip requests that are done
+		if req.done() {
+			continue
+		}
 
-	// launch a goroutine to keep the request coming
-	go func() {
-		defer close(reqsChan)
-		for {
-			if req := d.pop(); req == nil {
-				break
-			} else if req.done() {
-				continue
-			} else {
-				reqsChan <- req
+		// lease the price table, if that fails the download fetches a price
+		// table itself
+		if release == nil {
+			var err error
+			if release, err = d.host.AcquirePriceTable(req.ctx, downloadPriceTableMinValidity); err != nil {
+				release = func() {}
 			}
 		}
-	}()
 
-	return doneChan
+		d.processRequest(req)
+	}
 }
 
-func (d *downloader) processQueue(hp hostProvider) {
-outer:
-	for {
-		// wait for work
+func (d *downloader) processRequest(req *sectorDownloadReq) {
+	// stagger the request if necessary
+	if delay := d.launchDelay(); delay > 0 {
 		select {
-		case <-d.signalWorkChan:
-		case <-d.stopChan:
-			return
+		case <-req.ctx.Done():
+		case <-d.clock.After(delay):
 		}
+	}
 
-		for {
-			// try fill a batch of requests
-			batch := d.fillBatch()
-			if len(batch) == 0 {
-				continue outer
-			}
+	// update state
+	d.mu.Lock()
+	if d.statsStart.IsZero() {
+		d.statsStart = time.Now()
+	}
+	d.statsConcurrent++
+	d.mu.Unlock()
 
-			// process the batch
-			doneChan := d.processBatch(batch)
-			for {
-				select {
-				case <-d.stopChan:
-					return
-				case <-doneChan:
-					continue outer
-				}
-			}
+	// execute the request
+	err := d.execute(req)
+	d.trackFailure(err)
+
+	// update state + potentially track stats
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		d.statsDownloadedB += int64(req.length) + downloadOverheadB
+		if d.statsDownloadedB >= maxConcurrentSectorsPerHost*rhpv2.SectorSize || d.statsConcurrent == maxConcurrentSectorsPerHost {
+			d.trackStats()
 		}
 	}
+	d.statsConcurrent--
+	if d.statsConcurrent < 0 {
+		panic("concurrent can never be less than zero") // developer error
+	}
+
+	// last worker that's done flushes the stats
+	if d.statsConcurrent == 0 && len(d.queue) == 0 {
+		d.trackStats()
+	}
+}
+
+// trackStats tracks the download speed and sector download estimate of all
+// requests that were executed since the stats were last tracked. The caller is
+// expected to hold the downloader's mutex.
+func (d *downloader) trackStats() {
+	if d.statsStart.IsZero() || time.Since(d.statsStart).Milliseconds() == 0 || d.statsDownloadedB == 0 {
+		return
+	}
+	durationMS := time.Since(d.statsStart).Milliseconds()
+	d.statsDownloadSpeedBytesPerMS.Track(float64(d.statsDownloadedB / durationMS))
+	d.statsSectorDownloadEstimateInMS.Track(float64(durationMS))
+	d.statsStart = time.Time{}
+	d.statsDownloadedB = 0
 }
 
 func (d *downloader) estimate() float64 {
@@ -689,12 +1057,22 @@ func (d *downloader) enqueue(download *sectorDownloadReq) {
 	d.mu.Unlock()
 
 	// signal there's work
+	d.signalWork()
+}
+
+func (d *downloader) signalWork() {
 	select {
 	case d.signalWorkChan <- struct{}{}:
 	default:
 	}
 }
 
+func (d *downloader) queueLen() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue)
+}
+
 func (d *downloader) pop() *sectorDownloadReq {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -717,6 +1095,10 @@ func (d *downloader) trackFailure(err error) {
 		return
 	}
 
+	if isPriceTableExpired(err) && d.reportPriceTableExpired != nil {
+		d.reportPriceTableExpired()
+	}
+
 	if isBalanceInsufficient(err) ||
 		isPriceTableExpired(err) ||
 		isPriceTableNotFound(err) ||
@@ -733,17 +1115,30 @@ func (d *downloader) execute(req *sectorDownloadReq) (err error) {
 	start := time.Now()
 	span := trace.SpanFromContext(req.ctx)
 	span.AddEvent("execute")
+	var retried bool
 	defer func() {
 		elapsed := time.Since(start)
 		span.SetAttributes(attribute.Int64("duration", elapsed.Milliseconds()))
 		span.RecordError(err)
-		span.End()
+		if !retried {
+			span.End()
+		}
 	}()
 
 	// download the sector
 	buf := bytes.NewBuffer(make([]byte, 0, rhpv2.SectorSize))
-	err = d.host.DownloadSector(req.ctx, buf, req.root, req.offset, req.length)
-	if err != nil {
+	hpt, err := d.host.DownloadSector(req.ctx, buf, req.root, req.offset, req.length)
+	if !hpt.Expiry.IsZero() {
+		span.SetAttributes(priceTableAttributes(hpt)...)
+		if err != nil {
+			err = fmt.Errorf("%w (price table %v, expiry %v)", err, hpt.UID, hpt.Expiry)
+		}
+	}
+	if isBalanceInsufficient(err) && d.retryAfterFunding(req) {
+		span.AddEvent("retry after funding account")
+		retried = true
+		return err
+	} else if err != nil {
 		req.fail(err)
 		return err
 	}
@@ -756,6 +1151,27 @@ func (d *downloader) execute(req *sectorDownloadReq) (err error) {
 	return nil
 }
 
+// retryAfterFunding funds the account with the host and re-enqueues the
+// request, it returns false if the request can't be retried.
+func (d *downloader) retryAfterFunding(req *sectorDownloadReq) bool {
+	if d.fundAccount == nil || req.allowFundRetry == nil || req.fundRetried || !req.allowFundRetry() {
+		return false
+	}
+	req.fundRetried = true
+
+	if err := d.fundAccount(req.ctx); err != nil {
+		trace.SpanFromContext(req.ctx).AddEvent("failed to fund account", trace.WithAttributes(attribute.String("err", err.Error())))
+		return false
+	}
+
+	d.mu.Lock()
+	d.numFundRetries++
+	d.mu.Unlock()
+
+	d.enqueue(req)
+	return true
+}
+
 func (req *sectorDownloadReq) succeed(sector []byte) {
 	select {
 	case <-req.ctx.Done():
@@ -772,9 +1188,10 @@ func (req *sectorDownloadReq) fail(err error) {
 	select {
 	case <-req.ctx.Done():
 	case req.responseChan <- sectorDownloadResp{
-		err:       err,
-		hk:        req.hk,
-		overdrive: req.overdrive,
+		err:         err,
+		hk:          req.hk,
+		overdrive:   req.overdrive,
+		sectorIndex: req.sectorIndex,
 	}:
 	}
 }
@@ -896,7 +1313,82 @@ func (s *slabDownload) nextRequest(ctx context.Context, responseChan chan sector
 		overdrive:    overdrive,
 		sectorIndex:  sector.index,
 		responseChan: responseChan,
+
+		allowFundRetry: s.allowFundRetry,
+	}
+}
+
+// hedgeRequests returns requests for shards that are neither in flight nor
+// completed, targeting hosts that weren't used yet. Any shard can complete the
+// slab so these race the shards that are still in flight.
+func (s *slabDownload) hedgeRequests(ctx context.Context, responseChan chan sectorDownloadResp) (reqs []*sectorDownloadReq) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// grab unused hosts
+	var hosts []types.PublicKey
+	for host := range s.hostToSectors {
+		if _, used := s.used[host]; !used {
+			hosts = append(hosts, host)
+		}
+	}
+
+	for len(reqs) < maxHedgedRequestsPerSlab && len(hosts) > 0 {
+		// pick the fastest host
+		host := s.mgr.fastest(hosts)
+		if host == (types.PublicKey{}) {
+			return
+		}
+		for i := range hosts {
+			if hosts[i] == host {
+				hosts = append(hosts[:i], hosts[i+1:]...)
+				break
+			}
+		}
+
+		// find a shard we don't have yet
+		for i, sector := range s.hostToSectors[host] {
+			if _, inflight := s.inflightSectors[sector.index]; inflight || s.sectors[sector.index] != nil {
+				continue
+			}
+			s.hostToSectors[host] = append(s.hostToSectors[host][:i:i], s.hostToSectors[host][i+1:]...)
+			s.used[host] = struct{}{}
+
+			// create the span
+			sCtx, span := tracing.Tracer.Start(ctx, "sectorDownloadReq")
+			span.SetAttributes(attribute.Stringer("hk", host))
+			span.SetAttributes(attribute.Bool("hedged", true))
+			span.SetAttributes(attribute.Int("sector", sector.index))
+
+			// build the request
+			reqs = append(reqs, &sectorDownloadReq{
+				ctx: sCtx,
+
+				offset: s.offset,
+				length: s.length,
+				root:   sector.Root,
+				hk:     host,
+
+				hedged:       true,
+				sectorIndex:  sector.index,
+				responseChan: responseChan,
+
+				allowFundRetry: s.allowFundRetry,
+			})
+			break
+		}
 	}
+	return
+}
+
+func (s *slabDownload) allowFundRetry() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.numFundRetries >= maxFundRetriesPerSlab {
+		return false
+	}
+	s.numFundRetries++
+	return true
 }
 
 func (s *slabDownload) downloadShards(ctx context.Context, nextSlabTrigger chan struct{}) ([][]byte, error) {
@@ -926,13 +1418,27 @@ func (s *slabDownload) downloadShards(ctx context.Context, nextSlabTrigger chan
 	var done bool
 	var next bool
 	var triggered bool
+	var hedged bool
+	var hedgeTimer <-chan time.Time
 	for s.inflight() > 0 && !done {
+		// schedule hedging the final outstanding shard
+		if !hedged && hedgeTimer == nil && s.mgr.hedgeDelay > 0 && s.completed() == s.minShards-1 {
+			hedgeTimer = time.After(s.mgr.hedgeDelay)
+		}
+
 		var resp sectorDownloadResp
 		select {
 		case <-s.mgr.stopChan:
 			return nil, errors.New("download stopped")
 		case <-ctx.Done():
 			return nil, ctx.Err()
+		case <-hedgeTimer:
+			for _, req := range s.hedgeRequests(ctx, respChan) {
+				_ = s.launch(req) // ignore error
+			}
+			hedged = true
+			hedgeTimer = nil
+			continue
 		case resp = <-respChan:
 		}
 
@@ -961,11 +1467,24 @@ func (s *slabDownload) downloadShards(ctx context.Context, nextSlabTrigger chan
 	}
 
 	// track stats
+	s.mgr.trackHedgedLaunches(s.hedgedLaunches())
 	s.mgr.statsOverdrivePct.Track(s.overdrivePct())
 	s.mgr.statsSlabDownloadSpeedBytesPerMS.Track(float64(s.downloadSpeed()))
 	return s.finish()
 }
 
+func (s *slabDownload) completed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numCompleted
+}
+
+func (s *slabDownload) hedgedLaunches() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numHedged
+}
+
 func (s *slabDownload) overdrivePct() float64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -984,6 +1503,9 @@ func (s *slabDownload) downloadSpeed() int64 {
 	completedShards := len(s.sectors)
 	bytes := completedShards * rhpv2.SectorSize
 	ms := time.Since(s.created).Milliseconds()
+	if ms == 0 {
+		ms = 1 // avoid division by zero
+	}
 	return int64(bytes) / ms
 }
 
@@ -1022,7 +1544,12 @@ func (s *slabDownload) launch(req *sectorDownloadReq) error {
 
 	// update the state
 	s.numInflight++
-	s.numLaunched++
+	if req.hedged {
+		s.numHedged++
+	} else {
+		s.numLaunched++
+	}
+	s.inflightSectors[req.sectorIndex] = sectorInfo{object.Sector{Host: req.hk, Root: req.root}, req.sectorIndex}
 	if req.overdrive {
 		s.numOverdriving++
 	}
@@ -1038,6 +1565,9 @@ func (s *slabDownload) receive(resp sectorDownloadResp) (finished bool, next boo
 		s.numOverdriving--
 	}
 
+	// remove the sector from the inflight sectors
+	delete(s.inflightSectors, resp.sectorIndex)
+
 	// failed reqs can't complete the upload
 	s.numInflight--
 	if resp.err != nil {
@@ -1084,6 +1614,142 @@ func (mgr *downloadManager) launch(req *sectorDownloadReq) error {
 	return nil
 }
 
+// checkAvailableHosts returns an ErrInsufficientHosts error if the given hosts
+// don't hold enough shards to download the slab.
+func checkAvailableHosts(slab object.Slab, index int, hosts map[types.PublicKey]struct{}) error {
+	var available uint8
+	var missing []types.PublicKey
+	for _, shard := range slab.Shards {
+		if _, exists := hosts[shard.Host]; exists {
+			available++
+		} else {
+			missing = append(missing, shard.Host)
+		}
+	}
+	if available < slab.MinShards {
+		return &ErrInsufficientHosts{
+			SlabIndex:    index,
+			MinShards:    slab.MinShards,
+			Available:    available,
+			MissingHosts: missing,
+		}
+	}
+	return nil
+}
+
+// recoverSlabData decrypts the given shards and recovers the data of the slab
+// slice.
+func recoverSlabData(slice object.SlabSlice, shards [][]byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, slice.Length))
+	slice.Decrypt(shards)
+	if err := slice.Recover(buf, shards); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// detachedContext is a context that carries the values of its parent but is
+// not cancelled when its parent is.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func newSlabCache(maxSize int, ttl time.Duration) *slabCache {
+	return &slabCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[slabCacheKey]*slabCacheEntry),
+	}
+}
+
+// Get returns the data of the slab with the given key, if the slab is still
+// being downloaded it blocks until the download is done.
+func (c *slabCache) Get(ctx context.Context, key slabCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	c.pruneExpired()
+	entry, exists := c.entries[key]
+	c.mu.Unlock()
+	if !exists {
+		return nil, false
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case <-entry.done:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return entry.data, entry.data != nil
+}
+
+// Reserve adds a pending entry for the slab with the given key, it returns
+// false if the cache already contains an entry for the slab.
+func (c *slabCache) Reserve(key slabCacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneExpired()
+	if _, exists := c.entries[key]; exists {
+		return false
+	}
+	c.entries[key] = &slabCacheEntry{done: make(chan struct{})}
+	return true
+}
+
+// Remove removes the entry with the given key, unblocking anyone waiting for
+// it.
+func (c *slabCache) Remove(key slabCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.entries[key]
+	if !exists {
+		return
+	}
+	c.size -= len(entry.data)
+	delete(c.entries, key)
+	select {
+	case <-entry.done:
+	default:
+		close(entry.done)
+	}
+}
+
+// Set sets the data of a reserved entry. If the data doesn't fit the cache,
+// the entry is removed instead.
+func (c *slabCache) Set(key slabCacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.entries[key]
+	if !exists {
+		return
+	}
+	if c.size+len(data) > c.maxSize {
+		data = nil
+		delete(c.entries, key)
+	} else {
+		c.size += len(data)
+	}
+	entry.data = data
+	entry.expiry = time.Now().Add(c.ttl)
+	close(entry.done)
+}
+
+// pruneExpired removes all expired entries from the cache. The caller is
+// expected to hold the cache's mutex.
+func (c *slabCache) pruneExpired() {
+	for key, entry := range c.entries {
+		if !entry.expiry.IsZero() && time.Now().After(entry.expiry) {
+			c.size -= len(entry.data)
+			delete(c.entries, key)
+		}
+	}
+}
+
 func newID() id {
 	var id id
 	frand.Read(id[:])
@@ -1094,7 +1760,9 @@ func (id id) String() string {
 	return fmt.Sprintf("%x", id[:])
 }
 
-func slabsForDownload(slabs []object.SlabSlice, offset, length uint64) []object.SlabSlice {
+// slabsForDownload returns the slab slices needed to download the given range
+// of an object, as well as the index of the first slab within the object.
+func slabsForDownload(slabs []object.SlabSlice, offset, length uint64) ([]object.SlabSlice, int) {
 	// declare a helper to cast a uint64 to uint32 with overflow detection. This
 	// could should never produce an overflow.
 	cast32 := func(in uint64) uint32 {
@@ -1107,10 +1775,12 @@ func slabsForDownload(slabs []object.SlabSlice, offset, length uint64) []object.
 	// mutate a copy
 	slabs = append([]object.SlabSlice(nil), slabs...)
 
+	var firstIndex int
 	firstOffset := offset
 	for i, ss := range slabs {
 		if firstOffset <= uint64(ss.Length) {
 			slabs = slabs[i:]
+			firstIndex = i
 			break
 		}
 		firstOffset -= uint64(ss.Length)
@@ -1127,5 +1797,5 @@ func slabsForDownload(slabs []object.SlabSlice, offset, length uint64) []object.
 		lastLength -= uint64(ss.Length)
 	}
 	slabs[len(slabs)-1].Length = cast32(lastLength)
-	return slabs
+	return slabs, firstIndex
 }
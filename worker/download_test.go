@@ -0,0 +1,951 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	rhpv2 "go.sia.tech/core/rhp/v2"
+	rhpv3 "go.sia.tech/core/rhp/v3"
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/hostdb"
+	"go.sia.tech/renterd/object"
+	"go.sia.tech/renterd/tracing"
+	"go.uber.org/zap"
+	"lukechampine.com/frand"
+)
+
+var errSectorUnavailable = errors.New("sector unavailable")
+
+type (
+	mockHost struct {
+		hk   types.PublicKey
+		fcid types.FileContractID
+
+		mu                  sync.Mutex
+		balanceInsufficient bool
+		delay               time.Duration
+		hpt                 hostdb.HostPriceTable
+		sectors             map[types.Hash256][]byte
+		numDownloads        int
+		inflight            int
+		maxInflight         int
+	}
+
+	mockHostProvider struct {
+		hosts map[types.PublicKey]*mockHost
+	}
+)
+
+var _ hostV3 = (*mockHost)(nil)
+
+func newMockHost() *mockHost {
+	return &mockHost{
+		hk:      types.PublicKey(frand.Entropy256()),
+		fcid:    types.FileContractID(frand.Entropy256()),
+		sectors: make(map[types.Hash256][]byte),
+	}
+}
+
+func (h *mockHost) Contract() types.FileContractID { return h.fcid }
+func (h *mockHost) HostKey() types.PublicKey       { return h.hk }
+
+func (h *mockHost) DownloadSector(ctx context.Context, w io.Writer, root types.Hash256, offset, length uint32) (hostdb.HostPriceTable, error) {
+	h.mu.Lock()
+	hpt := h.hpt
+	if h.balanceInsufficient {
+		h.mu.Unlock()
+		return hpt, errBalanceInsufficient
+	}
+	sector, exists := h.sectors[root]
+	delay := h.delay
+	h.inflight++
+	if h.inflight > h.maxInflight {
+		h.maxInflight = h.inflight
+	}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		h.inflight--
+		h.mu.Unlock()
+	}()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return hpt, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if !exists {
+		return hpt, errSectorUnavailable
+	}
+
+	h.mu.Lock()
+	h.numDownloads++
+	h.mu.Unlock()
+
+	_, err := w.Write(sector[offset : offset+length])
+	return hpt, err
+}
+
+func (h *mockHost) AcquirePriceTable(ctx context.Context, minValidity time.Duration) (func(), error) {
+	return func() {}, nil
+}
+
+func (h *mockHost) FetchPriceTable(ctx context.Context, rev *types.FileContractRevision) (hostdb.HostPriceTable, error) {
+	return hostdb.HostPriceTable{}, nil
+}
+
+func (h *mockHost) FetchRevision(ctx context.Context, fetchTimeout time.Duration, blockHeight uint64) (types.FileContractRevision, error) {
+	return types.FileContractRevision{}, nil
+}
+
+func (h *mockHost) FundAccount(ctx context.Context, balance types.Currency, rev *types.FileContractRevision) error {
+	return nil
+}
+
+func (h *mockHost) Renew(ctx context.Context, rrr api.RHPRenewRequest) (rhpv2.ContractRevision, []types.Transaction, error) {
+	return rhpv2.ContractRevision{}, nil, nil
+}
+
+func (h *mockHost) SyncAccount(ctx context.Context, rev *types.FileContractRevision) error {
+	return nil
+}
+
+func (h *mockHost) UploadSector(ctx context.Context, sector *[rhpv2.SectorSize]byte, rev types.FileContractRevision) (types.Hash256, error) {
+	root := rhpv2.SectorRoot(sector)
+	h.mu.Lock()
+	h.sectors[root] = append([]byte(nil), sector[:]...)
+	h.mu.Unlock()
+	return root, nil
+}
+
+func (h *mockHost) downloads() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.numDownloads
+}
+
+func (h *mockHost) maxConcurrentDownloads() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.maxInflight
+}
+
+func (h *mockHost) setDelay(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.delay = d
+}
+
+func newMockHostProvider(n int) *mockHostProvider {
+	hp := &mockHostProvider{hosts: make(map[types.PublicKey]*mockHost)}
+	for i := 0; i < n; i++ {
+		h := newMockHost()
+		hp.hosts[h.hk] = h
+	}
+	return hp
+}
+
+func (hp *mockHostProvider) newHostV3(_ types.FileContractID, hk types.PublicKey, _ string) hostV3 {
+	return hp.hosts[hk]
+}
+
+func (hp *mockHostProvider) contracts() (contracts []api.ContractMetadata) {
+	for _, h := range hp.hosts {
+		contracts = append(contracts, api.ContractMetadata{
+			ID:      h.fcid,
+			HostKey: h.hk,
+		})
+	}
+	return
+}
+
+func (hp *mockHostProvider) downloads() (n int) {
+	for _, h := range hp.hosts {
+		n += h.downloads()
+	}
+	return
+}
+
+// upload erasure codes, encrypts and stores the given data on the mock hosts,
+// it returns an object that can be used to download the data again.
+func (hp *mockHostProvider) upload(data []byte, minShards, totalShards int) object.Object {
+	if len(hp.hosts) < totalShards {
+		panic("not enough hosts")
+	}
+
+	var hosts []*mockHost
+	for _, h := range hp.hosts {
+		hosts = append(hosts, h)
+	}
+
+	o := object.NewObject()
+	r := o.Encrypt(bytes.NewReader(data))
+	slabSize := minShards * rhpv2.SectorSize
+	for {
+		buf := make([]byte, slabSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			panic(err)
+		}
+
+		slab := object.NewSlab(uint8(minShards))
+		shards := make([][]byte, totalShards)
+		slab.Encode(buf, shards)
+		slab.Encrypt(shards)
+		for i, shard := range shards {
+			var sector [rhpv2.SectorSize]byte
+			copy(sector[:], shard)
+			root, _ := hosts[i].UploadSector(context.Background(), &sector, types.FileContractRevision{})
+			slab.Shards = append(slab.Shards, object.Sector{Host: hosts[i].hk, Root: root})
+		}
+		o.Slabs = append(o.Slabs, object.SlabSlice{Slab: slab, Length: uint32(n)})
+	}
+	return o
+}
+
+func newTestDownloadManager(hp hostProvider) *downloadManager {
+	return newDownloadManager(hp, nil, 5, time.Second, 0, 0, 0, zap.NewNop().Sugar())
+}
+
+func TestDownloadObject(t *testing.T) {
+	hp := newMockHostProvider(6)
+	mgr := newTestDownloadManager(hp)
+	defer mgr.Stop()
+
+	// upload an object spanning multiple slabs
+	data := frand.Bytes(5*2*rhpv2.SectorSize + 123)
+	o := hp.upload(data, 2, 6)
+
+	// download the full object
+	var buf bytes.Buffer
+	if err := mgr.DownloadObject(context.Background(), &buf, o, 0, uint64(len(data)), hp.contracts()); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	}
+
+	// download a range spanning a slab boundary
+	offset, length := uint64(2*rhpv2.SectorSize-100), uint64(2*rhpv2.SectorSize+200)
+	buf.Reset()
+	if err := mgr.DownloadObject(context.Background(), &buf, o, offset, length, hp.contracts()); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data[offset:offset+length]) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestDownloadShards(t *testing.T) {
+	hp := newMockHostProvider(6)
+	mgr := newTestDownloadManager(hp)
+	defer mgr.Stop()
+
+	// upload a single slab
+	data := frand.Bytes(2 * rhpv2.SectorSize)
+	o := hp.upload(data, 2, 6)
+	slab := o.Slabs[0].Slab
+
+	// download a subset of the shards
+	indices := []int{3, 5}
+	shards, err := mgr.DownloadShards(context.Background(), slab, indices, false, hp.contracts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards {
+		sector := slab.Shards[i]
+		if i == 3 || i == 5 {
+			if !bytes.Equal(shard, hp.hosts[sector.Host].sectors[sector.Root]) {
+				t.Fatalf("shard %v mismatch", i)
+			}
+		} else if len(shard) != 0 {
+			t.Fatalf("shard %v wasn't requested", i)
+		}
+	}
+
+	// download the same shards but decrypted, encrypting them again should
+	// result in the stored sectors
+	shards, err = mgr.DownloadShards(context.Background(), slab, indices, true, hp.contracts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slab.Encrypt(shards)
+	for _, i := range indices {
+		sector := slab.Shards[i]
+		if !bytes.Equal(shards[i], hp.hosts[sector.Host].sectors[sector.Root]) {
+			t.Fatalf("shard %v mismatch", i)
+		}
+	}
+
+	// remove the contract with the host of one of the requested shards
+	var contracts []api.ContractMetadata
+	for _, c := range hp.contracts() {
+		if c.HostKey != slab.Shards[5].Host {
+			contracts = append(contracts, c)
+		}
+	}
+
+	// assert the download fails
+	_, err = mgr.DownloadShards(context.Background(), slab, indices, false, contracts)
+	if err == nil {
+		t.Fatal("expected download to fail")
+	}
+
+	// assert out of bounds indices are rejected
+	_, err = mgr.DownloadShards(context.Background(), slab, []int{6}, false, hp.contracts())
+	if err == nil {
+		t.Fatal("expected download to fail")
+	}
+}
+
+func TestDownloadInsufficientHosts(t *testing.T) {
+	hp := newMockHostProvider(6)
+	mgr := newTestDownloadManager(hp)
+	defer mgr.Stop()
+
+	// upload an object spanning multiple slabs
+	data := frand.Bytes(2 * 3 * rhpv2.SectorSize)
+	o := hp.upload(data, 3, 6)
+
+	// only keep contracts with the hosts of the first two shards
+	slab := o.Slabs[0].Slab
+	var contracts []api.ContractMetadata
+	for _, c := range hp.contracts() {
+		if c.HostKey == slab.Shards[0].Host || c.HostKey == slab.Shards[1].Host {
+			contracts = append(contracts, c)
+		}
+	}
+
+	// assert the error when downloading the object
+	var ihErr *ErrInsufficientHosts
+	err := mgr.DownloadObject(context.Background(), io.Discard, o, 0, uint64(len(data)), contracts)
+	if !errors.As(err, &ihErr) {
+		t.Fatalf("expected ErrInsufficientHosts, got %v", err)
+	} else if ihErr.SlabIndex != 0 || ihErr.Available != 2 || ihErr.MinShards != 3 || len(ihErr.MissingHosts) != 4 {
+		t.Fatalf("unexpected error %+v", ihErr)
+	}
+
+	// assert the error when downloading the slab
+	_, err = mgr.DownloadSlab(context.Background(), slab, contracts)
+	if !errors.As(err, &ihErr) {
+		t.Fatalf("expected ErrInsufficientHosts, got %v", err)
+	}
+	for i, hk := range ihErr.MissingHosts {
+		if hk != slab.Shards[i+2].Host {
+			t.Fatalf("unexpected missing host %v", hk)
+		}
+	}
+}
+
+func TestDownloadObjectReadAhead(t *testing.T) {
+	hp := newMockHostProvider(6)
+	mgr := newDownloadManager(hp, nil, 5, time.Second, 0, 0, 1, zap.NewNop().Sugar())
+	defer mgr.Stop()
+
+	// upload an object spanning three slabs
+	numSlabs, minShards := 3, 2
+	slabSize := minShards * rhpv2.SectorSize
+	data := frand.Bytes(numSlabs * slabSize)
+	o := hp.upload(data, minShards, 6)
+
+	// perform three sequential ranged reads
+	for k := 0; k < numSlabs; k++ {
+		offset, length := uint64(k*slabSize), uint64(slabSize)
+		var buf bytes.Buffer
+		if err := mgr.DownloadObject(context.Background(), &buf, o, offset, length, hp.contracts()); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), data[offset:offset+length]) {
+			t.Fatal("data mismatch")
+		}
+
+		// assert the next slab was read ahead
+		want := (k + 2) * minShards
+		if k == numSlabs-1 {
+			want = numSlabs * minShards
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for hp.downloads() < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %v sector downloads after reading slab %v, got %v", want, k, hp.downloads())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// assert every slab was only downloaded once
+	if n := hp.downloads(); n != numSlabs*minShards {
+		t.Fatalf("expected %v sector downloads, got %v", numSlabs*minShards, n)
+	}
+}
+
+// blockingWriter is a writer that blocks until it is unblocked.
+type blockingWriter struct {
+	buf     bytes.Buffer
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.buf.Write(p)
+}
+
+func TestDownloadObjectSlowWriter(t *testing.T) {
+	hp := newMockHostProvider(6)
+	mgr := newTestDownloadManager(hp)
+	defer mgr.Stop()
+
+	// upload an object spanning multiple slabs
+	numSlabs, minShards := 4, 2
+	data := frand.Bytes(numSlabs * minShards * rhpv2.SectorSize)
+	o := hp.upload(data, minShards, 6)
+
+	// download the object using a writer that blocks
+	w := &blockingWriter{unblock: make(chan struct{})}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- mgr.DownloadObject(context.Background(), w, o, 0, uint64(len(data)), hp.contracts())
+	}()
+
+	// assert the sectors of all slabs are downloaded while the writer lags
+	deadline := time.Now().Add(10 * time.Second)
+	for hp.downloads() < numSlabs*minShards {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v sector downloads while the writer is blocked, got %v", numSlabs*minShards, hp.downloads())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// unblock the writer and assert the data is correct
+	close(w.unblock)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(w.buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func BenchmarkDownloadObject(b *testing.B) {
+	for _, numSlabs := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("%d slabs", numSlabs), func(b *testing.B) {
+			hp := newMockHostProvider(30)
+			mgr := newTestDownloadManager(hp)
+			defer mgr.Stop()
+
+			data := frand.Bytes(numSlabs * 10 * rhpv2.SectorSize)
+			o := hp.upload(data, 10, 30)
+			contracts := hp.contracts()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := mgr.DownloadObject(context.Background(), io.Discard, o, 0, uint64(len(data)), contracts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// enqueueSectors enqueues a download request for every sector on the given
+// downloader and returns the channel on which the responses are sent.
+func enqueueSectors(ctx context.Context, d *downloader, h *mockHost, length uint32) (int, chan sectorDownloadResp) {
+	respChan := make(chan sectorDownloadResp)
+	var n int
+	for root := range h.sectors {
+		d.enqueue(&sectorDownloadReq{
+			ctx:          ctx,
+			length:       length,
+			root:         root,
+			hk:           h.hk,
+			sectorIndex:  n,
+			responseChan: respChan,
+		})
+		n++
+	}
+	return n, respChan
+}
+
+func TestDownloaderConcurrency(t *testing.T) {
+	// prepare a host with a bunch of sectors
+	hp := newMockHostProvider(1)
+	h := hp.hosts[hp.contracts()[0].HostKey]
+	for i := 0; i < 20; i++ {
+		var sector [rhpv2.SectorSize]byte
+		frand.Read(sector[:64])
+		h.UploadSector(context.Background(), &sector, types.FileContractRevision{})
+	}
+	h.setDelay(10 * time.Millisecond)
+
+	// start a downloader
+	d := newDownloader(h, 0, systemClock{})
+	go d.processQueue(hp)
+	defer close(d.stopChan)
+
+	// enqueue all sectors and await the responses
+	n, respChan := enqueueSectors(context.Background(), d, h, rhpv2.LeafSize)
+	for i := 0; i < n; i++ {
+		if resp := <-respChan; resp.err != nil {
+			t.Fatal(resp.err)
+		}
+	}
+
+	// assert the concurrency limit was respected
+	if maxConcurrent := h.maxConcurrentDownloads(); maxConcurrent > maxConcurrentSectorsPerHost {
+		t.Fatalf("expected at most %v concurrent downloads, got %v", maxConcurrentSectorsPerHost, maxConcurrent)
+	} else if maxConcurrent < 2 {
+		t.Fatalf("expected concurrent downloads, got %v", maxConcurrent)
+	}
+
+	// assert stats were tracked
+	if d.stats().numDownloads != uint64(n) {
+		t.Fatalf("expected %v downloads, got %v", n, d.stats().numDownloads)
+	} else if d.statsSectorDownloadEstimateInMS.Average() == 0 {
+		t.Fatal("expected stats to be tracked")
+	}
+}
+
+func BenchmarkDownloaderTinyRequests(b *testing.B) {
+	// prepare a host with a bunch of sectors
+	hp := newMockHostProvider(1)
+	h := hp.hosts[hp.contracts()[0].HostKey]
+	for i := 0; i < 100; i++ {
+		var sector [rhpv2.SectorSize]byte
+		frand.Read(sector[:64])
+		h.UploadSector(context.Background(), &sector, types.FileContractRevision{})
+	}
+
+	// start a downloader
+	d := newDownloader(h, 0, systemClock{})
+	go d.processQueue(hp)
+	defer close(d.stopChan)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, respChan := enqueueSectors(context.Background(), d, h, rhpv2.LeafSize)
+		for j := 0; j < n; j++ {
+			if resp := <-respChan; resp.err != nil {
+				b.Fatal(resp.err)
+			}
+		}
+	}
+}
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	afters []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.afters = append(c.afters, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) reset() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	afters := c.afters
+	c.afters = nil
+	return afters
+}
+
+func TestDownloadLaunchStagger(t *testing.T) {
+	hp := newMockHostProvider(1)
+	h := hp.hosts[hp.contracts()[0].HostKey]
+	c := &fakeClock{now: time.Unix(0, 0)}
+	stagger := 10 * time.Millisecond
+
+	// assert launches to a cold downloader are staggered, every launch
+	// reserves the next slot
+	d := newDownloader(h, stagger, c)
+	for i := 0; i < 3; i++ {
+		if delay := d.launchDelay(); delay != time.Duration(i)*stagger {
+			t.Fatalf("unexpected delay %v for launch %d", delay, i)
+		}
+	}
+
+	// assert launches aren't delayed once the reserved slots have passed
+	c.advance(3 * stagger)
+	if delay := d.launchDelay(); delay != 0 {
+		t.Fatalf("unexpected delay %v", delay)
+	}
+
+	// assert launches to a warm downloader aren't staggered
+	d.statsSectorDownloadEstimateInMS.Track(1)
+	for i := 0; i < 3; i++ {
+		if delay := d.launchDelay(); delay != 0 {
+			t.Fatalf("unexpected delay %v", delay)
+		}
+	}
+
+	// assert a zero stagger disables staggering
+	d = newDownloader(h, 0, c)
+	for i := 0; i < 3; i++ {
+		if delay := d.launchDelay(); delay != 0 {
+			t.Fatalf("unexpected delay %v", delay)
+		}
+	}
+}
+
+func TestDownloadStatsPersistence(t *testing.T) {
+	hp := newMockHostProvider(3)
+	path := filepath.Join(t.TempDir(), "downloadstats.json")
+
+	// create a manager and track some stats
+	mgr := newTestDownloadManager(hp)
+	if err := mgr.enableStatsPersistence(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mgr.refreshDownloaders(hp.contracts())
+	p90s := make(map[types.PublicKey]float64)
+	mgr.mu.Lock()
+	for hk, d := range mgr.downloaders {
+		for i := 1; i <= 10; i++ {
+			d.statsSectorDownloadEstimateInMS.Track(float64(i * 100))
+		}
+		d.statsSectorDownloadEstimateInMS.Recompute()
+		p90s[hk] = d.statsSectorDownloadEstimateInMS.P90()
+	}
+	mgr.mu.Unlock()
+
+	// stopping the manager persists the stats
+	mgr.Stop()
+
+	// assert fresh downloaders are seeded with the persisted stats
+	mgr = newTestDownloadManager(hp)
+	if err := mgr.enableStatsPersistence(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Stop()
+	mgr.refreshDownloaders(hp.contracts())
+	mgr.mu.Lock()
+	for hk, d := range mgr.downloaders {
+		if p90 := d.statsSectorDownloadEstimateInMS.P90(); p90 == 0 || p90 != p90s[hk] {
+			t.Fatalf("unexpected p90 %v != %v", p90, p90s[hk])
+		} else if d.isCold() {
+			t.Fatal("expected downloader to be warm")
+		}
+	}
+	mgr.mu.Unlock()
+
+	// persist a stale snapshot
+	snapshot, err := loadDownloadStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Timestamp = time.Now().Add(-2 * time.Hour)
+	if err := saveDownloadStats(path, *snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert stale snapshots are ignored
+	stale := newTestDownloadManager(hp)
+	if err := stale.enableStatsPersistence(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Stop()
+	stale.refreshDownloaders(hp.contracts())
+	stale.mu.Lock()
+	for _, d := range stale.downloaders {
+		if !d.isCold() {
+			t.Fatal("expected downloader to be cold")
+		}
+	}
+	stale.mu.Unlock()
+}
+
+type mockAccountFunder struct {
+	hp *mockHostProvider
+
+	mu       sync.Mutex
+	broke    bool
+	numFunds int
+}
+
+func (f *mockAccountFunder) fundAccount(_ context.Context, _ types.FileContractID, hk types.PublicKey, _ string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.numFunds++
+	if !f.broke {
+		h := f.hp.hosts[hk]
+		h.mu.Lock()
+		h.balanceInsufficient = false
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+func TestDownloadFundRetry(t *testing.T) {
+	hp := newMockHostProvider(3)
+	data := frand.Bytes(2 * rhpv2.SectorSize)
+	o := hp.upload(data, 2, 3)
+
+	drain := func() {
+		for _, h := range hp.hosts {
+			h.mu.Lock()
+			h.balanceInsufficient = true
+			h.mu.Unlock()
+		}
+	}
+
+	// assert the download fails without a funder
+	drain()
+	mgr := newDownloadManager(hp, nil, 5, time.Minute, 0, 0, 0, zap.NewNop().Sugar())
+	defer mgr.Stop()
+	err := mgr.DownloadObject(context.Background(), io.Discard, o, 0, uint64(len(data)), hp.contracts())
+	if !isBalanceInsufficient(err) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the download succeeds after funding the accounts
+	f := &mockAccountFunder{hp: hp}
+	mgr = newDownloadManager(hp, f, 5, time.Minute, 0, 0, 0, zap.NewNop().Sugar())
+	defer mgr.Stop()
+	var buf bytes.Buffer
+	if err := mgr.DownloadObject(context.Background(), &buf, o, 0, uint64(len(data)), hp.contracts()); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	} else if f.numFunds < 2 {
+		t.Fatalf("expected at least 2 fundings, got %v", f.numFunds)
+	}
+
+	// assert the retries show up in the stats
+	var retries uint64
+	for _, stats := range mgr.Stats().downloaders {
+		retries += stats.numFundRetries
+	}
+	if retries != uint64(f.numFunds) {
+		t.Fatalf("unexpected number of retries %v != %v", retries, f.numFunds)
+	}
+
+	// assert the retries are bounded if funding doesn't help
+	drain()
+	f = &mockAccountFunder{hp: hp, broke: true}
+	mgr = newDownloadManager(hp, f, 5, time.Minute, 0, 0, 0, zap.NewNop().Sugar())
+	defer mgr.Stop()
+	err = mgr.DownloadObject(context.Background(), io.Discard, o, 0, uint64(len(data)), hp.contracts())
+	if !isBalanceInsufficient(err) {
+		t.Fatal("unexpected error", err)
+	} else if f.numFunds > maxFundRetriesPerSlab {
+		t.Fatalf("expected at most %v fundings, got %v", maxFundRetriesPerSlab, f.numFunds)
+	}
+}
+
+func TestDownloadHedging(t *testing.T) {
+	hp := newMockHostProvider(3)
+	mgr := newDownloadManager(hp, nil, 5, time.Minute, 10*time.Millisecond, 0, 0, zap.NewNop().Sugar())
+	defer mgr.Stop()
+
+	// pick the hosts, the backup host stores a spare shard
+	var hosts []*mockHost
+	for _, h := range hp.hosts {
+		hosts = append(hosts, h)
+	}
+	fast, slow, backup := hosts[0], hosts[1], hosts[2]
+	slow.setDelay(time.Minute)
+
+	// upload the sectors
+	var sector1, sector2, sector3 [rhpv2.SectorSize]byte
+	frand.Read(sector1[:])
+	frand.Read(sector2[:])
+	frand.Read(sector3[:])
+	root1, _ := fast.UploadSector(context.Background(), &sector1, types.FileContractRevision{})
+	root2, _ := slow.UploadSector(context.Background(), &sector2, types.FileContractRevision{})
+	root3, _ := backup.UploadSector(context.Background(), &sector3, types.FileContractRevision{})
+
+	slab := object.Slab{
+		Key:       object.GenerateEncryptionKey(),
+		MinShards: 2,
+		Shards: []object.Sector{
+			{Host: fast.hk, Root: root1},
+			{Host: slow.hk, Root: root2},
+			{Host: backup.hk, Root: root3},
+		},
+	}
+	slice := object.SlabSlice{Slab: slab, Length: uint32(slab.Length())}
+
+	// prepare the downloaders so the backup host is picked last
+	mgr.refreshDownloaders(hp.contracts())
+	mgr.mu.Lock()
+	for hk, estimate := range map[types.PublicKey]float64{fast.hk: 1, slow.hk: 2, backup.hk: 100} {
+		mgr.downloaders[hk].statsSectorDownloadEstimateInMS.Track(estimate)
+		mgr.downloaders[hk].statsSectorDownloadEstimateInMS.Recompute()
+	}
+	mgr.mu.Unlock()
+
+	// download the slab
+	s, finishFn := mgr.newSlabDownload(context.Background(), id{}, slice, 0)
+	defer finishFn()
+	start := time.Now()
+	shards, err := s.downloadShards(context.Background(), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	} else if time.Since(start) > 10*time.Second {
+		t.Fatal("download wasn't hedged")
+	} else if !bytes.Equal(shards[0], sector1[:]) || shards[1] != nil || !bytes.Equal(shards[2], sector3[:]) {
+		t.Fatal("unexpected shards")
+	}
+
+	// assert the hedged launch was tracked
+	if n := mgr.Stats().numHedgedLaunches; n != 1 {
+		t.Fatalf("expected 1 hedged launch, got %v", n)
+	}
+
+	// assert the slow download was cancelled
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		slow.mu.Lock()
+		inflight := slow.inflight
+		slow.mu.Unlock()
+		if inflight == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("slow download wasn't cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slow.downloads() != 0 || backup.downloads() != 1 {
+		t.Fatal("unexpected downloads", slow.downloads(), backup.downloads())
+	}
+}
+
+func TestDownloaderPriceTableExpired(t *testing.T) {
+	hp := newMockHostProvider(2)
+	pts := newPriceTables(nil, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// create a manager that reports to the price tables
+	mgr := newTestDownloadManager(hp)
+	mgr.ptr = pts
+	defer mgr.Stop()
+	mgr.refreshDownloaders(hp.contracts())
+
+	contracts := hp.contracts()
+	hkA, hkB := contracts[0].HostKey, contracts[1].HostKey
+	mgr.mu.Lock()
+	dA, dB := mgr.downloaders[hkA], mgr.downloaders[hkB]
+	mgr.mu.Unlock()
+
+	// simulate a batch of failures
+	for i := 0; i < 3; i++ {
+		dA.trackFailure(fmt.Errorf("failed to download sector: %w", errPriceTableExpired))
+	}
+	dB.trackFailure(errPriceTableExpired)
+	dB.trackFailure(errPriceTableNotFound)
+	dB.trackFailure(errSectorUnavailable)
+
+	// assert the expired price tables were attributed to the right hosts
+	stats := pts.Stats()
+	if stats.numExpired != 4 {
+		t.Fatal("unexpected number of expired price tables", stats.numExpired)
+	} else if n := stats.hosts[hkA].numExpired; n != 3 {
+		t.Fatal("unexpected number of expired price tables for host A", n)
+	} else if n := stats.hosts[hkB].numExpired; n != 1 {
+		t.Fatal("unexpected number of expired price tables for host B", n)
+	}
+
+	// assert the hosts weren't blamed for the expired price tables
+	dA.mu.Lock()
+	defer dA.mu.Unlock()
+	if dA.consecutiveFailures != 0 {
+		t.Fatal("unexpected consecutive failures", dA.consecutiveFailures)
+	}
+}
+
+func TestDownloaderPriceTableTracing(t *testing.T) {
+	// record spans
+	sr := tracetest.NewSpanRecorder()
+	tracer := tracing.Tracer
+	tracing.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+	defer func() { tracing.Tracer = tracer }()
+
+	// prepare a host with a sector and a price table
+	hp := newMockHostProvider(1)
+	h := hp.hosts[hp.contracts()[0].HostKey]
+	var sector [rhpv2.SectorSize]byte
+	frand.Read(sector[:64])
+	root, _ := h.UploadSector(context.Background(), &sector, types.FileContractRevision{})
+	h.hpt = hostdb.HostPriceTable{
+		HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}},
+		Expiry:         time.Now().Add(time.Hour),
+	}
+
+	// start a downloader
+	d := newDownloader(h, 0, systemClock{})
+	go d.processQueue(hp)
+	defer close(d.stopChan)
+
+	// download the sector and a sector the host doesn't have
+	respChan := make(chan sectorDownloadResp)
+	for i, root := range []types.Hash256{root, {}} {
+		ctx, _ := tracing.Tracer.Start(context.Background(), "sectorDownloadReq")
+		d.enqueue(&sectorDownloadReq{
+			ctx:          ctx,
+			length:       rhpv2.LeafSize,
+			root:         root,
+			hk:           h.hk,
+			sectorIndex:  i,
+			responseChan: respChan,
+		})
+	}
+	for i := 0; i < 2; i++ {
+		resp := <-respChan
+		if resp.sectorIndex == 0 && resp.err != nil {
+			t.Fatal(resp.err)
+		} else if resp.sectorIndex == 1 && !errors.Is(resp.err, errSectorUnavailable) {
+			t.Fatal("unexpected error", resp.err)
+		} else if resp.sectorIndex == 1 && !strings.Contains(resp.err.Error(), h.hpt.UID.String()) {
+			t.Fatal("expected error to contain the price table", resp.err)
+		}
+	}
+
+	// wait for the spans to end
+	for start := time.Now(); len(sr.Ended()) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for spans")
+		}
+	}
+
+	// assert the price table was recorded on the spans
+	for _, span := range sr.Ended() {
+		attrs := make(map[string]string)
+		for _, kv := range span.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if attrs["priceTable"] != h.hpt.UID.String() {
+			t.Fatal("unexpected price table attribute", attrs["priceTable"])
+		} else if attrs["priceTableExpiry"] != h.hpt.Expiry.Format(time.RFC3339Nano) {
+			t.Fatal("unexpected price table expiry attribute", attrs["priceTableExpiry"])
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.sia.tech/core/types"
+)
+
+const (
+	// downloadStatsPersistInterval is the interval at which the download
+	// manager persists a snapshot of its downloader stats.
+	downloadStatsPersistInterval = 5 * time.Minute
+)
+
+type (
+	// downloadStatsSnapshot is a snapshot of the stats of all downloaders,
+	// it's persisted to disk so the download manager doesn't have to start
+	// from scratch after a restart.
+	downloadStatsSnapshot struct {
+		Timestamp   time.Time                                   `json:"timestamp"`
+		Downloaders map[types.PublicKey]downloaderStatsSnapshot `json:"downloaders"`
+	}
+
+	downloaderStatsSnapshot struct {
+		DownloadSpeedBytesPerMS    []float64 `json:"downloadSpeedBytesPerMS"`
+		SectorDownloadEstimateInMS []float64 `json:"sectorDownloadEstimateInMS"`
+	}
+)
+
+// enableStatsPersistence loads the stats snapshot at the given path and
+// periodically persists a new snapshot to it. Snapshots older than maxAge are
+// ignored when seeding downloaders.
+func (mgr *downloadManager) enableStatsPersistence(path string, maxAge time.Duration) error {
+	snapshot, err := loadDownloadStats(path)
+	if err != nil {
+		return err
+	}
+
+	mgr.mu.Lock()
+	if mgr.statsPath != "" {
+		mgr.mu.Unlock()
+		panic("stats persistence already enabled") // developer error
+	}
+	mgr.statsPath = path
+	mgr.statsMaxAge = maxAge
+	mgr.statsSnapshot = snapshot
+	mgr.mu.Unlock()
+
+	go func() {
+		t := time.NewTicker(downloadStatsPersistInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-mgr.stopChan:
+				return
+			case <-t.C:
+			}
+			if err := mgr.persistStats(); err != nil {
+				mgr.logger.Errorf("failed to persist download stats, err: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// persistStats writes a snapshot of the downloader stats to disk.
+func (mgr *downloadManager) persistStats() error {
+	mgr.mu.Lock()
+	if mgr.statsPath == "" {
+		mgr.mu.Unlock()
+		return nil
+	}
+	path := mgr.statsPath
+	snapshot := downloadStatsSnapshot{
+		Timestamp:   time.Now(),
+		Downloaders: make(map[types.PublicKey]downloaderStatsSnapshot),
+	}
+	for hk, d := range mgr.downloaders {
+		if d.isCold() {
+			continue
+		}
+		snapshot.Downloaders[hk] = downloaderStatsSnapshot{
+			DownloadSpeedBytesPerMS:    d.statsDownloadSpeedBytesPerMS.Snapshot(),
+			SectorDownloadEstimateInMS: d.statsSectorDownloadEstimateInMS.Snapshot(),
+		}
+	}
+	mgr.mu.Unlock()
+
+	return saveDownloadStats(path, snapshot)
+}
+
+// seedDownloader seeds the stats of the given downloader with the persisted
+// stats of its host, the caller is expected to hold the manager's lock.
+func (mgr *downloadManager) seedDownloader(hk types.PublicKey, d *downloader) {
+	if mgr.statsSnapshot == nil || time.Since(mgr.statsSnapshot.Timestamp) > mgr.statsMaxAge {
+		return
+	}
+	s, exists := mgr.statsSnapshot.Downloaders[hk]
+	if !exists {
+		return
+	}
+	d.statsDownloadSpeedBytesPerMS.Seed(s.DownloadSpeedBytesPerMS)
+	d.statsSectorDownloadEstimateInMS.Seed(s.SectorDownloadEstimateInMS)
+}
+
+// loadDownloadStats loads the stats snapshot at the given path, if there's no
+// snapshot it returns nil.
+func loadDownloadStats(path string) (*downloadStatsSnapshot, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read download stats: %w", err)
+	}
+
+	var snapshot downloadStatsSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode download stats: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// saveDownloadStats atomically writes the stats snapshot to the given path.
+func saveDownloadStats(path string, snapshot downloadStatsSnapshot) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + "_tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
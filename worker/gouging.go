@@ -14,7 +14,10 @@ import (
 )
 
 const (
-	keyGougingChecker contextKey = "GougingChecker"
+	keyGougingChecker        contextKey = "GougingChecker"
+	keyDialTimeout           contextKey = "DialTimeout"
+	keyPriceTableClock       contextKey = "PriceTableClock"
+	keyPriceTableMinValidity contextKey = "PriceTableMinValidity"
 
 	// maxBaseRPCPriceVsBandwidth is the max ratio for sane pricing between the
 	// MinBaseRPCPrice and the MinDownloadBandwidthPrice. This ensures that 1
@@ -35,6 +38,7 @@ const (
 type (
 	GougingChecker interface {
 		Check(*rhpv2.HostSettings, *rhpv3.HostPriceTable) api.HostGougingBreakdown
+		CheckPriceTablePayment(types.PublicKey, rhpv3.HostPriceTable) error
 	}
 
 	gougingChecker struct {
@@ -52,6 +56,20 @@ type (
 
 var _ GougingChecker = gougingChecker{}
 
+// ErrPriceTableGouging is returned when we refuse to pay for a host's price
+// table because one of its prices exceeds the configured maximum.
+type ErrPriceTableGouging struct {
+	HostKey types.PublicKey
+	Field   string
+	Value   types.Currency
+	Limit   types.Currency
+}
+
+// Error implements error.
+func (e *ErrPriceTableGouging) Error() string {
+	return fmt.Sprintf("price table of host %v is gouging, %v exceeds max: %v > %v", e.HostKey, e.Field, e.Value, e.Limit)
+}
+
 func GougingCheckerFromContext(ctx context.Context) (GougingChecker, error) {
 	gc, ok := ctx.Value(keyGougingChecker).(func() (GougingChecker, error))
 	if !ok {
@@ -106,6 +124,12 @@ func (gc gougingChecker) Check(hs *rhpv2.HostSettings, pt *rhpv3.HostPriceTable)
 	return
 }
 
+// CheckPriceTablePayment checks whether the given price table is safe to pay
+// for, it returns an ErrPriceTableGouging if it's not.
+func (gc gougingChecker) CheckPriceTablePayment(hk types.PublicKey, pt rhpv3.HostPriceTable) error {
+	return checkPriceTablePayment(gc.settings, hk, pt)
+}
+
 func (gc gougingChecker) checkHS(hs *rhpv2.HostSettings) (check api.GougingChecks) {
 	if hs != nil {
 		check = api.GougingChecks{
@@ -319,6 +343,41 @@ func checkPriceGougingPT(gs api.GougingSettings, cs api.ConsensusState, txnFee t
 	return nil
 }
 
+func checkPriceTablePayment(gs api.GougingSettings, hk types.PublicKey, pt rhpv3.HostPriceTable) error {
+	// calculate the bandwidth prices per TiB
+	dbpptb, overflow := pt.DownloadBandwidthCost.Mul64WithOverflow(1 << 40)
+	if overflow {
+		return fmt.Errorf("overflow detected when computing download bandwidth price per TiB")
+	}
+	ubpptb, overflow := pt.UploadBandwidthCost.Mul64WithOverflow(1 << 40)
+	if overflow {
+		return fmt.Errorf("overflow detected when computing upload bandwidth price per TiB")
+	}
+
+	for _, check := range []struct {
+		field string
+		value types.Currency
+		limit types.Currency
+	}{
+		{"UpdatePriceTableCost", pt.UpdatePriceTableCost, gs.MaxRPCPrice},
+		{"InitBaseCost", pt.InitBaseCost, gs.MaxRPCPrice},
+		{"ContractPrice", pt.ContractPrice, gs.MaxContractPrice},
+		{"WriteStoreCost", pt.WriteStoreCost, gs.MaxStoragePrice},
+		{"DownloadBandwidthCost", dbpptb, gs.MaxDownloadPrice},
+		{"UploadBandwidthCost", ubpptb, gs.MaxUploadPrice},
+	} {
+		if !check.limit.IsZero() && check.value.Cmp(check.limit) > 0 {
+			return &ErrPriceTableGouging{
+				HostKey: hk,
+				Field:   check.field,
+				Value:   check.value,
+				Limit:   check.limit,
+			}
+		}
+	}
+	return nil
+}
+
 func checkContractGougingRHPv2(period, renewWindow *uint64, hs rhpv2.HostSettings) error {
 	// period and renew window might be nil since we don't always have access to
 	// these settings when performing gouging checks
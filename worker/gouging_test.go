@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	rhpv3 "go.sia.tech/core/rhp/v3"
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+)
+
+func TestCheckPriceTablePayment(t *testing.T) {
+	gs := api.GougingSettings{
+		MaxRPCPrice:      types.Siacoins(1),
+		MaxContractPrice: types.Siacoins(1),
+		MaxDownloadPrice: types.Siacoins(1).Mul64(1 << 40),
+		MaxUploadPrice:   types.Siacoins(1).Mul64(1 << 40),
+		MaxStoragePrice:  types.Siacoins(1),
+	}
+	hk := types.GeneratePrivateKey().PublicKey()
+
+	// assert a sane price table passes
+	if err := checkPriceTablePayment(gs, hk, rhpv3.HostPriceTable{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert every field is checked
+	tooHigh := types.Siacoins(2)
+	tests := []struct {
+		field  string
+		update func(pt *rhpv3.HostPriceTable)
+	}{
+		{"UpdatePriceTableCost", func(pt *rhpv3.HostPriceTable) { pt.UpdatePriceTableCost = tooHigh }},
+		{"InitBaseCost", func(pt *rhpv3.HostPriceTable) { pt.InitBaseCost = tooHigh }},
+		{"ContractPrice", func(pt *rhpv3.HostPriceTable) { pt.ContractPrice = tooHigh }},
+		{"WriteStoreCost", func(pt *rhpv3.HostPriceTable) { pt.WriteStoreCost = tooHigh }},
+		{"DownloadBandwidthCost", func(pt *rhpv3.HostPriceTable) { pt.DownloadBandwidthCost = tooHigh }},
+		{"UploadBandwidthCost", func(pt *rhpv3.HostPriceTable) { pt.UploadBandwidthCost = tooHigh }},
+	}
+	for _, test := range tests {
+		var pt rhpv3.HostPriceTable
+		test.update(&pt)
+
+		// assert the error survives wrapping
+		err := fmt.Errorf("couldn't create payment: %w", checkPriceTablePayment(gs, hk, pt))
+		var gougingErr *ErrPriceTableGouging
+		if !errors.As(err, &gougingErr) {
+			t.Fatalf("%v: expected gouging error, got %v", test.field, err)
+		} else if gougingErr.Field != test.field || gougingErr.HostKey != hk {
+			t.Fatalf("%v: unexpected error %v", test.field, gougingErr)
+		}
+	}
+
+	// assert a zero limit disables the check
+	var pt rhpv3.HostPriceTable
+	pt.UpdatePriceTableCost = tooHigh
+	if err := checkPriceTablePayment(api.GougingSettings{}, hk, pt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreparePriceTablePayment(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+	h := &host{
+		acc:        &account{host: hk},
+		accountKey: types.GeneratePrivateKey(),
+	}
+	gc := gougingChecker{settings: api.GougingSettings{MaxRPCPrice: types.Siacoins(1)}}
+
+	// assert we pay for a sane price table
+	paymentFn := h.preparePriceTableAccountPayment(gc, 0)
+	if payment, err := paymentFn(rhpv3.HostPriceTable{UpdatePriceTableCost: types.NewCurrency64(1)}); err != nil {
+		t.Fatal(err)
+	} else if payment == nil {
+		t.Fatal("expected payment")
+	}
+
+	// assert we refuse to pay for a gouging price table
+	var gougingErr *ErrPriceTableGouging
+	if payment, err := paymentFn(rhpv3.HostPriceTable{UpdatePriceTableCost: types.Siacoins(2)}); !errors.As(err, &gougingErr) {
+		t.Fatal("expected gouging error", err)
+	} else if payment != nil {
+		t.Fatal("unexpected payment")
+	}
+	paymentFn = h.preparePriceTableContractPayment(gc, &types.FileContractRevision{})
+	if _, err := paymentFn(rhpv3.HostPriceTable{UpdatePriceTableCost: types.Siacoins(2)}); !errors.As(err, &gougingErr) {
+		t.Fatal("expected gouging error", err)
+	}
+}
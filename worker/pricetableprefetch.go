@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"container/heap"
+	"context"
+	"time"
+
+	"go.sia.tech/core/types"
+)
+
+const (
+	// priceTablePrefetchLeeway is the amount of time before a price table
+	// crosses the validity leeway threshold when we refresh it.
+	priceTablePrefetchLeeway = 10 * time.Second
+)
+
+type (
+	// priceTableExpiry is an entry in the expiry heap, it keeps track of
+	// whether the price table was used since it was last scheduled to decide
+	// whether it's still worth refreshing.
+	priceTableExpiry struct {
+		hk     types.PublicKey
+		expiry time.Time
+		used   bool
+		index  int
+	}
+
+	// priceTableExpiryHeap is a min-heap of price tables ordered by expiry.
+	priceTableExpiryHeap []*priceTableExpiry
+)
+
+func (h priceTableExpiryHeap) Len() int           { return len(h) }
+func (h priceTableExpiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h priceTableExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *priceTableExpiryHeap) Push(x interface{}) {
+	e := x.(*priceTableExpiry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *priceTableExpiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// startPrefetching starts a goroutine that refreshes the price tables that are
+// about to cross the validity leeway threshold, as long as they are being used.
+func (pts *priceTables) startPrefetching() {
+	go func() {
+		for {
+			pts.mu.Lock()
+			var wait <-chan time.Time
+			if len(pts.expiries) > 0 {
+				wait = pts.clock.After(pts.refreshAt(pts.expiries[0]).Sub(pts.clock.Now()))
+			}
+			pts.mu.Unlock()
+
+			select {
+			case <-pts.stopChan:
+				return
+			case <-pts.wakeChan:
+				continue
+			case <-wait:
+			}
+			pts.prefetch()
+		}
+	}()
+}
+
+// Stop stops prefetching price tables.
+func (pts *priceTables) Stop() {
+	close(pts.stopChan)
+}
+
+// prefetch refreshes all price tables that are due, price tables that weren't
+// used since they were last scheduled are dropped from the heap.
+func (pts *priceTables) prefetch() {
+	now := pts.clock.Now()
+
+	pts.mu.Lock()
+	var due []*priceTable
+	for len(pts.expiries) > 0 && !now.Before(pts.refreshAt(pts.expiries[0])) {
+		e := heap.Pop(&pts.expiries).(*priceTableExpiry)
+		delete(pts.expiryIndex, e.hk)
+		if pt, exists := pts.priceTables[e.hk]; exists && e.used {
+			due = append(due, pt)
+		}
+	}
+	pts.mu.Unlock()
+
+	for _, pt := range due {
+		select {
+		case <-pts.stopChan:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), priceTableRefreshTimeout)
+		hpt, err := pt.refresh(ctx, nil)
+		cancel()
+		if err != nil {
+			continue // failures are tracked in the price table stats
+		}
+
+		pts.mu.Lock()
+		if _, exists := pts.priceTables[pt.hk]; exists {
+			pts.schedule(pt.hk, hpt.Expiry)
+		}
+		pts.mu.Unlock()
+	}
+}
+
+// refreshAt returns the time at which the given price table is refreshed.
+func (pts *priceTables) refreshAt(e *priceTableExpiry) time.Time {
+	return e.expiry.Add(-(pts.validityLeeway + priceTablePrefetchLeeway))
+}
+
+// schedule adds the price table of the given host to the expiry heap or
+// reorders it if its expiry changed, the caller is expected to hold the lock.
+func (pts *priceTables) schedule(hk types.PublicKey, expiry time.Time) {
+	if e, exists := pts.expiryIndex[hk]; exists {
+		if e.expiry.Equal(expiry) {
+			return
+		}
+		e.expiry = expiry
+		e.used = false
+		heap.Fix(&pts.expiries, e.index)
+	} else {
+		e := &priceTableExpiry{hk: hk, expiry: expiry}
+		heap.Push(&pts.expiries, e)
+		pts.expiryIndex[hk] = e
+	}
+
+	// wake up the prefetch goroutine
+	select {
+	case pts.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// unschedule removes the price table of the given host from the expiry heap,
+// the caller is expected to hold the lock.
+func (pts *priceTables) unschedule(hk types.PublicKey) {
+	if e, exists := pts.expiryIndex[hk]; exists {
+		heap.Remove(&pts.expiries, e.index)
+		delete(pts.expiryIndex, hk)
+	}
+}
@@ -11,10 +11,14 @@ import (
 	"math"
 	"math/big"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	rhpv2 "go.sia.tech/core/rhp/v2"
 	rhpv3 "go.sia.tech/core/rhp/v3"
 	"go.sia.tech/core/types"
@@ -22,6 +26,7 @@ import (
 	"go.sia.tech/renterd/api"
 	"go.sia.tech/renterd/hostdb"
 	"go.sia.tech/renterd/metrics"
+	"go.sia.tech/renterd/tracing"
 	"go.sia.tech/siad/crypto"
 	"go.uber.org/zap"
 	"lukechampine.com/frand"
@@ -41,6 +46,14 @@ const (
 	// messages.
 	defaultWithdrawalExpiryBlocks = 6
 
+	// defaultTransportIdleTimeout is the amount of time we keep an unused
+	// transport to a host open before closing it.
+	defaultTransportIdleTimeout = time.Minute
+
+	// defaultTransportMaxIdlePerHost is the maximum number of unused
+	// transports we keep open per host.
+	defaultTransportMaxIdlePerHost = 2
+
 	// responseLeeway is the amount of leeway given to the maxLen when we read
 	// the response in the ReadSector RPC
 	responseLeeway = 1 << 12 // 4 KiB
@@ -55,6 +68,9 @@ var (
 	// balance over the maximum allowed ephemeral account balance.
 	errBalanceMaxExceeded = errors.New("ephemeral account maximum balance exceeded")
 
+	// errDialTransport occurs when we fail to dial a transport to the host.
+	errDialTransport = errors.New("could not dial transport")
+
 	// errMaxRevisionReached occurs when trying to revise a contract that has
 	// already reached the highest possible revision number. Usually happens
 	// when trying to use a renewed contract.
@@ -65,6 +81,14 @@ var (
 	// valid.
 	errPriceTableExpired = errors.New("price table requested is expired")
 
+	// errInvalidPriceTable occurs when a host sends us a price table that
+	// doesn't pass our sanity checks.
+	errInvalidPriceTable = errors.New("invalid price table")
+
+	// errPriceTableUpdateTimeout occurs when updating a price table takes
+	// longer than the maximum amount of time we allow for it.
+	errPriceTableUpdateTimeout = errors.New("price table update timed out")
+
 	// errPriceTableNotFound is returned by the host when it can not find a
 	// price table that corresponds with the id we sent it.
 	errPriceTableNotFound = errors.New("price table not found")
@@ -83,12 +107,20 @@ func isBalanceMaxExceeded(err error) bool  { return isError(err, errBalanceMaxEx
 func isClosedStream(err error) bool {
 	return isError(err, mux.ErrClosedStream) || isError(err, net.ErrClosed)
 }
+func isDialTransport(err error) bool       { return isError(err, errDialTransport) }
 func isInsufficientFunds(err error) bool   { return isError(err, ErrInsufficientFunds) }
 func isPriceTableExpired(err error) bool   { return isError(err, errPriceTableExpired) }
 func isPriceTableNotFound(err error) bool  { return isError(err, errPriceTableNotFound) }
 func isSectorNotFound(err error) bool      { return isError(err, errSectorNotFound) }
 func isWithdrawalsInactive(err error) bool { return isError(err, errWithdrawalsInactive) }
 
+// isHostUnreachable returns true if the error indicates we weren't able to
+// talk to the host at all, e.g. because dialing it failed or timed out.
+func isHostUnreachable(err error) bool {
+	var netErr net.Error
+	return isDialTransport(err) || errors.As(err, &netErr)
+}
+
 func isError(err error, target error) bool {
 	if err == nil {
 		return err == target
@@ -103,9 +135,14 @@ func isError(err error, target error) bool {
 
 // transportV3 is a reference-counted wrapper for rhpv3.Transport.
 type transportV3 struct {
-	refCount uint64 // locked by pool
+	// locked by pool
+	refCount  uint64
+	discarded bool
+	idleSince time.Time
+	idleTimer *time.Timer
 
 	mu         sync.Mutex
+	closed     bool
 	hostKey    types.PublicKey
 	siamuxAddr string
 	t          *rhpv3.Transport
@@ -122,15 +159,71 @@ func (s *streamV3) Close() error {
 	return s.Stream.Close()
 }
 
+// withDialTimeout returns a context that limits the time spent dialing a host
+// when a new transport is needed.
+func withDialTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, keyDialTimeout, timeout)
+}
+
+// dialTimeoutFromContext returns the dial timeout attached to the given
+// context, if any.
+func dialTimeoutFromContext(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(keyDialTimeout).(time.Duration)
+	return timeout, ok && timeout > 0
+}
+
+// withPriceTableClock returns a context that makes fetchPriceTable derive the
+// expiry of the price tables it fetches from the given clock.
+func withPriceTableClock(ctx context.Context, c clock) context.Context {
+	return context.WithValue(ctx, keyPriceTableClock, c)
+}
+
+// priceTableClockFromContext returns the clock attached to the given context,
+// falling back to the system clock.
+func priceTableClockFromContext(ctx context.Context) clock {
+	if c, ok := ctx.Value(keyPriceTableClock).(clock); ok {
+		return c
+	}
+	return systemClock{}
+}
+
+// withPriceTableMinValidity returns a context that makes fetchPriceTable
+// sanity check the price tables it fetches before paying for them, price tables
+// that aren't valid for at least minValidity are rejected.
+func withPriceTableMinValidity(ctx context.Context, minValidity time.Duration) context.Context {
+	return context.WithValue(ctx, keyPriceTableMinValidity, minValidity)
+}
+
+// checkPriceTable sanity checks the given price table if the context asks for
+// it, it's called before paying for a price table.
+func checkPriceTable(ctx context.Context, pt rhpv3.HostPriceTable) error {
+	minValidity, ok := ctx.Value(keyPriceTableMinValidity).(time.Duration)
+	if !ok {
+		return nil
+	}
+	now := priceTableClockFromContext(ctx).Now()
+	return validatePriceTable(hostdb.HostPriceTable{HostPriceTable: pt, Expiry: now.Add(pt.Validity)}, now, minValidity)
+}
+
 // DialStream dials a new stream on the transport.
 func (t *transportV3) DialStream(ctx context.Context) (*streamV3, error) {
 	t.mu.Lock()
-	if t.t == nil {
+	if t.closed {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("DialStream: %w", net.ErrClosed)
+	} else if t.t == nil {
+		dialCtx := ctx
+		if timeout, ok := dialTimeoutFromContext(ctx); ok {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
 		start := time.Now()
-		newTransport, err := dialTransport(ctx, t.siamuxAddr, t.hostKey)
+		newTransport, err := dialTransport(dialCtx, t.siamuxAddr, t.hostKey)
 		if err != nil {
 			t.mu.Unlock()
-			return nil, fmt.Errorf("DialStream: could not dial transport: %w (%v)", err, time.Since(start))
+			return nil, fmt.Errorf("DialStream: %v: %w (%v)", errDialTransport, err, time.Since(start))
 		}
 		t.t = newTransport
 	}
@@ -162,10 +255,31 @@ func (t *transportV3) DialStream(ctx context.Context) (*streamV3, error) {
 	}, nil
 }
 
+// close closes the underlying transport, the transport can't be used to dial
+// streams afterwards.
+func (t *transportV3) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.t != nil {
+		_ = t.t.Close()
+		t.t = nil
+	}
+}
+
 // transportPoolV3 is a pool of rhpv3.Transports which allows for reusing them.
+// Transports are shared by all operations on a host, e.g. price table updates,
+// downloads and account funding, and are kept open for idleTimeout after they
+// were last used.
 type transportPoolV3 struct {
 	recordInteractions func([]hostdb.Interaction)
 
+	// idleTimeout is the amount of time an unused transport is kept open,
+	// maxIdlePerHost is the maximum number of unused transports kept open
+	// per host, a host can have multiple siamux addresses
+	idleTimeout    time.Duration
+	maxIdlePerHost int
+
 	mu   sync.Mutex
 	pool map[string]*transportV3
 }
@@ -173,10 +287,38 @@ type transportPoolV3 struct {
 func newTransportPoolV3(w *worker) *transportPoolV3 {
 	return &transportPoolV3{
 		recordInteractions: w.recordInteractions,
+		idleTimeout:        defaultTransportIdleTimeout,
+		maxIdlePerHost:     defaultTransportMaxIdlePerHost,
 		pool:               make(map[string]*transportV3),
 	}
 }
 
+// Close closes all transports in the pool.
+func (p *transportPoolV3) Close() {
+	p.mu.Lock()
+	var toClose []*transportV3
+	for addr, t := range p.pool {
+		if t.idleTimer != nil {
+			t.idleTimer.Stop()
+			t.idleTimer = nil
+		}
+		t.discarded = true
+		delete(p.pool, addr)
+		toClose = append(toClose, t)
+	}
+	p.mu.Unlock()
+
+	for _, t := range toClose {
+		t.close()
+	}
+}
+
+// isConnectionClosed returns true if the error indicates the connection to the
+// host was closed.
+func isConnectionClosed(err error) bool {
+	return isClosedStream(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 func dialTransport(ctx context.Context, siamuxAddr string, hostKey types.PublicKey) (*rhpv3.Transport, error) {
 	// Dial host.
 	conn, err := dial(ctx, siamuxAddr, hostKey)
@@ -208,8 +350,32 @@ func (p *transportPoolV3) withTransportV3(ctx context.Context, hostKey types.Pub
 	}()
 	ctx = metrics.WithRecorder(ctx, &mr)
 
-	// Create or fetch transport.
+	// Execute function.
+	t := p.acquire(hostKey, siamuxAddr)
+	err = fn(ctx, t)
+
+	// If the connection died, discard the transport and retry once on a fresh
+	// connection, a pooled connection might have been closed by the host
+	// while it was idle.
+	if err != nil && isConnectionClosed(err) && ctx.Err() == nil {
+		p.discard(t)
+		p.release(t)
+		t = p.acquire(hostKey, siamuxAddr)
+		err = fn(ctx, t)
+		if err != nil && isConnectionClosed(err) {
+			p.discard(t)
+		}
+	}
+	p.release(t)
+	return err
+}
+
+// acquire returns the transport for the given address, creating it if it
+// doesn't exist, and increments its reference counter.
+func (p *transportPoolV3) acquire(hostKey types.PublicKey, siamuxAddr string) *transportV3 {
 	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	t, found := p.pool[siamuxAddr]
 	if !found {
 		t = &transportV3{
@@ -218,25 +384,82 @@ func (p *transportPoolV3) withTransportV3(ctx context.Context, hostKey types.Pub
 		}
 		p.pool[siamuxAddr] = t
 	}
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
 	t.refCount++
-	p.mu.Unlock()
+	return t
+}
 
-	// Execute function.
-	err = fn(ctx, t)
+// discard removes the transport from the pool and closes it, operations that
+// are still using it fail and won't be able to dial new streams.
+func (p *transportPoolV3) discard(t *transportV3) {
+	p.mu.Lock()
+	t.discarded = true
+	if p.pool[t.siamuxAddr] == t {
+		delete(p.pool, t.siamuxAddr)
+	}
+	p.mu.Unlock()
+	t.close()
+}
 
-	// Decrement refcounter again and clean up pool.
+// release decrements the reference counter of the transport, unused transports
+// are kept open until they've been idle for the idle timeout or the host has
+// too many idle transports.
+func (p *transportPoolV3) release(t *transportV3) {
 	p.mu.Lock()
 	t.refCount--
-	if t.refCount == 0 {
-		// Cleanup
-		if t.t != nil {
-			_ = t.t.Close()
-			t.t = nil
+	if t.refCount > 0 || t.discarded {
+		p.mu.Unlock()
+		return
+	} else if p.idleTimeout <= 0 {
+		delete(p.pool, t.siamuxAddr)
+		p.mu.Unlock()
+		t.close()
+		return
+	}
+
+	// schedule the transport to be closed once it's been idle for too long
+	idleSince := time.Now()
+	t.idleSince = idleSince
+	t.idleTimer = time.AfterFunc(p.idleTimeout, func() {
+		p.mu.Lock()
+		expired := t.refCount == 0 && t.idleSince == idleSince && p.pool[t.siamuxAddr] == t
+		if expired {
+			delete(p.pool, t.siamuxAddr)
+		}
+		p.mu.Unlock()
+		if expired {
+			t.close()
+		}
+	})
+
+	// close the least recently used idle transports of the host if it has
+	// too many
+	var idle []*transportV3
+	for _, pt := range p.pool {
+		if pt.hostKey == t.hostKey && pt.refCount == 0 {
+			idle = append(idle, pt)
+		}
+	}
+	var toClose []*transportV3
+	if p.maxIdlePerHost > 0 && len(idle) > p.maxIdlePerHost {
+		sort.Slice(idle, func(i, j int) bool {
+			return idle[i].idleSince.Before(idle[j].idleSince)
+		})
+		for _, pt := range idle[:len(idle)-p.maxIdlePerHost] {
+			pt.idleTimer.Stop()
+			pt.idleTimer = nil
+			delete(p.pool, pt.siamuxAddr)
+			toClose = append(toClose, pt)
 		}
-		delete(p.pool, siamuxAddr)
 	}
 	p.mu.Unlock()
-	return err
+
+	for _, pt := range toClose {
+		pt.close()
+	}
 }
 
 // FetchRevision tries to fetch a contract revision from the host. We pass in
@@ -361,6 +584,11 @@ func (h *host) FundAccount(ctx context.Context, balance types.Currency, rev *typ
 		amount = maxAmount
 	}
 
+	// refuse to pay with contracts that exceeded their budget
+	if err := h.contractSpendingRecorder.checkBudget(rev.ParentID); err != nil {
+		return err
+	}
+
 	return h.acc.WithDeposit(ctx, func() (types.Currency, error) {
 		return amount, h.transportPool.withTransportV3(ctx, h.HostKey(), h.siamuxAddr, func(ctx context.Context, t *transportV3) (err error) {
 			cost := amount.Add(pt.FundAccountCost)
@@ -583,25 +811,36 @@ func (r *host) HostKey() types.PublicKey {
 // will be used to pay for the price table. The returned price table is
 // guaranteed to be safe to use.
 func (h *host) priceTable(ctx context.Context, rev *types.FileContractRevision) (rhpv3.HostPriceTable, error) {
-	pt, err := h.priceTables.fetch(ctx, h.HostKey(), rev)
+	hpt, err := h.priceTableWithExpiry(ctx, rev)
+	return hpt.HostPriceTable, err
+}
+
+// priceTableWithExpiry is like priceTable but also returns the expiry of the
+// price table.
+func (h *host) priceTableWithExpiry(ctx context.Context, rev *types.FileContractRevision) (hostdb.HostPriceTable, error) {
+	res, err := h.priceTables.fetch(ctx, h.HostKey(), rev, 0)
 	if err != nil {
-		return rhpv3.HostPriceTable{}, err
+		return hostdb.HostPriceTable{}, err
 	}
 	gc, err := GougingCheckerFromContext(ctx)
 	if err != nil {
-		return rhpv3.HostPriceTable{}, err
+		return hostdb.HostPriceTable{}, err
 	}
-	if breakdown := gc.Check(nil, &pt.HostPriceTable); breakdown.Gouging() {
-		return rhpv3.HostPriceTable{}, fmt.Errorf("host price table gouging: %v", breakdown)
+	if breakdown := gc.Check(nil, &res.HostPriceTable.HostPriceTable); breakdown.Gouging() {
+		return hostdb.HostPriceTable{}, fmt.Errorf("host price table gouging: %v", breakdown)
 	}
-	return pt.HostPriceTable, nil
+	return res.HostPriceTable, nil
 }
 
-func (h *host) DownloadSector(ctx context.Context, w io.Writer, root types.Hash256, offset, length uint32) (err error) {
-	pt, err := h.priceTable(ctx, nil)
+// DownloadSector downloads a sector from the host, it returns the price table
+// that was used to pay for the download.
+func (h *host) DownloadSector(ctx context.Context, w io.Writer, root types.Hash256, offset, length uint32) (hpt hostdb.HostPriceTable, err error) {
+	hpt, err = h.priceTableWithExpiry(ctx, nil)
 	if err != nil {
-		return err
+		return hostdb.HostPriceTable{}, err
 	}
+	pt := hpt.HostPriceTable
+
 	// return errBalanceInsufficient if balance insufficient
 	defer func() {
 		if isBalanceInsufficient(err) {
@@ -609,7 +848,7 @@ func (h *host) DownloadSector(ctx context.Context, w io.Writer, root types.Hash2
 		}
 	}()
 
-	return h.acc.WithWithdrawal(ctx, func() (amount types.Currency, err error) {
+	err = h.acc.WithWithdrawal(ctx, func() (amount types.Currency, err error) {
 		err = h.transportPool.withTransportV3(ctx, h.HostKey(), h.siamuxAddr, func(ctx context.Context, t *transportV3) error {
 			cost, err := readSectorCost(pt, uint64(length))
 			if err != nil {
@@ -624,6 +863,14 @@ func (h *host) DownloadSector(ctx context.Context, w io.Writer, root types.Hash2
 		})
 		return
 	})
+	if err != nil {
+		return hpt, err
+	}
+
+	// record the downloaded data, the download is paid for by account so
+	// there's no spending to record
+	h.contractSpendingRecorder.RecordTransfer(h.fcid, 0, uint64(length))
+	return hpt, nil
 }
 
 // UploadSector uploads a sector to the host.
@@ -634,6 +881,11 @@ func (h *host) UploadSector(ctx context.Context, sector *[rhpv2.SectorSize]byte,
 		return types.Hash256{}, err
 	}
 
+	// refuse to pay with contracts that exceeded their budget
+	if err := h.contractSpendingRecorder.checkBudget(rev.ParentID); err != nil {
+		return types.Hash256{}, err
+	}
+
 	// prepare payment
 	//
 	// TODO: change to account payments once we have the means to check for an
@@ -659,8 +911,9 @@ func (h *host) UploadSector(ctx context.Context, sector *[rhpv2.SectorSize]byte,
 		return types.Hash256{}, err
 	}
 
-	// record spending
+	// record spending and the uploaded data
 	h.contractSpendingRecorder.Record(rev.ParentID, rev.RevisionNumber, rev.Filesize, api.ContractSpending{Uploads: cost})
+	h.contractSpendingRecorder.RecordTransfer(rev.ParentID, rhpv2.SectorSize, 0)
 	return root, err
 }
 
@@ -693,56 +946,679 @@ func uploadSectorCost(pt rhpv3.HostPriceTable, windowEnd uint64) (cost, collater
 	return cost.Div64(20), collateral, rc.Storage, nil
 }
 
-// priceTableValidityLeeway is the number of time before the actual expiry of a
-// price table when we start considering it invalid.
-const priceTableValidityLeeway = -30 * time.Second
+const (
+	// defaultPriceTableValidityLeeway is the default amount of time before the
+	// actual expiry of a price table when we start considering it invalid.
+	defaultPriceTableValidityLeeway = 30 * time.Second
+
+	// defaultPriceTableIncreaseThreshold is the default percentage by which a
+	// price in a host's price table has to rise between two consecutive price
+	// tables for it to be reported.
+	defaultPriceTableIncreaseThreshold = 50
+
+	// defaultPriceTableStaleWindow is the default amount of time before a price
+	// table becomes invalid during which it's still returned by lookups while
+	// it's being refreshed in the background.
+	defaultPriceTableStaleWindow = time.Minute
+
+	// priceTableEvictionThreshold is the time after the expiry of a price
+	// table after which it's evicted from the cache.
+	priceTableEvictionThreshold = time.Hour
+
+	// priceTablePruneInterval is the minimum amount of time between two
+	// attempts to evict price tables from the cache.
+	priceTablePruneInterval = 10 * time.Minute
+
+	// defaultPriceTablesMaxEntries is the default maximum number of price
+	// tables we keep in the cache, it comfortably exceeds realistic contract
+	// counts so price tables are only evicted under heavy host churn.
+	defaultPriceTablesMaxEntries = 10000
+
+	// priceTableRecentUseThreshold is the amount of time after a price table
+	// was last used during which it's never evicted to bound the cache.
+	priceTableRecentUseThreshold = 5 * time.Minute
+
+	// priceTableUpdateMinBackoff is the amount of time we wait before trying
+	// to update a price table again after a failed update, it doubles with
+	// every consecutive failure up until priceTableUpdateMaxBackoff.
+	priceTableUpdateMinBackoff = 5 * time.Second
+
+	// priceTableUpdateMaxBackoff is the maximum amount of time we wait before
+	// trying to update a price table again after a failed update.
+	priceTableUpdateMaxBackoff = 5 * time.Minute
+
+	// priceTableRefreshTimeout is the maximum amount of time we spend
+	// refreshing a price table in the background.
+	priceTableRefreshTimeout = 30 * time.Second
+
+	// defaultPriceTableDialTimeout is the default maximum amount of time we
+	// spend dialing a host when updating its price table.
+	defaultPriceTableDialTimeout = 30 * time.Second
+
+	// defaultPriceTableUpdateTimeout is the default maximum amount of time an
+	// update of a price table can take, regardless of the caller's context.
+	defaultPriceTableUpdateTimeout = 2 * time.Minute
+
+	// priceTableMinValidity is the minimum amount of time a price table has to
+	// remain valid for, on top of the validity leeway, to be accepted.
+	priceTableMinValidity = 10 * time.Second
+)
+
+var (
+	// priceTableMaxBaseCost and priceTableMaxByteCost are hard ceilings for
+	// the prices in a price table, they are far above anything the gouging
+	// checks would allow and only protect against nonsensical price tables.
+	priceTableMaxBaseCost = types.Siacoins(100)
+	priceTableMaxByteCost = types.Siacoins(1).Div64(1e6) // 1MS/TB
+)
+
+// priceTableFetchFn fetches a fresh price table for the given host, if a
+// revision is given it can be used to pay for the price table. The returned
+// payment is nil if the price table wasn't paid for.
+type priceTableFetchFn func(ctx context.Context, hk types.PublicKey, rev *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error)
+
+// priceTableStore is a store of price tables that is shared between workers, it
+// allows workers to use the price tables other workers paid for. Price tables
+// end up in the store because every price table update is recorded as an
+// interaction with the bus.
+type priceTableStore interface {
+	sharedPriceTable(ctx context.Context, hk types.PublicKey) (hostdb.HostPriceTable, error)
+}
+
+// transportFn executes the given function with a transport to the host at the
+// given siamux address.
+type transportFn func(ctx context.Context, hostKey types.PublicKey, siamuxAddr string, fn func(context.Context, *transportV3) error) error
 
 type priceTables struct {
-	w *worker
+	// cacheStats is accessed atomically and must therefore be the first
+	// field to guarantee 64-bit alignment on 32-bit platforms
+	cacheStats priceTableCacheStats
+
+	clock          clock
+	fetchFn        priceTableFetchFn
+	logger         *zap.SugaredLogger
+	sr             priceTableSpendingRecorder
+	staleWindow    time.Duration
+	store          priceTableStore
+	validityLeeway time.Duration
+	withTransport  transportFn
+
+	// increaseThreshold is the percentage by which a price has to rise
+	// between two consecutive price tables to be reported, 0 disables it
+	increaseThreshold uint64
+
+	// maxEntries is the maximum number of price tables in the cache, when
+	// exceeded the least recently used price tables are evicted
+	maxEntries int
+
+	// dialTimeout and updateTimeout limit the time spent dialing the host
+	// and updating the price table, if the caller's context has a shorter
+	// deadline that one wins
+	dialTimeout   time.Duration
+	updateTimeout time.Duration
+
+	wakeChan chan struct{}
+	stopChan chan struct{}
 
 	mu          sync.Mutex
+	expiries    priceTableExpiryHeap
+	expiryIndex map[types.PublicKey]*priceTableExpiry
+	lastPrune   time.Time
+	numEvicted  uint64
+	numExpired  map[types.PublicKey]uint64
 	priceTables map[types.PublicKey]*priceTable
+	scanned     map[types.PublicKey]hostdb.HostPriceTable
+	siamuxAddrs map[types.PublicKey]string
+}
+
+// priceTableCacheStats counts the outcomes of price table lookups and updates.
+type priceTableCacheStats struct {
+	validHits    uint64 // lookups served from the cache
+	staleHits    uint64 // lookups served from the cache that trigger or await a refresh
+	misses       uint64 // lookups that had to wait for an update
+	updates      uint64 // updates performed
+	deduplicated uint64 // updates avoided by joining an ongoing update
+	failures     uint64 // updates that failed
+}
+
+func (s *priceTableCacheStats) load() priceTableCacheStats {
+	return priceTableCacheStats{
+		validHits:    atomic.LoadUint64(&s.validHits),
+		staleHits:    atomic.LoadUint64(&s.staleHits),
+		misses:       atomic.LoadUint64(&s.misses),
+		updates:      atomic.LoadUint64(&s.updates),
+		deduplicated: atomic.LoadUint64(&s.deduplicated),
+		failures:     atomic.LoadUint64(&s.failures),
+	}
+}
+
+type priceTablesStats struct {
+	cache          priceTableCacheStats
+	numPriceTables int
+	numEvictions   uint64
+	numExpired     uint64
+	numUpdates     uint64
+	numFailures    uint64
+	hosts          map[types.PublicKey]priceTableStats
+}
+
+type priceTableStats struct {
+	numUpdates          uint64
+	numFailures         uint64
+	numExpired          uint64
+	consecutiveFailures uint64
+	backoffUntil        time.Time
+	lastErr             error
+	avgUpdateLatencyMS  float64
+	p90UpdateLatencyMS  float64
 }
 
 type priceTable struct {
-	w  *worker
-	hk types.PublicKey
+	pts *priceTables
+	hk  types.PublicKey
+
+	// lastUsed is guarded by the mutex of the price tables
+	lastUsed time.Time
+
+	statsUpdateLatencyMS *dataPoints
+
+	mu                  sync.Mutex
+	hpt                 hostdb.HostPriceTable
+	leases              int
+	staged              *hostdb.HostPriceTable
+	update              *priceTableUpdate
+	backoffUntil        time.Time
+	consecutiveFailures uint64
+	unreachable         bool
+	statsLastErr        error
+	statsNumUpdates     uint64
+	statsNumFailures    uint64
+}
+
+// priceTableSource indicates where the result of a price table lookup came
+// from.
+type priceTableSource uint8
+
+const (
+	priceTableSourceCache priceTableSource = iota
+	priceTableSourceUpdate
+	priceTableSourceWaited
+)
 
-	mu     sync.Mutex
-	hpt    hostdb.HostPriceTable
-	update *priceTableUpdate
+// priceTableLookup is the result of a price table lookup, the embedded price
+// table contains its absolute expiry.
+type priceTableLookup struct {
+	hostdb.HostPriceTable
+	source priceTableSource
 }
 
 type priceTableUpdate struct {
 	err  error
 	done chan struct{}
 	hpt  hostdb.HostPriceTable
+
+	// interrupted is set when the update failed because the context of the
+	// thread performing it was done, waiters can then take over the update
+	interrupted bool
 }
 
 func (w *worker) initPriceTables() {
 	if w.priceTables != nil {
 		panic("priceTables already initialized") // developer error
 	}
-	w.priceTables = &priceTables{
-		w:           w,
+	w.priceTables = newPriceTables(w.updatePriceTable, w.contractSpendingRecorder, defaultPriceTableValidityLeeway, defaultPriceTableStaleWindow, systemClock{})
+	w.priceTables.store = w
+	w.priceTables.withTransport = w.transportPoolV3.withTransportV3
+	w.priceTables.logger = w.logger.Named("pricetables")
+	w.priceTables.increaseThreshold = defaultPriceTableIncreaseThreshold
+	w.priceTables.startPrefetching()
+}
+
+// newPriceTables returns a new price table cache, price tables are considered
+// invalid validityLeeway before they actually expire. If staleWindow is
+// non-zero, lookups of price tables that become invalid within the window
+// return the cached price table and refresh it in the background. Payments for
+// price tables are recorded with the given spending recorder, expiries are
+// evaluated using the given clock.
+func newPriceTables(fetchFn priceTableFetchFn, sr priceTableSpendingRecorder, validityLeeway, staleWindow time.Duration, c clock) *priceTables {
+	return &priceTables{
+		clock:          c,
+		fetchFn:        fetchFn,
+		logger:         zap.NewNop().Sugar(),
+		dialTimeout:    defaultPriceTableDialTimeout,
+		maxEntries:     defaultPriceTablesMaxEntries,
+		updateTimeout:  defaultPriceTableUpdateTimeout,
+		sr:             sr,
+		staleWindow:    staleWindow,
+		validityLeeway: validityLeeway,
+
+		wakeChan: make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+
+		expiryIndex: make(map[types.PublicKey]*priceTableExpiry),
+		numExpired:  make(map[types.PublicKey]uint64),
 		priceTables: make(map[types.PublicKey]*priceTable),
+		scanned:     make(map[types.PublicKey]hostdb.HostPriceTable),
+		siamuxAddrs: make(map[types.PublicKey]string),
+	}
+}
+
+func newPriceTable(pts *priceTables, hk types.PublicKey) *priceTable {
+	return &priceTable{
+		pts:                  pts,
+		hk:                   hk,
+		statsUpdateLatencyMS: newDataPoints(0),
+	}
+}
+
+// fetch returns a price table for the given host that remains valid for at
+// least minRemaining, if the cached price table doesn't it gets updated first.
+func (pts *priceTables) fetch(ctx context.Context, hk types.PublicKey, rev *types.FileContractRevision, minRemaining time.Duration) (priceTableLookup, error) {
+	pt := pts.getOrCreate(hk)
+	res, err := pt.fetch(ctx, rev, minRemaining)
+	if err != nil || res.source != priceTableSourceCache {
+		atomic.AddUint64(&pts.cacheStats.misses, 1)
+	}
+	if err != nil {
+		return priceTableLookup{}, err
+	}
+
+	// (re)schedule the price table for prefetching and mark it as used
+	pts.mu.Lock()
+	pts.schedule(hk, pt.latestExpiry())
+	pts.expiryIndex[hk].used = true
+	pts.mu.Unlock()
+	return res, nil
+}
+
+// ForceUpdate updates the price table of the given host regardless of whether
+// the cached price table is still valid and returns the fresh price table. If a
+// revision is given it's used to pay for the price table if paying by account
+// fails. Concurrent updates for the same host result in a single update.
+func (pts *priceTables) ForceUpdate(ctx context.Context, hk types.PublicKey, rev *types.FileContractRevision) (hostdb.HostPriceTable, error) {
+	pt := pts.getOrCreate(hk)
+	hpt, err := pt.refresh(ctx, rev)
+	if err != nil {
+		return hostdb.HostPriceTable{}, err
+	}
+
+	pts.mu.Lock()
+	if _, exists := pts.priceTables[hk]; exists {
+		pts.schedule(hk, pt.latestExpiry())
+	}
+	pts.mu.Unlock()
+	return hpt, nil
+}
+
+// SiamuxAddr returns the siamux address of the given host that was last used to
+// successfully update its price table.
+func (pts *priceTables) SiamuxAddr(hk types.PublicKey) (string, bool) {
+	pts.mu.Lock()
+	defer pts.mu.Unlock()
+	addr, exists := pts.siamuxAddrs[hk]
+	return addr, exists
+}
+
+// fetchWithFallback fetches a price table from the given host by trying the
+// given siamux addresses in order, the address that worked last is tried
+// first. We only fall back to the next address if the host was unreachable.
+func (pts *priceTables) fetchWithFallback(ctx context.Context, hk types.PublicKey, addrs []string, fetchFn func(ctx context.Context, siamuxAddr string) (hostdb.HostPriceTable, *priceTablePayment, error)) (hpt hostdb.HostPriceTable, payment *priceTablePayment, err error) {
+	// move the preferred address to the front
+	pts.mu.Lock()
+	preferred, exists := pts.siamuxAddrs[hk]
+	pts.mu.Unlock()
+	candidates := make([]string, 0, len(addrs))
+	if exists {
+		for _, addr := range addrs {
+			if addr == preferred {
+				candidates = append(candidates, addr)
+				break
+			}
+		}
+	}
+	for _, addr := range addrs {
+		if addr == "" || (len(candidates) > 0 && addr == candidates[0]) {
+			continue
+		}
+		candidates = append(candidates, addr)
 	}
+	if len(candidates) == 0 {
+		return hostdb.HostPriceTable{}, nil, fmt.Errorf("host %v has no siamux address", hk)
+	}
+
+	for i, addr := range candidates {
+		hpt, payment, err = fetchFn(ctx, addr)
+		if err == nil {
+			pts.mu.Lock()
+			pts.siamuxAddrs[hk] = addr
+			pts.mu.Unlock()
+			return hpt, payment, nil
+		} else if !isHostUnreachable(err) || ctx.Err() != nil {
+			break
+		} else if i < len(candidates)-1 {
+			pts.logger.Debugw("failed to reach host, trying next address", "host", hk, "addr", addr, "err", err)
+		}
+	}
+	return hostdb.HostPriceTable{}, nil, err
 }
 
-// fetch returns a price table for the given host
-func (pts *priceTables) fetch(ctx context.Context, hk types.PublicKey, rev *types.FileContractRevision) (hostdb.HostPriceTable, error) {
+// getOrCreate returns the price table of the given host, creating it if it
+// doesn't exist yet.
+func (pts *priceTables) getOrCreate(hk types.PublicKey) *priceTable {
 	pts.mu.Lock()
+	defer pts.mu.Unlock()
+
+	if pts.clock.Now().Sub(pts.lastPrune) > priceTablePruneInterval {
+		pts.prune()
+	}
 	pt, exists := pts.priceTables[hk]
 	if !exists {
-		pt = &priceTable{
-			w:  pts.w,
-			hk: hk,
-		}
+		pt = newPriceTable(pts, hk)
 		pts.priceTables[hk] = pt
 	}
-	pts.mu.Unlock()
+	pt.lastUsed = pts.clock.Now()
+	if !exists && len(pts.priceTables) > pts.maxEntries {
+		pts.evictLRU()
+	}
+	return pt
+}
+
+// Acquire returns a price table for the given host that remains valid for at
+// least minValidity and leases it until the returned function is called. While
+// leased, the price table is neither evicted nor replaced, lookups keep
+// returning it for as long as it's valid for them and refreshes are staged
+// until all leases are released. If the leased price table isn't valid for
+// long enough, the staged price table is returned without a lease.
+func (pts *priceTables) Acquire(ctx context.Context, hk types.PublicKey, minValidity time.Duration) (priceTableLookup, func(), error) {
+	for {
+		res, err := pts.fetch(ctx, hk, nil, minValidity)
+		if err != nil {
+			return priceTableLookup{}, nil, err
+		}
+
+		pts.mu.Lock()
+		pt, exists := pts.priceTables[hk]
+		pts.mu.Unlock()
+		if !exists {
+			continue // evicted in the meantime
+		}
+
+		pt.mu.Lock()
+		if pt.hpt.UID == res.UID {
+			pt.leases++
+			pt.mu.Unlock()
+
+			var once sync.Once
+			return res, func() { once.Do(pt.release) }, nil
+		} else if pt.leases > 0 {
+			pt.mu.Unlock()
+			return res, func() {}, nil
+		}
+		pt.mu.Unlock()
+
+		// the price table was replaced in the meantime, try again
+		if err := ctx.Err(); err != nil {
+			return priceTableLookup{}, nil, err
+		}
+	}
+}
+
+// Prefetch updates the price tables of the given hosts that aren't valid for at
+// least minRemaining, updating at most maxConcurrent price tables at a time. It
+// returns the errors that occurred, keyed by host.
+func (pts *priceTables) Prefetch(ctx context.Context, hks []types.PublicKey, minRemaining time.Duration, maxConcurrent int) map[types.PublicKey]error {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	var mu sync.Mutex
+	errs := make(map[types.PublicKey]error)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrent)
+	for _, hk := range hks {
+		// skip hosts with a price table that is valid for long enough
+		pts.mu.Lock()
+		pt, exists := pts.priceTables[hk]
+		pts.mu.Unlock()
+		if exists {
+			pt.mu.Lock()
+			hpt := pt.hpt
+			pt.mu.Unlock()
+			if pt.validFor(hpt, pts.clock.Now(), minRemaining) {
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			errs[hk] = ctx.Err()
+			mu.Unlock()
+			continue
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(hk types.PublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// fetch uses the same update machinery as regular lookups so
+			// concurrent lookups don't cause us to pay twice
+			if _, err := pts.fetch(ctx, hk, nil, minRemaining); err != nil {
+				mu.Lock()
+				errs[hk] = err
+				mu.Unlock()
+			}
+		}(hk)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Fetch fetches a price table from the host without paying for it, hosts return
+// the price table for free if it isn't registered. The price table is not added
+// to the cache of paid price tables, if cache is true it's kept in a separate
+// cache of scanned price tables instead.
+func (pts *priceTables) Fetch(ctx context.Context, hk types.PublicKey, siamuxAddr string, cache bool) (hostdb.HostPriceTable, error) {
+	var hpt hostdb.HostPriceTable
+	err := pts.withTransport(ctx, hk, siamuxAddr, func(ctx context.Context, t *transportV3) error {
+		pt, err := RPCPriceTable(ctx, t, func(pt rhpv3.HostPriceTable) (rhpv3.PaymentMethod, error) { return nil, nil })
+		if err != nil {
+			return err
+		}
+		hpt = hostdb.HostPriceTable{
+			HostPriceTable: pt,
+			Expiry:         pts.clock.Now().Add(pt.Validity),
+		}
+		return nil
+	})
+	if err != nil {
+		return hostdb.HostPriceTable{}, err
+	}
+
+	if cache {
+		pts.mu.Lock()
+		pts.scanned[hk] = hpt
+		pts.mu.Unlock()
+	}
+	return hpt, nil
+}
+
+// Scanned returns the scanned price table of the given host, if any.
+func (pts *priceTables) Scanned(hk types.PublicKey) (hostdb.HostPriceTable, bool) {
+	pts.mu.Lock()
+	defer pts.mu.Unlock()
+	hpt, exists := pts.scanned[hk]
+	return hpt, exists
+}
+
+// All returns the key fields of all cached price tables, sorted by host key.
+func (pts *priceTables) All() []api.CachedPriceTable {
+	pts.mu.Lock()
+	defer pts.mu.Unlock()
+
+	cpts := make([]api.CachedPriceTable, 0, len(pts.priceTables))
+	for hk, pt := range pts.priceTables {
+		pt.mu.Lock()
+		hpt, updating := pt.hpt, pt.update != nil
+		pt.mu.Unlock()
+
+		cpts = append(cpts, api.CachedPriceTable{
+			HostKey:  hk,
+			UID:      hpt.UID,
+			Expiry:   hpt.Expiry,
+			Updating: updating,
+
+			UpdatePriceTableCost:  hpt.UpdatePriceTableCost,
+			InitBaseCost:          hpt.InitBaseCost,
+			ReadBaseCost:          hpt.ReadBaseCost,
+			WriteBaseCost:         hpt.WriteBaseCost,
+			DownloadBandwidthCost: hpt.DownloadBandwidthCost,
+			UploadBandwidthCost:   hpt.UploadBandwidthCost,
+		})
+	}
+	sort.Slice(cpts, func(i, j int) bool {
+		return bytes.Compare(cpts[i].HostKey[:], cpts[j].HostKey[:]) < 0
+	})
+	return cpts
+}
+
+// Prices returns the key prices of all cached price tables, sorted by host key.
+// Hosts for which we don't have a price table are omitted.
+func (pts *priceTables) Prices() []api.HostPrices {
+	pts.mu.Lock()
+	defer pts.mu.Unlock()
+
+	now := pts.clock.Now()
+	prices := make([]api.HostPrices, 0, len(pts.priceTables))
+	for hk, pt := range pts.priceTables {
+		pt.mu.Lock()
+		hpt := pt.hpt
+		pt.mu.Unlock()
+		if hpt.Expiry.IsZero() {
+			continue
+		}
+
+		prices = append(prices, api.HostPrices{
+			HostKey: hk,
+			Expiry:  hpt.Expiry,
+			Valid:   pt.validFor(hpt, now, 0),
+
+			DownloadPerByte:      hpt.DownloadBandwidthCost,
+			UploadPerByte:        hpt.UploadBandwidthCost,
+			BaseRPCCost:          hpt.InitBaseCost,
+			UpdatePriceTableCost: hpt.UpdatePriceTableCost,
+		})
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return bytes.Compare(prices[i].HostKey[:], prices[j].HostKey[:]) < 0
+	})
+	return prices
+}
+
+// Stats returns the stats of the price table cache.
+func (pts *priceTables) Stats() priceTablesStats {
+	pts.mu.Lock()
+	defer pts.mu.Unlock()
+
+	stats := priceTablesStats{
+		cache:          pts.cacheStats.load(),
+		numPriceTables: len(pts.priceTables),
+		numEvictions:   pts.numEvicted,
+		hosts:          make(map[types.PublicKey]priceTableStats),
+	}
+	for hk, pt := range pts.priceTables {
+		s := pt.stats()
+		stats.numUpdates += s.numUpdates
+		stats.numFailures += s.numFailures
+		stats.hosts[hk] = s
+	}
+	for hk, n := range pts.numExpired {
+		s := stats.hosts[hk]
+		s.numExpired = n
+		stats.numExpired += n
+		stats.hosts[hk] = s
+	}
+	return stats
+}
+
+// ReportPriceTableExpired is called when an RPC with the given host failed
+// because the host considered the price table to be expired.
+func (pts *priceTables) ReportPriceTableExpired(hk types.PublicKey) {
+	pts.mu.Lock()
+	defer pts.mu.Unlock()
+	pts.numExpired[hk]++
+}
 
-	return pt.fetch(ctx, rev)
+// evictLRU evicts the least recently used price tables until the cache is
+// within its bounds. Price tables that are being updated, are leased or were
+// used recently are never evicted. The caller is expected to hold the lock.
+func (pts *priceTables) evictLRU() {
+	var candidates []*priceTable
+	for _, pt := range pts.priceTables {
+		pt.mu.Lock()
+		inUse := pt.update != nil || pt.leases > 0
+		pt.mu.Unlock()
+		if !inUse && pts.clock.Now().Sub(pt.lastUsed) > priceTableRecentUseThreshold {
+			candidates = append(candidates, pt)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+	for _, pt := range candidates {
+		if len(pts.priceTables) <= pts.maxEntries {
+			break
+		}
+		pts.evict(pt.hk)
+	}
+}
+
+// evict removes the price table of the given host from the cache, the caller is
+// expected to hold the lock.
+func (pts *priceTables) evict(hk types.PublicKey) {
+	delete(pts.priceTables, hk)
+	pts.unschedule(hk)
+	pts.numEvicted++
+}
+
+// prune evicts the price tables that expired a while ago, including scanned
+// price tables. Price tables that are being updated or are leased are never
+// evicted. The
+// caller is expected to hold the lock.
+func (pts *priceTables) prune() {
+	for hk, pt := range pts.priceTables {
+		pt.mu.Lock()
+		evict := pt.update == nil && pt.leases == 0 && pts.clock.Now().Sub(pt.hpt.Expiry) > priceTableEvictionThreshold
+		pt.mu.Unlock()
+		if evict {
+			pts.evict(hk)
+		}
+	}
+	for hk, hpt := range pts.scanned {
+		if pts.clock.Now().Sub(hpt.Expiry) > priceTableEvictionThreshold {
+			delete(pts.scanned, hk)
+		}
+	}
+	pts.lastPrune = pts.clock.Now()
+}
+
+func (pt *priceTable) stats() priceTableStats {
+	pt.statsUpdateLatencyMS.Recompute()
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return priceTableStats{
+		numUpdates:          pt.statsNumUpdates,
+		numFailures:         pt.statsNumFailures,
+		consecutiveFailures: pt.consecutiveFailures,
+		backoffUntil:        pt.backoffUntil,
+		lastErr:             pt.statsLastErr,
+		avgUpdateLatencyMS:  pt.statsUpdateLatencyMS.Average(),
+		p90UpdateLatencyMS:  pt.statsUpdateLatencyMS.P90(),
+	}
 }
 
 func (pt *priceTable) ongoingUpdate() (bool, *priceTableUpdate) {
@@ -759,34 +1635,145 @@ func (pt *priceTable) ongoingUpdate() (bool, *priceTableUpdate) {
 	return ongoing, pt.update
 }
 
-func (p *priceTable) fetch(ctx context.Context, rev *types.FileContractRevision) (hpt hostdb.HostPriceTable, err error) {
-	// convenience variables
-	hk := p.hk
-	w := p.w
-	b := p.w.bus
+// validFor returns true if the given price table is still valid for at least
+// minRemaining at the given time, taking into account the validity leeway.
+func (p *priceTable) validFor(hpt hostdb.HostPriceTable, now time.Time, minRemaining time.Duration) bool {
+	return !hpt.Expiry.IsZero() && now.Add(p.pts.validityLeeway+minRemaining).Before(hpt.Expiry)
+}
+
+// latestExpiry returns the expiry of the most recent price table, which is the
+// staged one if the price table is leased and was refreshed in the meantime.
+func (p *priceTable) latestExpiry() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.staged != nil {
+		return p.staged.Expiry
+	}
+	return p.hpt.Expiry
+}
 
+// release releases a lease on the price table, when the last lease is released
+// the staged price table replaces the leased one.
+func (p *priceTable) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.leases--
+	if p.leases < 0 {
+		panic("price table leases can never be less than zero") // developer error
+	}
+	if p.leases == 0 && p.staged != nil {
+		p.hpt = *p.staged
+		p.staged = nil
+	}
+}
+
+func (p *priceTable) fetch(ctx context.Context, rev *types.FileContractRevision, minRemaining time.Duration) (priceTableLookup, error) {
 	// grab the current price table
 	p.mu.Lock()
-	hpt = p.hpt
+	hpt, staged := p.hpt, p.staged
+	backoffUntil, lastErr, unreachable := p.backoffUntil, p.statsLastErr, p.unreachable
 	p.mu.Unlock()
+	now := p.pts.clock.Now()
+
+	// a leased price table is returned for as long as it's valid, after that
+	// we fall back to the price table that was staged in the meantime
+	if staged != nil {
+		if p.validFor(hpt, now, minRemaining) {
+			atomic.AddUint64(&p.pts.cacheStats.validHits, 1)
+			return priceTableLookup{HostPriceTable: hpt, source: priceTableSourceCache}, nil
+		}
+		hpt = *staged
+	}
+	cached := priceTableLookup{HostPriceTable: hpt, source: priceTableSourceCache}
+
+	// the host was unreachable recently, report it as not having a valid
+	// price table to avoid every operation waiting for it to time out
+	if unreachable && now.Before(backoffUntil) {
+		return priceTableLookup{}, fmt.Errorf("%w; host is unreachable, price table updates are backing off until %v", lastErr, backoffUntil)
+	}
 
 	// price table is valid, no update necessary, return early
-	if !hpt.Expiry.IsZero() {
-		total := int(math.Floor(hpt.HostPriceTable.Validity.Seconds() * 0.1))
-		priceTableUpdateLeeway := -time.Duration(frand.Intn(total)) * time.Second
-		if time.Now().Before(hpt.Expiry.Add(priceTableValidityLeeway).Add(priceTableUpdateLeeway)) {
-			return
+	if p.pts.staleWindow > 0 {
+		if p.validFor(hpt, now, minRemaining+p.pts.staleWindow) {
+			atomic.AddUint64(&p.pts.cacheStats.validHits, 1)
+			return cached, nil
+		}
+	} else if !hpt.Expiry.IsZero() {
+		var priceTableUpdateLeeway time.Duration
+		if total := int(math.Floor(hpt.HostPriceTable.Validity.Seconds() * 0.1)); total > 0 {
+			priceTableUpdateLeeway = time.Duration(frand.Intn(total)) * time.Second
 		}
+		if p.validFor(hpt, now, minRemaining+priceTableUpdateLeeway) {
+			atomic.AddUint64(&p.pts.cacheStats.validHits, 1)
+			return cached, nil
+		}
+	}
+
+	// price table is stale but still valid, refresh it in the background
+	if p.pts.staleWindow > 0 && p.validFor(hpt, now, minRemaining) {
+		p.refreshAsync()
+		atomic.AddUint64(&p.pts.cacheStats.staleHits, 1)
+		return cached, nil
+	}
+
+	// a previous update failed recently, avoid hammering the host and return
+	// the price table if it's still valid or fail fast with the cached error
+	if now.Before(backoffUntil) {
+		if p.validFor(hpt, now, minRemaining) {
+			atomic.AddUint64(&p.pts.cacheStats.staleHits, 1)
+			return cached, nil
+		}
+		return priceTableLookup{}, fmt.Errorf("%w; price table updates are backing off until %v", lastErr, backoffUntil)
 	}
 
 	// price table is valid and update ongoing, return early
 	ongoing, update := p.ongoingUpdate()
-	if ongoing && !hpt.Expiry.IsZero() && time.Now().Before(hpt.Expiry.Add(priceTableValidityLeeway)) {
-		return
+	if ongoing && p.validFor(hpt, now, minRemaining) {
+		atomic.AddUint64(&p.pts.cacheStats.staleHits, 1)
+		return cached, nil
 	}
 
 	// price table is being updated, wait for the update
 	if ongoing {
+		atomic.AddUint64(&p.pts.cacheStats.deduplicated, 1)
+		select {
+		case <-ctx.Done():
+			return priceTableLookup{}, fmt.Errorf("%w; timeout while blocking for pricetable update", ctx.Err())
+		case <-update.done:
+		}
+
+		// if the update was interrupted because the context of the thread
+		// performing it was done, take over the update if our context allows
+		if update.interrupted && ctx.Err() == nil {
+			return p.fetch(ctx, rev, minRemaining)
+		} else if update.err != nil {
+			return priceTableLookup{}, update.err
+		}
+		return priceTableLookup{HostPriceTable: update.hpt, source: priceTableSourceWaited}, nil
+	}
+
+	// this thread is updating the price table
+	hpt, err := p.performUpdate(ctx, rev, update)
+	if err != nil {
+		return priceTableLookup{}, err
+	}
+	return priceTableLookup{HostPriceTable: hpt, source: priceTableSourceUpdate}, nil
+}
+
+// refresh updates the price table regardless of whether the cached price table
+// is still valid, unless an update is ongoing or updates are backing off. If a
+// revision is given it can be used to pay for the price table.
+func (p *priceTable) refresh(ctx context.Context, rev *types.FileContractRevision) (hostdb.HostPriceTable, error) {
+	p.mu.Lock()
+	backoffUntil, lastErr := p.backoffUntil, p.statsLastErr
+	p.mu.Unlock()
+	if p.pts.clock.Now().Before(backoffUntil) {
+		return hostdb.HostPriceTable{}, fmt.Errorf("%w; price table updates are backing off until %v", lastErr, backoffUntil)
+	}
+
+	ongoing, update := p.ongoingUpdate()
+	if ongoing {
+		atomic.AddUint64(&p.pts.cacheStats.deduplicated, 1)
 		select {
 		case <-ctx.Done():
 			return hostdb.HostPriceTable{}, fmt.Errorf("%w; timeout while blocking for pricetable update", ctx.Err())
@@ -794,35 +1781,262 @@ func (p *priceTable) fetch(ctx context.Context, rev *types.FileContractRevision)
 		}
 		return update.hpt, update.err
 	}
+	return p.performUpdate(ctx, rev, update)
+}
+
+// refreshAsync refreshes the price table in the background unless an update is
+// ongoing or updates are backing off.
+func (p *priceTable) refreshAsync() {
+	p.mu.Lock()
+	backoffUntil := p.backoffUntil
+	p.mu.Unlock()
+	if p.pts.clock.Now().Before(backoffUntil) {
+		return
+	}
 
-	// this thread is updating the price table
+	ongoing, update := p.ongoingUpdate()
+	if ongoing {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), priceTableRefreshTimeout)
+		defer cancel()
+		p.performUpdate(ctx, nil, update)
+	}()
+}
+
+// performUpdate fetches a fresh price table and completes the given update,
+// the caller is expected to have started the update.
+func (p *priceTable) performUpdate(ctx context.Context, rev *types.FileContractRevision, update *priceTableUpdate) (hpt hostdb.HostPriceTable, err error) {
+	// add tracing
+	ctx, span := tracing.Tracer.Start(ctx, "priceTableUpdate")
+	span.SetAttributes(attribute.Stringer("hk", p.hk))
+	defer func() {
+		if err == nil {
+			span.SetAttributes(priceTableAttributes(hpt)...)
+		}
+		span.RecordError(err)
+		span.End()
+	}()
+
+	start := time.Now()
 	defer func() {
 		update.hpt = hpt
 		update.err = err
-		close(update.done)
+		update.interrupted = err != nil && ctx.Err() != nil
+
+		p.statsUpdateLatencyMS.Track(float64(time.Since(start).Milliseconds()))
+		atomic.AddUint64(&p.pts.cacheStats.updates, 1)
+		if err != nil {
+			atomic.AddUint64(&p.pts.cacheStats.failures, 1)
+		}
 
 		p.mu.Lock()
 		if err == nil {
-			p.hpt = hpt
+			if !p.hpt.Expiry.IsZero() && p.pts.increaseThreshold > 0 {
+				for _, c := range priceTableIncreases(p.hpt.HostPriceTable, hpt.HostPriceTable, p.pts.increaseThreshold) {
+					p.pts.logger.Warnw("significant price increase detected", "host", p.hk, "field", c.field, "old", c.old, "new", c.new)
+				}
+			}
+			if p.leases > 0 {
+				p.staged = &hpt
+			} else {
+				p.hpt = hpt
+				p.staged = nil
+			}
+			p.backoffUntil = time.Time{}
+			p.consecutiveFailures = 0
+			p.unreachable = false
+		} else {
+			// an interrupted update says nothing about the host, so we don't
+			// back off and let a waiter take over
+			if !update.interrupted {
+				p.consecutiveFailures++
+				p.backoffUntil = p.pts.clock.Now().Add(priceTableUpdateBackoff(p.consecutiveFailures))
+				p.unreachable = isHostUnreachable(err)
+			}
+			p.statsLastErr = err
+			p.statsNumFailures++
 		}
+		p.statsNumUpdates++
 		p.update = nil
 		p.mu.Unlock()
+
+		// signal waiters after resetting the update so they can take over
+		close(update.done)
 	}()
 
-	// fetch the host, return early if it has a valid price table
-	host, err := b.Host(ctx, hk)
-	if err == nil && host.Scanned && time.Now().Before(host.PriceTable.Expiry.Add(priceTableValidityLeeway)) {
-		hpt = host.PriceTable
-		return
+	// limit the time spent updating the price table so waiters are released
+	// even if the caller's context has no deadline
+	updateCtx, cancel := context.WithTimeout(ctx, p.pts.updateTimeout)
+	defer cancel()
+	updateCtx = withDialTimeout(updateCtx, p.pts.dialTimeout)
+	updateCtx = withPriceTableClock(updateCtx, p.pts.clock)
+	updateCtx = withPriceTableMinValidity(updateCtx, p.pts.validityLeeway+priceTableMinValidity)
+
+	// use the price table shared by another worker if it's valid for long
+	// enough to not immediately be prefetched again
+	if p.pts.store != nil {
+		p.mu.Lock()
+		current := p.hpt.UID
+		p.mu.Unlock()
+		if shared, err := p.pts.store.sharedPriceTable(updateCtx, p.hk); err == nil && shared.UID != current && p.validFor(shared, p.pts.clock.Now(), priceTablePrefetchLeeway) && validatePriceTable(shared, p.pts.clock.Now(), p.pts.validityLeeway+priceTableMinValidity) == nil {
+			return shared, nil
+		}
+	}
+
+	hpt, payment, err := p.pts.fetchFn(updateCtx, p.hk, rev)
+	if err != nil && errors.Is(updateCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return hostdb.HostPriceTable{}, fmt.Errorf("%w after %v: %v", errPriceTableUpdateTimeout, p.pts.updateTimeout, err)
+	} else if err != nil {
+		return hostdb.HostPriceTable{}, err
+	}
+	if payment != nil && p.pts.sr != nil {
+		p.pts.sr.RecordPriceTableSpending(*payment)
+	}
+
+	// invalid price tables are rejected before they're paid for, we check
+	// again before accepting it since the update might have taken a while, a
+	// rejected price table counts as a failed update so we back off
+	if err := validatePriceTable(hpt, p.pts.clock.Now(), p.pts.validityLeeway+priceTableMinValidity); err != nil {
+		p.pts.logger.Warnw("rejected price table", "host", p.hk, "err", err)
+		return hostdb.HostPriceTable{}, err
+	}
+	return hpt, nil
+}
+
+// priceTableChange describes a change of a price between two price tables.
+type priceTableChange struct {
+	field string
+	old   types.Currency
+	new   types.Currency
+}
+
+// priceTableIncreases returns the key prices that rose by more than the given
+// percentage between the two price tables.
+func priceTableIncreases(before, after rhpv3.HostPriceTable, thresholdPct uint64) (changes []priceTableChange) {
+	for _, f := range []struct {
+		name     string
+		old, new types.Currency
+	}{
+		{"InitBaseCost", before.InitBaseCost, after.InitBaseCost},
+		{"ReadBaseCost", before.ReadBaseCost, after.ReadBaseCost},
+		{"ReadLengthCost", before.ReadLengthCost, after.ReadLengthCost},
+		{"WriteBaseCost", before.WriteBaseCost, after.WriteBaseCost},
+		{"WriteLengthCost", before.WriteLengthCost, after.WriteLengthCost},
+		{"UpdatePriceTableCost", before.UpdatePriceTableCost, after.UpdatePriceTableCost},
+	} {
+		// new * 100 > old * (100 + threshold)
+		if f.new.Mul64(100).Cmp(f.old.Mul64(100+thresholdPct)) > 0 {
+			changes = append(changes, priceTableChange{field: f.name, old: f.old, new: f.new})
+		}
+	}
+	return
+}
+
+// validatePriceTable performs sanity checks on the given price table, it
+// returns an error if the price table has no UID, isn't valid for at least
+// minValidity or contains prices above our hard ceilings.
+func validatePriceTable(hpt hostdb.HostPriceTable, now time.Time, minValidity time.Duration) error {
+	if hpt.UID == (rhpv3.SettingsID{}) {
+		return fmt.Errorf("%w: missing UID", errInvalidPriceTable)
+	} else if validity := hpt.Expiry.Sub(now); validity < minValidity {
+		return fmt.Errorf("%w: validity %v is below the minimum of %v", errInvalidPriceTable, validity, minValidity)
+	}
+
+	for _, f := range []struct {
+		name    string
+		cost    types.Currency
+		ceiling types.Currency
+	}{
+		{"InitBaseCost", hpt.InitBaseCost, priceTableMaxBaseCost},
+		{"ReadBaseCost", hpt.ReadBaseCost, priceTableMaxBaseCost},
+		{"WriteBaseCost", hpt.WriteBaseCost, priceTableMaxBaseCost},
+		{"UpdatePriceTableCost", hpt.UpdatePriceTableCost, priceTableMaxBaseCost},
+		{"AccountBalanceCost", hpt.AccountBalanceCost, priceTableMaxBaseCost},
+		{"FundAccountCost", hpt.FundAccountCost, priceTableMaxBaseCost},
+		{"LatestRevisionCost", hpt.LatestRevisionCost, priceTableMaxBaseCost},
+		{"ReadLengthCost", hpt.ReadLengthCost, priceTableMaxByteCost},
+		{"WriteLengthCost", hpt.WriteLengthCost, priceTableMaxByteCost},
+		{"DownloadBandwidthCost", hpt.DownloadBandwidthCost, priceTableMaxByteCost},
+		{"UploadBandwidthCost", hpt.UploadBandwidthCost, priceTableMaxByteCost},
+	} {
+		if f.cost.Cmp(f.ceiling) > 0 {
+			return fmt.Errorf("%w: %v %v exceeds the ceiling of %v", errInvalidPriceTable, f.name, f.cost, f.ceiling)
+		}
+	}
+	return nil
+}
+
+// priceTableAttributes returns the span attributes that identify the given
+// price table.
+func priceTableAttributes(hpt hostdb.HostPriceTable) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Stringer("priceTable", hpt.UID),
+		attribute.String("priceTableExpiry", hpt.Expiry.Format(time.RFC3339Nano)),
+	}
+}
+
+// priceTableUpdateBackoff returns the amount of time to wait before updating a
+// price table again after the given number of consecutive failed updates.
+func priceTableUpdateBackoff(consecutiveFailures uint64) time.Duration {
+	backoff := priceTableUpdateMinBackoff
+	for i := uint64(1); i < consecutiveFailures && backoff < priceTableUpdateMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > priceTableUpdateMaxBackoff {
+		backoff = priceTableUpdateMaxBackoff
+	}
+	return backoff
+}
+
+// updatePriceTable fetches a fresh price table for the given host.
+func (w *worker) updatePriceTable(ctx context.Context, hk types.PublicKey, rev *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+	// attach a gouging checker unless the update was triggered by an operation
+	// that has one attached already, background refreshes don't
+	if _, ok := ctx.Value(keyGougingChecker).(func() (GougingChecker, error)); !ok {
+		gp, err := w.bus.GougingParams(ctx)
+		if err != nil {
+			return hostdb.HostPriceTable{}, nil, fmt.Errorf("could not get gouging parameters: %w", err)
+		}
+		ctx = WithGougingChecker(ctx, w.bus, gp)
 	}
 
 	// sanity check the host has been scanned before fetching the price table
-	if !host.Scanned {
-		return hostdb.HostPriceTable{}, fmt.Errorf("host %v was not scanned", hk)
+	host, err := w.bus.Host(ctx, hk)
+	if err != nil {
+		return hostdb.HostPriceTable{}, nil, err
+	} else if !host.Scanned {
+		return hostdb.HostPriceTable{}, nil, fmt.Errorf("host %v was not scanned", hk)
 	}
+	return w.priceTables.fetchWithFallback(ctx, hk, hostSiamuxAddrs(host.Host), func(ctx context.Context, siamuxAddr string) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		return w.fetchPriceTable(ctx, hk, siamuxAddr, rev)
+	})
+}
 
-	// otherwise fetch it
-	return w.fetchPriceTable(ctx, hk, host.Settings.SiamuxAddr(), rev)
+// hostSiamuxAddrs returns the siamux addresses the host might be reachable on,
+// the address from the host's settings comes first followed by the announced
+// address if it differs.
+func hostSiamuxAddrs(host hostdb.Host) (addrs []string) {
+	if addr := host.Settings.SiamuxAddr(); addr != "" {
+		addrs = append(addrs, addr)
+	}
+	if hostname, _, err := net.SplitHostPort(host.NetAddress); err == nil && hostname != "" && host.Settings.SiaMuxPort != "" {
+		if addr := net.JoinHostPort(hostname, host.Settings.SiaMuxPort); len(addrs) == 0 || addr != addrs[0] {
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
+
+// sharedPriceTable returns the price table the bus has for the given host,
+// price tables are shared through the bus by recording price table updates.
+func (w *worker) sharedPriceTable(ctx context.Context, hk types.PublicKey) (hostdb.HostPriceTable, error) {
+	host, err := w.bus.Host(ctx, hk)
+	if err != nil {
+		return hostdb.HostPriceTable{}, err
+	}
+	return host.PriceTable, nil
 }
 
 // preparePriceTableContractPayment prepare a payment function to pay for a
@@ -831,9 +2045,11 @@ func (p *priceTable) fetch(ctx context.Context, rev *types.FileContractRevision)
 // NOTE: This way of paying for a price table should only be used if payment by
 // EA is not possible or if we already need a contract revision anyway. e.g.
 // funding an EA.
-func (h *host) preparePriceTableContractPayment(rev *types.FileContractRevision) PriceTablePaymentFunc {
+func (h *host) preparePriceTableContractPayment(gc GougingChecker, rev *types.FileContractRevision) PriceTablePaymentFunc {
 	return func(pt rhpv3.HostPriceTable) (rhpv3.PaymentMethod, error) {
-		// TODO: gouging check on price table
+		if err := gc.CheckPriceTablePayment(h.HostKey(), pt); err != nil {
+			return nil, err
+		}
 
 		refundAccount := rhpv3.Account(h.accountKey.PublicKey())
 		payment, err := payByContract(rev, pt.UpdatePriceTableCost, refundAccount, h.renterKey)
@@ -849,9 +2065,11 @@ func (h *host) preparePriceTableContractPayment(rev *types.FileContractRevision)
 //
 // NOTE: This is the preferred way of paying for a price table since it is
 // faster and doesn't require locking a contract.
-func (h *host) preparePriceTableAccountPayment(bh uint64) PriceTablePaymentFunc {
+func (h *host) preparePriceTableAccountPayment(gc GougingChecker, bh uint64) PriceTablePaymentFunc {
 	return func(pt rhpv3.HostPriceTable) (rhpv3.PaymentMethod, error) {
-		// TODO: gouging check on price table
+		if err := gc.CheckPriceTablePayment(h.HostKey(), pt); err != nil {
+			return nil, err
+		}
 
 		account := rhpv3.Account(h.accountKey.PublicKey())
 		payment := rhpv3.PayByEphemeralAccount(account, pt.UpdatePriceTableCost, bh+defaultWithdrawalExpiryBlocks, h.accountKey)
@@ -898,9 +2116,9 @@ func (h *host) Renew(ctx context.Context, rrr api.RHPRenewRequest) (_ rhpv2.Cont
 	ptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	var pt *rhpv3.HostPriceTable
-	hpt, err := h.priceTables.fetch(ptCtx, h.HostKey(), nil)
+	res, err := h.priceTables.fetch(ptCtx, h.HostKey(), nil, 0)
 	if err == nil {
-		pt = &hpt.HostPriceTable
+		pt = &res.HostPriceTable.HostPriceTable
 	} else {
 		h.logger.Debugf("unable to fetch price table for renew: %v", err)
 	}
@@ -922,36 +2140,111 @@ func (h *host) Renew(ctx context.Context, rrr api.RHPRenewRequest) (_ rhpv2.Cont
 	return rev, txnSet, renewErr
 }
 
+// AcquirePriceTable leases a price table that remains valid for at least
+// minValidity, ensuring subsequent RPCs use the same price table for as long as
+// it's valid. The lease is held until release is called.
+func (h *host) AcquirePriceTable(ctx context.Context, minValidity time.Duration) (release func(), err error) {
+	_, release, err = h.priceTables.Acquire(ctx, h.HostKey(), minValidity)
+	return
+}
+
 func (h *host) FetchPriceTable(ctx context.Context, rev *types.FileContractRevision) (hpt hostdb.HostPriceTable, err error) {
+	hpt, _, err = h.fetchPriceTable(ctx, rev)
+	return
+}
+
+// fetchPriceTable fetches a price table from the host, paying for it with the
+// account or, if that fails and a revision is given, with the contract. It
+// returns the payment that was made for the price table.
+func (h *host) fetchPriceTable(ctx context.Context, rev *types.FileContractRevision) (hpt hostdb.HostPriceTable, payment *priceTablePayment, err error) {
+	// the expiry is derived from the clock of the price table cache
+	c := priceTableClockFromContext(ctx)
+
 	// fetchPT is a helper function that performs the RPC given a payment function
 	fetchPT := func(paymentFn PriceTablePaymentFunc) (hpt hostdb.HostPriceTable, err error) {
 		err = h.transportPool.withTransportV3(ctx, h.HostKey(), h.siamuxAddr, func(ctx context.Context, t *transportV3) (err error) {
 			defer recordPriceTableUpdate(ctx, h.siamuxAddr, h.HostKey(), &hpt, &err)()
 
-			pt, err := RPCPriceTable(ctx, t, paymentFn)
+			pt, err := RPCPriceTable(ctx, t, func(pt rhpv3.HostPriceTable) (rhpv3.PaymentMethod, error) {
+				// sanity check the price table before the payment function
+				// performs the gouging checks and pays for it
+				if err := checkPriceTable(ctx, pt); err != nil {
+					return nil, err
+				}
+				return paymentFn(pt)
+			})
 			if err != nil {
 				return err
 			}
 			hpt = hostdb.HostPriceTable{
 				HostPriceTable: pt,
-				Expiry:         time.Now().Add(pt.Validity),
+				Expiry:         c.Now().Add(pt.Validity),
 			}
 			return nil
 		})
 		return
 	}
 
-	// pay by contract if a revision is given
+	// fetch the gouging checker, it's used to check the price table before
+	// paying for it
+	gc, err := GougingCheckerFromContext(ctx)
+	if err != nil {
+		return hostdb.HostPriceTable{}, nil, err
+	}
+
+	// prepare the contract payment if a revision is given
+	var contractPayment PriceTablePaymentFunc
 	if rev != nil {
-		return fetchPT(h.preparePriceTableContractPayment(rev))
+		contractPayment = h.preparePriceTableContractPayment(gc, rev)
 	}
 
-	// pay by account
+	// prepare the account payment
 	cs, err := h.bus.ConsensusState(ctx)
 	if err != nil {
-		return hostdb.HostPriceTable{}, err
+		return hostdb.HostPriceTable{}, nil, err
+	}
+	accountPayment := h.preparePriceTableAccountPayment(gc, cs.BlockHeight)
+
+	// pay by account, falling back to the contract
+	hpt, fallback, err := fetchPriceTableWithFallback(fetchPT, accountPayment, contractPayment)
+	if fallback {
+		trace.SpanFromContext(ctx).AddEvent("price table paid by contract after account payment failed")
+		h.logger.Debugw("paid for price table by contract after account payment failed", "host", h.HostKey())
+	}
+	if err != nil {
+		return hostdb.HostPriceTable{}, nil, err
+	}
+
+	// keep track of the payment
+	payment = &priceTablePayment{
+		hostKey: h.HostKey(),
+		amount:  hpt.UpdatePriceTableCost,
+		method:  priceTablePaymentAccount,
+	}
+	if fallback {
+		payment.contractID = rev.ParentID
+		payment.revisionNumber = rev.RevisionNumber
+		payment.size = rev.Filesize
+		payment.method = priceTablePaymentContract
+	}
+	return hpt, payment, nil
+}
+
+// fetchPriceTableWithFallback fetches a price table paying for it with the
+// account. If the account balance is insufficient and a contract payment is
+// given, the price table is paid for with the contract instead. The returned
+// boolean indicates whether we fell back to paying with the contract.
+func fetchPriceTableWithFallback(fetchPT func(PriceTablePaymentFunc) (hostdb.HostPriceTable, error), accountPayment, contractPayment PriceTablePaymentFunc) (hostdb.HostPriceTable, bool, error) {
+	hpt, err := fetchPT(accountPayment)
+	if err == nil || contractPayment == nil || !isBalanceInsufficient(err) {
+		return hpt, false, err
+	}
+
+	hpt, contractErr := fetchPT(contractPayment)
+	if contractErr != nil {
+		return hostdb.HostPriceTable{}, true, fmt.Errorf("failed to pay for price table by contract: %w; account payment failed: %v", contractErr, err)
 	}
-	return fetchPT(h.preparePriceTableAccountPayment(cs.BlockHeight))
+	return hpt, true, nil
 }
 
 // RPCPriceTable calls the UpdatePriceTable RPC.
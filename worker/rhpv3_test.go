@@ -0,0 +1,2286 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	rhpv3 "go.sia.tech/core/rhp/v3"
+	"go.sia.tech/core/types"
+	"go.sia.tech/jape"
+	"go.sia.tech/renterd/api"
+	"go.sia.tech/renterd/hostdb"
+	"go.sia.tech/renterd/metrics"
+	"go.sia.tech/renterd/tracing"
+	"go.uber.org/zap"
+)
+
+func TestPriceTablesPrune(t *testing.T) {
+	pts := newPriceTables(nil, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	add := func(expiry time.Time) *priceTable {
+		hk := types.GeneratePrivateKey().PublicKey()
+		pt := newPriceTable(pts, hk)
+		pt.hpt = hostdb.HostPriceTable{Expiry: expiry}
+		pts.priceTables[hk] = pt
+		return pt
+	}
+
+	// add a valid, a recently expired and an old price table
+	valid := add(time.Now().Add(time.Hour))
+	recent := add(time.Now().Add(-time.Minute))
+	old := add(time.Now().Add(-2 * priceTableEvictionThreshold))
+
+	// add an old price table that's being updated
+	updating := add(time.Now().Add(-2 * priceTableEvictionThreshold))
+	if ongoing, _ := updating.ongoingUpdate(); ongoing {
+		t.Fatal("unexpected ongoing update")
+	}
+
+	// prune the price tables
+	pts.mu.Lock()
+	pts.prune()
+	pts.mu.Unlock()
+
+	// assert only the old price table got evicted
+	if n := pts.Stats().numPriceTables; n != 3 {
+		t.Fatalf("expected 3 price tables, got %v", n)
+	}
+	for _, pt := range []*priceTable{valid, recent, updating} {
+		if _, exists := pts.priceTables[pt.hk]; !exists {
+			t.Fatal("price table was evicted", pt.hk)
+		}
+	}
+	if _, exists := pts.priceTables[old.hk]; exists {
+		t.Fatal("price table wasn't evicted")
+	}
+
+	// assert waiters can still join the ongoing update
+	ongoing, update := updating.ongoingUpdate()
+	if !ongoing {
+		t.Fatal("expected ongoing update")
+	}
+
+	// finish the update, it failed so the table becomes evictable
+	updating.mu.Lock()
+	updating.update = nil
+	updating.mu.Unlock()
+	close(update.done)
+
+	pts.mu.Lock()
+	pts.prune()
+	pts.mu.Unlock()
+	if n := pts.Stats().numPriceTables; n != 2 {
+		t.Fatalf("expected 2 price tables, got %v", n)
+	}
+}
+
+func TestPriceTablesHandlerGET(t *testing.T) {
+	pts := newPriceTables(nil, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	w := &worker{priceTables: pts}
+	srv := httptest.NewServer(jape.Mux(map[string]jape.Handler{
+		"GET /pricetables": w.priceTablesHandlerGET,
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "")
+
+	// populate the cache
+	expiry := time.Now().Add(time.Hour).Round(time.Second).UTC()
+	var hks []types.PublicKey
+	for i := 0; i < 3; i++ {
+		hk := types.GeneratePrivateKey().PublicKey()
+		hks = append(hks, hk)
+		pt := newPriceTable(pts, hk)
+		pt.hpt = hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{
+				UID:                  rhpv3.SettingsID{byte(i + 1)},
+				UpdatePriceTableCost: types.NewCurrency64(uint64(i + 1)),
+			},
+			Expiry: expiry,
+		}
+		pts.priceTables[hk] = pt
+	}
+
+	// mark one of them as being updated
+	pts.priceTables[hks[1]].ongoingUpdate()
+
+	// assert all price tables are returned
+	cpts, err := c.PriceTables(types.PublicKey{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cpts) != 3 {
+		t.Fatalf("expected 3 price tables, got %v", len(cpts))
+	}
+	for _, cpt := range cpts {
+		pt := pts.priceTables[cpt.HostKey]
+		if cpt.UID != pt.hpt.UID || !cpt.Expiry.Equal(expiry) || !cpt.UpdatePriceTableCost.Equals(pt.hpt.UpdatePriceTableCost) {
+			t.Fatal("unexpected price table", cpt)
+		} else if cpt.Updating != (cpt.HostKey == hks[1]) {
+			t.Fatal("unexpected updating flag", cpt)
+		}
+	}
+
+	// assert the price tables can be filtered by host key
+	cpts, err = c.PriceTables(hks[2])
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cpts) != 1 || cpts[0].HostKey != hks[2] {
+		t.Fatal("unexpected price tables", cpts)
+	}
+
+	// assert the raw JSON uses the expected field names
+	resp, err := http.Get(srv.URL + "/pricetables?hostkey=" + hks[2].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	} else if len(raw) != 1 {
+		t.Fatal("unexpected response", raw)
+	}
+	for _, field := range []string{"hostKey", "uid", "expiry", "updating", "updatePriceTableCost", "downloadBandwidthCost"} {
+		if _, exists := raw[0][field]; !exists {
+			t.Fatalf("missing field %v", field)
+		}
+	}
+}
+
+func TestFetchPriceTableWithFallback(t *testing.T) {
+	h := &host{
+		acc:        &account{host: types.GeneratePrivateKey().PublicKey()},
+		accountKey: types.GeneratePrivateKey(),
+		renterKey:  types.GeneratePrivateKey(),
+	}
+	gc := gougingChecker{}
+	accountPayment := h.preparePriceTableAccountPayment(gc, 0)
+	contractPayment := h.preparePriceTableContractPayment(gc, &types.FileContractRevision{
+		ValidProofOutputs:  make([]types.SiacoinOutput, 2),
+		MissedProofOutputs: make([]types.SiacoinOutput, 3),
+	})
+
+	// create a helper that fakes the RPC, it fails payments using the
+	// payment methods in the given map
+	errContract := errors.New("contract payment failed")
+	fetchPT := func(failures map[string]error) func(PriceTablePaymentFunc) (hostdb.HostPriceTable, error) {
+		return func(paymentFn PriceTablePaymentFunc) (hostdb.HostPriceTable, error) {
+			payment, err := paymentFn(rhpv3.HostPriceTable{})
+			if err != nil {
+				return hostdb.HostPriceTable{}, err
+			}
+			var method string
+			switch payment.(type) {
+			case *rhpv3.PayByEphemeralAccountRequest:
+				method = "account"
+			case *rhpv3.PayByContractRequest:
+				method = "contract"
+			}
+			if err := failures[method]; err != nil {
+				return hostdb.HostPriceTable{}, err
+			}
+			return hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}}}, nil
+		}
+	}
+
+	// assert paying by account works without falling back
+	hpt, fallback, err := fetchPriceTableWithFallback(fetchPT(nil), accountPayment, contractPayment)
+	if err != nil {
+		t.Fatal(err)
+	} else if fallback || hpt.UID != (rhpv3.SettingsID{1}) {
+		t.Fatal("unexpected result", fallback, hpt.UID)
+	}
+
+	// assert we fall back to the contract if the account is empty
+	hpt, fallback, err = fetchPriceTableWithFallback(fetchPT(map[string]error{"account": errBalanceInsufficient}), accountPayment, contractPayment)
+	if err != nil {
+		t.Fatal(err)
+	} else if !fallback || hpt.UID != (rhpv3.SettingsID{1}) {
+		t.Fatal("unexpected result", fallback, hpt.UID)
+	}
+
+	// assert we don't fall back without a contract payment or for other errors
+	_, fallback, err = fetchPriceTableWithFallback(fetchPT(map[string]error{"account": errBalanceInsufficient}), accountPayment, nil)
+	if !isBalanceInsufficient(err) || fallback {
+		t.Fatal("unexpected result", fallback, err)
+	}
+	_, fallback, err = fetchPriceTableWithFallback(fetchPT(map[string]error{"account": errContract}), accountPayment, contractPayment)
+	if !errors.Is(err, errContract) || fallback {
+		t.Fatal("unexpected result", fallback, err)
+	}
+
+	// assert both errors are returned if both payments fail
+	_, fallback, err = fetchPriceTableWithFallback(fetchPT(map[string]error{"account": errBalanceInsufficient, "contract": errContract}), accountPayment, contractPayment)
+	if !errors.Is(err, errContract) || !isBalanceInsufficient(err) || !fallback {
+		t.Fatal("unexpected result", fallback, err)
+	}
+}
+
+func TestPriceTablesStats(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+
+	// create a fetch function that blocks until it's released
+	var mu sync.Mutex
+	var calls int
+	release := make(chan error)
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		if err := <-release; err != nil {
+			return hostdb.HostPriceTable{}, nil, err
+		}
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}, Validity: time.Minute},
+			Expiry:         time.Now().Add(time.Minute),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// create a helper that fetches the price table concurrently
+	fetch := func(n int) chan error {
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				_, err := pts.fetch(context.Background(), hk, nil, 0)
+				errs <- err
+			}()
+		}
+		return errs
+	}
+
+	// fail an update with concurrent waiters
+	errFetch := errors.New("fetch failed")
+	errs := fetch(5)
+	waitForPriceTableUpdate(pts, hk)
+	time.Sleep(10 * time.Millisecond) // give the waiters time to join
+	release <- errFetch
+	for i := 0; i < 5; i++ {
+		if err := <-errs; !errors.Is(err, errFetch) {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	// assert the failure was attributed once
+	stats := pts.Stats()
+	if stats.numUpdates != 1 || stats.numFailures != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	} else if hs := stats.hosts[hk]; hs.numUpdates != 1 || hs.numFailures != 1 || !errors.Is(hs.lastErr, errFetch) {
+		t.Fatalf("unexpected host stats %+v", hs)
+	}
+
+	// reset the backoff and perform a successful update
+	pts.priceTables[hk].mu.Lock()
+	pts.mu.Lock()
+	pt := pts.priceTables[hk]
+	pts.mu.Unlock()
+	pt.mu.Lock()
+	pt.backoffUntil = time.Time{}
+	pt.mu.Unlock()
+	pts.priceTables[hk].mu.Unlock()
+	errs = fetch(1)
+	waitForPriceTableUpdate(pts, hk)
+	release <- nil
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the stats were updated
+	stats = pts.Stats()
+	if stats.numUpdates != 2 || stats.numFailures != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	} else if hs := stats.hosts[hk]; hs.numUpdates != 2 || hs.numFailures != 1 || !errors.Is(hs.lastErr, errFetch) {
+		t.Fatalf("unexpected host stats %+v", hs)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %v", calls)
+	}
+}
+
+func TestPriceTableValidFor(t *testing.T) {
+	leeway := 30 * time.Second
+	pt := newPriceTable(newPriceTables(nil, nil, leeway, 0, systemClock{}), types.PublicKey{1})
+
+	now := time.Now()
+	minRemaining := 2 * time.Minute
+	threshold := now.Add(leeway + minRemaining)
+
+	tests := []struct {
+		expiry time.Time
+		valid  bool
+	}{
+		{time.Time{}, false},                          // no price table
+		{threshold.Add(-time.Nanosecond), false},      // just under
+		{threshold, false},                            // exactly at the threshold
+		{threshold.Add(time.Nanosecond), true},        // just over
+		{now.Add(minRemaining), false},                // within leeway
+		{now.Add(leeway).Add(time.Nanosecond), false}, // valid without min remaining
+	}
+	for i, test := range tests {
+		hpt := hostdb.HostPriceTable{Expiry: test.expiry}
+		if valid := pt.validFor(hpt, now, minRemaining); valid != test.valid {
+			t.Fatalf("%d: expected valid to be %v", i, test.valid)
+		}
+	}
+
+	// without min remaining the leeway is the only requirement
+	if !pt.validFor(hostdb.HostPriceTable{Expiry: now.Add(leeway).Add(time.Nanosecond)}, now, 0) {
+		t.Fatal("expected price table to be valid")
+	}
+}
+
+func TestPriceTablesMinRemaining(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+
+	var calls int
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		calls++
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{byte(calls)}},
+			Expiry:         time.Now().Add(time.Minute),
+		}, nil, nil
+	}, nil, 0, 0, systemClock{})
+
+	// fetch the price table, it should be valid for about a minute
+	hpt, err := pts.fetch(context.Background(), hk, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if calls != 1 {
+		t.Fatal("unexpected number of calls", calls)
+	}
+
+	// a short operation should be served from the cache
+	if cached, err := pts.fetch(context.Background(), hk, nil, time.Second); err != nil {
+		t.Fatal(err)
+	} else if cached.UID != hpt.UID || calls != 1 {
+		t.Fatal("expected cached price table")
+	}
+
+	// a long operation should trigger an update
+	if updated, err := pts.fetch(context.Background(), hk, nil, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	} else if updated.UID == hpt.UID || calls != 2 {
+		t.Fatal("expected updated price table")
+	}
+}
+
+func TestPriceTablesUpdateBackoff(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+
+	// create a fetch function that fails until told otherwise
+	var mu sync.Mutex
+	var calls int
+	fail := true
+	errFetch := errors.New("fetch failed")
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if fail {
+			return hostdb.HostPriceTable{}, nil, errFetch
+		}
+		return hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}}, Expiry: time.Now().Add(time.Hour)}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// fail an update
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); !errors.Is(err, errFetch) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert concurrent callers during the backoff window fail fast
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pts.fetch(context.Background(), hk, nil, 0); !errors.Is(err, errFetch) {
+				t.Error("unexpected error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	if calls != 1 {
+		t.Fatal("expected 1 call, got", calls)
+	}
+	mu.Unlock()
+
+	// assert the backoff is exposed in the stats
+	stats := pts.Stats().hosts[hk]
+	if stats.consecutiveFailures != 1 {
+		t.Fatal("unexpected consecutive failures", stats.consecutiveFailures)
+	} else if time.Until(stats.backoffUntil) <= 0 || time.Until(stats.backoffUntil) > priceTableUpdateMinBackoff {
+		t.Fatal("unexpected backoff", stats.backoffUntil)
+	}
+
+	// expire the backoff and fail another update, the backoff should double
+	pt := pts.priceTables[hk]
+	pt.mu.Lock()
+	pt.backoffUntil = time.Time{}
+	pt.mu.Unlock()
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); !errors.Is(err, errFetch) {
+		t.Fatal("unexpected error", err)
+	}
+	stats = pts.Stats().hosts[hk]
+	if stats.consecutiveFailures != 2 {
+		t.Fatal("unexpected consecutive failures", stats.consecutiveFailures)
+	} else if time.Until(stats.backoffUntil) <= priceTableUpdateMinBackoff {
+		t.Fatal("unexpected backoff", stats.backoffUntil)
+	}
+
+	// expire the backoff and perform a successful update, the backoff resets
+	pt.mu.Lock()
+	pt.backoffUntil = time.Time{}
+	pt.mu.Unlock()
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	stats = pts.Stats().hosts[hk]
+	if stats.consecutiveFailures != 0 || !stats.backoffUntil.IsZero() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPriceTableUpdateBackoff(t *testing.T) {
+	tests := []struct {
+		failures uint64
+		backoff  time.Duration
+	}{
+		{1, priceTableUpdateMinBackoff},
+		{2, 2 * priceTableUpdateMinBackoff},
+		{3, 4 * priceTableUpdateMinBackoff},
+		{100, priceTableUpdateMaxBackoff},
+	}
+	for _, test := range tests {
+		if backoff := priceTableUpdateBackoff(test.failures); backoff != test.backoff {
+			t.Fatalf("%d failures: expected %v, got %v", test.failures, test.backoff, backoff)
+		}
+	}
+}
+
+func TestPriceTablesUpdateTakeover(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+
+	// create a fetch function that blocks the first caller until its context
+	// is done and it's released, subsequent calls return a fresh price table
+	var mu sync.Mutex
+	var calls int
+	release := make(chan struct{})
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			<-ctx.Done()
+			<-release
+			return hostdb.HostPriceTable{}, nil, ctx.Err()
+		}
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}},
+			Expiry:         time.Now().Add(time.Hour),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// start the performer with a short deadline
+	performerErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		_, err := pts.fetch(ctx, hk, nil, 0)
+		performerErr <- err
+	}()
+
+	// wait until the update is ongoing
+	waitForPriceTableUpdate(pts, hk)
+
+	// start a waiter with plenty of time
+	type result struct {
+		hpt priceTableLookup
+		err error
+	}
+	waiterRes := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		hpt, err := pts.fetch(ctx, hk, nil, 0)
+		waiterRes <- result{hpt, err}
+	}()
+
+	// give the waiter time to join and release the performer
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	// assert the performer failed with its context error
+	if err := <-performerErr; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the waiter took over and ended up with a fresh price table
+	res := <-waiterRes
+	if res.err != nil {
+		t.Fatal(res.err)
+	} else if res.hpt.UID != (rhpv3.SettingsID{1}) {
+		t.Fatal("unexpected price table", res.hpt.UID)
+	} else if res.hpt.source != priceTableSourceUpdate {
+		t.Fatal("expected the waiter to have performed the update", res.hpt.source)
+	}
+
+	// assert the interrupted update didn't cause a backoff
+	if stats := pts.Stats().hosts[hk]; stats.consecutiveFailures != 0 || !stats.backoffUntil.IsZero() {
+		t.Fatalf("unexpected stats %+v", stats)
+	} else if stats.numUpdates != 2 || stats.numFailures != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestPriceTablesLookup verifies the metadata returned when looking up a price
+// table.
+func TestPriceTablesLookup(t *testing.T) {
+	hk := types.PublicKey{1}
+	validity := time.Hour
+	release := make(chan struct{})
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		<-release
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}, Validity: validity},
+			Expiry:         time.Now().Add(validity),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// start the performer
+	start := time.Now()
+	performerRes := make(chan priceTableLookup, 1)
+	go func() {
+		res, err := pts.fetch(context.Background(), hk, nil, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		performerRes <- res
+	}()
+
+	// wait until the update is ongoing and start a couple of waiters
+	waitForPriceTableUpdate(pts, hk)
+	var wg sync.WaitGroup
+	waiterRes := make(chan priceTableLookup, 3)
+	for i := 0; i < cap(waiterRes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := pts.fetch(context.Background(), hk, nil, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			waiterRes <- res
+		}()
+	}
+
+	// give the waiters time to join and release the performer
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(waiterRes)
+
+	// assert the performer's expiry is now + validity
+	performer := <-performerRes
+	if performer.source != priceTableSourceUpdate {
+		t.Fatal("unexpected source", performer.source)
+	} else if performer.Expiry.Before(start.Add(validity)) || performer.Expiry.After(time.Now().Add(validity)) {
+		t.Fatal("unexpected expiry", performer.Expiry)
+	}
+
+	// assert the waiters share the performer's expiry
+	for res := range waiterRes {
+		if res.source != priceTableSourceWaited {
+			t.Fatal("unexpected source", res.source)
+		} else if !res.Expiry.Equal(performer.Expiry) {
+			t.Fatal("unexpected expiry", res.Expiry, performer.Expiry)
+		}
+	}
+
+	// assert subsequent lookups are served from the cache
+	if res, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if res.source != priceTableSourceCache || !res.Expiry.Equal(performer.Expiry) {
+		t.Fatal("unexpected lookup", res.source, res.Expiry)
+	}
+}
+
+// waitForPriceTableUpdate blocks until the price table of the given host is
+// being updated.
+func waitForPriceTableUpdate(pts *priceTables, hk types.PublicKey) {
+	for {
+		pts.mu.Lock()
+		pt, exists := pts.priceTables[hk]
+		pts.mu.Unlock()
+		if exists {
+			pt.mu.Lock()
+			ongoing := pt.update != nil
+			pt.mu.Unlock()
+			if ongoing {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPriceTablesPrefetch(t *testing.T) {
+	c := &fakeClock{now: time.Now()}
+
+	// create three hosts with different validities
+	hkA := types.PublicKey{1}
+	hkB := types.PublicKey{2}
+	hkC := types.PublicKey{3}
+	validities := map[types.PublicKey]time.Duration{
+		hkA: time.Hour,
+		hkB: 2 * time.Hour,
+		hkC: 3 * time.Hour,
+	}
+
+	// create a fetch function that keeps track of the order of updates
+	var mu sync.Mutex
+	var updates []types.PublicKey
+	pts := newPriceTables(func(ctx context.Context, hk types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, hk)
+		return hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}}, Expiry: c.Now().Add(validities[hk])}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, c)
+	defer pts.Stop()
+
+	// create a helper to assert the host at the top of the heap
+	assertNext := func(hk types.PublicKey) {
+		t.Helper()
+		pts.mu.Lock()
+		defer pts.mu.Unlock()
+		if len(pts.expiries) == 0 || pts.expiries[0].hk != hk {
+			t.Fatal("unexpected next price table")
+		}
+	}
+
+	// fetch all price tables
+	for _, hk := range []types.PublicKey{hkC, hkA, hkB} {
+		if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertNext(hkA)
+
+	// renew A with a longer validity, B should be next
+	mu.Lock()
+	validities[hkA] = 4 * time.Hour
+	mu.Unlock()
+	if _, err := pts.fetch(context.Background(), hkA, nil, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertNext(hkB)
+
+	// evicting B should make C next
+	pts.mu.Lock()
+	pts.unschedule(hkB)
+	pts.mu.Unlock()
+	assertNext(hkC)
+	if _, err := pts.fetch(context.Background(), hkB, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertNext(hkB)
+
+	// start prefetching and wait until the heap is drained, since refreshed
+	// price tables aren't used they are dropped from the heap when due
+	pts.startPrefetching()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		pts.mu.Lock()
+		n := len(pts.expiries) + len(pts.expiryIndex)
+		pts.mu.Unlock()
+		if n == 0 {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for prefetches")
+		}
+	}
+
+	// assert the price tables were refreshed once, in order of expiry
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) != 7 {
+		t.Fatal("unexpected number of updates", len(updates))
+	} else if updates := updates[4:]; updates[0] != hkB || updates[1] != hkC || updates[2] != hkA {
+		t.Fatal("unexpected prefetch order", updates)
+	}
+}
+
+func TestPriceTablesClock(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	hkA := types.PublicKey{1}
+	hkB := types.PublicKey{2}
+	validity := 10 * time.Minute
+	leeway := 30 * time.Second
+
+	// create a fetch function that counts the number of updates per host
+	var mu sync.Mutex
+	calls := make(map[types.PublicKey]int)
+	pts := newPriceTables(func(ctx context.Context, hk types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[hk]++
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{byte(calls[hk])}},
+			Expiry:         c.Now().Add(validity),
+		}, nil, nil
+	}, nil, leeway, 0, c)
+
+	// helper to assert the number of updates
+	assertCalls := func(hk types.PublicKey, n int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if calls[hk] != n {
+			t.Fatalf("expected %v calls, got %v", n, calls[hk])
+		}
+	}
+
+	// fetch the price table
+	res, err := pts.fetch(context.Background(), hkA, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if !res.Expiry.Equal(c.Now().Add(validity)) {
+		t.Fatal("unexpected expiry", res.Expiry)
+	}
+	assertCalls(hkA, 1)
+
+	// right before the leeway window the price table is still valid
+	c.advance(validity - leeway - time.Nanosecond)
+	if _, err := pts.fetch(context.Background(), hkA, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if prices := pts.Prices(); len(prices) != 1 || !prices[0].Valid {
+		t.Fatal("expected valid price table", prices)
+	}
+	assertCalls(hkA, 1)
+
+	// the same lookup requiring more time triggers an update
+	if res, err := pts.fetch(context.Background(), hkA, nil, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	} else if res.UID != (rhpv3.SettingsID{2}) || !res.Expiry.Equal(c.Now().Add(validity)) {
+		t.Fatal("unexpected price table", res.UID, res.Expiry)
+	}
+	assertCalls(hkA, 2)
+
+	// entering the leeway window the price table is no longer valid, even
+	// though it didn't expire yet
+	c.advance(validity - leeway)
+	if prices := pts.Prices(); len(prices) != 1 || prices[0].Valid {
+		t.Fatal("expected invalid price table", prices)
+	}
+	if _, err := pts.fetch(context.Background(), hkA, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(hkA, 3)
+
+	// once the price table expired long enough ago it gets pruned on the next
+	// lookup
+	c.advance(validity + priceTableEvictionThreshold + time.Second)
+	if _, err := pts.fetch(context.Background(), hkB, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	pts.mu.Lock()
+	_, exists := pts.priceTables[hkA]
+	pts.mu.Unlock()
+	if exists {
+		t.Fatal("expected price table to be pruned")
+	} else if stats := pts.Stats(); stats.numEvictions != 1 {
+		t.Fatal("unexpected number of evictions", stats.numEvictions)
+	}
+
+	// failed updates back off until the clock passes the backoff
+	errFetch := errors.New("fetch failed")
+	pts.fetchFn = func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[hkA]++
+		return hostdb.HostPriceTable{}, nil, errFetch
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := pts.fetch(context.Background(), hkA, nil, 0); !errors.Is(err, errFetch) {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	assertCalls(hkA, 4)
+	c.advance(priceTableUpdateMinBackoff)
+	if _, err := pts.fetch(context.Background(), hkA, nil, 0); !errors.Is(err, errFetch) {
+		t.Fatal("unexpected error", err)
+	}
+	assertCalls(hkA, 5)
+}
+
+func TestPriceTablesAcquire(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	hkA := types.PublicKey{1}
+	hkB := types.PublicKey{2}
+
+	// create a fetch function that returns a new price table on every call
+	var mu sync.Mutex
+	var calls int
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{byte(calls)}},
+			Expiry:         c.Now().Add(10 * time.Minute),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, c)
+
+	// helper to assert the UID returned by a lookup
+	assertUID := func(uid byte) {
+		t.Helper()
+		if res, err := pts.fetch(context.Background(), hkA, nil, 0); err != nil {
+			t.Fatal(err)
+		} else if res.UID != (rhpv3.SettingsID{uid}) {
+			t.Fatal("unexpected price table", res.UID)
+		}
+	}
+
+	// lease the price table
+	res, release1, err := pts.Acquire(context.Background(), hkA, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.UID != (rhpv3.SettingsID{1}) {
+		t.Fatal("unexpected price table", res.UID)
+	}
+	pts.mu.Lock()
+	pt := pts.priceTables[hkA]
+	pts.mu.Unlock()
+
+	// refresh the price table while leased, lookups should keep returning the
+	// leased price table
+	c.advance(5 * time.Minute)
+	if hpt, err := pt.refresh(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	} else if hpt.UID != (rhpv3.SettingsID{2}) {
+		t.Fatal("unexpected price table", hpt.UID)
+	}
+	assertUID(1)
+
+	// leasing it again returns the same price table
+	res, release2, err := pts.Acquire(context.Background(), hkA, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.UID != (rhpv3.SettingsID{1}) {
+		t.Fatal("unexpected price table", res.UID)
+	}
+
+	// once the leased price table expired, lookups return the staged one
+	c.advance(5 * time.Minute)
+	assertUID(2)
+
+	// leasing can't pin the staged price table while the expired one is
+	// still leased
+	if res, release, err := pts.Acquire(context.Background(), hkA, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if res.UID != (rhpv3.SettingsID{2}) {
+		t.Fatal("unexpected price table", res.UID)
+	} else {
+		release()
+	}
+
+	// leased price tables are never pruned
+	c.advance(2 * time.Hour)
+	if _, err := pts.fetch(context.Background(), hkB, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	pts.mu.Lock()
+	_, exists := pts.priceTables[hkA]
+	pts.mu.Unlock()
+	if !exists {
+		t.Fatal("leased price table was pruned")
+	}
+
+	// once the staged price table expired as well, it gets updated
+	assertUID(4)
+
+	// releasing the first lease twice only releases it once
+	release1()
+	release1()
+	pt.mu.Lock()
+	if pt.hpt.UID != (rhpv3.SettingsID{1}) || pt.leases != 1 {
+		t.Fatal("unexpected lease", pt.hpt.UID, pt.leases)
+	}
+	pt.mu.Unlock()
+
+	// releasing the last lease replaces the leased price table
+	release2()
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.hpt.UID != (rhpv3.SettingsID{4}) || pt.staged != nil || pt.leases != 0 {
+		t.Fatal("unexpected price table", pt.hpt.UID, pt.staged, pt.leases)
+	}
+}
+
+func TestPriceTablesStaleWhileRevalidate(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+	staleWindow := time.Minute
+
+	// create a fetch function that blocks until it's released
+	var mu sync.Mutex
+	var calls int
+	release := make(chan struct{})
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{2}},
+			Expiry:         time.Now().Add(time.Hour),
+		}, nil, nil
+	}, nil, 0, staleWindow, systemClock{})
+
+	// add a price table that's inside the stale window
+	pt := newPriceTable(pts, hk)
+	pt.hpt = hostdb.HostPriceTable{
+		HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}},
+		Expiry:         time.Now().Add(staleWindow / 2),
+	}
+	pts.priceTables[hk] = pt
+
+	// perform concurrent lookups, they should all return the stale table
+	// without blocking
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if hpt, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+				t.Error(err)
+			} else if hpt.UID != (rhpv3.SettingsID{1}) {
+				t.Error("expected stale price table")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// release the refresh and wait for it to complete
+	close(release)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		pt.mu.Lock()
+		uid := pt.hpt.UID
+		pt.mu.Unlock()
+		if uid == (rhpv3.SettingsID{2}) {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for refresh")
+		}
+	}
+
+	// assert the price table was refreshed exactly once
+	mu.Lock()
+	if calls != 1 {
+		t.Fatal("expected 1 call, got", calls)
+	}
+	mu.Unlock()
+
+	// expire the price table, the lookup should block on the update
+	pt.mu.Lock()
+	pt.hpt = hostdb.HostPriceTable{
+		HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}},
+		Expiry:         time.Now().Add(-time.Second),
+	}
+	pt.mu.Unlock()
+	if hpt, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if hpt.UID != (rhpv3.SettingsID{2}) {
+		t.Fatal("expected fresh price table")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatal("expected 2 calls, got", calls)
+	}
+}
+
+type mockPriceTableSpendingRecorder struct {
+	mu       sync.Mutex
+	payments []priceTablePayment
+}
+
+func (r *mockPriceTableSpendingRecorder) RecordPriceTableSpending(p priceTablePayment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payments = append(r.payments, p)
+}
+
+func TestPriceTablesSpending(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+	fcid := types.FileContractID{1}
+
+	// create a fetch function that pays by contract if a revision is given
+	cost := types.Siacoins(1)
+	var fail bool
+	sr := &mockPriceTableSpendingRecorder{}
+	pts := newPriceTables(func(ctx context.Context, hk types.PublicKey, rev *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		if fail {
+			return hostdb.HostPriceTable{}, nil, errors.New("fetch failed")
+		}
+		hpt := hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}, UpdatePriceTableCost: cost},
+			Expiry:         time.Now().Add(time.Hour),
+		}
+		payment := &priceTablePayment{hostKey: hk, amount: cost, method: priceTablePaymentAccount}
+		if rev != nil {
+			payment.contractID = rev.ParentID
+			payment.revisionNumber = rev.RevisionNumber
+			payment.method = priceTablePaymentContract
+		}
+		return hpt, payment, nil
+	}, sr, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// create a helper to expire the price table
+	expire := func() {
+		pt := pts.priceTables[hk]
+		pt.mu.Lock()
+		pt.hpt = hostdb.HostPriceTable{}
+		pt.mu.Unlock()
+	}
+
+	// pay by account
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// pay by contract
+	expire()
+	if _, err := pts.fetch(context.Background(), hk, &types.FileContractRevision{ParentID: fcid, FileContract: types.FileContract{RevisionNumber: 2}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// fail an update, no payment should be recorded
+	expire()
+	fail = true
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert the payments
+	if len(sr.payments) != 2 {
+		t.Fatal("unexpected number of payments", len(sr.payments))
+	} else if p := sr.payments[0]; p.method != priceTablePaymentAccount || p.hostKey != hk || !p.amount.Equals(cost) || p.contractID != (types.FileContractID{}) {
+		t.Fatalf("unexpected account payment %+v", p)
+	} else if p := sr.payments[1]; p.method != priceTablePaymentContract || p.hostKey != hk || !p.amount.Equals(cost) || p.contractID != fcid || p.revisionNumber != 2 {
+		t.Fatalf("unexpected contract payment %+v", p)
+	}
+
+	// assert the contract spending recorder only records contract payments
+	csr := &contractSpendingRecorder{
+		contractSpendings: make(map[types.FileContractID]api.ContractSpendingRecord),
+		flushInterval:     time.Hour,
+	}
+	for _, p := range sr.payments {
+		csr.RecordPriceTableSpending(p)
+	}
+	csr.contractSpendingsFlushTimer.Stop()
+	if len(csr.contractSpendings) != 1 {
+		t.Fatal("unexpected number of records", len(csr.contractSpendings))
+	} else if r := csr.contractSpendings[fcid]; !r.FundAccount.Equals(cost) || r.RevisionNumber != 2 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+}
+
+type mockSpendingBus struct {
+	Bus
+	exceeded []types.FileContractID
+}
+
+func (b *mockSpendingBus) RecordContractSpending(context.Context, []api.ContractSpendingRecord) error {
+	if len(b.exceeded) > 0 {
+		return &api.BudgetExceededError{Contracts: b.exceeded}
+	}
+	return nil
+}
+
+func TestContractSpendingRecorderBudgetExceeded(t *testing.T) {
+	fcid := types.FileContractID{1}
+	csr := &contractSpendingRecorder{
+		bus:               &mockSpendingBus{exceeded: []types.FileContractID{fcid}},
+		contractSpendings: make(map[types.FileContractID]api.ContractSpendingRecord),
+		flushInterval:     time.Hour,
+		logger:            zap.NewNop().Sugar(),
+	}
+
+	// record spending the bus reports as exceeding the budget
+	csr.Record(fcid, 1, 0, api.ContractSpending{Uploads: types.NewCurrency64(1)})
+	csr.Stop()
+	if err := csr.checkBudget(fcid); !errors.Is(err, api.ErrBudgetExceeded) {
+		t.Fatal("expected ErrBudgetExceeded", err)
+	} else if err := csr.checkBudget(types.FileContractID{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the contract is used again once the report expired, e.g. because
+	// its budget was raised in the meantime
+	csr.mu.Lock()
+	csr.budgetExceeded[fcid] = time.Now().Add(-budgetExceededTTL)
+	csr.mu.Unlock()
+	if err := csr.checkBudget(fcid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPriceTablesPricesHandlerGET(t *testing.T) {
+	pts := newPriceTables(nil, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	w := &worker{priceTables: pts}
+	srv := httptest.NewServer(jape.Mux(map[string]jape.Handler{
+		"GET /pricetables/prices": w.priceTablesPricesHandlerGET,
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "")
+
+	// create a helper to add price tables
+	add := func(expiry time.Time, cost uint64) types.PublicKey {
+		hk := types.GeneratePrivateKey().PublicKey()
+		pt := newPriceTable(pts, hk)
+		pt.hpt = hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{
+				DownloadBandwidthCost: types.NewCurrency64(cost),
+				UploadBandwidthCost:   types.NewCurrency64(cost + 1),
+				InitBaseCost:          types.NewCurrency64(cost + 2),
+				UpdatePriceTableCost:  types.NewCurrency64(cost + 3),
+			},
+			Expiry: expiry,
+		}
+		pts.priceTables[hk] = pt
+		return hk
+	}
+
+	// add a valid, an expired price table and a host without a price table
+	valid := add(time.Now().Add(time.Hour).Round(time.Second).UTC(), 10)
+	expired := add(time.Now().Add(-time.Minute).Round(time.Second).UTC(), 20)
+	add(time.Time{}, 30)
+
+	// assert the host without a price table is omitted
+	prices, err := c.PriceTablesPrices()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(prices) != 2 {
+		t.Fatalf("expected 2 prices, got %v", len(prices))
+	}
+
+	// assert the prices match the price tables
+	for _, p := range prices {
+		pt := pts.priceTables[p.HostKey].hpt
+		if p.HostKey != valid && p.HostKey != expired {
+			t.Fatal("unexpected host", p.HostKey)
+		} else if p.Valid != (p.HostKey == valid) {
+			t.Fatal("unexpected valid flag", p)
+		} else if !p.Expiry.Equal(pt.Expiry) {
+			t.Fatal("unexpected expiry", p.Expiry)
+		} else if !p.DownloadPerByte.Equals(pt.DownloadBandwidthCost) ||
+			!p.UploadPerByte.Equals(pt.UploadBandwidthCost) ||
+			!p.BaseRPCCost.Equals(pt.InitBaseCost) ||
+			!p.UpdatePriceTableCost.Equals(pt.UpdatePriceTableCost) {
+			t.Fatal("unexpected prices", p)
+		}
+	}
+}
+
+func TestPriceTablesFetchUnpaid(t *testing.T) {
+	pts := newPriceTables(nil, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// mock the transport, keeping track of the host it's invoked with
+	var gotHK types.PublicKey
+	var gotAddr string
+	errTransport := errors.New("transport failed")
+	var transportErr error
+	pts.withTransport = func(ctx context.Context, hk types.PublicKey, siamuxAddr string, fn func(context.Context, *transportV3) error) error {
+		gotHK, gotAddr = hk, siamuxAddr
+		return transportErr
+	}
+
+	// fetch a price table without caching it
+	hk := types.GeneratePrivateKey().PublicKey()
+	if _, err := pts.Fetch(context.Background(), hk, "foo.bar:9983", false); err != nil {
+		t.Fatal(err)
+	} else if gotHK != hk || gotAddr != "foo.bar:9983" {
+		t.Fatal("transport invoked with wrong host", gotHK, gotAddr)
+	} else if _, exists := pts.Scanned(hk); exists {
+		t.Fatal("price table should not be cached")
+	}
+
+	// fetch it again, caching it this time
+	if _, err := pts.Fetch(context.Background(), hk, "foo.bar:9983", true); err != nil {
+		t.Fatal(err)
+	} else if _, exists := pts.Scanned(hk); !exists {
+		t.Fatal("price table should be cached")
+	}
+
+	// failed fetches are not cached
+	transportErr = errTransport
+	hk2 := types.GeneratePrivateKey().PublicKey()
+	if _, err := pts.Fetch(context.Background(), hk2, "foo.baz:9983", true); !errors.Is(err, errTransport) {
+		t.Fatal("unexpected error", err)
+	} else if gotHK != hk2 {
+		t.Fatal("transport invoked with wrong host", gotHK)
+	} else if _, exists := pts.Scanned(hk2); exists {
+		t.Fatal("price table should not be cached")
+	}
+
+	// assert the paid cache is untouched
+	if len(pts.priceTables) != 0 || len(pts.All()) != 0 {
+		t.Fatal("paid cache should be empty")
+	}
+}
+
+func TestPriceTableIncreases(t *testing.T) {
+	before := rhpv3.HostPriceTable{
+		InitBaseCost:         types.NewCurrency64(100),
+		ReadBaseCost:         types.NewCurrency64(100),
+		ReadLengthCost:       types.NewCurrency64(100),
+		WriteBaseCost:        types.NewCurrency64(100),
+		WriteLengthCost:      types.NewCurrency64(100),
+		UpdatePriceTableCost: types.NewCurrency64(100),
+	}
+
+	// no changes
+	if changes := priceTableIncreases(before, before, 50); len(changes) != 0 {
+		t.Fatal("unexpected changes", changes)
+	}
+
+	// decreases don't alert
+	after := before
+	after.ReadBaseCost = types.NewCurrency64(1)
+	after.UpdatePriceTableCost = types.ZeroCurrency
+	if changes := priceTableIncreases(before, after, 50); len(changes) != 0 {
+		t.Fatal("unexpected changes", changes)
+	}
+
+	// increases exactly at the threshold don't alert
+	after = before
+	after.WriteBaseCost = types.NewCurrency64(150)
+	if changes := priceTableIncreases(before, after, 50); len(changes) != 0 {
+		t.Fatal("unexpected changes", changes)
+	}
+
+	// increases just over the threshold do
+	after.WriteBaseCost = types.NewCurrency64(151)
+	after.InitBaseCost = types.NewCurrency64(1000)
+	changes := priceTableIncreases(before, after, 50)
+	if len(changes) != 2 {
+		t.Fatal("unexpected changes", changes)
+	} else if c := changes[0]; c.field != "InitBaseCost" || !c.old.Equals(before.InitBaseCost) || !c.new.Equals(after.InitBaseCost) {
+		t.Fatal("unexpected change", c)
+	} else if c := changes[1]; c.field != "WriteBaseCost" || !c.old.Equals(before.WriteBaseCost) || !c.new.Equals(after.WriteBaseCost) {
+		t.Fatal("unexpected change", c)
+	}
+
+	// any increase from zero alerts
+	before.ReadLengthCost = types.ZeroCurrency
+	after = before
+	after.ReadLengthCost = types.NewCurrency64(1)
+	if changes := priceTableIncreases(before, after, 50); len(changes) != 1 || changes[0].field != "ReadLengthCost" {
+		t.Fatal("unexpected changes", changes)
+	}
+}
+
+func TestPriceTablesPrefetchHosts(t *testing.T) {
+	// create a fetch function that keeps track of the number of concurrent
+	// updates and fails for a specific host
+	var mu sync.Mutex
+	var active, maxActive int
+	updated := make(map[types.PublicKey]int)
+	failing := types.GeneratePrivateKey().PublicKey()
+	errFetch := errors.New("fetch failed")
+	pts := newPriceTables(func(ctx context.Context, hk types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		updated[hk]++
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		if hk == failing {
+			return hostdb.HostPriceTable{}, nil, errFetch
+		}
+		return hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}}, Expiry: time.Now().Add(time.Hour)}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// create some hosts, one of which has a valid price table and one of
+	// which has a price table that expires soon
+	hks := []types.PublicKey{failing}
+	for i := 0; i < 10; i++ {
+		hks = append(hks, types.GeneratePrivateKey().PublicKey())
+	}
+	valid, expiring := hks[1], hks[2]
+	for hk, expiry := range map[types.PublicKey]time.Time{
+		valid:    time.Now().Add(time.Hour),
+		expiring: time.Now().Add(2 * time.Minute),
+	} {
+		pt := newPriceTable(pts, hk)
+		pt.hpt = hostdb.HostPriceTable{Expiry: expiry}
+		pts.priceTables[hk] = pt
+	}
+
+	// prefetch the price tables
+	errs := pts.Prefetch(context.Background(), hks, 10*time.Minute, 3)
+
+	// assert concurrency was bounded
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive > 3 {
+		t.Fatal("concurrency not bounded", maxActive)
+	}
+
+	// assert the valid host was skipped and all other hosts were updated once
+	for _, hk := range hks {
+		if hk == valid && updated[hk] != 0 {
+			t.Fatal("valid host should be skipped")
+		} else if hk != valid && updated[hk] != 1 {
+			t.Fatal("expected host to be updated once", updated[hk])
+		}
+	}
+
+	// assert the errors
+	if len(errs) != 1 || !errors.Is(errs[failing], errFetch) {
+		t.Fatal("unexpected errors", errs)
+	}
+}
+
+func TestPriceTablesEvictLRU(t *testing.T) {
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		return hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}}, Expiry: time.Now().Add(time.Hour)}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	pts.maxEntries = 3
+
+	// create a helper to add price tables that were last used a while ago
+	add := func(lastUsed time.Duration) types.PublicKey {
+		hk := types.GeneratePrivateKey().PublicKey()
+		pt := newPriceTable(pts, hk)
+		pt.hpt = hostdb.HostPriceTable{Expiry: time.Now().Add(time.Hour)}
+		pt.lastUsed = time.Now().Add(-lastUsed)
+		pts.priceTables[hk] = pt
+		return hk
+	}
+	updating := add(3 * time.Hour)
+	oldest := add(2 * time.Hour)
+	old := add(time.Hour)
+	pts.priceTables[updating].ongoingUpdate()
+
+	// create a helper that fetches the price table of a new host
+	fetchNew := func() types.PublicKey {
+		t.Helper()
+		hk := types.GeneratePrivateKey().PublicKey()
+		if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		return hk
+	}
+
+	// fetch a new price table, the oldest one that isn't updating is evicted
+	new1 := fetchNew()
+	if len(pts.priceTables) != 3 {
+		t.Fatal("unexpected number of price tables", len(pts.priceTables))
+	} else if _, exists := pts.priceTables[oldest]; exists {
+		t.Fatal("expected oldest price table to be evicted")
+	}
+	for _, hk := range []types.PublicKey{updating, old, new1} {
+		if _, exists := pts.priceTables[hk]; !exists {
+			t.Fatal("price table should not be evicted")
+		}
+	}
+
+	// fetch another one, the remaining old price table is evicted
+	new2 := fetchNew()
+	if _, exists := pts.priceTables[old]; exists {
+		t.Fatal("expected old price table to be evicted")
+	} else if _, exists := pts.priceTables[new2]; !exists {
+		t.Fatal("price table should not be evicted")
+	}
+
+	// fetch another one, no price table can be evicted since they're either
+	// updating or were used recently
+	fetchNew()
+	if len(pts.priceTables) != 4 {
+		t.Fatal("unexpected number of price tables", len(pts.priceTables))
+	} else if _, exists := pts.priceTables[updating]; !exists {
+		t.Fatal("updating price table should not be evicted")
+	}
+
+	// assert the evictions are tracked
+	if stats := pts.Stats(); stats.numEvictions != 2 {
+		t.Fatal("unexpected number of evictions", stats.numEvictions)
+	}
+}
+
+func TestPriceTablesUnreachableHost(t *testing.T) {
+	hk := types.GeneratePrivateKey().PublicKey()
+
+	// create a fetch function that mocks a transport that fails to dial the
+	// host a number of times before succeeding
+	const numFailures = 3
+	var calls int
+	errDial := fmt.Errorf("DialStream: %v: %w", errDialTransport, &net.OpError{Op: "dial", Err: errors.New("i/o timeout")})
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		calls++
+		if calls <= numFailures {
+			return hostdb.HostPriceTable{}, nil, errDial
+		}
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}},
+			Expiry:         time.Now().Add(time.Hour),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// add a price table that's valid but expires soon
+	pt := newPriceTable(pts, hk)
+	pt.hpt = hostdb.HostPriceTable{Expiry: time.Now().Add(2 * time.Minute)}
+	pts.priceTables[hk] = pt
+
+	var prevBackoff time.Duration
+	for i := 1; i <= numFailures; i++ {
+		// demand a price table that's valid for longer than the cached one,
+		// triggering an update that fails to dial the host
+		if _, err := pts.fetch(context.Background(), hk, nil, 10*time.Minute); !isDialTransport(err) {
+			t.Fatal("unexpected error", err)
+		} else if calls != i {
+			t.Fatal("unexpected number of calls", calls)
+		}
+
+		// assert the host is reported as not having a valid price table
+		// even though the cached one is still valid
+		if _, err := pts.fetch(context.Background(), hk, nil, 0); !isDialTransport(err) {
+			t.Fatal("unexpected error", err)
+		} else if calls != i {
+			t.Fatal("host should not be dialed again", calls)
+		}
+
+		// assert the retry-after increases
+		pt.mu.Lock()
+		backoff := time.Until(pt.backoffUntil)
+		if !pt.unreachable {
+			t.Fatal("expected host to be unreachable")
+		} else if backoff <= prevBackoff {
+			t.Fatal("expected backoff to increase", backoff, prevBackoff)
+		}
+		prevBackoff = backoff
+
+		// expire the backoff
+		pt.backoffUntil = time.Now()
+		pt.mu.Unlock()
+	}
+
+	// the next update succeeds and clears the negative entry
+	if hpt, err := pts.fetch(context.Background(), hk, nil, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	} else if hpt.UID != (rhpv3.SettingsID{1}) {
+		t.Fatal("expected fresh price table")
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.unreachable || !pt.backoffUntil.IsZero() || pt.consecutiveFailures != 0 {
+		t.Fatal("expected negative entry to be cleared")
+	}
+}
+
+func TestPriceTablesUpdateTracing(t *testing.T) {
+	// record spans
+	sr := tracetest.NewSpanRecorder()
+	tracer := tracing.Tracer
+	tracing.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+	defer func() { tracing.Tracer = tracer }()
+
+	hk := types.PublicKey{1}
+	expiry := time.Now().Add(time.Hour)
+	pts := newPriceTables(func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}},
+			Expiry:         expiry,
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// update the price table
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the update span contains the price table
+	spans := sr.Ended()
+	if len(spans) != 1 || spans[0].Name() != "priceTableUpdate" {
+		t.Fatal("expected a single update span", len(spans))
+	}
+	attrs := make(map[string]string)
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["hk"] != hk.String() {
+		t.Fatal("unexpected host attribute", attrs["hk"])
+	} else if attrs["priceTable"] != (rhpv3.SettingsID{1}).String() {
+		t.Fatal("unexpected price table attribute", attrs["priceTable"])
+	} else if attrs["priceTableExpiry"] != expiry.Format(time.RFC3339Nano) {
+		t.Fatal("unexpected price table expiry attribute", attrs["priceTableExpiry"])
+	}
+}
+
+// mockPriceTableBus keeps track of the price tables recorded through price
+// table update interactions, like the bus' host db does.
+type mockPriceTableBus struct {
+	Bus
+
+	mu          sync.Mutex
+	priceTables map[types.PublicKey]hostdb.HostPriceTable
+}
+
+func (b *mockPriceTableBus) Host(_ context.Context, hk types.PublicKey) (hostdb.HostInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hpt, exists := b.priceTables[hk]
+	if !exists {
+		return hostdb.HostInfo{}, errors.New("host not found")
+	}
+	return hostdb.HostInfo{Host: hostdb.Host{PublicKey: hk, PriceTable: hpt}}, nil
+}
+
+func (b *mockPriceTableBus) RecordInteractions(_ context.Context, interactions []hostdb.Interaction) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, hi := range interactions {
+		if hi.Type != hostdb.InteractionTypePriceTableUpdate || !hi.Success {
+			continue
+		}
+		var ptr hostdb.PriceTableUpdateResult
+		if err := json.Unmarshal(hi.Result, &ptr); err != nil {
+			return err
+		}
+		b.priceTables[hi.Host] = ptr.PriceTable
+	}
+	return nil
+}
+
+func TestPriceTablesShared(t *testing.T) {
+	c := &fakeClock{now: time.Now()}
+	hk := types.PublicKey{1}
+	bus := &mockPriceTableBus{priceTables: make(map[types.PublicKey]hostdb.HostPriceTable)}
+
+	// create two workers sharing the bus, keeping track of their RPCs
+	var mu sync.Mutex
+	calls := make(map[int]int)
+	newWorker := func(id int) *worker {
+		w := &worker{bus: bus, busFlushInterval: time.Hour, logger: zap.NewNop().Sugar()}
+		w.priceTables = newPriceTables(func(ctx context.Context, hk types.PublicKey, _ *types.FileContractRevision) (hpt hostdb.HostPriceTable, _ *priceTablePayment, err error) {
+			mu.Lock()
+			calls[id]++
+			hpt = hostdb.HostPriceTable{
+				HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{byte(id), byte(calls[id])}},
+				Expiry:         c.Now().Add(10 * time.Minute),
+			}
+			mu.Unlock()
+
+			// record the update like the transport pool does
+			var mr ephemeralMetricsRecorder
+			recordPriceTableUpdate(metrics.WithRecorder(ctx, &mr), "", hk, &hpt, &err)()
+			w.recordInteractions(mr.interactions())
+			return
+		}, nil, defaultPriceTableValidityLeeway, 0, c)
+		w.priceTables.store = w
+		return w
+	}
+	w1, w2 := newWorker(1), newWorker(2)
+
+	// helper to fetch a price table, flush the worker's interactions to the
+	// bus and assert the number of RPCs
+	assertFetch := func(w *worker, uid rhpv3.SettingsID, calls1, calls2 int) {
+		t.Helper()
+		if res, err := w.priceTables.fetch(context.Background(), hk, nil, 0); err != nil {
+			t.Fatal(err)
+		} else if res.UID != uid {
+			t.Fatal("unexpected price table", res.UID)
+		}
+		w.interactionsMu.Lock()
+		if w.interactionsFlushTimer != nil {
+			w.interactionsFlushTimer.Stop()
+		}
+		w.flushInteractions()
+		w.interactionsMu.Unlock()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if calls[1] != calls1 || calls[2] != calls2 {
+			t.Fatal("unexpected number of RPCs", calls)
+		}
+	}
+
+	// the first worker pays for the price table and shares it
+	assertFetch(w1, rhpv3.SettingsID{1, 1}, 1, 0)
+
+	// the second worker uses the shared price table
+	assertFetch(w2, rhpv3.SettingsID{1, 1}, 1, 0)
+
+	// once the shared price table is no longer valid, the second worker pays
+	// for a new one and shares it
+	c.advance(10*time.Minute - defaultPriceTableValidityLeeway)
+	assertFetch(w2, rhpv3.SettingsID{2, 1}, 1, 1)
+
+	// which is then used by the first worker
+	assertFetch(w1, rhpv3.SettingsID{2, 1}, 1, 1)
+}
+
+func TestPriceTablesUpdateTimeout(t *testing.T) {
+	hk := types.PublicKey{1}
+
+	// create a fetch function that never returns unless its context is done
+	dialTimeouts := make(chan time.Duration, 1)
+	pts := newPriceTables(func(ctx context.Context, _ types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		timeout, _ := dialTimeoutFromContext(ctx)
+		select {
+		case dialTimeouts <- timeout:
+		default:
+		}
+		<-ctx.Done()
+		return hostdb.HostPriceTable{}, nil, ctx.Err()
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	pts.dialTimeout = 10 * time.Millisecond
+	pts.updateTimeout = 50 * time.Millisecond
+
+	// start a performer and a couple of waiters without a deadline
+	start := time.Now()
+	errs := make(chan error, 3)
+	go func() {
+		_, err := pts.fetch(context.Background(), hk, nil, 0)
+		errs <- err
+	}()
+	waitForPriceTableUpdate(pts, hk)
+	for i := 0; i < cap(errs)-1; i++ {
+		go func() {
+			_, err := pts.fetch(context.Background(), hk, nil, 0)
+			errs <- err
+		}()
+	}
+
+	// assert they are all released with a timeout error within the limit
+	for i := 0; i < cap(errs); i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, errPriceTableUpdateTimeout) {
+				t.Fatal("unexpected error", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("waiters weren't released")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("update took too long", elapsed)
+	}
+
+	// assert the dial timeout was passed to the fetch function
+	if timeout := <-dialTimeouts; timeout != pts.dialTimeout {
+		t.Fatal("unexpected dial timeout", timeout)
+	}
+
+	// a caller with a shorter deadline gets its own context error
+	pts.mu.Lock()
+	pt := pts.priceTables[hk]
+	pts.mu.Unlock()
+	pt.mu.Lock()
+	pt.backoffUntil = time.Time{}
+	pt.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := pts.fetch(ctx, hk, nil, 0); errors.Is(err, errPriceTableUpdateTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestPriceTablesForceUpdate(t *testing.T) {
+	hk := types.PublicKey{1}
+
+	// create a fetch function that blocks until it's unblocked
+	var mu sync.Mutex
+	var calls int
+	unblock := make(chan struct{})
+	close(unblock)
+	pts := newPriceTables(func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		mu.Lock()
+		calls++
+		uid := rhpv3.SettingsID{byte(calls)}
+		block := unblock
+		mu.Unlock()
+		<-block
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: uid},
+			Expiry:         time.Now().Add(time.Hour),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	numCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	// fetch the price table, it gets cached
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if n := numCalls(); n != 1 {
+		t.Fatalf("expected 1 call, got %v", n)
+	}
+
+	// assert forcing an update ignores the cached price table
+	hpt, err := pts.ForceUpdate(context.Background(), hk, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if n := numCalls(); n != 2 {
+		t.Fatalf("expected 2 calls, got %v", n)
+	} else if hpt.UID != (rhpv3.SettingsID{2}) {
+		t.Fatal("unexpected price table", hpt.UID)
+	}
+
+	// assert the fresh price table is served from the cache
+	if lookup, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if lookup.UID != hpt.UID || lookup.source != priceTableSourceCache {
+		t.Fatal("unexpected lookup", lookup.UID, lookup.source)
+	}
+
+	// block the fetch function
+	mu.Lock()
+	unblock = make(chan struct{})
+	mu.Unlock()
+
+	// force a bunch of concurrent updates
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pts.ForceUpdate(context.Background(), hk, nil)
+			errs <- err
+		}()
+	}
+	waitForPriceTableUpdate(pts, hk)
+	time.Sleep(50 * time.Millisecond)
+
+	// unblock the update and assert they collapsed into a single call
+	mu.Lock()
+	close(unblock)
+	mu.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := numCalls(); n != 3 {
+		t.Fatalf("expected 3 calls, got %v", n)
+	}
+}
+
+func TestPriceTablesUpdateHandlerPOST(t *testing.T) {
+	hk := types.PublicKey{1}
+
+	var calls int
+	pts := newPriceTables(func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		calls++
+		return hostdb.HostPriceTable{
+			HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{byte(calls)}},
+			Expiry:         time.Now().Add(time.Hour).Round(time.Second),
+		}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+	w := &worker{priceTables: pts}
+	srv := httptest.NewServer(jape.Mux(map[string]jape.Handler{
+		"POST /pricetables/update": w.priceTablesUpdateHandlerPOST,
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "")
+
+	// populate the cache
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the endpoint returns a fresh price table
+	hpt, err := c.PriceTableUpdate(context.Background(), hk, types.FileContractID{})
+	if err != nil {
+		t.Fatal(err)
+	} else if calls != 2 {
+		t.Fatalf("expected 2 calls, got %v", calls)
+	} else if hpt.UID != (rhpv3.SettingsID{2}) || hpt.Expiry.IsZero() {
+		t.Fatal("unexpected price table", hpt)
+	}
+
+	// assert errors are returned
+	pts.fetchFn = func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		return hostdb.HostPriceTable{}, nil, errors.New("host unreachable")
+	}
+	if _, err := c.PriceTableUpdate(context.Background(), hk, types.FileContractID{}); err == nil || !strings.Contains(err.Error(), "host unreachable") {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestPriceTablesAddressFallback(t *testing.T) {
+	hk := types.PublicKey{1}
+	pts := newPriceTables(nil, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// create a fetch function that can't dial the first address
+	stale, working := "1.2.3.4:9983", "[::1]:9983"
+	var dialed []string
+	fetchFn := func(_ context.Context, siamuxAddr string) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		dialed = append(dialed, siamuxAddr)
+		if siamuxAddr == stale {
+			return hostdb.HostPriceTable{}, nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return hostdb.HostPriceTable{Expiry: time.Now().Add(time.Hour)}, nil, nil
+	}
+
+	// assert we fall back to the second address
+	if _, _, err := pts.fetchWithFallback(context.Background(), hk, []string{stale, working}, fetchFn); err != nil {
+		t.Fatal(err)
+	} else if len(dialed) != 2 || dialed[0] != stale || dialed[1] != working {
+		t.Fatal("unexpected addresses", dialed)
+	} else if addr, ok := pts.SiamuxAddr(hk); !ok || addr != working {
+		t.Fatal("unexpected address", addr, ok)
+	}
+
+	// assert the working address is tried first on subsequent updates
+	dialed = nil
+	if _, _, err := pts.fetchWithFallback(context.Background(), hk, []string{stale, working}, fetchFn); err != nil {
+		t.Fatal(err)
+	} else if len(dialed) != 1 || dialed[0] != working {
+		t.Fatal("unexpected addresses", dialed)
+	}
+
+	// assert we don't fall back if the host was reachable
+	dialed = nil
+	errGouging := errors.New("gouging")
+	if _, _, err := pts.fetchWithFallback(context.Background(), hk, []string{working, stale}, func(_ context.Context, siamuxAddr string) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		dialed = append(dialed, siamuxAddr)
+		return hostdb.HostPriceTable{}, nil, errGouging
+	}); !errors.Is(err, errGouging) {
+		t.Fatal("unexpected error", err)
+	} else if len(dialed) != 1 {
+		t.Fatal("unexpected addresses", dialed)
+	}
+
+	// assert the announced address is a candidate if it differs
+	var h hostdb.Host
+	h.NetAddress = "host.example.com:9982"
+	h.Settings.NetAddress = "1.2.3.4:9982"
+	h.Settings.SiaMuxPort = "9983"
+	if addrs := hostSiamuxAddrs(h); len(addrs) != 2 || addrs[0] != "1.2.3.4:9983" || addrs[1] != "host.example.com:9983" {
+		t.Fatal("unexpected addresses", addrs)
+	}
+	h.NetAddress = h.Settings.NetAddress
+	if addrs := hostSiamuxAddrs(h); len(addrs) != 1 {
+		t.Fatal("unexpected addresses", addrs)
+	}
+}
+
+func TestPriceTablesCacheStats(t *testing.T) {
+	hk := types.PublicKey{1}
+
+	// create a fetch function that takes a while
+	pts := newPriceTables(func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		time.Sleep(10 * time.Millisecond)
+		return hostdb.HostPriceTable{HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}}, Expiry: time.Now().Add(time.Hour)}, nil, nil
+	}, nil, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// hammer the cache from many goroutines
+	const goroutines, lookups = 50, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lookups; j++ {
+				if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// assert every lookup was counted and only one update was performed
+	stats := pts.Stats().cache
+	if total := stats.validHits + stats.staleHits + stats.misses; total != goroutines*lookups {
+		t.Fatalf("expected %v lookups, got %v", goroutines*lookups, total)
+	} else if stats.updates != 1 || stats.failures != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	} else if stats.misses == 0 || stats.deduplicated != stats.misses-1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	} else if stats.staleHits != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// fail an update and assert it's counted
+	pts.fetchFn = func(context.Context, types.PublicKey, *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		return hostdb.HostPriceTable{}, nil, errors.New("failed")
+	}
+	if _, err := pts.ForceUpdate(context.Background(), hk, nil); err == nil {
+		t.Fatal("expected error")
+	} else if stats := pts.Stats().cache; stats.updates != 2 || stats.failures != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// testTransportHost is a host that accepts rhpv3 transports and answers every
+// RPC with an empty response, it counts the number of handshakes.
+type testTransportHost struct {
+	hk         types.PrivateKey
+	l          net.Listener
+	handshakes uint64
+}
+
+func newTestTransportHost(tb testing.TB) *testTransportHost {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h := &testTransportHost{
+		hk: types.GeneratePrivateKey(),
+		l:  l,
+	}
+	go h.serve()
+	tb.Cleanup(func() { l.Close() })
+	return h
+}
+
+func (h *testTransportHost) serve() {
+	for {
+		conn, err := h.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			t, err := rhpv3.NewHostTransport(conn, h.hk)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			atomic.AddUint64(&h.handshakes, 1)
+			defer t.Close()
+			for {
+				s, err := t.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer s.Close()
+					if _, err := s.ReadID(); err == nil {
+						_ = s.WriteResponse(&rhpv3.RPCPriceTableResponse{})
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func (h *testTransportHost) numHandshakes() uint64 {
+	return atomic.LoadUint64(&h.handshakes)
+}
+
+func newTestTransportPool(idleTimeout time.Duration, maxIdlePerHost int) *transportPoolV3 {
+	return &transportPoolV3{
+		recordInteractions: func([]hostdb.Interaction) {},
+		idleTimeout:        idleTimeout,
+		maxIdlePerHost:     maxIdlePerHost,
+		pool:               make(map[string]*transportV3),
+	}
+}
+
+// testTransportRPC performs an RPC on a new stream of the given transport.
+func testTransportRPC(ctx context.Context, t *transportV3) error {
+	s, err := t.DialStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Call(types.NewSpecifier("Test"), nil, &rhpv3.RPCPriceTableResponse{})
+}
+
+func TestTransportPoolReuse(t *testing.T) {
+	h := newTestTransportHost(t)
+	p := newTestTransportPool(100*time.Millisecond, defaultTransportMaxIdlePerHost)
+	defer p.Close()
+	hk, addr := h.hk.PublicKey(), h.l.Addr().String()
+
+	// perform a couple of RPCs, sequentially and concurrently
+	for i := 0; i < 5; i++ {
+		if err := p.withTransportV3(context.Background(), hk, addr, testTransportRPC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.withTransportV3(context.Background(), hk, addr, testTransportRPC)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the transport was reused
+	if n := h.numHandshakes(); n != 1 {
+		t.Fatalf("expected 1 handshake, got %v", n)
+	}
+
+	// assert the transport is closed once it's been idle for too long
+	time.Sleep(300 * time.Millisecond)
+	p.mu.Lock()
+	n := len(p.pool)
+	p.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected idle transport to be closed, %v left", n)
+	}
+	if err := p.withTransportV3(context.Background(), hk, addr, testTransportRPC); err != nil {
+		t.Fatal(err)
+	} else if n := h.numHandshakes(); n != 2 {
+		t.Fatalf("expected 2 handshakes, got %v", n)
+	}
+}
+
+func TestTransportPoolMaxIdlePerHost(t *testing.T) {
+	p := newTestTransportPool(time.Hour, 2)
+	defer p.Close()
+
+	// use a host on three addresses and another host
+	hk, other := types.PublicKey{1}, types.PublicKey{2}
+	var ts []*transportV3
+	for _, addr := range []string{"1.1.1.1:9983", "2.2.2.2:9983", "3.3.3.3:9983"} {
+		ts = append(ts, p.acquire(hk, addr))
+	}
+	ts = append(ts, p.acquire(other, "4.4.4.4:9983"))
+	for _, tr := range ts {
+		p.release(tr)
+		time.Sleep(time.Millisecond) // ensure distinct idle timestamps
+	}
+
+	// assert only the least recently used transport was closed
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pool) != 3 {
+		t.Fatalf("expected 3 transports, got %v", len(p.pool))
+	} else if _, exists := p.pool["1.1.1.1:9983"]; exists {
+		t.Fatal("expected least recently used transport to be closed")
+	} else if !ts[0].closed {
+		t.Fatal("transport wasn't closed")
+	}
+}
+
+func TestTransportPoolRetry(t *testing.T) {
+	p := newTestTransportPool(time.Hour, defaultTransportMaxIdlePerHost)
+	defer p.Close()
+	hk, addr := types.PublicKey{1}, "1.1.1.1:9983"
+
+	// simulate a connection dying mid-RPC
+	var used []*transportV3
+	err := p.withTransportV3(context.Background(), hk, addr, func(_ context.Context, t *transportV3) error {
+		used = append(used, t)
+		if len(used) == 1 {
+			return fmt.Errorf("ReadResponse: %w", net.ErrClosed)
+		}
+		return nil
+	})
+
+	// assert the RPC was retried on a fresh transport
+	if err != nil {
+		t.Fatal(err)
+	} else if len(used) != 2 || used[0] == used[1] {
+		t.Fatal("expected retry on a fresh transport", len(used))
+	} else if !used[0].closed || used[1].closed {
+		t.Fatal("unexpected transport state")
+	}
+	p.mu.Lock()
+	if p.pool[addr] != used[1] {
+		t.Fatal("expected fresh transport to be pooled")
+	}
+	p.mu.Unlock()
+
+	// assert we only retry once and other errors aren't retried
+	for _, tc := range []struct {
+		err   error
+		calls int
+	}{
+		{fmt.Errorf("ReadResponse: %w", net.ErrClosed), 2},
+		{errors.New("host error"), 1},
+	} {
+		var calls int
+		err := p.withTransportV3(context.Background(), hk, addr, func(context.Context, *transportV3) error {
+			calls++
+			return tc.err
+		})
+		if !errors.Is(err, tc.err) {
+			t.Fatal("unexpected error", err)
+		} else if calls != tc.calls {
+			t.Fatalf("expected %v calls, got %v", tc.calls, calls)
+		}
+	}
+}
+
+func BenchmarkTransportPoolMixedOperations(b *testing.B) {
+	for _, bc := range []struct {
+		name        string
+		idleTimeout time.Duration
+	}{
+		{"unpooled", 0},
+		{"pooled", defaultTransportIdleTimeout},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h := newTestTransportHost(b)
+			p := newTestTransportPool(bc.idleTimeout, defaultTransportMaxIdlePerHost)
+			defer p.Close()
+			hk, addr := h.hk.PublicKey(), h.l.Addr().String()
+
+			// every iteration is a burst of price table updates, downloads
+			// and account fundings against the same host, some of which
+			// overlap
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < 10; j++ {
+					if j%3 == 0 {
+						wg.Wait()
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if err := p.withTransportV3(context.Background(), hk, addr, testTransportRPC); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(h.numHandshakes())/float64(b.N), "handshakes/op")
+		})
+	}
+}
+
+func TestPriceTablesValidation(t *testing.T) {
+	hk := types.PublicKey{1}
+
+	// create a fetch function that checks the next price table before paying
+	// for it, like fetchPriceTable does
+	var next hostdb.HostPriceTable
+	sr := &mockPriceTableSpendingRecorder{}
+	pts := newPriceTables(func(ctx context.Context, hk types.PublicKey, _ *types.FileContractRevision) (hostdb.HostPriceTable, *priceTablePayment, error) {
+		if err := checkPriceTable(ctx, next.HostPriceTable); err != nil {
+			return hostdb.HostPriceTable{}, nil, err
+		}
+		return next, &priceTablePayment{hostKey: hk, amount: next.UpdatePriceTableCost, method: priceTablePaymentAccount}, nil
+	}, sr, defaultPriceTableValidityLeeway, 0, systemClock{})
+
+	// assertPayments is a helper to assert the number of recorded payments
+	assertPayments := func(name string, n int) {
+		t.Helper()
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+		if len(sr.payments) != n {
+			t.Fatalf("%v: expected %v payments, got %v", name, n, len(sr.payments))
+		}
+	}
+
+	// fetch a valid price table
+	valid := hostdb.HostPriceTable{
+		HostPriceTable: rhpv3.HostPriceTable{UID: rhpv3.SettingsID{1}, Validity: time.Hour},
+		Expiry:         time.Now().Add(time.Hour),
+	}
+	next = valid
+	if _, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	pt := pts.priceTables[hk]
+	assertPayments("valid", 1)
+
+	// feed it a couple of nonsensical price tables
+	for _, tc := range []struct {
+		name   string
+		modify func(*hostdb.HostPriceTable)
+	}{
+		{"missing UID", func(hpt *hostdb.HostPriceTable) { hpt.UID = rhpv3.SettingsID{} }},
+		{"zero validity", func(hpt *hostdb.HostPriceTable) { hpt.Validity = 0; hpt.Expiry = time.Now() }},
+		{"short validity", func(hpt *hostdb.HostPriceTable) { hpt.Validity = time.Second; hpt.Expiry = time.Now().Add(time.Second) }},
+		{"absurd base cost", func(hpt *hostdb.HostPriceTable) { hpt.ReadBaseCost = priceTableMaxBaseCost.Add(types.NewCurrency64(1)) }},
+		{"absurd bandwidth cost", func(hpt *hostdb.HostPriceTable) { hpt.DownloadBandwidthCost = types.Siacoins(1) }},
+	} {
+		next = valid
+		next.UID = rhpv3.SettingsID{2}
+		tc.modify(&next)
+
+		// reset the backoff
+		pt.mu.Lock()
+		pt.backoffUntil = time.Time{}
+		failures := pt.consecutiveFailures
+		pt.mu.Unlock()
+
+		// assert the price table is rejected
+		if _, err := pts.ForceUpdate(context.Background(), hk, nil); !errors.Is(err, errInvalidPriceTable) {
+			t.Fatalf("%v: unexpected error %v", tc.name, err)
+		}
+
+		// assert the rejection counts as a failure and the old price table
+		// remains in place
+		pt.mu.Lock()
+		hpt, backoffUntil, consecutiveFailures := pt.hpt, pt.backoffUntil, pt.consecutiveFailures
+		pt.mu.Unlock()
+		if hpt.UID != valid.UID {
+			t.Fatalf("%v: price table was replaced", tc.name)
+		} else if consecutiveFailures != failures+1 || backoffUntil.IsZero() {
+			t.Fatalf("%v: rejection wasn't counted as a failure", tc.name)
+		} else if lookup, err := pts.fetch(context.Background(), hk, nil, 0); err != nil {
+			t.Fatal(err)
+		} else if lookup.UID != valid.UID {
+			t.Fatalf("%v: unexpected price table %v", tc.name, lookup.UID)
+		}
+
+		// assert the rejected price table wasn't paid for
+		assertPayments(tc.name, 1)
+	}
+
+	// assert a valid price table is accepted again
+	pt.mu.Lock()
+	pt.backoffUntil = time.Time{}
+	pt.mu.Unlock()
+	next = valid
+	next.UID = rhpv3.SettingsID{3}
+	if hpt, err := pts.ForceUpdate(context.Background(), hk, nil); err != nil {
+		t.Fatal(err)
+	} else if hpt.UID != next.UID {
+		t.Fatal("unexpected price table", hpt.UID)
+	}
+	assertPayments("valid again", 2)
+}
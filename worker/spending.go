@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -12,10 +13,44 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	priceTablePaymentAccount  priceTablePaymentMethod = "account"
+	priceTablePaymentContract priceTablePaymentMethod = "contract"
+)
+
+const (
+	// budgetExceededTTL is the amount of time the worker refuses paid
+	// operations on a contract after the bus reported it exceeded its budget.
+	// Afterwards the contract is used again so a budget that was raised in
+	// the meantime takes effect, if it's still over budget the bus reports
+	// it again with the next flush.
+	budgetExceededTTL = 5 * time.Minute
+)
+
 type (
-	// A ContractSpendingRecorder records the spending of a contract.
+	// A ContractSpendingRecorder records the spending of a contract and the
+	// amount of data transferred with it.
 	ContractSpendingRecorder interface {
 		Record(fcid types.FileContractID, revisionNumber, size uint64, cs api.ContractSpending)
+		RecordTransfer(fcid types.FileContractID, uploaded, downloaded uint64)
+	}
+
+	// priceTableSpendingRecorder records the payments made for price tables.
+	priceTableSpendingRecorder interface {
+		RecordPriceTableSpending(p priceTablePayment)
+	}
+
+	priceTablePaymentMethod string
+
+	// priceTablePayment describes the payment for a price table, the contract
+	// fields are only set if the price table was paid for by contract.
+	priceTablePayment struct {
+		hostKey        types.PublicKey
+		contractID     types.FileContractID
+		revisionNumber uint64
+		size           uint64
+		amount         types.Currency
+		method         priceTablePaymentMethod
 	}
 
 	contractSpendingRecorder struct {
@@ -26,6 +61,7 @@ type (
 		mu                          sync.Mutex
 		contractSpendings           map[types.FileContractID]api.ContractSpendingRecord
 		contractSpendingsFlushTimer *time.Timer
+		budgetExceeded              map[types.FileContractID]time.Time
 	}
 )
 
@@ -59,7 +95,31 @@ func (sr *contractSpendingRecorder) Record(fcid types.FileContractID, revisionNu
 		csr.Size = size
 	}
 	sr.contractSpendings[fcid] = csr
+	sr.scheduleFlush()
+}
+
+// RecordTransfer sends the number of bytes uploaded and downloaded with a
+// contract to the bus.
+func (sr *contractSpendingRecorder) RecordTransfer(fcid types.FileContractID, uploaded, downloaded uint64) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	// Update buffer.
+	csr, found := sr.contractSpendings[fcid]
+	if !found {
+		csr = api.ContractSpendingRecord{
+			ContractID: fcid,
+		}
+	}
+	csr.UploadedBytes += uploaded
+	csr.DownloadedBytes += downloaded
+	sr.contractSpendings[fcid] = csr
+	sr.scheduleFlush()
+}
 
+// scheduleFlush schedules a flush of the buffer unless one is scheduled
+// already, it must be called with the lock held.
+func (sr *contractSpendingRecorder) scheduleFlush() {
 	// If a thread was scheduled to flush the buffer we are done.
 	if sr.contractSpendingsFlushTimer != nil {
 		return
@@ -72,6 +132,18 @@ func (sr *contractSpendingRecorder) Record(fcid types.FileContractID, revisionNu
 	})
 }
 
+// RecordPriceTableSpending records the payment for a price table. Price tables
+// paid for by contract are recorded as fund account spending since we only pay
+// by contract if the account can't be used, which is typically the case when
+// it needs to be funded. Price tables paid for by account are not recorded
+// since the account's funding was already recorded.
+func (sr *contractSpendingRecorder) RecordPriceTableSpending(p priceTablePayment) {
+	if p.method != priceTablePaymentContract {
+		return
+	}
+	sr.Record(p.contractID, p.revisionNumber, p.size, api.ContractSpending{FundAccount: p.amount})
+}
+
 func (sr *contractSpendingRecorder) flush() {
 	if len(sr.contractSpendings) > 0 {
 		ctx, span := tracing.Tracer.Start(context.Background(), "worker: flushContractSpending")
@@ -80,7 +152,24 @@ func (sr *contractSpendingRecorder) flush() {
 		for _, cs := range sr.contractSpendings {
 			records = append(records, cs)
 		}
-		if err := sr.bus.RecordContractSpending(ctx, records); err != nil {
+		var bee *api.BudgetExceededError
+		if err := sr.bus.RecordContractSpending(ctx, records); errors.As(err, &bee) {
+			// the spending was recorded but pushed contracts past their
+			// budget, no more paid operations are performed on them
+			sr.logger.Warnw(fmt.Sprintf("contract spending exceeds budget, refusing further paid operations: %v", bee.Contracts))
+			if sr.budgetExceeded == nil {
+				sr.budgetExceeded = make(map[types.FileContractID]time.Time)
+			}
+			for _, fcid := range bee.Contracts {
+				sr.budgetExceeded[fcid] = time.Now()
+			}
+			sr.contractSpendings = make(map[types.FileContractID]api.ContractSpendingRecord)
+		} else if isError(err, api.ErrCurrencyOverflow) {
+			// the bus won't ever accept these records, drop them rather
+			// than sending them again with every flush
+			sr.logger.Errorw(fmt.Sprintf("dropping contract spending that overflows: %v", err))
+			sr.contractSpendings = make(map[types.FileContractID]api.ContractSpendingRecord)
+		} else if err != nil {
 			sr.logger.Errorw(fmt.Sprintf("failed to record contract spending: %v", err))
 		} else {
 			sr.contractSpendings = make(map[types.FileContractID]api.ContractSpendingRecord)
@@ -89,6 +178,22 @@ func (sr *contractSpendingRecorder) flush() {
 	sr.contractSpendingsFlushTimer = nil
 }
 
+// checkBudget returns an error wrapping api.ErrBudgetExceeded if the bus
+// reported that the spending of the given contract exceeds its budget less than
+// budgetExceededTTL ago.
+func (sr *contractSpendingRecorder) checkBudget(fcid types.FileContractID) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	reported, exceeded := sr.budgetExceeded[fcid]
+	if !exceeded {
+		return nil
+	} else if time.Since(reported) >= budgetExceededTTL {
+		delete(sr.budgetExceeded, fcid)
+		return nil
+	}
+	return fmt.Errorf("%w: contract %v", api.ErrBudgetExceeded, fcid)
+}
+
 // Stop stops the flush timer.
 func (sr *contractSpendingRecorder) Stop() {
 	sr.mu.Lock()
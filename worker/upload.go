@@ -1106,6 +1106,12 @@ func (a *dataPoints) Average() float64 {
 	return avg
 }
 
+func (a *dataPoints) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.Float64Data)
+}
+
 func (a *dataPoints) P90() float64 {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -1127,6 +1133,21 @@ func (a *dataPoints) Recompute() {
 	a.p90 = p90
 }
 
+// Seed tracks the given data points and recomputes the p90.
+func (a *dataPoints) Seed(points []float64) {
+	for _, p := range points {
+		a.Track(p)
+	}
+	a.Recompute()
+}
+
+// Snapshot returns a copy of the tracked data points.
+func (a *dataPoints) Snapshot() []float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]float64(nil), a.Float64Data...)
+}
+
 func (a *dataPoints) Track(p float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
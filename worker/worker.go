@@ -122,7 +122,7 @@ type (
 )
 
 type ContractLocker interface {
-	AcquireContract(ctx context.Context, fcid types.FileContractID, priority int, d time.Duration) (lockID uint64, err error)
+	AcquireContract(ctx context.Context, fcid types.FileContractID, priority int, holder string, d time.Duration) (lockID uint64, err error)
 	KeepaliveContract(ctx context.Context, fcid types.FileContractID, lockID uint64, d time.Duration) (err error)
 	ReleaseContract(ctx context.Context, fcid types.FileContractID, lockID uint64) (err error)
 }
@@ -202,7 +202,8 @@ type hostV2 interface {
 type hostV3 interface {
 	hostV2
 
-	DownloadSector(ctx context.Context, w io.Writer, root types.Hash256, offset, length uint32) error
+	AcquirePriceTable(ctx context.Context, minValidity time.Duration) (release func(), err error)
+	DownloadSector(ctx context.Context, w io.Writer, root types.Hash256, offset, length uint32) (hpt hostdb.HostPriceTable, err error)
 	FetchPriceTable(ctx context.Context, rev *types.FileContractRevision) (hpt hostdb.HostPriceTable, err error)
 	FetchRevision(ctx context.Context, fetchTimeout time.Duration, blockHeight uint64) (types.FileContractRevision, error)
 	FundAccount(ctx context.Context, balance types.Currency, rev *types.FileContractRevision) error
@@ -215,6 +216,29 @@ type hostProvider interface {
 	newHostV3(types.FileContractID, types.PublicKey, string) hostV3
 }
 
+type accountFunder interface {
+	fundAccount(ctx context.Context, fcid types.FileContractID, hk types.PublicKey, siamuxAddr string) error
+}
+
+type priceTableFailureReporter interface {
+	ReportPriceTableExpired(hk types.PublicKey)
+}
+
+type siamuxAddrProvider interface {
+	SiamuxAddr(hk types.PublicKey) (string, bool)
+}
+
+// A clock tells the time, it allows for replacing the system clock in tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
 // A worker talks to Sia hosts to perform contract and storage operations within
 // a renterd system.
 type worker struct {
@@ -280,6 +304,31 @@ func (w *worker) withTransportV2(ctx context.Context, hostKey types.PublicKey, h
 }
 
 func (w *worker) newHostV3(contractID types.FileContractID, hostKey types.PublicKey, siamuxAddr string) hostV3 {
+	return w.newHost(contractID, hostKey, siamuxAddr)
+}
+
+// lockingPurpose returns a description of the operation that acquires a
+// contract lock with the given priority.
+func lockingPurpose(priority int) string {
+	switch priority {
+	case lockingPriorityActiveContractRevision:
+		return "revision"
+	case lockingPriorityRenew:
+		return "renew"
+	case lockingPriorityPriceTable:
+		return "pricetable"
+	case lockingPriorityFunding:
+		return "funding"
+	case lockingPrioritySyncing:
+		return "syncing"
+	case lockingPriorityUpload:
+		return "upload"
+	default:
+		return "unknown"
+	}
+}
+
+func (w *worker) newHost(contractID types.FileContractID, hostKey types.PublicKey, siamuxAddr string) *host {
 	return &host{
 		acc:                      w.accounts.ForHost(hostKey),
 		bus:                      w.bus,
@@ -408,13 +457,13 @@ func (w *worker) fetchContracts(ctx context.Context, metadatas []api.ContractMet
 	return
 }
 
-func (w *worker) fetchPriceTable(ctx context.Context, hk types.PublicKey, siamuxAddr string, rev *types.FileContractRevision) (hpt hostdb.HostPriceTable, err error) {
-	h := w.newHostV3(types.FileContractID{}, hk, siamuxAddr)
-	hpt, err = h.FetchPriceTable(ctx, rev)
+func (w *worker) fetchPriceTable(ctx context.Context, hk types.PublicKey, siamuxAddr string, rev *types.FileContractRevision) (hpt hostdb.HostPriceTable, payment *priceTablePayment, err error) {
+	h := w.newHost(types.FileContractID{}, hk, siamuxAddr)
+	hpt, payment, err = h.fetchPriceTable(ctx, rev)
 	if err != nil {
-		return hostdb.HostPriceTable{}, err
+		return hostdb.HostPriceTable{}, nil, err
 	}
-	return hpt, nil
+	return hpt, payment, nil
 }
 
 func (w *worker) rhpPriceTableHandler(jc jape.Context) {
@@ -600,6 +649,25 @@ func (w *worker) rhpFundHandler(jc jape.Context) {
 	}))
 }
 
+// fundAccount tops up the ephemeral account with the given host.
+func (w *worker) fundAccount(ctx context.Context, fcid types.FileContractID, hk types.PublicKey, siamuxAddr string) error {
+	gp, err := w.bus.GougingParams(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get gouging parameters: %w", err)
+	}
+	ctx = WithGougingChecker(ctx, w.bus, gp)
+
+	return w.withRevision(ctx, defaultRevisionFetchTimeout, fcid, hk, siamuxAddr, lockingPriorityFunding, gp.ConsensusState.BlockHeight, func(rev types.FileContractRevision) error {
+		h := w.newHostV3(rev.ParentID, hk, siamuxAddr)
+		err := h.FundAccount(ctx, types.Siacoins(1), &rev) // same balance the autopilot maintains
+		if isBalanceMaxExceeded(err) {
+			// the host considers the account funded, sync it
+			err = h.SyncAccount(ctx, &rev)
+		}
+		return err
+	})
+}
+
 func (w *worker) rhpRegistryReadHandler(jc jape.Context) {
 	var rrrr api.RHPRegistryReadRequest
 	if jc.Decode(&rrrr) != nil {
@@ -740,6 +808,7 @@ func (w *worker) downloadsStatsHandlerGET(jc jape.Context) {
 			HostKey:                    hk,
 			AvgSectorDownloadSpeedMBPS: stat.avgSpeedMBPS,
 			NumDownloads:               stat.numDownloads,
+			NumFundRetries:             stat.numFundRetries,
 		})
 	}
 	sort.SliceStable(dss, func(i, j int) bool {
@@ -751,11 +820,117 @@ func (w *worker) downloadsStatsHandlerGET(jc jape.Context) {
 		AvgDownloadSpeedMBPS: math.Ceil(stats.avgDownloadSpeedMBPS*100) / 100,
 		AvgOverdrivePct:      math.Floor(stats.avgOverdrivePct*100*100) / 100,
 		HealthyDownloaders:   healthy,
+		NumHedgedLaunches:    stats.numHedgedLaunches,
 		NumDownloaders:       uint64(len(stats.downloaders)),
 		DownloadersStats:     dss,
 	})
 }
 
+func (w *worker) priceTablesHandlerGET(jc jape.Context) {
+	var hostKey types.PublicKey
+	if jc.DecodeForm("hostkey", &hostKey) != nil {
+		return
+	}
+
+	cpts := w.priceTables.All()
+	if hostKey != (types.PublicKey{}) {
+		filtered := cpts[:0]
+		for _, cpt := range cpts {
+			if cpt.HostKey == hostKey {
+				filtered = append(filtered, cpt)
+			}
+		}
+		cpts = filtered
+	}
+	jc.Encode(cpts)
+}
+
+func (w *worker) priceTablesUpdateHandlerPOST(jc jape.Context) {
+	var ptur api.PriceTableUpdateRequest
+	if jc.Decode(&ptur) != nil {
+		return
+	}
+	ctx := jc.Request.Context()
+
+	// without a contract we can only pay by account
+	if ptur.ContractID == (types.FileContractID{}) {
+		hpt, err := w.priceTables.ForceUpdate(ctx, ptur.HostKey, nil)
+		if jc.Check("couldn't update price table", err) != nil {
+			return
+		}
+		jc.Encode(hpt)
+		return
+	}
+
+	// attach gouging checker
+	gp, err := w.bus.GougingParams(ctx)
+	if jc.Check("could not get gouging parameters", err) != nil {
+		return
+	}
+	ctx = WithGougingChecker(ctx, w.bus, gp)
+
+	// fetch the host
+	host, err := w.bus.Host(ctx, ptur.HostKey)
+	if jc.Check("couldn't fetch host", err) != nil {
+		return
+	}
+
+	// update the price table, falling back to paying with the contract
+	var hpt hostdb.HostPriceTable
+	if jc.Check("couldn't update price table", w.withRevision(ctx, defaultRevisionFetchTimeout, ptur.ContractID, ptur.HostKey, host.Settings.SiamuxAddr(), lockingPriorityPriceTable, gp.ConsensusState.BlockHeight, func(rev types.FileContractRevision) (err error) {
+		hpt, err = w.priceTables.ForceUpdate(ctx, ptur.HostKey, &rev)
+		return
+	})) != nil {
+		return
+	}
+	jc.Encode(hpt)
+}
+
+func (w *worker) priceTablesPricesHandlerGET(jc jape.Context) {
+	jc.Encode(w.priceTables.Prices())
+}
+
+func (w *worker) priceTablesStatsHandlerGET(jc jape.Context) {
+	stats := w.priceTables.Stats()
+
+	// prepare host stats
+	var pss []api.PriceTableStats
+	for hk, stat := range stats.hosts {
+		pss = append(pss, api.PriceTableStats{
+			HostKey:             hk,
+			NumUpdates:          stat.numUpdates,
+			NumFailures:         stat.numFailures,
+			NumExpired:          stat.numExpired,
+			ConsecutiveFailures: stat.consecutiveFailures,
+			BackoffUntil:        stat.backoffUntil,
+			LastError:           errToStr(stat.lastErr),
+			AvgUpdateLatencyMS:  stat.avgUpdateLatencyMS,
+			P90UpdateLatencyMS:  stat.p90UpdateLatencyMS,
+		})
+	}
+	sort.SliceStable(pss, func(i, j int) bool {
+		return pss[i].P90UpdateLatencyMS > pss[j].P90UpdateLatencyMS
+	})
+
+	// encode response
+	jc.Encode(api.PriceTablesStatsResponse{
+		Cache: api.PriceTableCacheStats{
+			NumValidHits:      stats.cache.validHits,
+			NumStaleHits:      stats.cache.staleHits,
+			NumMisses:         stats.cache.misses,
+			NumUpdates:        stats.cache.updates,
+			NumDeduplicated:   stats.cache.deduplicated,
+			NumUpdateFailures: stats.cache.failures,
+		},
+		NumPriceTables: uint64(stats.numPriceTables),
+		NumEvictions:   stats.numEvictions,
+		NumExpired:     stats.numExpired,
+		NumUpdates:     stats.numUpdates,
+		NumFailures:    stats.numFailures,
+		HostsStats:     pss,
+	})
+}
+
 func (w *worker) uploadsStatsHandlerGET(jc jape.Context) {
 	stats := w.uploadManager.Stats()
 
@@ -863,7 +1038,12 @@ func (w *worker) objectsHandlerGET(jc jape.Context) {
 	}
 
 	// download the object
-	if jc.Check(fmt.Sprintf("couldn't download object '%v'", path), w.downloadManager.DownloadObject(ctx, &rw, obj, uint64(offset), uint64(length), contracts)) != nil {
+	err = w.downloadManager.DownloadObject(ctx, &rw, obj, uint64(offset), uint64(length), contracts)
+	var ihErr *ErrInsufficientHosts
+	if errors.As(err, &ihErr) {
+		jc.Error(fmt.Errorf("couldn't download object '%v': %w", path, err), http.StatusServiceUnavailable)
+		return
+	} else if jc.Check(fmt.Sprintf("couldn't download object '%v'", path), err) != nil {
 		return
 	}
 }
@@ -999,7 +1179,7 @@ func (w *worker) accountHandlerGET(jc jape.Context) {
 }
 
 // New returns an HTTP handler that serves the worker API.
-func New(masterKey [32]byte, id string, b Bus, contractLockingDuration, busFlushInterval, downloadOverdriveTimeout, uploadOverdriveTimeout time.Duration, downloadMaxOverdrive, uploadMaxOverdrive uint64, allowPrivateIPs bool, l *zap.Logger) (*worker, error) {
+func New(masterKey [32]byte, id string, b Bus, contractLockingDuration, busFlushInterval, downloadHedgeDelay, downloadLaunchStagger, downloadOverdriveTimeout, downloadStatsMaxAge, uploadOverdriveTimeout time.Duration, downloadMaxOverdrive, downloadReadAhead, uploadMaxOverdrive uint64, downloadStatsPath string, allowPrivateIPs bool, l *zap.Logger) (*worker, error) {
 	if contractLockingDuration == 0 {
 		return nil, errors.New("contract lock duration must be positive")
 	}
@@ -1026,7 +1206,9 @@ func New(masterKey [32]byte, id string, b Bus, contractLockingDuration, busFlush
 	w.initAccounts(b)
 	w.initContractSpendingRecorder()
 	w.initPriceTables()
-	w.initDownloadManager(downloadMaxOverdrive, downloadOverdriveTimeout, l.Sugar().Named("downloadmanager"))
+	if err := w.initDownloadManager(downloadMaxOverdrive, downloadOverdriveTimeout, downloadHedgeDelay, downloadLaunchStagger, downloadReadAhead, downloadStatsPath, downloadStatsMaxAge, l.Sugar().Named("downloadmanager")); err != nil {
+		return nil, err
+	}
 	w.initUploadManager(uploadMaxOverdrive, uploadOverdriveTimeout, l.Sugar().Named("uploadmanager"))
 	return w, nil
 }
@@ -1034,8 +1216,11 @@ func New(masterKey [32]byte, id string, b Bus, contractLockingDuration, busFlush
 // Handler returns an HTTP handler that serves the worker API.
 func (w *worker) Handler() http.Handler {
 	return jape.Mux(tracing.TracedRoutes("worker", map[string]jape.Handler{
-		"GET    /account/:hostkey": w.accountHandlerGET,
-		"GET    /id":               w.idHandlerGET,
+		"GET    /account/:hostkey":   w.accountHandlerGET,
+		"GET    /id":                 w.idHandlerGET,
+		"GET    /pricetables":        w.priceTablesHandlerGET,
+		"GET    /pricetables/prices": w.priceTablesPricesHandlerGET,
+		"POST   /pricetables/update": w.priceTablesUpdateHandlerPOST,
 
 		"GET    /rhp/contracts":       w.rhpContractsHandlerGET,
 		"POST   /rhp/scan":            w.rhpScanHandler,
@@ -1047,9 +1232,10 @@ func (w *worker) Handler() http.Handler {
 		"POST   /rhp/registry/read":   w.rhpRegistryReadHandler,
 		"POST   /rhp/registry/update": w.rhpRegistryUpdateHandler,
 
-		"GET    /stats/downloads": w.downloadsStatsHandlerGET,
-		"GET    /stats/uploads":   w.uploadsStatsHandlerGET,
-		"POST   /slab/migrate":    w.slabMigrateHandler,
+		"GET    /stats/downloads":   w.downloadsStatsHandlerGET,
+		"GET    /stats/pricetables": w.priceTablesStatsHandlerGET,
+		"GET    /stats/uploads":     w.uploadsStatsHandlerGET,
+		"POST   /slab/migrate":      w.slabMigrateHandler,
 
 		"GET    /objects/*path": w.objectsHandlerGET,
 		"PUT    /objects/*path": w.objectsHandlerPUT,
@@ -1069,11 +1255,17 @@ func (w *worker) Shutdown(_ context.Context) error {
 	// Stop contract spending recorder.
 	w.contractSpendingRecorder.Stop()
 
+	// Stop prefetching price tables.
+	w.priceTables.Stop()
+
 	// Stop the downloader.
 	w.downloadManager.Stop()
 
 	// Stop the uploader.
 	w.uploadManager.Stop()
+
+	// Close all pooled transports.
+	w.transportPoolV3.Close()
 	return nil
 }
 
@@ -1155,7 +1347,8 @@ func (cl *contractLock) keepaliveLoop() {
 }
 
 func (w *worker) acquireRevision(ctx context.Context, fcid types.FileContractID, priority int) (_ revisionUnlocker, err error) {
-	lockID, err := w.bus.AcquireContract(ctx, fcid, priority, w.contractLockingDuration)
+	holder := fmt.Sprintf("%s:%s", w.id, lockingPurpose(priority))
+	lockID, err := w.bus.AcquireContract(ctx, fcid, priority, holder, w.contractLockingDuration)
 	if err != nil {
 		return nil, err
 	}
@@ -1194,14 +1387,11 @@ func (w *worker) scanHost(ctx context.Context, hostKey types.PublicKey, hostIP s
 	elapsed := time.Since(start)
 
 	// fetch the host pricetable
-	var pt rhpv3.HostPriceTable
+	var hpt hostdb.HostPriceTable
 	if err == nil {
-		err = w.transportPoolV3.withTransportV3(ctx, hostKey, settings.SiamuxAddr(), func(ctx context.Context, t *transportV3) (err error) {
-			pt, err = RPCPriceTable(ctx, t, func(pt rhpv3.HostPriceTable) (rhpv3.PaymentMethod, error) { return nil, nil })
-			return err
-		})
+		hpt, err = w.priceTables.Fetch(ctx, hostKey, settings.SiamuxAddr(), true)
 	}
-	return settings, pt, elapsed, err
+	return settings, hpt.HostPriceTable, elapsed, err
 }
 
 func discardTxnOnErr(ctx context.Context, bus Bus, l *zap.SugaredLogger, txn types.Transaction, errContext string, err *error) {